@@ -0,0 +1,117 @@
+/*
+ * Network packet analysis framework.
+ *
+ * Copyright (c) 2014, Alessandro Ghedini
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are
+ * met:
+ *
+ *     * Redistributions of source code must retain the above copyright
+ *       notice, this list of conditions and the following disclaimer.
+ *
+ *     * Redistributions in binary form must reproduce the above copyright
+ *       notice, this list of conditions and the following disclaimer in the
+ *       documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS
+ * IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO,
+ * THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR
+ * PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR
+ * CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+ * EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+ * PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+ * PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF
+ * LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+ * NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+ * SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package capture
+
+import "github.com/ghedo/go.pkt/filter"
+import "github.com/ghedo/go.pkt/packet"
+
+type adapter struct {
+	h Base
+}
+
+// Convert the given handle to a Handle. The methods that are not supported by
+// the adapted handle return an UnsupportedError. If the given handle already
+// implements Handle, it's returned unchanged.
+func Adapt(h Base) Handle {
+	if handle, ok := h.(Handle); ok {
+		return handle
+	}
+
+	return &adapter{ h: h }
+}
+
+func (a *adapter) LinkType() packet.Type {
+	return a.h.LinkType()
+}
+
+func (a *adapter) SetMTU(mtu int) error {
+	if c, ok := a.h.(Configurable); ok {
+		return c.SetMTU(mtu)
+	}
+
+	return &UnsupportedError{ Op: "SetMTU" }
+}
+
+func (a *adapter) SetPromiscMode(promisc bool) error {
+	if c, ok := a.h.(Configurable); ok {
+		return c.SetPromiscMode(promisc)
+	}
+
+	return &UnsupportedError{ Op: "SetPromiscMode" }
+}
+
+func (a *adapter) SetMonitorMode(monitor bool) error {
+	if c, ok := a.h.(Configurable); ok {
+		return c.SetMonitorMode(monitor)
+	}
+
+	return &UnsupportedError{ Op: "SetMonitorMode" }
+}
+
+func (a *adapter) ApplyFilter(filter *filter.Filter) error {
+	if f, ok := a.h.(Filterable); ok {
+		return f.ApplyFilter(filter)
+	}
+
+	return &UnsupportedError{ Op: "ApplyFilter" }
+}
+
+func (a *adapter) Activate() error {
+	return a.h.Activate()
+}
+
+func (a *adapter) Capture() ([]byte, error) {
+	if r, ok := a.h.(Reader); ok {
+		return r.Capture()
+	}
+
+	return nil, &UnsupportedError{ Op: "Capture" }
+}
+
+func (a *adapter) Inject(buf []byte) error {
+	if i, ok := a.h.(Injector); ok {
+		return i.Inject(buf)
+	}
+
+	return &UnsupportedError{ Op: "Inject" }
+}
+
+func (a *adapter) Stats() (*Stats, error) {
+	if s, ok := a.h.(StatsProvider); ok {
+		return s.Stats()
+	}
+
+	return nil, &UnsupportedError{ Op: "Stats" }
+}
+
+func (a *adapter) Close() {
+	a.h.Close()
+}
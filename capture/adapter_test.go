@@ -0,0 +1,117 @@
+/*
+ * Network packet analysis framework.
+ *
+ * Copyright (c) 2014, Alessandro Ghedini
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are
+ * met:
+ *
+ *     * Redistributions of source code must retain the above copyright
+ *       notice, this list of conditions and the following disclaimer.
+ *
+ *     * Redistributions in binary form must reproduce the above copyright
+ *       notice, this list of conditions and the following disclaimer in the
+ *       documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS
+ * IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO,
+ * THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR
+ * PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR
+ * CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+ * EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+ * PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+ * PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF
+ * LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+ * NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+ * SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package capture_test
+
+import "errors"
+import "testing"
+
+import "github.com/ghedo/go.pkt/capture"
+import "github.com/ghedo/go.pkt/capture/file"
+import "github.com/ghedo/go.pkt/packet"
+
+type test_reader struct {
+	pkts [][]byte
+}
+
+func (r *test_reader) LinkType() packet.Type { return packet.Eth }
+func (r *test_reader) Activate() error       { return nil }
+func (r *test_reader) Close()                {}
+
+func (r *test_reader) Capture() ([]byte, error) {
+	if len(r.pkts) == 0 {
+		return nil, nil
+	}
+
+	buf := r.pkts[0]
+	r.pkts = r.pkts[1:]
+
+	return buf, nil
+}
+
+func TestAdapt(t *testing.T) {
+	src := &test_reader{ pkts: [][]byte{ { 0x01, 0x02 } } }
+
+	if caps := capture.Capabilities(src); caps != capture.CanRead {
+		t.Fatalf("Capabilities mismatch: %s", caps)
+	}
+
+	h := capture.Adapt(src)
+
+	if caps := capture.Capabilities(h); caps != capture.CanRead {
+		t.Fatalf("Capabilities mismatch: %s", caps)
+	}
+
+	buf, err := h.Capture()
+	if err != nil || len(buf) != 2 {
+		t.Fatalf("Capture mismatch: %x %s", buf, err)
+	}
+
+	err = h.Inject(buf)
+	if !errors.Is(err, capture.ErrUnsupported) {
+		t.Fatalf("Expected unsupported error, got: %s", err)
+	}
+
+	err = h.SetMTU(1500)
+	if !errors.Is(err, capture.ErrUnsupported) {
+		t.Fatalf("Expected unsupported error, got: %s", err)
+	}
+
+	if err.Error() != "SetMTU: Unsupported" {
+		t.Fatalf("Error mismatch: %s", err)
+	}
+
+	err = h.ApplyFilter(nil)
+	if !errors.Is(err, capture.ErrUnsupported) {
+		t.Fatalf("Expected unsupported error, got: %s", err)
+	}
+}
+
+func TestCapabilities(t *testing.T) {
+	src, err := file.Open("file/capture_test.pcap")
+	if err != nil {
+		t.Fatalf("Error opening: %s", err)
+	}
+	defer src.Close()
+
+	caps := capture.Capabilities(src)
+	if caps != capture.CanRead | capture.CanInject | capture.CanFilter {
+		t.Fatalf("Capabilities mismatch: %s", caps)
+	}
+
+	dst, err := file.OpenRotate("rotate_test.pcap")
+	if err != nil {
+		t.Fatalf("Error opening: %s", err)
+	}
+
+	if caps := capture.Capabilities(dst); caps != capture.CanInject {
+		t.Fatalf("Capabilities mismatch: %s", caps)
+	}
+}
@@ -0,0 +1,557 @@
+/*
+ * Network packet analysis framework.
+ *
+ * Copyright (c) 2014, Alessandro Ghedini
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are
+ * met:
+ *
+ *     * Redistributions of source code must retain the above copyright
+ *       notice, this list of conditions and the following disclaimer.
+ *
+ *     * Redistributions in binary form must reproduce the above copyright
+ *       notice, this list of conditions and the following disclaimer in the
+ *       documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS
+ * IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO,
+ * THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR
+ * PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR
+ * CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+ * EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+ * PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+ * PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF
+ * LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+ * NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+ * SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+// Provides packet capturing and injection on live Linux network interfaces via
+// AF_PACKET sockets, without depending on libpcap.
+package afpacket
+
+import "encoding/binary"
+import "fmt"
+import "runtime"
+import "syscall"
+import "time"
+import "unsafe"
+
+import "github.com/ghedo/go.pkt/capture"
+import "github.com/ghedo/go.pkt/filter"
+import "github.com/ghedo/go.pkt/packet"
+
+type Handle struct {
+	Device  string
+	fd      int
+	ifindex int
+	link    packet.Type
+	cooked  bool
+	match   filter.Func
+	snaplen int
+	promisc bool
+	timeout time.Duration
+	active  bool
+	buf     []byte
+	oob     []byte
+	ts      time.Time
+	msgs    []mmsghdr
+	iovs    []syscall.Iovec
+	names   []syscall.RawSockaddrLinklayer
+	stats   capture.Stats
+}
+
+type mmsghdr struct {
+	hdr syscall.Msghdr
+	len uint32
+}
+
+type packet_mreq struct {
+	ifindex int32
+	typ     uint16
+	alen    uint16
+	addr    [8]byte
+}
+
+type tpacket_stats struct {
+	packets uint32
+	drops   uint32
+}
+
+const eth_p_all = 0x0003
+
+/* length of the Linux cooked (SLL) header built in cooked mode */
+const sll_len = 16
+
+var oob_len = syscall.CmsgSpace(int(unsafe.Sizeof(syscall.Timespec{})))
+
+// Create a new capture handle from the given network interface. Note that this
+// requires root privileges (or the CAP_NET_RAW capability).
+//
+// Interfaces whose link-layer header is not supported (i.e. whose first link
+// type is SLL) are opened in cooked mode: the kernel strips the link-layer
+// header and the captured packets start with a Linux cooked (SLL) header
+// instead. The injected packets must then start with an SLL header too, whose
+// address is used as destination, and filters are run in user-space.
+func Open(dev_name string) (*Handle, error) {
+	iface, err := capture.InterfaceByName(dev_name)
+	if err != nil {
+		return nil, fmt.Errorf("Could not open device: %s", err)
+	}
+
+	link := packet.Eth
+
+	if len(iface.LinkTypes) > 0 {
+		link = iface.LinkTypes[0]
+	}
+
+	return open(dev_name, iface.Index, link)
+}
+
+func open(dev_name string, ifindex int, link packet.Type) (*Handle, error) {
+	typ := syscall.SOCK_RAW
+
+	if link == packet.SLL {
+		typ = syscall.SOCK_DGRAM
+	}
+
+	/* the socket doesn't receive any packet until it's bound */
+	fd, err := syscall.Socket(syscall.AF_PACKET, typ, 0)
+	if err != nil {
+		return nil, fmt.Errorf("Could not open socket: %s", err)
+	}
+
+	handle := &Handle{
+		Device:  dev_name,
+		fd:      fd,
+		ifindex: ifindex,
+		link:    link,
+		cooked:  link == packet.SLL,
+		snaplen: 65535,
+	}
+
+	return handle, nil
+}
+
+// Return the link type of the capture handle (that is, the type of packets that
+// come out of the packet source).
+func (h *Handle) LinkType() packet.Type {
+	return h.link
+}
+
+// Set the maximum number of bytes captured for each packet.
+func (h *Handle) SetMTU(mtu int) error {
+	if h.active {
+		return fmt.Errorf("Handle already active")
+	}
+
+	h.snaplen = mtu
+	return nil
+}
+
+// Enable/disable promiscuous mode.
+func (h *Handle) SetPromiscMode(promisc bool) error {
+	if h.active {
+		return fmt.Errorf("Handle already active")
+	}
+
+	h.promisc = promisc
+	return nil
+}
+
+// Set the read timeout, that is the maximum time Capture() waits for a packet.
+// When it expires, Capture() returns a nil packet and no error. If timeout is
+// zero (the default) Capture() blocks until a packet is received.
+func (h *Handle) SetReadTimeout(timeout time.Duration) error {
+	if h.active {
+		return fmt.Errorf("Handle already active")
+	}
+
+	if timeout < 0 {
+		return fmt.Errorf("Invalid timeout")
+	}
+
+	h.timeout = timeout
+	return nil
+}
+
+// Not supported.
+func (h *Handle) SetMonitorMode(monitor bool) error {
+	return &capture.UnsupportedError{ Op: "SetMonitorMode" }
+}
+
+// Apply the given filter it to the packet source. Only packets that match this
+// filter will be captured.
+func (h *Handle) ApplyFilter(filter *filter.Filter) error {
+	if !filter.Validate() {
+		return fmt.Errorf("Invalid filter")
+	}
+
+	/* the kernel would run the filter on packets without the SLL header */
+	if h.cooked {
+		match, err := filter.Func()
+		if err != nil {
+			return err
+		}
+
+		h.match = match
+		return nil
+	}
+
+	return filter.AttachFd(h.fd)
+}
+
+// Activate the packet source. Note that after calling this method it will not
+// be possible to change the packet source configuration (MTU, promiscuous mode,
+// ...)
+func (h *Handle) Activate() error {
+	if h.active {
+		return nil
+	}
+
+	err := syscall.SetsockoptInt(
+		h.fd, syscall.SOL_SOCKET, syscall.SO_TIMESTAMPNS, 1,
+	)
+	if err != nil {
+		return fmt.Errorf("Could not enable timestamps: %s", err)
+	}
+
+	if h.timeout > 0 {
+		tv := syscall.NsecToTimeval(h.timeout.Nanoseconds())
+
+		err = syscall.SetsockoptTimeval(
+			h.fd, syscall.SOL_SOCKET, syscall.SO_RCVTIMEO, &tv,
+		)
+		if err != nil {
+			return fmt.Errorf("Could not set read timeout: %s", err)
+		}
+	}
+
+	if h.promisc {
+		mreq := packet_mreq{
+			ifindex: int32(h.ifindex),
+			typ:     syscall.PACKET_MR_PROMISC,
+		}
+
+		_, _, errno := syscall.Syscall6(
+			syscall.SYS_SETSOCKOPT, uintptr(h.fd),
+			syscall.SOL_PACKET, syscall.PACKET_ADD_MEMBERSHIP,
+			uintptr(unsafe.Pointer(&mreq)), unsafe.Sizeof(mreq), 0,
+		)
+		if errno != 0 {
+			return fmt.Errorf("Could not enable promiscuous mode: %s",
+			                  errno)
+		}
+	}
+
+	addr := &syscall.SockaddrLinklayer{
+		Protocol: htons(eth_p_all),
+		Ifindex:  h.ifindex,
+	}
+
+	err = syscall.Bind(h.fd, addr)
+	if err != nil {
+		return fmt.Errorf("Could not bind socket: %s", err)
+	}
+
+	h.buf    = make([]byte, h.hdr_len() + h.snaplen)
+	h.oob    = make([]byte, oob_len)
+	h.active = true
+
+	return nil
+}
+
+// Capture a single packet from the packet source. This will block until a
+// packet is received, or the read timeout expires (in which case nil is
+// returned).
+func (h *Handle) Capture() ([]byte, error) {
+	buf, _, err := h.CaptureZeroCopy()
+	if buf == nil {
+		return nil, err
+	}
+
+	pkt := make([]byte, len(buf))
+	copy(pkt, buf)
+
+	return pkt, nil
+}
+
+// Capture a single packet from the packet source into the handle's internal
+// buffer, without allocating a new one. The returned slice is only valid until
+// the next call to any of the handle's capture methods. Apart from that, this
+// behaves like Capture().
+func (h *Handle) CaptureZeroCopy() ([]byte, capture.Info, error) {
+	if !h.active {
+		return nil, capture.Info{}, fmt.Errorf("Handle not active")
+	}
+
+	hdr := h.hdr_len()
+
+	for {
+		n, oobn, _, from, err := syscall.Recvmsg(
+			h.fd, h.buf[hdr:], h.oob, syscall.MSG_TRUNC,
+		)
+		if err == syscall.EINTR {
+			continue
+		}
+
+		if err == syscall.EAGAIN {
+			return nil, capture.Info{}, nil
+		}
+
+		if err != nil {
+			return nil, capture.Info{}, fmt.Errorf(
+				"Could not read packet: %s", err,
+			)
+		}
+
+		if sa, ok := from.(*syscall.SockaddrLinklayer); ok && h.cooked {
+			put_sll(h.buf, sa.Pkttype, sa.Hatype, sa.Halen, sa.Addr,
+			        htons(sa.Protocol))
+		}
+
+		caplen := min(hdr + n, len(h.buf))
+
+		if h.match != nil && !h.match.Match(h.buf[:caplen]) {
+			continue
+		}
+
+		h.ts = timestamp(h.oob[:oobn])
+
+		info := capture.Info{
+			Timestamp: h.ts,
+			CapLen:    caplen,
+			Length:    hdr + n,
+		}
+
+		return h.buf[:info.CapLen], info, nil
+	}
+}
+
+// Capture up to len(bufs) packets with a single system call, copying each of
+// them directly into the corresponding buffer (truncated to the buffer's
+// capacity) and storing its metadata in info. The buffers are resliced to the
+// captured length. This blocks until at least one packet is available (or the
+// read timeout expires), and returns the number of packets captured.
+func (h *Handle) CaptureBatch(bufs [][]byte, info []capture.Info) (int, error) {
+	if !h.active {
+		return 0, fmt.Errorf("Handle not active")
+	}
+
+	if len(info) < len(bufs) {
+		return 0, fmt.Errorf("Not enough room for packet info")
+	}
+
+	if len(bufs) == 0 {
+		return 0, nil
+	}
+
+	if len(h.msgs) < len(bufs) {
+		h.msgs  = make([]mmsghdr, len(bufs))
+		h.iovs  = make([]syscall.Iovec, len(bufs))
+		h.names = make([]syscall.RawSockaddrLinklayer, len(bufs))
+		h.oob   = make([]byte, len(bufs) * oob_len)
+	}
+
+	hdr := h.hdr_len()
+
+	for i := range bufs {
+		buf := bufs[i][:cap(bufs[i])]
+		if len(buf) <= hdr {
+			return 0, fmt.Errorf("Buffer too small")
+		}
+
+		h.iovs[i].Base = &buf[hdr]
+		h.iovs[i].SetLen(len(buf) - hdr)
+
+		h.msgs[i] = mmsghdr{}
+		h.msgs[i].hdr.Iov     = &h.iovs[i]
+		h.msgs[i].hdr.Iovlen  = 1
+		h.msgs[i].hdr.Control = &h.oob[i * oob_len]
+		h.msgs[i].hdr.SetControllen(oob_len)
+
+		/* the SLL header is built from the source address */
+		if h.cooked {
+			h.msgs[i].hdr.Name    = (*byte)(unsafe.Pointer(&h.names[i]))
+			h.msgs[i].hdr.Namelen = syscall.SizeofSockaddrLinklayer
+		}
+	}
+
+	var n uintptr
+	var errno syscall.Errno
+
+	for {
+		n, _, errno = syscall.Syscall6(
+			syscall.SYS_RECVMMSG, uintptr(h.fd),
+			uintptr(unsafe.Pointer(&h.msgs[0])), uintptr(len(bufs)),
+			syscall.MSG_WAITFORONE | syscall.MSG_TRUNC, 0, 0,
+		)
+		if errno != syscall.EINTR {
+			break
+		}
+	}
+
+	runtime.KeepAlive(bufs)
+
+	if errno == syscall.EAGAIN {
+		return 0, nil
+	}
+
+	if errno != 0 {
+		return 0, fmt.Errorf("Could not read packets: %s", errno)
+	}
+
+	count := 0
+
+	for i := 0; i < int(n); i++ {
+		msg := &h.msgs[i]
+		oob := h.oob[i * oob_len:][:msg.hdr.Controllen]
+
+		length := hdr + int(msg.len)
+		caplen := min(length, cap(bufs[i]))
+
+		if h.cooked {
+			sa := &h.names[i]
+
+			put_sll(bufs[i][:hdr], sa.Pkttype, sa.Hatype, sa.Halen,
+			        sa.Addr, htons(sa.Protocol))
+		}
+
+		if h.match != nil && !h.match.Match(bufs[i][:caplen]) {
+			continue
+		}
+
+		h.ts = timestamp(oob)
+
+		/* move the packet after the ones already accepted */
+		bufs[count], bufs[i] = bufs[i], bufs[count]
+		bufs[count] = bufs[count][:caplen]
+
+		info[count] = capture.Info{
+			Timestamp: h.ts,
+			CapLen:    caplen,
+			Length:    length,
+		}
+
+		count++
+	}
+
+	return count, nil
+}
+
+// Return the capture statistics (the number of packets received and dropped)
+// since the handle was activated.
+func (h *Handle) Stats() (*capture.Stats, error) {
+	var st tpacket_stats
+
+	size := uint32(unsafe.Sizeof(st))
+
+	/* the kernel resets its counters every time they are read */
+	_, _, errno := syscall.Syscall6(
+		syscall.SYS_GETSOCKOPT, uintptr(h.fd),
+		syscall.SOL_PACKET, syscall.PACKET_STATISTICS,
+		uintptr(unsafe.Pointer(&st)), uintptr(unsafe.Pointer(&size)), 0,
+	)
+	if errno != 0 {
+		return nil, fmt.Errorf("Could not get stats: %s", errno)
+	}
+
+	/* tp_packets also counts the dropped packets */
+	h.stats.Received += uint64(st.packets)
+	h.stats.Dropped  += uint64(st.drops)
+
+	stats := h.stats
+	return &stats, nil
+}
+
+// Return the timestamp of the last packet captured.
+func (h *Handle) Timestamp() time.Time {
+	return h.ts
+}
+
+// Inject a packet in the packet source.
+func (h *Handle) Inject(buf []byte) error {
+	if !h.active {
+		return fmt.Errorf("Handle not active")
+	}
+
+	if h.cooked {
+		return h.inject_cooked(buf)
+	}
+
+	_, err := syscall.Write(h.fd, buf)
+	if err != nil {
+		return fmt.Errorf("Could not inject packet: %w", err)
+	}
+
+	return nil
+}
+
+/* Send the packet following the SLL header, to the header's address. */
+func (h *Handle) inject_cooked(buf []byte) error {
+	if len(buf) < sll_len {
+		return fmt.Errorf("Packet too short")
+	}
+
+	addr := &syscall.SockaddrLinklayer{
+		Protocol: htons(binary.BigEndian.Uint16(buf[14:])),
+		Ifindex:  h.ifindex,
+		Halen:    uint8(min(int(binary.BigEndian.Uint16(buf[4:])), 8)),
+	}
+
+	copy(addr.Addr[:], buf[6:14])
+
+	err := syscall.Sendto(h.fd, buf[sll_len:], 0, addr)
+	if err != nil {
+		return fmt.Errorf("Could not inject packet: %w", err)
+	}
+
+	return nil
+}
+
+// Close the packet source.
+func (h *Handle) Close() {
+	syscall.Close(h.fd)
+}
+
+/* Return the length of the link-layer header built by the handle. */
+func (h *Handle) hdr_len() int {
+	if h.cooked {
+		return sll_len
+	}
+
+	return 0
+}
+
+func put_sll(buf []byte, pkttype uint8, hatype uint16, halen uint8, addr [8]uint8, proto uint16) {
+	binary.BigEndian.PutUint16(buf[0:], uint16(pkttype))
+	binary.BigEndian.PutUint16(buf[2:], hatype)
+	binary.BigEndian.PutUint16(buf[4:], uint16(halen))
+	copy(buf[6:14], addr[:])
+	binary.BigEndian.PutUint16(buf[14:], proto)
+}
+
+func timestamp(oob []byte) time.Time {
+	msgs, err := syscall.ParseSocketControlMessage(oob)
+	if err != nil {
+		return time.Now()
+	}
+
+	for _, m := range msgs {
+		if m.Header.Level != syscall.SOL_SOCKET ||
+		   m.Header.Type != syscall.SO_TIMESTAMPNS {
+			continue
+		}
+
+		ts := (*syscall.Timespec)(unsafe.Pointer(&m.Data[0]))
+		return time.Unix(ts.Unix())
+	}
+
+	return time.Now()
+}
+
+func htons(v uint16) uint16 {
+	return v << 8 | v >> 8
+}
@@ -0,0 +1,301 @@
+/*
+ * Network packet analysis framework.
+ *
+ * Copyright (c) 2014, Alessandro Ghedini
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are
+ * met:
+ *
+ *     * Redistributions of source code must retain the above copyright
+ *       notice, this list of conditions and the following disclaimer.
+ *
+ *     * Redistributions in binary form must reproduce the above copyright
+ *       notice, this list of conditions and the following disclaimer in the
+ *       documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS
+ * IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO,
+ * THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR
+ * PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR
+ * CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+ * EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+ * PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+ * PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF
+ * LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+ * NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+ * SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package afpacket_test
+
+import "bytes"
+import "syscall"
+import "testing"
+import "time"
+
+import "github.com/ghedo/go.pkt/capture"
+import "github.com/ghedo/go.pkt/capture/afpacket"
+import "github.com/ghedo/go.pkt/filter"
+import "github.com/ghedo/go.pkt/layers"
+import "github.com/ghedo/go.pkt/packet"
+import "github.com/ghedo/go.pkt/packet/sll"
+
+var test_eth_frame = []byte{
+	0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+	0x88, 0xb5, 0xde, 0xad, 0xbe, 0xef, 0x00, 0x01, 0x02, 0x03, 0x04, 0x05,
+}
+
+func open_lo(t *testing.T) *afpacket.Handle {
+	return open_lo_timeout(t, 0)
+}
+
+func open_lo_timeout(t *testing.T, timeout time.Duration) *afpacket.Handle {
+	src, err := afpacket.Open("lo")
+	if err != nil {
+		t.Skipf("Error opening: %s", err)
+	}
+
+	err = src.SetReadTimeout(timeout)
+	if err != nil {
+		t.Fatalf("Error setting timeout: %s", err)
+	}
+
+	flt, err := filter.NewBuilder().
+		LD(filter.Half, filter.ABS, 12).
+		JEQ(filter.Const, "", "fail", 0x88b5).
+		RET(filter.Const, 0x40000).
+		Label("fail").
+		RET(filter.Const, 0x0).
+		Build()
+	if err != nil {
+		t.Fatalf("Error building filter: %s", err)
+	}
+
+	err = src.ApplyFilter(flt)
+	if err != nil {
+		t.Fatalf("Error applying filter: %s", err)
+	}
+
+	err = src.Activate()
+	if err != nil {
+		t.Fatalf("Error activating source: %s", err)
+	}
+
+	return src
+}
+
+func TestCapture(t *testing.T) {
+	src := open_lo(t)
+	defer src.Close()
+
+	err := src.Inject(test_eth_frame)
+	if err != nil {
+		t.Fatalf("Error injecting packet: %s", err)
+	}
+
+	buf, err := src.Capture()
+	if err != nil {
+		t.Fatalf("Error capturing packet: %s", err)
+	}
+
+	if !bytes.Equal(buf, test_eth_frame) {
+		t.Fatalf("Packet mismatch: %x", buf)
+	}
+
+	if src.Timestamp().IsZero() {
+		t.Fatalf("Missing timestamp")
+	}
+
+	stats, err := src.Stats()
+	if err != nil {
+		t.Fatalf("Error getting stats: %s", err)
+	}
+
+	if stats.Received < 1 {
+		t.Fatalf("Stats mismatch: %d", stats.Received)
+	}
+}
+
+func TestCaptureZeroCopy(t *testing.T) {
+	h := open_lo(t)
+	defer h.Close()
+
+	var src capture.ZeroCopyHandle = h
+
+	err := h.Inject(test_eth_frame)
+	if err != nil {
+		t.Fatalf("Error injecting packet: %s", err)
+	}
+
+	buf, info, err := src.CaptureZeroCopy()
+	if err != nil {
+		t.Fatalf("Error capturing packet: %s", err)
+	}
+
+	if !bytes.Equal(buf, test_eth_frame) {
+		t.Fatalf("Packet mismatch: %x", buf)
+	}
+
+	if info.CapLen != len(test_eth_frame) ||
+	   info.Length != len(test_eth_frame) {
+		t.Fatalf("Length mismatch: %d %d", info.CapLen, info.Length)
+	}
+}
+
+func TestCaptureBatch(t *testing.T) {
+	h := open_lo(t)
+	defer h.Close()
+
+	var src capture.BatchHandle = h
+
+	for i := 0; i < 4; i++ {
+		err := h.Inject(test_eth_frame)
+		if err != nil {
+			t.Fatalf("Error injecting packet: %s", err)
+		}
+	}
+
+	bufs := make([][]byte, 16)
+	info := make([]capture.Info, 16)
+
+	for i := range bufs {
+		bufs[i] = make([]byte, 0, 16)
+	}
+
+	n, err := src.CaptureBatch(bufs, info)
+	if err != nil {
+		t.Fatalf("Error capturing packets: %s", err)
+	}
+
+	if n < 1 {
+		t.Fatalf("No packets captured")
+	}
+
+	for i := 0; i < n; i++ {
+		if !bytes.Equal(bufs[i], test_eth_frame[:16]) {
+			t.Fatalf("Packet mismatch: %x", bufs[i])
+		}
+
+		if info[i].CapLen != 16 ||
+		   info[i].Length != len(test_eth_frame) {
+			t.Fatalf("Length mismatch: %d %d",
+			         info[i].CapLen, info[i].Length)
+		}
+
+		if info[i].Timestamp.IsZero() {
+			t.Fatalf("Missing timestamp")
+		}
+	}
+}
+
+func TestReadTimeout(t *testing.T) {
+	src := open_lo_timeout(t, 20 * time.Millisecond)
+	defer src.Close()
+
+	start := time.Now()
+
+	/* nothing matches the filter unless injected */
+	buf, err := src.Capture()
+	if err != nil {
+		t.Fatalf("Error capturing packet: %s", err)
+	}
+
+	if buf != nil {
+		t.Fatalf("Unexpected packet: %x", buf)
+	}
+
+	if time.Since(start) > time.Second {
+		t.Fatalf("Timeout not applied: %s", time.Since(start))
+	}
+
+	err = src.SetReadTimeout(time.Second)
+	if err == nil {
+		t.Fatalf("Timeout changed after activation")
+	}
+}
+
+/* SLL header for an Ethernet frame to the null address, followed by the same
+ * payload of test_eth_frame */
+var test_sll_frame = []byte{
+	0x00, 0x00, 0x00, 0x01, 0x00, 0x06, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+	0x00, 0x00, 0x88, 0xb5, 0xde, 0xad, 0xbe, 0xef, 0x00, 0x01, 0x02, 0x03,
+	0x04, 0x05,
+}
+
+func TestCaptureCooked(t *testing.T) {
+	src, err := afpacket.OpenCooked("lo")
+	if err != nil {
+		t.Skipf("Error opening: %s", err)
+	}
+	defer src.Close()
+
+	if src.LinkType() != packet.SLL {
+		t.Fatalf("Link type mismatch: %s", src.LinkType())
+	}
+
+	err = src.SetReadTimeout(time.Second)
+	if err != nil {
+		t.Fatalf("Error setting timeout: %s", err)
+	}
+
+	/* the filter is run on the SLL header */
+	flt, err := filter.NewBuilder().
+		LD(filter.Half, filter.ABS, 14).
+		JEQ(filter.Const, "", "fail", 0x88b5).
+		RET(filter.Const, 0x40000).
+		Label("fail").
+		RET(filter.Const, 0x0).
+		Build()
+	if err != nil {
+		t.Fatalf("Error building filter: %s", err)
+	}
+
+	err = src.ApplyFilter(flt)
+	if err != nil {
+		t.Fatalf("Error applying filter: %s", err)
+	}
+
+	err = src.Activate()
+	if err != nil {
+		t.Fatalf("Error activating source: %s", err)
+	}
+
+	for i := 0; i < 2; i++ {
+		err = src.Inject(test_sll_frame)
+		if err != nil {
+			t.Fatalf("Error injecting packet: %s", err)
+		}
+	}
+
+	buf, err := src.Capture()
+	if err != nil {
+		t.Fatalf("Error capturing packet: %s", err)
+	}
+
+	pkt, err := layers.UnpackAll(buf, packet.SLL)
+	if err != nil {
+		t.Fatalf("Error unpacking: %s", err)
+	}
+
+	sll_pkt := pkt.(*sll.Packet)
+	/* the protocol and payload are the injected ones */
+	if sll_pkt.AddrType != syscall.ARPHRD_LOOPBACK ||
+	   !bytes.Equal(buf[14:], test_sll_frame[14:]) {
+		t.Fatalf("Packet mismatch: %x", buf)
+	}
+
+	bufs := [][]byte{ make([]byte, 0, 64) }
+	info := make([]capture.Info, 1)
+
+	n, err := src.CaptureBatch(bufs, info)
+	if err != nil {
+		t.Fatalf("Error capturing packets: %s", err)
+	}
+
+	if n != 1 || !bytes.Equal(bufs[0][14:], test_sll_frame[14:]) ||
+	   info[0].Length != len(test_sll_frame) {
+		t.Fatalf("Packet mismatch: %x", bufs[0])
+	}
+}
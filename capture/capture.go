@@ -29,25 +29,196 @@
  */
 
 // Provides the basic interface for packet capturing and injection. Different
-// implementations ("pcap", "file", ...) are provided as subpackages.
+// implementations ("pcap", "afpacket", "file", ...) are provided as subpackages.
+//
+// Each implementation only provides the capabilities supported by its packet
+// source (e.g. capturing, injecting, filtering, ...), which can be discovered at
+// runtime with Capabilities() or by type assertion on the single capability
+// interfaces. Adapt() can be used where a full Handle is needed.
 package capture
 
+import "errors"
+import "strings"
+import "time"
+
 import "github.com/ghedo/go.pkt/filter"
 import "github.com/ghedo/go.pkt/packet"
 
-type Handle interface {
+// ErrUnsupported is returned (possibly wrapped in an UnsupportedError) by the
+// handles' methods that are not supported by the underlying packet source.
+var ErrUnsupported = errors.New("Unsupported")
+
+// UnsupportedError records the name of the unsupported operation.
+type UnsupportedError struct {
+	Op string
+}
+
+func (e *UnsupportedError) Error() string {
+	return e.Op + ": " + ErrUnsupported.Error()
+}
+
+func (e *UnsupportedError) Is(target error) bool {
+	return target == ErrUnsupported
+}
+
+// Base contains the methods implemented by all the capture handles.
+type Base interface {
+	// Return the link type of the packets captured or injected.
 	LinkType() packet.Type
 
+	Activate() error
+	Close()
+}
+
+// Reader is implemented by the handles that can capture packets.
+type Reader interface {
+	Base
+
+	Capture() ([]byte, error)
+}
+
+// Injector is implemented by the handles that can inject packets.
+type Injector interface {
+	Base
+
+	Inject(buf []byte) error
+}
+
+// ReadInjector is implemented by the handles that can both capture and inject
+// packets.
+type ReadInjector interface {
+	Reader
+	Injector
+}
+
+// Configurable is implemented by the handles whose packet source can be
+// configured before activation.
+type Configurable interface {
 	SetMTU(mtu int) error
 	SetPromiscMode(promisc bool) error
 	SetMonitorMode(monitor bool) error
+}
 
+// Filterable is implemented by the handles that can filter the captured packets.
+type Filterable interface {
 	ApplyFilter(filter *filter.Filter) error
+}
 
-	Activate() error
+// StatsProvider is implemented by the handles that keep capture statistics.
+type StatsProvider interface {
+	Stats() (*Stats, error)
+}
 
-	Capture() ([]byte, error)
-	Inject(buf []byte) error
+// Capture statistics.
+type Stats struct {
+	Received  uint64
+	Dropped   uint64
+	IfDropped uint64
+}
 
-	Close()
+// Handle is the union of all the basic capabilities. Handles that only support
+// some of them can be converted to a Handle with Adapt().
+type Handle interface {
+	ReadInjector
+	Configurable
+	Filterable
+}
+
+type Capability uint32
+
+const (
+	CanRead Capability = 1 << iota
+	CanInject
+	CanConfigure
+	CanFilter
+	CanStats
+)
+
+// Return the capabilities supported by the given handle. Handles returned by
+// Adapt() report the capabilities of the adapted handle.
+func Capabilities(h Base) Capability {
+	var caps Capability
+
+	if a, ok := h.(*adapter); ok {
+		h = a.h
+	}
+
+	if _, ok := h.(Reader); ok {
+		caps |= CanRead
+	}
+
+	if _, ok := h.(Injector); ok {
+		caps |= CanInject
+	}
+
+	if _, ok := h.(Configurable); ok {
+		caps |= CanConfigure
+	}
+
+	if _, ok := h.(Filterable); ok {
+		caps |= CanFilter
+	}
+
+	if _, ok := h.(StatsProvider); ok {
+		caps |= CanStats
+	}
+
+	return caps
+}
+
+func (c Capability) String() string {
+	var caps []string
+
+	if c & CanRead != 0 {
+		caps = append(caps, "read")
+	}
+
+	if c & CanInject != 0 {
+		caps = append(caps, "inject")
+	}
+
+	if c & CanConfigure != 0 {
+		caps = append(caps, "configure")
+	}
+
+	if c & CanFilter != 0 {
+		caps = append(caps, "filter")
+	}
+
+	if c & CanStats != 0 {
+		caps = append(caps, "stats")
+	}
+
+	return strings.Join(caps, ",")
+}
+
+// Metadata of a captured packet.
+type Info struct {
+	Timestamp time.Time
+	CapLen    int
+	Length    int
+}
+
+// ZeroCopyHandle is implemented by the handles that can return captured packets
+// without copying them into a newly allocated buffer.
+type ZeroCopyHandle interface {
+	Reader
+
+	// Capture a single packet from the packet source. The returned slice
+	// points to memory owned by the handle and is only valid until the next
+	// call to any of the handle's capture methods.
+	CaptureZeroCopy() ([]byte, Info, error)
+}
+
+// BatchHandle is implemented by the handles that can capture multiple packets
+// with a single call.
+type BatchHandle interface {
+	Reader
+
+	// Capture up to len(bufs) packets, copying each of them into the
+	// corresponding buffer (up to the buffer's capacity) and storing its
+	// metadata in info. The buffers are resliced to the captured length.
+	// This blocks until at least one packet is available, and then returns
+	// the number of packets captured without waiting for more.
+	CaptureBatch(bufs [][]byte, info []Info) (int, error)
 }
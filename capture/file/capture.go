@@ -37,6 +37,7 @@ import "encoding/binary"
 import "fmt"
 import "io"
 import "os"
+import "time"
 
 import "github.com/ghedo/go.pkt/filter"
 import "github.com/ghedo/go.pkt/packet"
@@ -48,7 +49,8 @@ type Handle struct {
 	order  binary.ByteOrder
 	link   uint32
 	mtu    uint32
-	filter *filter.Filter
+	ts     time.Time
+	filter filter.Func
 }
 
 var BigEndian    = []byte{0xa1, 0xb2, 0xc3, 0xd4}
@@ -62,7 +64,9 @@ func Open(file_name string) (*Handle, error) {
 	open := open_file
 
 	if _, err := os.Stat(file_name); os.IsNotExist(err) {
-		open = create_file
+		open = func(file_name string) (*os.File, error) {
+			return create_file(file_name, 1)
+		}
 	}
 
 	file, err := open(file_name)
@@ -112,7 +116,7 @@ func Open(file_name string) (*Handle, error) {
 	return handle, nil
 }
 
-func create_file(file_name string) (*os.File, error) {
+func create_file(file_name string, link_type uint32) (*os.File, error) {
 	file, err := os.Create(file_name)
 	if err != nil {
 		return nil, fmt.Errorf("Could not create file: %s", err)
@@ -125,7 +129,7 @@ func create_file(file_name string) (*os.File, error) {
 	binary.Write(file, binary.BigEndian, uint32(0))
 	binary.Write(file, binary.BigEndian, uint32(0))
 	binary.Write(file, binary.BigEndian, uint32(0x7fff)) /* MTU */
-	binary.Write(file, binary.BigEndian, uint32(1)) /* link type */
+	binary.Write(file, binary.BigEndian, link_type) /* link type */
 
 	return file, nil
 }
@@ -145,29 +149,15 @@ func (h *Handle) LinkType() packet.Type {
 	return packet.LinkType(h.link)
 }
 
-// Not supported.
-func (h *Handle) SetMTU(mtu int) error {
-	return fmt.Errorf("Unsupported")
-}
-
-// Not supported.
-func (h *Handle) SetPromiscMode(promisc bool) error {
-	return fmt.Errorf("Unsupported")
-}
-
-// Not supported.
-func (h *Handle) SetMonitorMode(monitor bool) error {
-	return fmt.Errorf("Unsupported")
-}
-
 // Apply the given filter it to the packet source. Only packets that match this
 // filter will be captured.
 func (h *Handle) ApplyFilter(filter *filter.Filter) error {
-	if !filter.Validate() {
-		return fmt.Errorf("Invalid filter")
+	fn, err := filter.Func()
+	if err != nil {
+		return err
 	}
 
-	h.filter = filter
+	h.filter = fn
 	return nil
 }
 
@@ -195,6 +185,8 @@ func (h *Handle) Capture() ([]byte, error) {
 			return nil, nil
 		}
 
+		h.ts = time.Unix(int64(sec), int64(usec) * 1000)
+
 		buf = make([]byte, int(caplen))
 
 		_, err := h.file.Read(buf)
@@ -216,6 +208,22 @@ func (h *Handle) Capture() ([]byte, error) {
 	return buf, nil
 }
 
+// Return the timestamp of the last packet returned by Capture().
+func (h *Handle) Timestamp() time.Time {
+	return h.ts
+}
+
+// Move back to the start of the dump file, so that the following calls to
+// Capture() will return the packets from the first one again.
+func (h *Handle) Rewind() error {
+	_, err := h.file.Seek(24, 0)
+	if err != nil {
+		return fmt.Errorf("Could not rewind: %s", err)
+	}
+
+	return nil
+}
+
 // Inject a packet in the packet source. This will automatically append packets
 // at the end of the dump file, instead of truncating it.
 func (h *Handle) Inject(buf []byte) error {
@@ -0,0 +1,330 @@
+/*
+ * Network packet analysis framework.
+ *
+ * Copyright (c) 2014, Alessandro Ghedini
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are
+ * met:
+ *
+ *     * Redistributions of source code must retain the above copyright
+ *       notice, this list of conditions and the following disclaimer.
+ *
+ *     * Redistributions in binary form must reproduce the above copyright
+ *       notice, this list of conditions and the following disclaimer in the
+ *       documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS
+ * IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO,
+ * THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR
+ * PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR
+ * CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+ * EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+ * PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+ * PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF
+ * LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+ * NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+ * SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package file
+
+import "fmt"
+import "os"
+import "strconv"
+import "time"
+
+import "github.com/ghedo/go.pkt/packet"
+
+// A RotateHandle writes packets to a sequence of dump files, starting a new
+// file whenever the current one grows past a given size, number of packets or
+// age (similarly to tcpdump's -C, -G and -W options). It's a write-only handle,
+// so it only implements capture.Injector.
+type RotateHandle struct {
+	pattern      string
+	cur          *Handle
+	cur_name     string
+	cur_bytes    uint64
+	cur_packets  uint64
+	cur_opened   time.Time
+	seq          uint64
+	files        []string
+	link         uint32
+	max_bytes    uint64
+	max_packets  uint64
+	max_duration time.Duration
+	max_files    int
+	on_close     func(file_name string)
+}
+
+/* size of the pcap global and per-record headers */
+const file_hdr_len   = 24
+const record_hdr_len = 16
+
+// Create a new rotating capture handle. The names of the dump files are
+// generated from the given pattern, which may contain strftime-style
+// conversion specifications (e.g. "dump-%Y%m%d-%H%M%S.pcap") that are expanded
+// using the time at which each file is created.
+//
+// When rotating by size or number of packets, a sequence number is appended to
+// the generated names (like tcpdump -C does). No file is created until the
+// handle is activated.
+func OpenRotate(pattern string) (*RotateHandle, error) {
+	if pattern == "" {
+		return nil, fmt.Errorf("Invalid file pattern")
+	}
+
+	return &RotateHandle{ pattern: pattern, link: 1 }, nil
+}
+
+// Return the link type of the capture handle (that is, the type of packets that
+// are written to the dump files).
+func (h *RotateHandle) LinkType() packet.Type {
+	return packet.LinkType(h.link)
+}
+
+// Set the link type written in the header of the dump files (Ethernet by
+// default).
+func (h *RotateHandle) SetLinkType(link_type packet.Type) error {
+	if h.cur != nil {
+		return fmt.Errorf("Handle already active")
+	}
+
+	link, ok := link_type.ToLinkType()
+	if !ok {
+		return fmt.Errorf("Unsupported link type: %s", link_type)
+	}
+
+	h.link = link
+	return nil
+}
+
+// Start a new file after the current one reaches the given size in bytes. Zero
+// disables size-based rotation.
+func (h *RotateHandle) SetMaxBytes(max uint64) error {
+	if h.cur != nil {
+		return fmt.Errorf("Handle already active")
+	}
+
+	h.max_bytes = max
+	return nil
+}
+
+// Start a new file after the given number of packets have been written to the
+// current one. Zero disables count-based rotation.
+func (h *RotateHandle) SetMaxPackets(max uint64) error {
+	if h.cur != nil {
+		return fmt.Errorf("Handle already active")
+	}
+
+	h.max_packets = max
+	return nil
+}
+
+// Start a new file once the current one is older than the given duration. Zero
+// disables time-based rotation.
+func (h *RotateHandle) SetMaxDuration(max time.Duration) error {
+	if h.cur != nil {
+		return fmt.Errorf("Handle already active")
+	}
+
+	h.max_duration = max
+	return nil
+}
+
+// Keep at most the given number of files, deleting the oldest one when a new
+// file is started (i.e. use the files as a ring buffer). Zero means that no
+// file is ever deleted.
+func (h *RotateHandle) SetMaxFiles(max int) error {
+	if h.cur != nil {
+		return fmt.Errorf("Handle already active")
+	}
+
+	if max < 0 {
+		return fmt.Errorf("Invalid number of files")
+	}
+
+	h.max_files = max
+	return nil
+}
+
+// Set a function that will be called with the name of every dump file after
+// it has been closed (e.g. in order to compress or upload it).
+func (h *RotateHandle) SetCloseCallback(fn func(file_name string)) {
+	h.on_close = fn
+}
+
+// Activate the capture handle. This creates the first dump file, after which
+// the handle configuration can't be changed anymore.
+func (h *RotateHandle) Activate() error {
+	if h.cur != nil {
+		return fmt.Errorf("Handle already active")
+	}
+
+	return h.rotate(time.Now())
+}
+
+// Inject a packet in the current dump file, starting a new file first if any
+// of the configured limits has been reached.
+func (h *RotateHandle) Inject(buf []byte) error {
+	if h.cur == nil {
+		return fmt.Errorf("Handle not active")
+	}
+
+	now := time.Now()
+
+	if h.must_rotate(now, len(buf)) {
+		err := h.rotate(now)
+		if err != nil {
+			return err
+		}
+	}
+
+	err := h.cur.Inject(buf)
+	if err != nil {
+		return err
+	}
+
+	h.cur_bytes   += uint64(record_hdr_len + len(buf))
+	h.cur_packets += 1
+
+	return nil
+}
+
+// Return the name of the dump file currently being written.
+func (h *RotateHandle) FileName() string {
+	return h.cur_name
+}
+
+// Close the current dump file.
+func (h *RotateHandle) Close() {
+	h.close_current()
+}
+
+func (h *RotateHandle) must_rotate(now time.Time, pkt_len int) bool {
+	if h.max_duration > 0 && now.Sub(h.cur_opened) >= h.max_duration {
+		return true
+	}
+
+	/* never leave a file empty, even if the packet alone exceeds it */
+	if h.cur_packets == 0 {
+		return false
+	}
+
+	if h.max_packets > 0 && h.cur_packets >= h.max_packets {
+		return true
+	}
+
+	if h.max_bytes > 0 &&
+	   h.cur_bytes + uint64(record_hdr_len + pkt_len) > h.max_bytes {
+		return true
+	}
+
+	return false
+}
+
+func (h *RotateHandle) rotate(now time.Time) error {
+	h.close_current()
+
+	name := h.file_name(now)
+
+	if h.max_files > 0 && len(h.files) >= h.max_files {
+		os.Remove(h.files[0])
+		h.files = h.files[1:]
+	}
+
+	/* truncate any stale file with the same name */
+	os.Remove(name)
+
+	out, err := create_file(name, h.link)
+	if err != nil {
+		return err
+	}
+	out.Close()
+
+	cur, err := Open(name)
+	if err != nil {
+		return err
+	}
+
+	h.cur         = cur
+	h.cur_name    = name
+	h.cur_bytes   = file_hdr_len
+	h.cur_packets = 0
+	h.cur_opened  = now
+
+	h.files = append(h.files, name)
+	h.seq++
+
+	return nil
+}
+
+func (h *RotateHandle) close_current() {
+	if h.cur == nil {
+		return
+	}
+
+	h.cur.Close()
+	h.cur = nil
+
+	if h.on_close != nil {
+		h.on_close(h.cur_name)
+	}
+}
+
+func (h *RotateHandle) file_name(now time.Time) string {
+	name := strftime(h.pattern, now)
+
+	if h.max_bytes == 0 && h.max_packets == 0 {
+		return name
+	}
+
+	if h.max_files > 0 {
+		width := len(strconv.Itoa(h.max_files - 1))
+		seq   := h.seq % uint64(h.max_files)
+
+		return fmt.Sprintf("%s%0*d", name, width, seq)
+	}
+
+	if h.seq > 0 {
+		return fmt.Sprintf("%s%d", name, h.seq)
+	}
+
+	return name
+}
+
+func strftime(format string, t time.Time) string {
+	var out []byte
+
+	for i := 0; i < len(format); i++ {
+		if format[i] != '%' || i == len(format) - 1 {
+			out = append(out, format[i])
+			continue
+		}
+
+		i++
+
+		switch format[i] {
+		case 'Y': out = append(out, fmt.Sprintf("%04d", t.Year())...)
+		case 'y': out = append(out, fmt.Sprintf("%02d", t.Year() % 100)...)
+		case 'm': out = append(out, fmt.Sprintf("%02d", int(t.Month()))...)
+		case 'd': out = append(out, fmt.Sprintf("%02d", t.Day())...)
+		case 'j': out = append(out, fmt.Sprintf("%03d", t.YearDay())...)
+		case 'H': out = append(out, fmt.Sprintf("%02d", t.Hour())...)
+		case 'M': out = append(out, fmt.Sprintf("%02d", t.Minute())...)
+		case 'S': out = append(out, fmt.Sprintf("%02d", t.Second())...)
+		case 's': out = append(out, strconv.FormatInt(t.Unix(), 10)...)
+		case 'a': out = append(out, t.Format("Mon")...)
+		case 'b': out = append(out, t.Format("Jan")...)
+		case 'Z': out = append(out, t.Format("MST")...)
+		case 'z': out = append(out, t.Format("-0700")...)
+		case 'F': out = append(out, t.Format("2006-01-02")...)
+		case 'T': out = append(out, t.Format("15:04:05")...)
+		case '%': out = append(out, '%')
+		default:  out = append(out, '%', format[i])
+		}
+	}
+
+	return string(out)
+}
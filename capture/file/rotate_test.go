@@ -0,0 +1,235 @@
+/*
+ * Network packet analysis framework.
+ *
+ * Copyright (c) 2014, Alessandro Ghedini
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are
+ * met:
+ *
+ *     * Redistributions of source code must retain the above copyright
+ *       notice, this list of conditions and the following disclaimer.
+ *
+ *     * Redistributions in binary form must reproduce the above copyright
+ *       notice, this list of conditions and the following disclaimer in the
+ *       documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS
+ * IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO,
+ * THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR
+ * PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR
+ * CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+ * EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+ * PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+ * PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF
+ * LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+ * NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+ * SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package file_test
+
+import "io/ioutil"
+import "os"
+import "path/filepath"
+import "testing"
+import "time"
+
+import "github.com/ghedo/go.pkt/capture/file"
+import "github.com/ghedo/go.pkt/packet"
+
+var test_eth_arp = []byte{
+	0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x4c, 0x72, 0xb9, 0x54, 0xe5, 0x3d,
+	0x08, 0x06, 0x00, 0x01, 0x08, 0x00, 0x06, 0x04, 0x00, 0x01, 0x4c, 0x72,
+	0xb9, 0x54, 0xe5, 0x3d, 0xc0, 0xa8, 0x01, 0x87, 0x00, 0x00, 0x00, 0x00,
+	0x00, 0x00, 0xc1, 0x1b, 0xd0, 0x25,
+}
+
+func count_packets(t *testing.T, file_name string) uint64 {
+	src, err := file.Open(file_name)
+	if err != nil {
+		t.Fatalf("Error opening: %s", err)
+	}
+	defer src.Close()
+
+	var count uint64
+	for {
+		buf, err := src.Capture()
+		if err != nil {
+			t.Fatalf("Error reading: %s", err)
+		}
+
+		if buf == nil {
+			break
+		}
+
+		count++
+	}
+
+	return count
+}
+
+func TestRotatePackets(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rotate_test")
+	if err != nil {
+		t.Fatalf("Error creating dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	dst, err := file.OpenRotate(filepath.Join(dir, "dump.pcap"))
+	if err != nil {
+		t.Fatalf("Error opening: %s", err)
+	}
+
+	dst.SetMaxPackets(4)
+	dst.SetMaxFiles(3)
+
+	var closed []string
+	dst.SetCloseCallback(func(name string) {
+		closed = append(closed, name)
+	})
+
+	err = dst.Activate()
+	if err != nil {
+		t.Fatalf("Error activating: %s", err)
+	}
+
+	for i := 0; i < 18; i++ {
+		err = dst.Inject(test_eth_arp)
+		if err != nil {
+			t.Fatalf("Error writing: %s", err)
+		}
+	}
+
+	dst.Close()
+
+	if len(closed) != 5 {
+		t.Fatalf("Closed files mismatch: %v", closed)
+	}
+
+	if filepath.Base(closed[4]) != "dump.pcap1" {
+		t.Fatalf("File name mismatch: %s", closed[4])
+	}
+
+	files, _ := filepath.Glob(filepath.Join(dir, "*"))
+	if len(files) != 3 {
+		t.Fatalf("Ring size mismatch: %v", files)
+	}
+
+	expected := map[string]uint64{
+		"dump.pcap0": 4, "dump.pcap1": 2, "dump.pcap2": 4,
+	}
+
+	for name, count := range expected {
+		n := count_packets(t, filepath.Join(dir, name))
+		if n != count {
+			t.Fatalf("Count mismatch for %s: %d", name, n)
+		}
+	}
+}
+
+func TestRotateBytes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rotate_test")
+	if err != nil {
+		t.Fatalf("Error creating dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	dst, err := file.OpenRotate(filepath.Join(dir, "dump.pcap"))
+	if err != nil {
+		t.Fatalf("Error opening: %s", err)
+	}
+
+	/* header + 2 records */
+	dst.SetMaxBytes(uint64(24 + 2 * (16 + len(test_eth_arp))))
+
+	err = dst.Activate()
+	if err != nil {
+		t.Fatalf("Error activating: %s", err)
+	}
+
+	for i := 0; i < 5; i++ {
+		dst.Inject(test_eth_arp)
+	}
+
+	dst.Close()
+
+	for name, count := range map[string]uint64{
+		"dump.pcap": 2, "dump.pcap1": 2, "dump.pcap2": 1,
+	} {
+		n := count_packets(t, filepath.Join(dir, name))
+		if n != count {
+			t.Fatalf("Count mismatch for %s: %d", name, n)
+		}
+	}
+}
+
+func TestRotateDuration(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rotate_test")
+	if err != nil {
+		t.Fatalf("Error creating dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	pattern := filepath.Join(dir, "dump-%Y%m%d-%H%M%S.pcap")
+
+	dst, err := file.OpenRotate(pattern)
+	if err != nil {
+		t.Fatalf("Error opening: %s", err)
+	}
+
+	dst.SetMaxDuration(1100 * time.Millisecond)
+
+	start := time.Now()
+
+	err = dst.Activate()
+	if err != nil {
+		t.Fatalf("Error activating: %s", err)
+	}
+
+	first := dst.FileName()
+
+	dst.Inject(test_eth_arp)
+	time.Sleep(1200 * time.Millisecond)
+	dst.Inject(test_eth_arp)
+
+	second := dst.FileName()
+
+	dst.Close()
+
+	if first == second {
+		t.Fatalf("File not rotated: %s", first)
+	}
+
+	if filepath.Base(first) != start.Format("dump-20060102-150405.pcap") &&
+	   filepath.Base(first) != start.Add(time.Second).
+	                           Format("dump-20060102-150405.pcap") {
+		t.Fatalf("File name mismatch: %s", first)
+	}
+
+	if count_packets(t, first) != 1 || count_packets(t, second) != 1 {
+		t.Fatalf("Count mismatch")
+	}
+}
+
+func TestRotateLinkType(t *testing.T) {
+	dst, err := file.OpenRotate("dump.pcap")
+	if err != nil {
+		t.Fatalf("Error opening: %s", err)
+	}
+
+	err = dst.SetLinkType(packet.TCP)
+	if err == nil {
+		t.Fatalf("Unsupported link type accepted")
+	}
+
+	err = dst.SetLinkType(packet.IPv4)
+	if err != nil {
+		t.Fatalf("Error setting link type: %s", err)
+	}
+
+	if dst.LinkType() != packet.IPv4 {
+		t.Fatalf("Link type mismatch: %s", dst.LinkType())
+	}
+}
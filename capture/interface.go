@@ -0,0 +1,148 @@
+/*
+ * Network packet analysis framework.
+ *
+ * Copyright (c) 2014, Alessandro Ghedini
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are
+ * met:
+ *
+ *     * Redistributions of source code must retain the above copyright
+ *       notice, this list of conditions and the following disclaimer.
+ *
+ *     * Redistributions in binary form must reproduce the above copyright
+ *       notice, this list of conditions and the following disclaimer in the
+ *       documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS
+ * IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO,
+ * THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR
+ * PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR
+ * CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+ * EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+ * PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+ * PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF
+ * LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+ * NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+ * SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package capture
+
+import "fmt"
+import "net"
+import "strings"
+
+import "github.com/ghedo/go.pkt/packet"
+
+// Interface represents a network interface that can be used for capturing and
+// injecting packets.
+type Interface struct {
+	Index        int
+	Name         string
+	Description  string
+	Flags        Flags
+	MTU          int
+	HardwareAddr net.HardwareAddr
+	Addrs        []*net.IPNet
+	LinkTypes    []packet.Type
+}
+
+type Flags uint32
+
+const (
+	Up Flags = 1 << iota
+	Running
+	Loopback
+	Wireless
+	Broadcast
+	Multicast
+	PointToPoint
+)
+
+// Return the network interface with the given name.
+func InterfaceByName(name string) (*Interface, error) {
+	ifaces, err := Interfaces()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, iface := range ifaces {
+		if iface.Name == name {
+			return iface, nil
+		}
+	}
+
+	return nil, fmt.Errorf("No such interface: %s", name)
+}
+
+func (i *Interface) String() string {
+	var parts []string
+
+	parts = append(parts, fmt.Sprintf("%d: %s", i.Index, i.Name))
+
+	if i.Description != "" {
+		parts = append(parts, fmt.Sprintf("(%s)", i.Description))
+	}
+
+	parts = append(parts, fmt.Sprintf("<%s>", i.Flags))
+	parts = append(parts, fmt.Sprintf("mtu %d", i.MTU))
+
+	if len(i.HardwareAddr) > 0 {
+		parts = append(parts, fmt.Sprintf("link %s", i.HardwareAddr))
+	}
+
+	for _, a := range i.Addrs {
+		if a.IP.To4() != nil {
+			parts = append(parts, fmt.Sprintf("inet %s", a))
+		} else {
+			parts = append(parts, fmt.Sprintf("inet6 %s", a))
+		}
+	}
+
+	var types []string
+	for _, t := range i.LinkTypes {
+		types = append(types, t.String())
+	}
+
+	if len(types) > 0 {
+		parts = append(parts, fmt.Sprintf("[%s]", strings.Join(types, ",")))
+	}
+
+	return strings.Join(parts, " ")
+}
+
+func (f Flags) String() string {
+	var flags []string
+
+	if f & Up != 0 {
+		flags = append(flags, "up")
+	}
+
+	if f & Running != 0 {
+		flags = append(flags, "running")
+	}
+
+	if f & Loopback != 0 {
+		flags = append(flags, "loopback")
+	}
+
+	if f & Wireless != 0 {
+		flags = append(flags, "wireless")
+	}
+
+	if f & Broadcast != 0 {
+		flags = append(flags, "broadcast")
+	}
+
+	if f & Multicast != 0 {
+		flags = append(flags, "multicast")
+	}
+
+	if f & PointToPoint != 0 {
+		flags = append(flags, "pointtopoint")
+	}
+
+	return strings.Join(flags, ",")
+}
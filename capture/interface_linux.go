@@ -0,0 +1,261 @@
+/*
+ * Network packet analysis framework.
+ *
+ * Copyright (c) 2014, Alessandro Ghedini
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are
+ * met:
+ *
+ *     * Redistributions of source code must retain the above copyright
+ *       notice, this list of conditions and the following disclaimer.
+ *
+ *     * Redistributions in binary form must reproduce the above copyright
+ *       notice, this list of conditions and the following disclaimer in the
+ *       documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS
+ * IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO,
+ * THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR
+ * PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR
+ * CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+ * EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+ * PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+ * PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF
+ * LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+ * NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+ * SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package capture
+
+import "fmt"
+import "net"
+import "os"
+import "sort"
+import "syscall"
+import "unsafe"
+
+import "github.com/ghedo/go.pkt/packet"
+
+type ifaddrmsg struct {
+	family    uint8
+	prefixlen uint8
+	flags     uint8
+	scope     uint8
+	index     uint32
+}
+
+/* not defined by the syscall package */
+const arphrd_ieee80211_radiotap = 803
+
+// List all network interfaces available on the system.
+func Interfaces() ([]*Interface, error) {
+	links, err := netlink_dump(syscall.RTM_GETLINK)
+	if err != nil {
+		return nil, err
+	}
+
+	ifaces := make(map[int]*Interface)
+
+	for _, m := range links {
+		if m.Header.Type != syscall.RTM_NEWLINK {
+			continue
+		}
+
+		ifinfo := (*syscall.IfInfomsg)(unsafe.Pointer(&m.Data[0]))
+
+		attrs, err := syscall.ParseNetlinkRouteAttr(&m)
+		if err != nil {
+			return nil, fmt.Errorf("Could not parse attr: %s", err)
+		}
+
+		iface := &Interface{ Index: int(ifinfo.Index) }
+
+		for _, a := range attrs {
+			switch a.Attr.Type {
+			case syscall.IFLA_IFNAME:
+				iface.Name = c_string(a.Value)
+
+			case syscall.IFLA_IFALIAS:
+				iface.Description = c_string(a.Value)
+
+			case syscall.IFLA_MTU:
+				mtu := *(*uint32)(unsafe.Pointer(&a.Value[0]))
+				iface.MTU = int(mtu)
+
+			case syscall.IFLA_ADDRESS:
+				if !is_zero(a.Value) {
+					iface.HardwareAddr = net.HardwareAddr(a.Value)
+				}
+			}
+		}
+
+		iface.Flags     = link_flags(ifinfo.Flags, iface.Name)
+		iface.LinkTypes = link_types(ifinfo.Type)
+
+		ifaces[iface.Index] = iface
+	}
+
+	addrs, err := netlink_dump(syscall.RTM_GETADDR)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, m := range addrs {
+		if m.Header.Type != syscall.RTM_NEWADDR {
+			continue
+		}
+
+		ifaddr := (*ifaddrmsg)(unsafe.Pointer(&m.Data[0]))
+
+		iface, ok := ifaces[int(ifaddr.index)]
+		if !ok {
+			continue
+		}
+
+		attrs, err := syscall.ParseNetlinkRouteAttr(&m)
+		if err != nil {
+			return nil, fmt.Errorf("Could not parse attr: %s", err)
+		}
+
+		var addr net.IP
+
+		for _, a := range attrs {
+			switch a.Attr.Type {
+			case syscall.IFA_ADDRESS:
+				if addr == nil {
+					addr = net.IP(a.Value)
+				}
+
+			/* on point-to-point links IFA_ADDRESS is the peer */
+			case syscall.IFA_LOCAL:
+				addr = net.IP(a.Value)
+			}
+		}
+
+		if addr == nil {
+			continue
+		}
+
+		iface.Addrs = append(iface.Addrs, &net.IPNet{
+			IP:   addr,
+			Mask: net.CIDRMask(int(ifaddr.prefixlen), len(addr) * 8),
+		})
+	}
+
+	var list []*Interface
+	for _, iface := range ifaces {
+		list = append(list, iface)
+	}
+
+	sort.Sort(iface_slice(list))
+
+	return list, nil
+}
+
+type iface_slice []*Interface
+
+func (s iface_slice) Len() int {
+	return len(s)
+}
+
+func (s iface_slice) Swap(i, j int) {
+	s[i], s[j] = s[j], s[i]
+}
+
+func (s iface_slice) Less(i, j int) bool {
+	return s[i].Index < s[j].Index
+}
+
+func netlink_dump(proto int) ([]syscall.NetlinkMessage, error) {
+	rib, err := syscall.NetlinkRIB(proto, syscall.AF_UNSPEC)
+	if err != nil {
+		return nil, fmt.Errorf("Could not retrieve RIB: %s", err)
+	}
+
+	msgs, err := syscall.ParseNetlinkMessage(rib)
+	if err != nil {
+		return nil, fmt.Errorf("Could not parse messages: %s", err)
+	}
+
+	return msgs, nil
+}
+
+func link_flags(ifi_flags uint32, name string) Flags {
+	var flags Flags
+
+	if ifi_flags & syscall.IFF_UP != 0 {
+		flags |= Up
+	}
+
+	if ifi_flags & syscall.IFF_RUNNING != 0 {
+		flags |= Running
+	}
+
+	if ifi_flags & syscall.IFF_LOOPBACK != 0 {
+		flags |= Loopback
+	}
+
+	if ifi_flags & syscall.IFF_BROADCAST != 0 {
+		flags |= Broadcast
+	}
+
+	if ifi_flags & syscall.IFF_MULTICAST != 0 {
+		flags |= Multicast
+	}
+
+	if ifi_flags & syscall.IFF_POINTOPOINT != 0 {
+		flags |= PointToPoint
+	}
+
+	for _, dir := range []string{ "wireless", "phy80211" } {
+		if _, err := os.Stat("/sys/class/net/" + name + "/" + dir); err == nil {
+			flags |= Wireless
+		}
+	}
+
+	return flags
+}
+
+/*
+ * Map the ARPHRD_* hardware type of an interface to the link types that can be
+ * captured from it. Like libpcap, fall back to Linux cooked mode for hardware
+ * types without a matching link type.
+ */
+func link_types(hw_type uint16) []packet.Type {
+	switch hw_type {
+	case syscall.ARPHRD_ETHER, syscall.ARPHRD_LOOPBACK:
+		return []packet.Type{ packet.Eth, packet.SLL, packet.SLL2 }
+
+	case arphrd_ieee80211_radiotap:
+		return []packet.Type{ packet.RadioTap, packet.SLL, packet.SLL2 }
+
+	case syscall.ARPHRD_NONE:
+		return []packet.Type{ packet.IP, packet.SLL, packet.SLL2 }
+
+	default:
+		return []packet.Type{ packet.SLL, packet.SLL2 }
+	}
+}
+
+func c_string(b []byte) string {
+	for i, c := range b {
+		if c == 0 {
+			return string(b[:i])
+		}
+	}
+
+	return string(b)
+}
+
+func is_zero(b []byte) bool {
+	for _, c := range b {
+		if c != 0 {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,109 @@
+/*
+ * Network packet analysis framework.
+ *
+ * Copyright (c) 2014, Alessandro Ghedini
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are
+ * met:
+ *
+ *     * Redistributions of source code must retain the above copyright
+ *       notice, this list of conditions and the following disclaimer.
+ *
+ *     * Redistributions in binary form must reproduce the above copyright
+ *       notice, this list of conditions and the following disclaimer in the
+ *       documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS
+ * IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO,
+ * THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR
+ * PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR
+ * CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+ * EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+ * PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+ * PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF
+ * LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+ * NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+ * SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+//go:build !linux
+
+package capture
+
+import "fmt"
+import "net"
+
+import "github.com/ghedo/go.pkt/packet"
+
+// List all network interfaces available on the system. On this system the link
+// types are guessed from the interface's flags and link-layer address, and the
+// Wireless flag and the description are never set (the pcap package can be
+// used to get the actual link types of an interface).
+func Interfaces() ([]*Interface, error) {
+	sys_ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil, fmt.Errorf("Could not list interfaces: %s", err)
+	}
+
+	var ifaces []*Interface
+
+	for _, i := range sys_ifaces {
+		iface := &Interface{
+			Index:        i.Index,
+			Name:         i.Name,
+			MTU:          i.MTU,
+			HardwareAddr: i.HardwareAddr,
+		}
+
+		if i.Flags & net.FlagUp != 0 {
+			iface.Flags |= Up | Running
+		}
+
+		if i.Flags & net.FlagLoopback != 0 {
+			iface.Flags |= Loopback
+		}
+
+		if i.Flags & net.FlagBroadcast != 0 {
+			iface.Flags |= Broadcast
+		}
+
+		if i.Flags & net.FlagMulticast != 0 {
+			iface.Flags |= Multicast
+		}
+
+		if i.Flags & net.FlagPointToPoint != 0 {
+			iface.Flags |= PointToPoint
+		}
+
+		iface.LinkTypes = link_types(i)
+
+		addrs, _ := i.Addrs()
+		for _, a := range addrs {
+			if ipnet, ok := a.(*net.IPNet); ok {
+				iface.Addrs = append(iface.Addrs, ipnet)
+			}
+		}
+
+		ifaces = append(ifaces, iface)
+	}
+
+	return ifaces, nil
+}
+
+func link_types(i net.Interface) []packet.Type {
+	switch {
+	case i.Flags & net.FlagLoopback != 0:
+		return []packet.Type{ packet.Loopback }
+
+	case len(i.HardwareAddr) == 6:
+		return []packet.Type{ packet.Eth }
+
+	case i.Flags & net.FlagPointToPoint != 0:
+		return []packet.Type{ packet.IP }
+
+	default:
+		return nil
+	}
+}
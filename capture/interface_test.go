@@ -0,0 +1,88 @@
+/*
+ * Network packet analysis framework.
+ *
+ * Copyright (c) 2014, Alessandro Ghedini
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are
+ * met:
+ *
+ *     * Redistributions of source code must retain the above copyright
+ *       notice, this list of conditions and the following disclaimer.
+ *
+ *     * Redistributions in binary form must reproduce the above copyright
+ *       notice, this list of conditions and the following disclaimer in the
+ *       documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS
+ * IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO,
+ * THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR
+ * PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR
+ * CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+ * EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+ * PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+ * PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF
+ * LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+ * NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+ * SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package capture_test
+
+import "log"
+import "testing"
+
+import "github.com/ghedo/go.pkt/capture"
+
+func TestInterfaces(t *testing.T) {
+	ifaces, err := capture.Interfaces()
+	if err != nil {
+		t.Fatalf("Error listing interfaces: %s", err)
+	}
+
+	var lo *capture.Interface
+
+	for _, iface := range ifaces {
+		if iface.Flags & capture.Loopback != 0 {
+			lo = iface
+		}
+	}
+
+	if lo == nil {
+		t.Fatalf("No loopback interface found")
+	}
+
+	if lo.MTU == 0 || len(lo.LinkTypes) == 0 {
+		t.Fatalf("Loopback mismatch: %s", lo)
+	}
+
+	found, err := capture.InterfaceByName(lo.Name)
+	if err != nil {
+		t.Fatalf("Error finding %s: %s", lo.Name, err)
+	}
+
+	if found.Index != lo.Index {
+		t.Fatalf("Index mismatch: %d", found.Index)
+	}
+
+	_, err = capture.InterfaceByName("nonexistent0")
+	if err == nil {
+		t.Fatalf("Found nonexistent interface")
+	}
+}
+
+func ExampleInterfaces() {
+	ifaces, err := capture.Interfaces()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	for _, iface := range ifaces {
+		if iface.Flags & capture.Up == 0 {
+			continue
+		}
+
+		log.Println(iface)
+	}
+}
@@ -34,20 +34,104 @@ package pcap
 
 // #cgo LDFLAGS: -lpcap
 // #include <stdlib.h>
+// #include <string.h>
 // #include <pcap.h>
+//
+// static void go_pcap_dump(pcap_dumper_t *d, long sec, long usec,
+//                          bpf_u_int32 len, const u_char *buf) {
+//     struct pcap_pkthdr hdr;
+//
+//     hdr.ts.tv_sec  = sec;
+//     hdr.ts.tv_usec = usec;
+//     hdr.caplen     = len;
+//     hdr.len        = len;
+//
+//     pcap_dump((u_char *) d, &hdr, buf);
+// }
+//
+// struct go_pcap_pkt {
+//     u_char      *data;
+//     bpf_u_int32  size;
+//     bpf_u_int32  caplen;
+//     bpf_u_int32  len;
+//     long         sec;
+//     long         frac;
+// };
+//
+// struct go_pcap_batch {
+//     struct go_pcap_pkt *pkts;
+//     int                 cnt;
+//     int                 n;
+// };
+//
+// static void go_pcap_batch_cb(u_char *user, const struct pcap_pkthdr *hdr,
+//                              const u_char *buf) {
+//     struct go_pcap_batch *b   = (struct go_pcap_batch *) user;
+//     struct go_pcap_pkt   *pkt = &b->pkts[b->n++];
+//
+//     pkt->caplen = hdr->caplen < pkt->size ? hdr->caplen : pkt->size;
+//     pkt->len    = hdr->len;
+//     pkt->sec    = hdr->ts.tv_sec;
+//     pkt->frac   = hdr->ts.tv_usec;
+//
+//     memcpy(pkt->data, buf, pkt->caplen);
+// }
+//
+// static int go_pcap_dispatch(pcap_t *p, struct go_pcap_batch *b) {
+//     b->n = 0;
+//     return pcap_dispatch(p, b->cnt, go_pcap_batch_cb, (u_char *) b);
+// }
 import "C"
 
 import "fmt"
+import "runtime"
+import "time"
 import "unsafe"
 
+import "github.com/ghedo/go.pkt/capture"
 import "github.com/ghedo/go.pkt/filter"
 import "github.com/ghedo/go.pkt/packet"
 
 type Handle struct {
-	Device string
-	pcap   *C.pcap_t
+	Device    string
+	pcap      *C.pcap_t
+	dumper    *C.pcap_dumper_t
+	active    bool
+	nonblock  bool
+	offline   bool
+	nano      bool
+	direction Direction
+	ts        time.Time
 }
 
+// Direction represents the direction of the packets to be captured.
+type Direction int
+
+const (
+	InOut Direction = C.PCAP_D_INOUT
+	In    Direction = C.PCAP_D_IN
+	Out   Direction = C.PCAP_D_OUT
+)
+
+// TimestampType represents the source of the packets' timestamps.
+type TimestampType int
+
+const (
+	Host            TimestampType = C.PCAP_TSTAMP_HOST
+	HostLowPrec     TimestampType = C.PCAP_TSTAMP_HOST_LOWPREC
+	HostHiPrec      TimestampType = C.PCAP_TSTAMP_HOST_HIPREC
+	Adapter         TimestampType = C.PCAP_TSTAMP_ADAPTER
+	AdapterUnsynced TimestampType = C.PCAP_TSTAMP_ADAPTER_UNSYNCED
+)
+
+// Precision represents the precision of the packets' timestamps.
+type Precision int
+
+const (
+	Micro Precision = C.PCAP_TSTAMP_PRECISION_MICRO
+	Nano  Precision = C.PCAP_TSTAMP_PRECISION_NANO
+)
+
 // Create a new capture handle from the given network interface. Noe that this
 // may require root privileges.
 func Open(dev_name string) (*Handle, error) {
@@ -60,7 +144,7 @@ func Open(dev_name string) (*Handle, error) {
 	defer C.free(unsafe.Pointer(err_str))
 
 	handle.pcap = C.pcap_create(dev_str, err_str)
-	if handle == nil {
+	if handle.pcap == nil {
 		return nil, fmt.Errorf(
 			"Could not open device: %s", C.GoString(err_str),
 		)
@@ -69,12 +153,110 @@ func Open(dev_name string) (*Handle, error) {
 	return handle, nil
 }
 
+// Create a new capture handle from the given dump file. Differently from the
+// "file" capture package, this supports all the formats known to libpcap (e.g.
+// pcapng or nanosecond-precision pcap). The returned handle is already active.
+func OpenOffline(file_name string) (*Handle, error) {
+	handle := &Handle{ Device: file_name }
+
+	file_str := C.CString(file_name)
+	defer C.free(unsafe.Pointer(file_str))
+
+	err_str := (*C.char)(C.calloc(256, 1))
+	defer C.free(unsafe.Pointer(err_str))
+
+	handle.pcap = C.pcap_open_offline_with_tstamp_precision(
+		file_str, C.PCAP_TSTAMP_PRECISION_NANO, err_str,
+	)
+	if handle.pcap == nil {
+		return nil, fmt.Errorf(
+			"Could not open file: %s", C.GoString(err_str),
+		)
+	}
+
+	handle.active  = true
+	handle.offline = true
+	handle.nano    = true
+
+	return handle, nil
+}
+
+// Create a new handle that writes the injected packets to the given dump file
+// using libpcap, truncating the file if it already exists. The returned handle
+// is already active and can't be used to capture packets.
+func OpenDump(file_name string, link_type packet.Type) (*Handle, error) {
+	handle := &Handle{ Device: file_name }
+
+	dlt, ok := link_type.ToLinkType()
+	if !ok {
+		return nil, fmt.Errorf("Unsupported link type: %s", link_type)
+	}
+
+	handle.pcap = C.pcap_open_dead(C.int(dlt), 0xffff)
+	if handle.pcap == nil {
+		return nil, fmt.Errorf("Could not open dump")
+	}
+
+	file_str := C.CString(file_name)
+	defer C.free(unsafe.Pointer(file_str))
+
+	handle.dumper = C.pcap_dump_open(handle.pcap, file_str)
+	if handle.dumper == nil {
+		err := handle.get_error()
+		C.pcap_close(handle.pcap)
+
+		return nil, fmt.Errorf("Could not open file: %s", err)
+	}
+
+	handle.active = true
+
+	return handle, nil
+}
+
 // Return the link type of the capture handle (that is, the type of packets that
 // come out of the packet source).
 func (h *Handle) LinkType() packet.Type {
 	return packet.LinkType(uint32(C.pcap_datalink(h.pcap)))
 }
 
+// Change the link type of the capture handle. The supported link types can be
+// retrieved with LinkTypes().
+func (h *Handle) SetLinkType(link_type packet.Type) error {
+	dlt, ok := link_type.ToLinkType()
+	if !ok {
+		return fmt.Errorf("Unsupported link type: %s", link_type)
+	}
+
+	err := C.pcap_set_datalink(h.pcap, C.int(dlt))
+	if err < 0 {
+		return fmt.Errorf("Could not set link type: %s", h.get_error())
+	}
+
+	return nil
+}
+
+// Return the link types supported by the capture handle. Note that this can
+// only be called on active handles.
+func (h *Handle) LinkTypes() ([]packet.Type, error) {
+	var dlts *C.int
+
+	n := C.pcap_list_datalinks(h.pcap, &dlts)
+	if n < 0 {
+		return nil, fmt.Errorf("Could not list link types: %s", h.get_error())
+	}
+	defer C.pcap_free_datalinks(dlts)
+
+	var types []packet.Type
+
+	for _, dlt := range (*[1 << 16]C.int)(unsafe.Pointer(dlts))[:n:n] {
+		if t := packet.LinkType(uint32(dlt)); t != packet.None {
+			types = append(types, t)
+		}
+	}
+
+	return types, nil
+}
+
 func (h *Handle) SetMTU(mtu int) error {
 	err := C.pcap_set_snaplen(h.pcap, C.int(mtu))
 	if err < 0 {
@@ -121,20 +303,165 @@ func (h *Handle) SetMonitorMode(monitor bool) error {
 	return nil
 }
 
+// Set the size of the kernel buffer used to hold the captured packets.
+func (h *Handle) SetBufferSize(size int) error {
+	err := C.pcap_set_buffer_size(h.pcap, C.int(size))
+	if err < 0 {
+		return fmt.Errorf("Handle already active")
+	}
+
+	return nil
+}
+
+// Enable/disable immediate mode. In immediate mode packets are delivered as
+// soon as they arrive, instead of being buffered by the kernel.
+func (h *Handle) SetImmediateMode(immediate bool) error {
+	var immediate_int C.int
+
+	if immediate {
+		immediate_int = 1
+	} else {
+		immediate_int = 0
+	}
+
+	err := C.pcap_set_immediate_mode(h.pcap, immediate_int)
+	if err < 0 {
+		return fmt.Errorf("Handle already active")
+	}
+
+	return nil
+}
+
+// Set the read timeout, that is the maximum time the kernel waits for more
+// packets before delivering a buffer of captured packets.
+func (h *Handle) SetReadTimeout(timeout time.Duration) error {
+	ms := timeout.Nanoseconds() / int64(time.Millisecond)
+
+	err := C.pcap_set_timeout(h.pcap, C.int(ms))
+	if err < 0 {
+		return fmt.Errorf("Handle already active")
+	}
+
+	return nil
+}
+
+// Set the source of the packets' timestamps. The supported types can be
+// retrieved with TimestampTypes().
+func (h *Handle) SetTimestampType(ts_type TimestampType) error {
+	err := C.pcap_set_tstamp_type(h.pcap, C.int(ts_type))
+	switch {
+	case err == C.PCAP_ERROR_ACTIVATED:
+		return fmt.Errorf("Handle already active")
+
+	case err < 0:
+		return fmt.Errorf("Unsupported timestamp type")
+	}
+
+	return nil
+}
+
+// Return the timestamp types supported by the capture handle.
+func (h *Handle) TimestampTypes() ([]TimestampType, error) {
+	var list *C.int
+
+	n := C.pcap_list_tstamp_types(h.pcap, &list)
+	if n < 0 {
+		return nil, fmt.Errorf(
+			"Could not list timestamp types: %s", h.get_error(),
+		)
+	}
+	defer C.pcap_free_tstamp_types(list)
+
+	var types []TimestampType
+
+	if n == 0 {
+		return types, nil
+	}
+
+	for _, t := range (*[1 << 16]C.int)(unsafe.Pointer(list))[:n:n] {
+		types = append(types, TimestampType(t))
+	}
+
+	return types, nil
+}
+
+// Set the precision of the packets' timestamps.
+func (h *Handle) SetTimestampPrecision(prec Precision) error {
+	err := C.pcap_set_tstamp_precision(h.pcap, C.int(prec))
+	switch {
+	case err == C.PCAP_ERROR_ACTIVATED:
+		return fmt.Errorf("Handle already active")
+
+	case err < 0:
+		return fmt.Errorf("Unsupported timestamp precision")
+	}
+
+	h.nano = prec == Nano
+	return nil
+}
+
+// Select the direction of the packets that will be captured (e.g. only the
+// ones received by the network interface). If the handle is not active yet,
+// the direction will be applied on activation.
+func (h *Handle) SetDirection(dir Direction) error {
+	h.direction = dir
+
+	if !h.active {
+		return nil
+	}
+
+	err := C.pcap_setdirection(h.pcap, C.pcap_direction_t(dir))
+	if err < 0 {
+		return fmt.Errorf("Could not set direction: %s", h.get_error())
+	}
+
+	return nil
+}
+
+// Enable/disable non-blocking mode. In non-blocking mode Capture() returns a nil
+// slice immediately when no packet is available.
+func (h *Handle) SetNonBlockMode(nonblock bool) error {
+	var nonblock_int C.int
+
+	if nonblock {
+		nonblock_int = 1
+	} else {
+		nonblock_int = 0
+	}
+
+	err_str := (*C.char)(C.calloc(256, 1))
+	defer C.free(unsafe.Pointer(err_str))
+
+	err := C.pcap_setnonblock(h.pcap, nonblock_int, err_str)
+	if err < 0 {
+		return fmt.Errorf(
+			"Could not set non-blocking mode: %s", C.GoString(err_str),
+		)
+	}
+
+	h.nonblock = nonblock
+	return nil
+}
+
 // Apply the given filter it to the packet source. Only packets that match this
 // filter will be captured.
 func (h *Handle) ApplyFilter(filter *filter.Filter) error {
-	if !filter.Validate() {
+	if filter.Len() == 0 || !filter.Validate() {
 		return fmt.Errorf("Invalid filter")
 	}
 
-	err_str := (*C.char)(C.calloc(256, 1))
-	defer C.free(unsafe.Pointer(err_str))
+	insns := filter.Insns()
+	size  := len(insns) * int(unsafe.Sizeof(insns[0]))
+	buf   := unsafe.Slice((*byte)(unsafe.Pointer(&insns[0])), size)
 
-	dev_str := C.CString(h.Device)
-	defer C.free(unsafe.Pointer(dev_str))
+	/* pcap_setfilter() makes its own copy of the program */
+	prog := C.struct_bpf_program{
+		bf_len:   C.u_int(len(insns)),
+		bf_insns: (*C.struct_bpf_insn)(C.CBytes(buf)),
+	}
+	defer C.free(unsafe.Pointer(prog.bf_insns))
 
-	err := C.pcap_setfilter(h.pcap, (*C.struct_bpf_program)(filter.Program()))
+	err := C.pcap_setfilter(h.pcap, &prog)
 	if err < 0 {
 		return fmt.Errorf("Could not set filter: %s", h.get_error())
 	}
@@ -146,17 +473,44 @@ func (h *Handle) ApplyFilter(filter *filter.Filter) error {
 // be possible to change the packet source configuration (MTU, promiscuous mode,
 // monitor mode, ...)
 func (h *Handle) Activate() error {
+	if h.active {
+		return nil
+	}
+
 	err := C.pcap_activate(h.pcap)
 	if err < 0 {
 		return fmt.Errorf("Could not activate: %s", h.get_error())
 	}
 
+	h.active = true
+
+	if h.direction != InOut {
+		return h.SetDirection(h.direction)
+	}
+
 	return nil
 }
 
 // Capture a single packet from the packet source. This will block until a
-// packet is received.
+// packet is received, unless non-blocking mode is enabled. When reading from a
+// dump file, a nil slice is returned once the end of the file is reached.
 func (h *Handle) Capture() ([]byte, error) {
+	buf, _, err := h.CaptureZeroCopy()
+	if buf == nil {
+		return nil, err
+	}
+
+	pkt := make([]byte, len(buf))
+	copy(pkt, buf)
+
+	return pkt, nil
+}
+
+// Capture a single packet from the packet source without copying it. The
+// returned slice points to libpcap's own buffer and is only valid until the
+// next call to any of the handle's capture methods. Apart from that, this
+// behaves like Capture().
+func (h *Handle) CaptureZeroCopy() ([]byte, capture.Info, error) {
 	var buf *C.u_char
 	var pkt_hdr *C.struct_pcap_pkthdr
 
@@ -164,32 +518,154 @@ func (h *Handle) Capture() ([]byte, error) {
 		err := C.pcap_next_ex(h.pcap, &pkt_hdr, &buf)
 		switch err {
 		case -2:
-			return nil, nil
+			return nil, capture.Info{}, nil
 
 		case -1:
-			return nil, fmt.Errorf(
+			return nil, capture.Info{}, fmt.Errorf(
 				"Could not read packet: %s", h.get_error(),
 			)
 
 		case 0:
+			if h.nonblock {
+				return nil, capture.Info{}, nil
+			}
+
 			continue
 
 		case 1:
-			return C.GoBytes(unsafe.Pointer(buf),
-			                 C.int(pkt_hdr.len)), nil
+			h.ts = h.timestamp(
+				int64(pkt_hdr.ts.tv_sec), int64(pkt_hdr.ts.tv_usec),
+			)
+
+			info := capture.Info{
+				Timestamp: h.ts,
+				CapLen:    int(pkt_hdr.caplen),
+				Length:    int(pkt_hdr.len),
+			}
+
+			pkt := unsafe.Slice((*byte)(unsafe.Pointer(buf)),
+			                    int(pkt_hdr.caplen))
+
+			return pkt, info, nil
+		}
+	}
+}
+
+// Capture up to len(bufs) packets with a single call to libpcap, copying each
+// of them directly into the corresponding buffer (truncated to the buffer's
+// capacity) and storing its metadata in info. The buffers are resliced to the
+// captured length. This blocks until at least one packet is available, unless
+// non-blocking mode is enabled, and returns the number of packets captured.
+// When reading from a dump file, 0 is returned once the end of the file is
+// reached.
+func (h *Handle) CaptureBatch(bufs [][]byte, info []capture.Info) (int, error) {
+	if len(info) < len(bufs) {
+		return 0, fmt.Errorf("Not enough room for packet info")
+	}
+
+	if len(bufs) == 0 {
+		return 0, nil
+	}
+
+	var pinner runtime.Pinner
+	defer pinner.Unpin()
+
+	pkts := make([]C.struct_go_pcap_pkt, len(bufs))
+
+	for i := range bufs {
+		buf := bufs[i][:cap(bufs[i])]
+		if len(buf) == 0 {
+			return 0, fmt.Errorf("Empty buffer")
 		}
+
+		pinner.Pin(&buf[0])
+
+		pkts[i].data = (*C.u_char)(&buf[0])
+		pkts[i].size = C.bpf_u_int32(len(buf))
+	}
+
+	pinner.Pin(&pkts[0])
+
+	batch := &C.struct_go_pcap_batch{
+		pkts: &pkts[0],
+		cnt:  C.int(len(pkts)),
+	}
+
+	for {
+		err := C.go_pcap_dispatch(h.pcap, batch)
+		switch {
+		case err == -2:
+			return 0, nil
+
+		case err < 0:
+			return 0, fmt.Errorf(
+				"Could not read packets: %s", h.get_error(),
+			)
+
+		case batch.n == 0 && !h.nonblock && !h.offline:
+			continue
+		}
+
+		break
+	}
+
+	n := int(batch.n)
+
+	for i := 0; i < n; i++ {
+		h.ts = h.timestamp(int64(pkts[i].sec), int64(pkts[i].frac))
+
+		bufs[i] = bufs[i][:pkts[i].caplen]
+
+		info[i] = capture.Info{
+			Timestamp: h.ts,
+			CapLen:    int(pkts[i].caplen),
+			Length:    int(pkts[i].len),
+		}
+	}
+
+	return n, nil
+}
+
+// Return the capture statistics (the number of packets received and dropped)
+// since the handle was activated.
+func (h *Handle) Stats() (*capture.Stats, error) {
+	var stat C.struct_pcap_stat
+
+	err := C.pcap_stats(h.pcap, &stat)
+	if err < 0 {
+		return nil, fmt.Errorf("Could not get stats: %s", h.get_error())
 	}
 
-	return nil, fmt.Errorf("WTF")
+	stats := &capture.Stats{
+		Received:  uint64(stat.ps_recv),
+		Dropped:   uint64(stat.ps_drop),
+		IfDropped: uint64(stat.ps_ifdrop),
+	}
+
+	return stats, nil
+}
+
+// Return the timestamp of the last packet captured.
+func (h *Handle) Timestamp() time.Time {
+	return h.ts
 }
 
-// Inject a packet in the packet source.
+// Inject a packet in the packet source. If the handle was created with
+// OpenDump() the packet is appended to the dump file instead.
 func (h *Handle) Inject(buf []byte) error {
+	if h.dumper != nil {
+		return h.dump(buf)
+	}
+
 	cbuf := (*C.u_char)(&buf[0])
 	blen := C.int(len(buf))
 
-	err := C.pcap_sendpacket(h.pcap, cbuf, blen)
-	if err < 0 {
+	res, errno := C.pcap_sendpacket(h.pcap, cbuf, blen)
+	if res < 0 {
+		if errno != nil {
+			return fmt.Errorf("Could not inject packet: %w", errno)
+		}
+
 		return fmt.Errorf("Could not inject packet: %s", h.get_error())
 	}
 
@@ -198,10 +674,38 @@ func (h *Handle) Inject(buf []byte) error {
 
 // Close the packet source.
 func (h *Handle) Close() {
+	if h.dumper != nil {
+		C.pcap_dump_close(h.dumper)
+		h.dumper = nil
+	}
+
 	C.pcap_close(h.pcap)
 }
 
+func (h *Handle) dump(buf []byte) error {
+	now := time.Now()
+
+	C.go_pcap_dump(
+		h.dumper, C.long(now.Unix()), C.long(now.Nanosecond() / 1000),
+		C.bpf_u_int32(len(buf)), (*C.u_char)(&buf[0]),
+	)
+
+	if C.pcap_dump_flush(h.dumper) < 0 {
+		return fmt.Errorf("Could not write packet")
+	}
+
+	return nil
+}
+
+func (h *Handle) timestamp(sec, frac int64) time.Time {
+	if !h.nano {
+		frac *= 1000
+	}
+
+	return time.Unix(sec, frac)
+}
+
 func (h *Handle) get_error() error {
 	err_str := C.pcap_geterr(h.pcap)
-	return fmt.Errorf(C.GoString(err_str))
+	return fmt.Errorf("%s", C.GoString(err_str))
 }
@@ -30,9 +30,18 @@
 
 package pcap_test
 
+import "bytes"
+import "encoding/binary"
+import "io/ioutil"
 import "log"
+import "os"
+import "path/filepath"
+import "testing"
+import "time"
 
+import "github.com/ghedo/go.pkt/capture"
 import "github.com/ghedo/go.pkt/capture/pcap"
+import "github.com/ghedo/go.pkt/packet"
 
 func ExampleCapture() {
 	src, err := pcap.Open("eth0")
@@ -81,3 +90,299 @@ func ExampleInject() {
 		log.Fatal(err)
 	}
 }
+
+func ExampleOpenOffline() {
+	src, err := pcap.OpenOffline("/path/to/file/dump.pcapng")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer src.Close()
+
+	dst, err := pcap.OpenDump("/path/to/file/dump.pcap", src.LinkType())
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer dst.Close()
+
+	for {
+		buf, err := src.Capture()
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		if buf == nil {
+			break
+		}
+
+		log.Println(src.Timestamp())
+
+		err = dst.Inject(buf)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+}
+
+var test_eth_arp = []byte{
+	0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x4c, 0x72, 0xb9, 0x54, 0xe5, 0x3d,
+	0x08, 0x06, 0x00, 0x01, 0x08, 0x00, 0x06, 0x04, 0x00, 0x01, 0x4c, 0x72,
+	0xb9, 0x54, 0xe5, 0x3d, 0xc0, 0xa8, 0x01, 0x87, 0x00, 0x00, 0x00, 0x00,
+	0x00, 0x00, 0xc1, 0x1b, 0xd0, 0x25,
+}
+
+/* write a nanosecond-precision pcap file with count copies of test_eth_arp */
+func write_nano_file(t *testing.T, file_name string, count int) {
+	var out bytes.Buffer
+
+	binary.Write(&out, binary.LittleEndian, []uint32{
+		0xa1b23c4d, 0x00040002, 0, 0, 65535, 1,
+	})
+
+	for i := 0; i < count; i++ {
+		binary.Write(&out, binary.LittleEndian, []uint32{
+			uint32(1000 + i), 123456789,
+			uint32(len(test_eth_arp)), uint32(len(test_eth_arp)),
+		})
+
+		out.Write(test_eth_arp)
+	}
+
+	err := ioutil.WriteFile(file_name, out.Bytes(), 0644)
+	if err != nil {
+		t.Fatalf("Error writing file: %s", err)
+	}
+}
+
+func temp_dir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "pcap_test")
+	if err != nil {
+		t.Fatalf("Error creating dir: %s", err)
+	}
+
+	return dir
+}
+
+func TestOpenOfflineNano(t *testing.T) {
+	dir := temp_dir(t)
+	defer os.RemoveAll(dir)
+
+	file_name := filepath.Join(dir, "nano.pcap")
+	write_nano_file(t, file_name, 2)
+
+	src, err := pcap.OpenOffline(file_name)
+	if err != nil {
+		t.Fatalf("Error opening: %s", err)
+	}
+	defer src.Close()
+
+	if src.LinkType() != packet.Eth {
+		t.Fatalf("Link type mismatch: %s", src.LinkType())
+	}
+
+	for i := 0; i < 2; i++ {
+		buf, err := src.Capture()
+		if err != nil {
+			t.Fatalf("Error capturing: %s", err)
+		}
+
+		if !bytes.Equal(buf, test_eth_arp) {
+			t.Fatalf("Packet mismatch: %x", buf)
+		}
+
+		ts := time.Unix(int64(1000 + i), 123456789)
+		if !src.Timestamp().Equal(ts) {
+			t.Fatalf("Timestamp mismatch: %s", src.Timestamp())
+		}
+	}
+
+	buf, err := src.Capture()
+	if buf != nil || err != nil {
+		t.Fatalf("Expected end of file: %x %v", buf, err)
+	}
+}
+
+func TestOpenOfflineConfig(t *testing.T) {
+	dir := temp_dir(t)
+	defer os.RemoveAll(dir)
+
+	file_name := filepath.Join(dir, "nano.pcap")
+	write_nano_file(t, file_name, 1)
+
+	src, err := pcap.OpenOffline(file_name)
+	if err != nil {
+		t.Fatalf("Error opening: %s", err)
+	}
+	defer src.Close()
+
+	/* offline handles are already active */
+	setters := map[string]func() error{
+		"buffer size":    func() error { return src.SetBufferSize(1 << 20) },
+		"immediate mode": func() error { return src.SetImmediateMode(true) },
+		"read timeout":   func() error { return src.SetReadTimeout(time.Second) },
+		"timestamp type": func() error { return src.SetTimestampType(pcap.Host) },
+		"precision":      func() error { return src.SetTimestampPrecision(pcap.Micro) },
+		"direction":      func() error { return src.SetDirection(pcap.In) },
+	}
+
+	for name, set := range setters {
+		if set() == nil {
+			t.Fatalf("Set %s on offline handle", name)
+		}
+	}
+
+	err = src.Activate()
+	if err != nil {
+		t.Fatalf("Error activating: %s", err)
+	}
+}
+
+func TestCaptureBatch(t *testing.T) {
+	dir := temp_dir(t)
+	defer os.RemoveAll(dir)
+
+	file_name := filepath.Join(dir, "nano.pcap")
+	write_nano_file(t, file_name, 3)
+
+	src, err := pcap.OpenOffline(file_name)
+	if err != nil {
+		t.Fatalf("Error opening: %s", err)
+	}
+	defer src.Close()
+
+	/* the second buffer is too small for the whole packet */
+	bufs := [][]byte{
+		make([]byte, 0, 64), make([]byte, 0, 20), make([]byte, 0, 64),
+		make([]byte, 0, 64),
+	}
+	info := make([]capture.Info, len(bufs))
+
+	n, err := src.CaptureBatch(bufs, info)
+	if err != nil {
+		t.Fatalf("Error capturing: %s", err)
+	}
+
+	if n != 3 {
+		t.Fatalf("Count mismatch: %d", n)
+	}
+
+	for i := 0; i < n; i++ {
+		cap_len := len(test_eth_arp)
+		if i == 1 {
+			cap_len = 20
+		}
+
+		if !bytes.Equal(bufs[i], test_eth_arp[:cap_len]) ||
+		   info[i].CapLen != cap_len ||
+		   info[i].Length != len(test_eth_arp) {
+			t.Fatalf("Packet mismatch: %x %+v", bufs[i], info[i])
+		}
+
+		ts := time.Unix(int64(1000 + i), 123456789)
+		if !info[i].Timestamp.Equal(ts) {
+			t.Fatalf("Timestamp mismatch: %s", info[i].Timestamp)
+		}
+	}
+
+	n, err = src.CaptureBatch(bufs, info)
+	if n != 0 || err != nil {
+		t.Fatalf("Expected end of file: %d %v", n, err)
+	}
+}
+
+func TestOpenDump(t *testing.T) {
+	dir := temp_dir(t)
+	defer os.RemoveAll(dir)
+
+	file_name := filepath.Join(dir, "dump.pcap")
+
+	_, err := pcap.OpenDump(file_name, packet.TCP)
+	if err == nil {
+		t.Fatalf("Unsupported link type accepted")
+	}
+
+	dst, err := pcap.OpenDump(file_name, packet.Eth)
+	if err != nil {
+		t.Fatalf("Error opening: %s", err)
+	}
+
+	for i := 0; i < 3; i++ {
+		err = dst.Inject(test_eth_arp)
+		if err != nil {
+			t.Fatalf("Error injecting: %s", err)
+		}
+	}
+
+	dst.Close()
+
+	src, err := pcap.OpenOffline(file_name)
+	if err != nil {
+		t.Fatalf("Error opening: %s", err)
+	}
+	defer src.Close()
+
+	if src.LinkType() != packet.Eth {
+		t.Fatalf("Link type mismatch: %s", src.LinkType())
+	}
+
+	count := 0
+
+	for {
+		buf, err := src.Capture()
+		if err != nil {
+			t.Fatalf("Error capturing: %s", err)
+		}
+
+		if buf == nil {
+			break
+		}
+
+		if !bytes.Equal(buf, test_eth_arp) {
+			t.Fatalf("Packet mismatch: %x", buf)
+		}
+
+		count++
+	}
+
+	if count != 3 {
+		t.Fatalf("Count mismatch: %d", count)
+	}
+}
+
+func TestDeadLinkType(t *testing.T) {
+	dir := temp_dir(t)
+	defer os.RemoveAll(dir)
+
+	dst, err := pcap.OpenDump(filepath.Join(dir, "dump.pcap"), packet.IPv4)
+	if err != nil {
+		t.Fatalf("Error opening: %s", err)
+	}
+	defer dst.Close()
+
+	types, err := dst.LinkTypes()
+	if err != nil {
+		t.Fatalf("Error listing link types: %s", err)
+	}
+
+	if len(types) != 1 || types[0] != packet.IPv4 {
+		t.Fatalf("Link types mismatch: %v", types)
+	}
+
+	err = dst.SetLinkType(packet.IPv4)
+	if err != nil {
+		t.Fatalf("Error setting link type: %s", err)
+	}
+
+	err = dst.SetLinkType(packet.Eth)
+	if err == nil {
+		t.Fatalf("Unsupported link type accepted")
+	}
+
+	err = dst.SetLinkType(packet.TCP)
+	if err == nil {
+		t.Fatalf("Unmapped link type accepted")
+	}
+
+	if dst.LinkType() != packet.IPv4 {
+		t.Fatalf("Link type mismatch: %s", dst.LinkType())
+	}
+}
@@ -0,0 +1,536 @@
+/*
+ * Network packet analysis framework.
+ *
+ * Copyright (c) 2014, Alessandro Ghedini
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are
+ * met:
+ *
+ *     * Redistributions of source code must retain the above copyright
+ *       notice, this list of conditions and the following disclaimer.
+ *
+ *     * Redistributions in binary form must reproduce the above copyright
+ *       notice, this list of conditions and the following disclaimer in the
+ *       documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS
+ * IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO,
+ * THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR
+ * PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR
+ * CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+ * EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+ * PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+ * PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF
+ * LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+ * NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+ * SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+// Provides packet capturing and injection of IPv4 and IPv6 packets via raw IP
+// sockets, without depending on libpcap or on link-layer access.
+//
+// Packets are injected with the IP header included (IP_HDRINCL/IPV6_HDRINCL),
+// so they must start at the IP layer, and are captured on one raw socket for
+// each of the configured IP protocols. Since IPv6 raw sockets don't return the
+// IPv6 header, it is rebuilt from the packet's ancillary data.
+package rawip
+
+import "encoding/binary"
+import "fmt"
+import "net"
+import "syscall"
+import "time"
+import "unsafe"
+
+import "github.com/ghedo/go.pkt/capture"
+import "github.com/ghedo/go.pkt/filter"
+import "github.com/ghedo/go.pkt/packet"
+import "github.com/ghedo/go.pkt/packet/ipv4"
+
+type Handle struct {
+	link     packet.Type
+	family   int
+	protos   []packet.Type
+	fd       int
+	recv_fds []int
+	next     int
+	snaplen  int
+	timeout  time.Duration
+	filter   *filter.Filter
+	active   bool
+	buf      []byte
+	oob      []byte
+	ts       time.Time
+}
+
+/* not defined by the syscall package */
+const ipv6_hdrincl = 36
+
+const ipv6_hdr_len = 40
+
+var oob_len = syscall.CmsgSpace(int(unsafe.Sizeof(syscall.Timespec{}))) +
+              syscall.CmsgSpace(syscall.SizeofInet6Pktinfo) +
+              syscall.CmsgSpace(4)
+
+// Create a new capture handle for the given IP version (either packet.IPv4 or
+// packet.IPv6). By default TCP, UDP and ICMP packets are captured. Note that
+// this requires root privileges (or the CAP_NET_RAW capability).
+func Open(link packet.Type) (*Handle, error) {
+	handle := &Handle{
+		link:    link,
+		snaplen: 65535,
+	}
+
+	switch link {
+	case packet.IPv4:
+		handle.family = syscall.AF_INET
+		handle.protos = []packet.Type{ packet.TCP, packet.UDP, packet.ICMPv4 }
+
+	case packet.IPv6:
+		handle.family = syscall.AF_INET6
+		handle.protos = []packet.Type{ packet.TCP, packet.UDP, packet.ICMPv6 }
+
+	default:
+		return nil, fmt.Errorf("Unsupported link type: %s", link)
+	}
+
+	/* IPPROTO_RAW sockets can only send, and imply IP_HDRINCL */
+	fd, err := syscall.Socket(handle.family, syscall.SOCK_RAW,
+	                          syscall.IPPROTO_RAW)
+	if err != nil {
+		return nil, fmt.Errorf("Could not open socket: %s", err)
+	}
+
+	if link == packet.IPv4 {
+		err = syscall.SetsockoptInt(
+			fd, syscall.IPPROTO_IP, syscall.IP_HDRINCL, 1,
+		)
+	} else {
+		err = syscall.SetsockoptInt(
+			fd, syscall.IPPROTO_IPV6, ipv6_hdrincl, 1,
+		)
+	}
+	if err != nil {
+		syscall.Close(fd)
+		return nil, fmt.Errorf("Could not include IP header: %s", err)
+	}
+
+	handle.fd = fd
+
+	return handle, nil
+}
+
+// Return the link type of the capture handle (that is, the type of packets that
+// come out of the packet source).
+func (h *Handle) LinkType() packet.Type {
+	return h.link
+}
+
+// Set the IP protocols of the packets to capture (e.g. packet.TCP, packet.UDP,
+// ...). If no protocol is given no packet is captured.
+func (h *Handle) SetProtocols(protos ...packet.Type) error {
+	if h.active {
+		return fmt.Errorf("Handle already active")
+	}
+
+	for _, p := range protos {
+		if ipv4.TypeToProtocol(p) == ipv4.None {
+			return fmt.Errorf("Unsupported protocol: %s", p)
+		}
+	}
+
+	h.protos = protos
+	return nil
+}
+
+// Set the maximum number of bytes captured for each packet.
+func (h *Handle) SetMTU(mtu int) error {
+	if h.active {
+		return fmt.Errorf("Handle already active")
+	}
+
+	h.snaplen = mtu
+	return nil
+}
+
+// Set the read timeout, that is the maximum time Capture() waits for a packet.
+// When it expires, Capture() returns a nil packet and no error. If timeout is
+// zero (the default) Capture() blocks until a packet is received.
+func (h *Handle) SetReadTimeout(timeout time.Duration) error {
+	if h.active {
+		return fmt.Errorf("Handle already active")
+	}
+
+	if timeout < 0 {
+		return fmt.Errorf("Invalid timeout")
+	}
+
+	h.timeout = timeout
+	return nil
+}
+
+// Not supported.
+func (h *Handle) SetPromiscMode(promisc bool) error {
+	return &capture.UnsupportedError{ Op: "SetPromiscMode" }
+}
+
+// Not supported.
+func (h *Handle) SetMonitorMode(monitor bool) error {
+	return &capture.UnsupportedError{ Op: "SetMonitorMode" }
+}
+
+// Apply the given filter it to the packet source. Only packets that match this
+// filter will be captured. The filter is run in user space against the IP
+// packets, since the kernel would run it against different data for IPv4 and
+// IPv6 raw sockets.
+func (h *Handle) ApplyFilter(filter *filter.Filter) error {
+	if !filter.Validate() {
+		return fmt.Errorf("Invalid filter")
+	}
+
+	h.filter = filter
+	return nil
+}
+
+// Activate the packet source. Note that after calling this method it will not
+// be possible to change the packet source configuration (MTU, protocols, ...)
+func (h *Handle) Activate() error {
+	if h.active {
+		return nil
+	}
+
+	for _, p := range h.protos {
+		fd, err := h.open_recv(int(ipv4.TypeToProtocol(p)))
+		if err != nil {
+			h.close_recv()
+			return err
+		}
+
+		h.recv_fds = append(h.recv_fds, fd)
+	}
+
+	h.buf    = make([]byte, h.snaplen)
+	h.oob    = make([]byte, oob_len)
+	h.active = true
+
+	return nil
+}
+
+// Capture a single packet from the packet source. This will block until a
+// packet is received, or the read timeout expires (in which case nil is
+// returned).
+func (h *Handle) Capture() ([]byte, error) {
+	if !h.active {
+		return nil, fmt.Errorf("Handle not active")
+	}
+
+	for {
+		fd, err := h.wait()
+		if err != nil {
+			return nil, fmt.Errorf("Could not read packet: %s", err)
+		}
+
+		if fd < 0 {
+			return nil, nil
+		}
+
+		pkt, err := h.recv(fd)
+		if err == syscall.EAGAIN {
+			return nil, nil
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("Could not read packet: %s", err)
+		}
+
+		if pkt == nil {
+			continue
+		}
+
+		if h.filter != nil && !h.filter.Match(pkt) {
+			continue
+		}
+
+		return pkt, nil
+	}
+}
+
+// Return the timestamp of the last packet captured.
+func (h *Handle) Timestamp() time.Time {
+	return h.ts
+}
+
+// Inject a packet in the packet source. The packet must start with an IP header
+// of the handle's IP version, and is routed by the kernel according to its
+// destination address.
+func (h *Handle) Inject(buf []byte) error {
+	if !h.active {
+		return fmt.Errorf("Handle not active")
+	}
+
+	addr, err := h.dst_addr(buf)
+	if err != nil {
+		return fmt.Errorf("Could not inject packet: %s", err)
+	}
+
+	err = syscall.Sendto(h.fd, buf, 0, addr)
+	if err != nil {
+		return fmt.Errorf("Could not inject packet: %w", err)
+	}
+
+	return nil
+}
+
+// Close the packet source.
+func (h *Handle) Close() {
+	h.close_recv()
+	syscall.Close(h.fd)
+}
+
+func (h *Handle) open_recv(proto int) (int, error) {
+	fd, err := syscall.Socket(h.family, syscall.SOCK_RAW, proto)
+	if err != nil {
+		return -1, fmt.Errorf("Could not open socket: %s", err)
+	}
+
+	opts := [][2]int{
+		{ syscall.SOL_SOCKET, syscall.SO_TIMESTAMPNS },
+	}
+
+	if h.family == syscall.AF_INET6 {
+		opts = append(opts,
+			[2]int{ syscall.IPPROTO_IPV6, syscall.IPV6_RECVPKTINFO },
+			[2]int{ syscall.IPPROTO_IPV6, syscall.IPV6_RECVHOPLIMIT },
+		)
+	}
+
+	for _, opt := range opts {
+		err = syscall.SetsockoptInt(fd, opt[0], opt[1], 1)
+		if err != nil {
+			syscall.Close(fd)
+			return -1, fmt.Errorf("Could not set socket option: %s", err)
+		}
+	}
+
+	if h.timeout > 0 {
+		tv := syscall.NsecToTimeval(h.timeout.Nanoseconds())
+
+		err = syscall.SetsockoptTimeval(
+			fd, syscall.SOL_SOCKET, syscall.SO_RCVTIMEO, &tv,
+		)
+		if err != nil {
+			syscall.Close(fd)
+			return -1, fmt.Errorf("Could not set read timeout: %s", err)
+		}
+	}
+
+	return fd, nil
+}
+
+func (h *Handle) close_recv() {
+	for _, fd := range h.recv_fds {
+		syscall.Close(fd)
+	}
+
+	h.recv_fds = nil
+}
+
+/* wait until one of the receiving sockets is readable, starting from the one
+ * after the last returned, so that no protocol starves the others; -1 is
+ * returned if the read timeout expires first */
+func (h *Handle) wait() (int, error) {
+	if len(h.recv_fds) == 0 {
+		return -1, fmt.Errorf("No protocol to capture")
+	}
+
+	if len(h.recv_fds) == 1 {
+		return h.recv_fds[0], nil
+	}
+
+	for {
+		var fds syscall.FdSet
+
+		max := 0
+
+		for _, fd := range h.recv_fds {
+			fd_set(&fds, fd)
+
+			if fd > max {
+				max = fd
+			}
+		}
+
+		var tv *syscall.Timeval
+
+		if h.timeout > 0 {
+			t := syscall.NsecToTimeval(h.timeout.Nanoseconds())
+			tv = &t
+		}
+
+		n, err := syscall.Select(max + 1, &fds, nil, nil, tv)
+		if err == syscall.EINTR {
+			continue
+		}
+
+		if err != nil {
+			return -1, err
+		}
+
+		if n == 0 {
+			return -1, nil
+		}
+
+		for i := range h.recv_fds {
+			fd := h.recv_fds[(h.next + i) % len(h.recv_fds)]
+
+			if fd_isset(&fds, fd) {
+				h.next = (h.next + i + 1) % len(h.recv_fds)
+				return fd, nil
+			}
+		}
+	}
+}
+
+/* receive a packet from the given socket, rebuilding the IPv6 header if needed;
+ * a nil packet is returned if the source address is missing */
+func (h *Handle) recv(fd int) ([]byte, error) {
+	buf := h.buf
+
+	if h.family == syscall.AF_INET6 {
+		buf = h.buf[ipv6_hdr_len:]
+	}
+
+	for {
+		n, oobn, _, from, err := syscall.Recvmsg(
+			fd, buf, h.oob, syscall.MSG_TRUNC,
+		)
+		if err == syscall.EINTR {
+			continue
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		n = min(n, len(buf))
+
+		cmsgs, _ := syscall.ParseSocketControlMessage(h.oob[:oobn])
+
+		h.ts = timestamp(cmsgs)
+
+		if h.family == syscall.AF_INET {
+			return copy_pkt(h.buf[:n]), nil
+		}
+
+		src, ok := from.(*syscall.SockaddrInet6)
+		if !ok {
+			return nil, nil
+		}
+
+		proto := h.protos[0]
+
+		for i, rfd := range h.recv_fds {
+			if rfd == fd {
+				proto = h.protos[i]
+			}
+		}
+
+		hdr := h.buf[:ipv6_hdr_len]
+
+		for i := range hdr {
+			hdr[i] = 0
+		}
+
+		hdr[0] = 6 << 4
+		binary.BigEndian.PutUint16(hdr[4:6], uint16(n))
+		hdr[6] = uint8(ipv4.TypeToProtocol(proto))
+		copy(hdr[8:24], src.Addr[:])
+
+		parse_ipv6_cmsgs(cmsgs, hdr)
+
+		return copy_pkt(h.buf[:ipv6_hdr_len + n]), nil
+	}
+}
+
+func (h *Handle) dst_addr(buf []byte) (syscall.Sockaddr, error) {
+	switch h.family {
+	case syscall.AF_INET:
+		if len(buf) < 20 || buf[0] >> 4 != 4 {
+			return nil, fmt.Errorf("Not an IPv4 packet")
+		}
+
+		addr := &syscall.SockaddrInet4{}
+		copy(addr.Addr[:], buf[16:20])
+		return addr, nil
+
+	default:
+		if len(buf) < ipv6_hdr_len || buf[0] >> 4 != 6 {
+			return nil, fmt.Errorf("Not an IPv6 packet")
+		}
+
+		addr := &syscall.SockaddrInet6{}
+		copy(addr.Addr[:], buf[24:40])
+
+		/* link-local destinations need the outgoing interface */
+		dst := net.IP(addr.Addr[:])
+		if dst.IsLinkLocalUnicast() || dst.IsLinkLocalMulticast() {
+			return nil, fmt.Errorf("Link-local destination")
+		}
+
+		return addr, nil
+	}
+}
+
+/* fill the destination address and hop limit of the IPv6 header */
+func parse_ipv6_cmsgs(cmsgs []syscall.SocketControlMessage, hdr []byte) {
+	for _, m := range cmsgs {
+		if m.Header.Level != syscall.IPPROTO_IPV6 {
+			continue
+		}
+
+		switch m.Header.Type {
+		case syscall.IPV6_PKTINFO:
+			if len(m.Data) >= syscall.SizeofInet6Pktinfo {
+				copy(hdr[24:40], m.Data[:16])
+			}
+
+		case syscall.IPV6_HOPLIMIT:
+			if len(m.Data) >= 4 {
+				hop := *(*int32)(unsafe.Pointer(&m.Data[0]))
+				hdr[7] = uint8(hop)
+			}
+		}
+	}
+}
+
+func timestamp(cmsgs []syscall.SocketControlMessage) time.Time {
+	for _, m := range cmsgs {
+		if m.Header.Level != syscall.SOL_SOCKET ||
+		   m.Header.Type != syscall.SO_TIMESTAMPNS {
+			continue
+		}
+
+		ts := (*syscall.Timespec)(unsafe.Pointer(&m.Data[0]))
+		return time.Unix(ts.Unix())
+	}
+
+	return time.Now()
+}
+
+func copy_pkt(buf []byte) []byte {
+	pkt := make([]byte, len(buf))
+	copy(pkt, buf)
+	return pkt
+}
+
+func fd_set(fds *syscall.FdSet, fd int) {
+	bits := int(8 * unsafe.Sizeof(fds.Bits[0]))
+	fds.Bits[fd / bits] |= 1 << uint(fd % bits)
+}
+
+func fd_isset(fds *syscall.FdSet, fd int) bool {
+	bits := int(8 * unsafe.Sizeof(fds.Bits[0]))
+	return fds.Bits[fd / bits] & (1 << uint(fd % bits)) != 0
+}
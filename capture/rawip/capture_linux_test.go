@@ -0,0 +1,265 @@
+/*
+ * Network packet analysis framework.
+ *
+ * Copyright (c) 2014, Alessandro Ghedini
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are
+ * met:
+ *
+ *     * Redistributions of source code must retain the above copyright
+ *       notice, this list of conditions and the following disclaimer.
+ *
+ *     * Redistributions in binary form must reproduce the above copyright
+ *       notice, this list of conditions and the following disclaimer in the
+ *       documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS
+ * IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO,
+ * THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR
+ * PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR
+ * CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+ * EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+ * PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+ * PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF
+ * LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+ * NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+ * SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package rawip_test
+
+import "net"
+import "testing"
+import "time"
+
+import "github.com/ghedo/go.pkt/capture"
+import "github.com/ghedo/go.pkt/capture/rawip"
+import "github.com/ghedo/go.pkt/filter"
+import "github.com/ghedo/go.pkt/layers"
+import "github.com/ghedo/go.pkt/network"
+import "github.com/ghedo/go.pkt/packet"
+import "github.com/ghedo/go.pkt/packet/icmpv4"
+import "github.com/ghedo/go.pkt/packet/icmpv6"
+import "github.com/ghedo/go.pkt/packet/ipv4"
+import "github.com/ghedo/go.pkt/packet/ipv6"
+
+func open_raw(t *testing.T, link packet.Type, protos ...packet.Type) *rawip.Handle {
+	src, err := rawip.Open(link)
+	if err != nil {
+		t.Skipf("Error opening: %s", err)
+	}
+
+	err = src.SetProtocols(protos...)
+	if err != nil {
+		t.Fatalf("Error setting protocols: %s", err)
+	}
+
+	err = src.Activate()
+	if err != nil {
+		t.Fatalf("Error activating source: %s", err)
+	}
+
+	return src
+}
+
+func TestSendRecvIPv4(t *testing.T) {
+	src := open_raw(t, packet.IPv4, packet.ICMPv4)
+	defer src.Close()
+
+	var _ capture.Handle = src
+
+	ip4_pkt := ipv4.Make()
+	ip4_pkt.SrcAddr = net.ParseIP("127.0.0.1")
+	ip4_pkt.DstAddr = net.ParseIP("127.0.0.1")
+
+	icmp_pkt := icmpv4.Make()
+	icmp_pkt.Type = icmpv4.EchoRequest
+	icmp_pkt.Id   = 0x4242
+	icmp_pkt.Seq  = 1
+
+	ans, err := network.SendRecv(src, time.Second, ip4_pkt, icmp_pkt)
+	if err != nil {
+		t.Fatalf("Error sending: %s", err)
+	}
+
+	reply := layers.FindLayer(ans, packet.ICMPv4).(*icmpv4.Packet)
+	if reply.Type != icmpv4.EchoReply || reply.Id != 0x4242 {
+		t.Fatalf("Reply mismatch: %s", reply)
+	}
+
+	if src.Timestamp().IsZero() {
+		t.Fatalf("Missing timestamp")
+	}
+}
+
+func TestSendRecvIPv6(t *testing.T) {
+	src := open_raw(t, packet.IPv6, packet.ICMPv6, packet.UDP)
+	defer src.Close()
+
+	ip6_pkt := ipv6.Make()
+	ip6_pkt.SrcAddr = net.ParseIP("::1")
+	ip6_pkt.DstAddr = net.ParseIP("::1")
+
+	icmp_pkt := icmpv6.Make()
+	icmp_pkt.Type = icmpv6.EchoRequest
+	icmp_pkt.Body = 0x42420001
+
+	ans, err := network.SendRecv(src, time.Second, ip6_pkt, icmp_pkt)
+	if err != nil {
+		t.Skipf("Error sending: %s", err)
+	}
+
+	ip6_ans := ans.(*ipv6.Packet)
+	if !ip6_ans.SrcAddr.Equal(ip6_pkt.DstAddr) ||
+	   !ip6_ans.DstAddr.Equal(ip6_pkt.SrcAddr) ||
+	   ip6_ans.HopLimit == 0 {
+		t.Fatalf("Header mismatch: %s", ip6_ans)
+	}
+
+	reply := layers.FindLayer(ans, packet.ICMPv6).(*icmpv6.Packet)
+	if reply.Type != icmpv6.EchoReply || reply.Body != 0x42420001 {
+		t.Fatalf("Reply mismatch: %s", reply)
+	}
+}
+
+func TestSendRecvTimeout(t *testing.T) {
+	/* the echo replies are not captured, so no answer is ever received */
+	for _, protos := range [][]packet.Type{
+		{ packet.UDP },
+		{ packet.TCP, packet.UDP },
+	} {
+		src, err := rawip.Open(packet.IPv4)
+		if err != nil {
+			t.Skipf("Error opening: %s", err)
+		}
+
+		err = src.SetReadTimeout(50 * time.Millisecond)
+		if err != nil {
+			t.Fatalf("Error setting timeout: %s", err)
+		}
+
+		err = src.SetProtocols(protos...)
+		if err != nil {
+			t.Fatalf("Error setting protocols: %s", err)
+		}
+
+		err = src.Activate()
+		if err != nil {
+			t.Fatalf("Error activating source: %s", err)
+		}
+
+		ip4_pkt := ipv4.Make()
+		ip4_pkt.SrcAddr = net.ParseIP("127.0.0.1")
+		ip4_pkt.DstAddr = net.ParseIP("127.0.0.1")
+
+		icmp_pkt := icmpv4.Make()
+		icmp_pkt.Type = icmpv4.EchoRequest
+		icmp_pkt.Id   = 0x4444
+
+		start := time.Now()
+
+		_, err = network.SendRecv(src, 200 * time.Millisecond,
+		                          ip4_pkt, icmp_pkt)
+		if err == nil {
+			t.Fatalf("Answer received")
+		}
+
+		if time.Since(start) > 2 * time.Second {
+			t.Fatalf("Timeout not honoured")
+		}
+
+		err = src.SetReadTimeout(time.Second)
+		if err == nil {
+			t.Fatalf("Timeout changed after activation")
+		}
+
+		src.Close()
+	}
+}
+
+func TestFilter(t *testing.T) {
+	src, err := rawip.Open(packet.IPv4)
+	if err != nil {
+		t.Skipf("Error opening: %s", err)
+	}
+	defer src.Close()
+
+	/* only accept ICMP echo replies, the echo requests are captured too */
+	flt, err := filter.NewBuilder().
+		LD(filter.Byte, filter.ABS, 20).
+		JEQ(filter.Const, "", "fail", 0).
+		RET(filter.Const, 0x40000).
+		Label("fail").
+		RET(filter.Const, 0x0).
+		Build()
+	if err != nil {
+		t.Fatalf("Error building filter: %s", err)
+	}
+
+	err = src.ApplyFilter(flt)
+	if err != nil {
+		t.Fatalf("Error applying filter: %s", err)
+	}
+
+	err = src.Activate()
+	if err != nil {
+		t.Fatalf("Error activating source: %s", err)
+	}
+
+	ip4_pkt := ipv4.Make()
+	ip4_pkt.SrcAddr = net.ParseIP("127.0.0.1")
+	ip4_pkt.DstAddr = net.ParseIP("127.0.0.1")
+
+	icmp_pkt := icmpv4.Make()
+	icmp_pkt.Type = icmpv4.EchoRequest
+	icmp_pkt.Id   = 0x4343
+
+	err = network.Send(src, ip4_pkt, icmp_pkt)
+	if err != nil {
+		t.Fatalf("Error sending: %s", err)
+	}
+
+	pkt, err := network.Recv(src)
+	if err != nil {
+		t.Fatalf("Error receiving: %s", err)
+	}
+
+	if !pkt.Answers(ip4_pkt) {
+		t.Fatalf("Filter not applied: %s", pkt)
+	}
+}
+
+func TestInvalid(t *testing.T) {
+	_, err := rawip.Open(packet.Eth)
+	if err == nil {
+		t.Fatalf("Invalid link type accepted")
+	}
+
+	src, err := rawip.Open(packet.IPv4)
+	if err != nil {
+		t.Skipf("Error opening: %s", err)
+	}
+	defer src.Close()
+
+	err = src.SetProtocols(packet.Eth)
+	if err == nil {
+		t.Fatalf("Invalid protocol accepted")
+	}
+
+	err = src.Activate()
+	if err != nil {
+		t.Fatalf("Error activating source: %s", err)
+	}
+
+	err = src.Inject([]byte{ 0x60, 0x00 })
+	if err == nil {
+		t.Fatalf("Invalid packet injected")
+	}
+
+	err = src.SetMTU(100)
+	if err == nil {
+		t.Fatalf("MTU changed after activation")
+	}
+}
@@ -37,10 +37,8 @@ import "time"
 import "github.com/docopt/docopt-go"
 
 import "github.com/ghedo/go.pkt/capture/pcap"
-import "github.com/ghedo/go.pkt/packet/eth"
-import "github.com/ghedo/go.pkt/packet/arp"
 
-import "github.com/ghedo/go.pkt/network"
+import "github.com/ghedo/go.pkt/network/neighbor"
 import "github.com/ghedo/go.pkt/routing"
 
 func main() {
@@ -48,7 +46,7 @@ func main() {
 
 	usage := `Usage: arp <addr>
 
-Resolve the given IP address using ARP.`
+Resolve the given IP address using ARP (or NDP for IPv6 addresses).`
 
 	args, err := docopt.Parse(usage, nil, true, "", false)
 	if err != nil {
@@ -79,20 +77,13 @@ Resolve the given IP address using ARP.`
 		log.Fatalf("Error activating source: %s", err)
 	}
 
-	eth_pkt := eth.Make()
-	eth_pkt.SrcAddr = route.Iface.HardwareAddr
-	eth_pkt.DstAddr, _ = net.ParseMAC("ff:ff:ff:ff:ff:ff")
+	cache := neighbor.NewCache(c, route.Iface)
+	cache.SetTimeout(timeout)
 
-	arp_pkt := arp.Make()
-	arp_pkt.HWSrcAddr = route.Iface.HardwareAddr
-	arp_pkt.HWDstAddr, _ = net.ParseMAC("00:00:00:00:00:00")
-	arp_pkt.ProtoSrcAddr, _ = route.GetIfaceIPv4Addr()
-	arp_pkt.ProtoDstAddr = addr_ip
-
-	pkt, err := network.SendRecv(c, timeout, eth_pkt, arp_pkt)
+	hwaddr, err := cache.Resolve(addr_ip)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	log.Println(pkt.Payload().(*arp.Packet).HWSrcAddr)
+	log.Println(hwaddr)
 }
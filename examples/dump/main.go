@@ -32,6 +32,7 @@ package main
 
 import "log"
 import "strconv"
+import "time"
 
 import "github.com/docopt/docopt-go"
 
@@ -44,21 +45,42 @@ import "github.com/ghedo/go.pkt/layers"
 func main() {
 	log.SetFlags(0)
 
-	usage := `Usage: dump [options] [<expression>]
+	usage := `Usage: dump [-d...] [options] [<expression>]
+       dump -D
 
 Dump the traffic on the network (like tcpdump).
 
 Options:
+  -D          List the available interfaces.
+  -d          Dump the compiled filter and exit (-dd and -ddd for the C
+              array and decimal formats).
+  -O          Do not run the filter optimizer.
   -c <count>  Exit after receiving count packets.
   -i <iface>  Listen on interface.
   -r <file>   Read packets from file.
-  -w <file>   Write the raw packets to file.`
+  -w <file>   Write the raw packets to file.
+  -C <size>   Start a new output file every size megabytes.
+  -G <secs>   Start a new output file every secs seconds.
+  -W <count>  Keep at most count output files.`
 
 	args, err := docopt.Parse(usage, nil, true, "", false)
 	if err != nil {
 		log.Fatalf("Invalid arguments: %s", err)
 	}
 
+	if args["-D"].(bool) {
+		ifaces, err := capture.Interfaces()
+		if err != nil {
+			log.Fatalf("Error listing interfaces: %s", err)
+		}
+
+		for _, iface := range ifaces {
+			log.Println(iface)
+		}
+
+		return
+	}
+
 	var count uint64
 
 	if args["-c"] != nil {
@@ -71,23 +93,69 @@ Options:
 	var src capture.Handle
 
 	if args["-i"] != nil {
+		if args["-i"].(string) != "any" {
+			_, err = capture.InterfaceByName(args["-i"].(string))
+			if err != nil {
+				log.Fatalf("Error: %s", err)
+			}
+		}
+
 		src, err = pcap.Open(args["-i"].(string))
 		if err != nil {
 			log.Fatalf("Error opening iface: %s", err)
 		}
 	} else if args["-r"] != nil {
-		src, err = file.Open(args["-r"].(string))
+		file_src, err := file.Open(args["-r"].(string))
 		if err != nil {
 			log.Fatalf("Error opening file: %s", err)
 		}
+
+		src = capture.Adapt(file_src)
 	} else {
 		log.Fatalf("Must select a source (either -i or -r)")
 	}
 	defer src.Close()
 
-	var dst capture.Handle
+	var dst capture.Injector
+	var rot *file.RotateHandle
+
+	if args["-w"] != nil &&
+	   (args["-C"] != nil || args["-G"] != nil || args["-W"] != nil) {
+		rot, err = file.OpenRotate(args["-w"].(string))
+		if err != nil {
+			log.Fatalf("Error opening file: %s", err)
+		}
+
+		if args["-C"] != nil {
+			size, err := strconv.ParseUint(args["-C"].(string), 10, 64)
+			if err != nil {
+				log.Fatalf("Error parsing size: %s", err)
+			}
+
+			rot.SetMaxBytes(size * 1000000)
+		}
+
+		if args["-G"] != nil {
+			secs, err := strconv.ParseUint(args["-G"].(string), 10, 64)
+			if err != nil {
+				log.Fatalf("Error parsing seconds: %s", err)
+			}
+
+			rot.SetMaxDuration(time.Duration(secs) * time.Second)
+		}
 
-	if args["-w"] != nil {
+		if args["-W"] != nil {
+			files, err := strconv.ParseUint(args["-W"].(string), 10, 16)
+			if err != nil {
+				log.Fatalf("Error parsing file count: %s", err)
+			}
+
+			rot.SetMaxFiles(int(files))
+		}
+
+		dst = rot
+		defer dst.Close()
+	} else if args["-w"] != nil {
 		dst, err = file.Open(args["-w"].(string))
 		if err != nil {
 			log.Fatalf("Error opening file: %s", err)
@@ -100,15 +168,39 @@ Options:
 		log.Fatalf("Error activating source: %s", err)
 	}
 
+	if rot != nil {
+		rot.SetLinkType(src.LinkType())
+
+		err = rot.Activate()
+		if err != nil {
+			log.Fatalf("Error activating output: %s", err)
+		}
+	}
+
 	if args["<expression>"] != nil {
 		expr := args["<expression>"].(string)
 
-		flt, err := filter.Compile(expr, src.LinkType(), false)
+		optimize := !args["-O"].(bool)
+
+		flt, err := filter.Compile(expr, src.LinkType(), optimize)
 		if err != nil {
 			log.Fatalf("Error parsing filter: %s", err)
 		}
 		defer flt.Cleanup()
 
+		if dump := args["-d"].(int); dump > 0 {
+			formats := []filter.Format{
+				filter.Mnemonic, filter.CArray, filter.Decimal,
+			}
+
+			if dump > len(formats) {
+				dump = len(formats)
+			}
+
+			log.Println(flt.Disassemble(formats[dump - 1]))
+			return
+		}
+
 		err = src.ApplyFilter(flt)
 		if err != nil {
 			log.Fatalf("Error appying filter: %s", err)
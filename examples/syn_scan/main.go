@@ -35,29 +35,29 @@ import "log"
 import "math"
 import "math/rand"
 import "net"
+import "strconv"
 import "time"
 
 import "github.com/docopt/docopt-go"
 
-import "github.com/ghedo/go.pkt/capture"
-import "github.com/ghedo/go.pkt/capture/pcap"
-
 import "github.com/ghedo/go.pkt/packet"
-import "github.com/ghedo/go.pkt/packet/arp"
-import "github.com/ghedo/go.pkt/packet/eth"
 import "github.com/ghedo/go.pkt/packet/ipv4"
 import "github.com/ghedo/go.pkt/packet/tcp"
 
 import "github.com/ghedo/go.pkt/layers"
+import "github.com/ghedo/go.pkt/capture"
 import "github.com/ghedo/go.pkt/network"
-import "github.com/ghedo/go.pkt/routing"
+import "github.com/ghedo/go.pkt/network/pacer"
 
 func main() {
 	log.SetFlags(0)
 
-	usage := `Usage: syn_scan <addr>
+	usage := `Usage: syn_scan [options] <addr>
 
-Simple TCP port scanner.`
+Simple TCP port scanner.
+
+Options:
+  -r <pps>, --rate <pps>  Probes sent per second [default: 1000].`
 
 	args, err := docopt.Parse(usage, nil, true, "", false)
 	if err != nil {
@@ -68,37 +68,12 @@ Simple TCP port scanner.`
 	addr_ip := net.ParseIP(addr)
 	timeout := 1 * time.Second
 
-	route, err := routing.RouteTo(addr_ip)
-	if err != nil {
-		log.Fatalf("Error: %s", err)
-	}
-
-	if route == nil {
-		log.Println("No route found")
-	}
-
-	c, err := pcap.Open(route.Iface.Name)
+	rate, err := strconv.ParseFloat(args["--rate"].(string), 64)
 	if err != nil {
-		log.Fatalf("Error opening interface: %s", err)
-	}
-	defer c.Close()
-
-	err = c.Activate()
-	if err != nil {
-		log.Fatalf("Error activating source: %s", err)
-	}
-
-	eth_pkt := eth.Make()
-	eth_pkt.SrcAddr = route.Iface.HardwareAddr
-
-	if route.Default {
-		eth_pkt.DstAddr = ResolveARP(c, timeout, route, route.Gateway)
-	} else {
-		eth_pkt.DstAddr = ResolveARP(c, timeout, route, addr_ip)
+		log.Fatalf("Invalid rate: %s", err)
 	}
 
 	ipv4_pkt := ipv4.Make()
-	ipv4_pkt.SrcAddr, _ = route.GetIfaceIPv4Addr()
 	ipv4_pkt.DstAddr = addr_ip
 
 	tcp_pkt := tcp.Make()
@@ -108,42 +83,59 @@ Simple TCP port scanner.`
 	tcp_pkt.Seq     = uint32(rand.Intn(math.MaxUint32))
 	tcp_pkt.WindowSize = 5840
 
+	c, pkts, err := network.RouteL3(timeout, ipv4_pkt, tcp_pkt)
+	if err != nil {
+		log.Fatalf("Error: %s", err)
+	}
+	defer network.CloseL3()
+
+	p := pacer.New(capture.Adapt(c))
+
+	err = p.SetPPS(rate)
+	if err != nil {
+		log.Fatalf("Error: %s", err)
+	}
+
+	session := network.NewSession(p, timeout)
+	defer session.Close()
+
 	for port := uint16(1); port < math.MaxUint16; port ++ {
 		tcp_pkt.DstPort = port
 
-		fmt.Printf("Scanning port %.5d: ", port)
-
-		pkt, err := network.SendRecv(c, timeout, eth_pkt, ipv4_pkt, tcp_pkt)
+		err := session.Send(pkts...)
 		if err != nil {
-			fmt.Printf("%s\n", err)
+			log.Fatalf("Error sending: %s", err)
+		}
+	}
+
+	ans, unans, err := session.Wait()
+	if err != nil {
+		log.Fatalf("Error: %s", err)
+	}
+
+	closed   := 0
+	filtered := len(unans)
+
+	for _, r := range ans {
+		/* ICMP errors (e.g. "administratively prohibited") quote the probe */
+		if r.ICMPError != nil {
+			filtered++
 			continue
 		}
 
-		tcp_pkt := layers.FindLayer(pkt, packet.TCP).(*tcp.Packet)
+		probe := layers.FindLayer(r.Probe, packet.TCP).(*tcp.Packet)
+		reply := layers.FindLayer(r.Answers[0], packet.TCP).(*tcp.Packet)
 
-		if tcp_pkt.Flags & tcp.Rst == 0 {
-			fmt.Printf("OPEN\n")
-		} else if tcp_pkt.Flags & tcp.Syn == 0{
-			fmt.Printf("CLOSED\n")
+		if reply.Flags & tcp.Rst == 0 {
+			fmt.Printf("Port %.5d: OPEN\n", probe.DstPort)
+		} else {
+			closed++
 		}
 	}
-}
-
-func ResolveARP(c capture.Handle, t time.Duration, r *routing.Route, addr net.IP) net.HardwareAddr {
-	eth_pkt := eth.Make()
-	eth_pkt.SrcAddr = r.Iface.HardwareAddr
-	eth_pkt.DstAddr, _ = net.ParseMAC("ff:ff:ff:ff:ff:ff")
 
-	arp_pkt := arp.Make()
-	arp_pkt.HWSrcAddr = r.Iface.HardwareAddr
-	arp_pkt.HWDstAddr, _ = net.ParseMAC("00:00:00:00:00:00")
-	arp_pkt.ProtoSrcAddr, _ = r.GetIfaceIPv4Addr()
-	arp_pkt.ProtoDstAddr = addr
+	fmt.Printf("%d closed, %d filtered\n", closed, filtered)
 
-	pkt, err := network.SendRecv(c, t, eth_pkt, arp_pkt)
-	if err != nil {
-		log.Fatal(err)
+	if c := p.Counters(); c.Failed > 0 {
+		fmt.Printf("%d probes could not be sent\n", c.Failed)
 	}
-
-	return pkt.Payload().(*arp.Packet).HWSrcAddr
 }
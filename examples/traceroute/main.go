@@ -38,12 +38,7 @@ import "time"
 
 import "github.com/docopt/docopt-go"
 
-import "github.com/ghedo/go.pkt/capture"
-import "github.com/ghedo/go.pkt/capture/pcap"
-
 import "github.com/ghedo/go.pkt/packet"
-import "github.com/ghedo/go.pkt/packet/arp"
-import "github.com/ghedo/go.pkt/packet/eth"
 import "github.com/ghedo/go.pkt/packet/icmpv4"
 import "github.com/ghedo/go.pkt/packet/ipv4"
 import "github.com/ghedo/go.pkt/packet/raw"
@@ -52,7 +47,6 @@ import "github.com/ghedo/go.pkt/packet/udp"
 
 import "github.com/ghedo/go.pkt/layers"
 import "github.com/ghedo/go.pkt/network"
-import "github.com/ghedo/go.pkt/routing"
 
 func main() {
 	log.SetFlags(0)
@@ -75,37 +69,9 @@ Options:
 	addr_ip := net.ParseIP(addr)
 	timeout := 5 * time.Second
 
-	route, err := routing.RouteTo(addr_ip)
-	if err != nil {
-		log.Fatalf("Error: %s", err)
-	}
-
-	if route == nil {
-		log.Println("No route found")
-	}
-
-	c, err := pcap.Open(route.Iface.Name)
-	if err != nil {
-		log.Fatalf("Error opening interface: %s", err)
-	}
-	defer c.Close()
-
-	err = c.Activate()
-	if err != nil {
-		log.Fatalf("Error activating source: %s", err)
-	}
-
-	eth_pkt := eth.Make()
-	eth_pkt.SrcAddr = route.Iface.HardwareAddr
-
-	if route.Default {
-		eth_pkt.DstAddr = ResolveARP(c, timeout, route, route.Gateway)
-	} else {
-		eth_pkt.DstAddr = ResolveARP(c, timeout, route, addr_ip)
-	}
+	defer network.CloseL3()
 
 	ipv4_pkt := ipv4.Make()
-	ipv4_pkt.SrcAddr, _ = route.GetIfaceIPv4Addr()
 	ipv4_pkt.DstAddr = addr_ip
 	ipv4_pkt.Id      = uint16(rand.Intn(math.MaxUint16))
 	ipv4_pkt.TTL     = 1
@@ -159,16 +125,21 @@ Options:
 	}
 
 	for {
-		pkt, err := network.SendRecv(c, timeout, eth_pkt, ipv4_pkt, payload_pkt)
+		pkt, err := network.SendRecvL3(timeout, ipv4_pkt, payload_pkt)
 		if err != nil {
 			log.Fatal(err)
 		}
 
-		ipv4_rsp := layers.FindLayer(pkt, packet.IPv4).(*ipv4.Packet)
-
-		log.Println(ipv4_rsp.SrcAddr)
-
-		if ipv4_rsp.SrcAddr.Equal(addr_ip) {
+		/* the routers on the way answer with "time exceeded" errors */
+		icmp_err := network.ParseICMPError(pkt)
+		if icmp_err != nil && icmp_err.TimeExceeded() {
+			log.Printf("%2d  %s", ipv4_pkt.TTL, icmp_err.From)
+		} else if icmp_err != nil && !icmp_err.From.Equal(addr_ip) {
+			log.Printf("%2d  %s (%s)", ipv4_pkt.TTL, icmp_err.From, icmp_err)
+			return
+		} else {
+			ipv4_rsp := layers.FindLayer(pkt, packet.IPv4).(*ipv4.Packet)
+			log.Printf("%2d  %s", ipv4_pkt.TTL, ipv4_rsp.SrcAddr)
 			return
 		}
 
@@ -180,22 +151,3 @@ Options:
 		}
 	}
 }
-
-func ResolveARP(c capture.Handle, t time.Duration, r *routing.Route, addr net.IP) net.HardwareAddr {
-	eth_pkt := eth.Make()
-	eth_pkt.SrcAddr = r.Iface.HardwareAddr
-	eth_pkt.DstAddr, _ = net.ParseMAC("ff:ff:ff:ff:ff:ff")
-
-	arp_pkt := arp.Make()
-	arp_pkt.HWSrcAddr = r.Iface.HardwareAddr
-	arp_pkt.HWDstAddr, _ = net.ParseMAC("00:00:00:00:00:00")
-	arp_pkt.ProtoSrcAddr, _ = r.GetIfaceIPv4Addr()
-	arp_pkt.ProtoDstAddr = addr
-
-	pkt, err := network.SendRecv(c, t, eth_pkt, arp_pkt)
-	if err != nil {
-		log.Fatal(err)
-	}
-
-	return pkt.Payload().(*arp.Packet).HWSrcAddr
-}
@@ -0,0 +1,723 @@
+/*
+ * Network packet analysis framework.
+ *
+ * Copyright (c) 2014, Alessandro Ghedini
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are
+ * met:
+ *
+ *     * Redistributions of source code must retain the above copyright
+ *       notice, this list of conditions and the following disclaimer.
+ *
+ *     * Redistributions in binary form must reproduce the above copyright
+ *       notice, this list of conditions and the following disclaimer in the
+ *       documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS
+ * IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO,
+ * THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR
+ * PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR
+ * CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+ * EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+ * PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+ * PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF
+ * LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+ * NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+ * SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package filter
+
+import "fmt"
+import "strconv"
+import "strings"
+
+type asm_token struct {
+	text string
+	col  int
+}
+
+/* a jump target, either a label or an absolute instruction index */
+type asm_target struct {
+	label string
+	abs   int
+	line  int
+	col   int
+}
+
+type asm_insn struct {
+	code uint16
+	k    uint32
+	jt   *asm_target
+	jf   *asm_target
+	line int
+}
+
+type assembler struct {
+	insns  []asm_insn
+	labels map[string]int
+
+	line   int
+	toks   []asm_token
+	pos    int
+	eol    int
+}
+
+var ext_ids = make(map[string]uint32)
+
+func init() {
+	for k, name := range ext_names {
+		ext_ids[name] = k
+	}
+}
+
+// Assemble a filter from its textual representation, using the same syntax of
+// the Linux bpf_asm tool. Every line contains at most one instruction,
+// optionally preceded by a "label:" definition, and comments start with ';'.
+//
+// Conditional jumps take either one or two targets ("jeq #0x800, l1, l2"), in
+// which case a single target is taken when the condition is true, or the
+// tcpdump -d form ("jeq #0x800 jt 2 jf 5"). Targets are either labels or
+// absolute instruction indices. The "jne", "jlt" and "jle" pseudo-jumps are
+// translated to the inverse of "jeq", "jge" and "jgt", and the Linux ancillary
+// fields can be loaded by name (e.g. "ld #proto"). This means that the output of
+// Disassemble() can be assembled back, in all but the CArray and Decimal
+// formats.
+func Assemble(src string) (*Filter, error) {
+	a := &assembler{ labels: make(map[string]int) }
+
+	for i, line := range strings.Split(src, "\n") {
+		a.line = i + 1
+		a.eol  = len(line) + 1
+
+		err := a.tokenize(line)
+		if err == nil {
+			err = a.parse_line()
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("Could not assemble filter: %s", err)
+		}
+	}
+
+	if len(a.insns) == 0 {
+		return nil, fmt.Errorf("Could not assemble filter: Empty program")
+	}
+
+	flt := &Filter{}
+
+	for pc, insn := range a.insns {
+		var jt, jf uint8
+
+		switch {
+		case insn.code == uint16(JMP) | bpf_ja:
+			off, err := a.resolve(pc, insn.jt, 0xffffffff)
+			if err != nil {
+				flt.Cleanup()
+				return nil, err
+			}
+
+			insn.k = uint32(off)
+
+		case insn.code & 0x07 == uint16(JMP):
+			off, err := a.resolve(pc, insn.jt, 0xff)
+			if err != nil {
+				flt.Cleanup()
+				return nil, err
+			}
+
+			jt = uint8(off)
+
+			off, err = a.resolve(pc, insn.jf, 0xff)
+			if err != nil {
+				flt.Cleanup()
+				return nil, err
+			}
+
+			jf = uint8(off)
+		}
+
+		flt.append_insn(Code(insn.code), jt, jf, insn.k)
+	}
+
+	return flt, nil
+}
+
+func (a *assembler) resolve(pc int, t *asm_target, max int) (int, error) {
+	/* a missing target means the next instruction */
+	if t == nil {
+		return 0, nil
+	}
+
+	addr  := t.abs
+	where := fmt.Sprintf("%d", t.abs)
+
+	if t.label != "" {
+		var ok bool
+
+		addr, ok = a.labels[t.label]
+		if !ok {
+			return 0, fmt.Errorf(
+				"Could not assemble filter: %d:%d: Undefined label '%s'",
+				t.line, t.col, t.label,
+			)
+		}
+
+		where = "'" + t.label + "'"
+	}
+
+	off := addr - pc - 1
+
+	if off < 0 {
+		return 0, fmt.Errorf(
+			"Could not assemble filter: %d:%d: Backward jump to %s",
+			t.line, t.col, where,
+		)
+	}
+
+	if off > max || addr >= len(a.insns) {
+		return 0, fmt.Errorf(
+			"Could not assemble filter: %d:%d: Jump to %s out of range",
+			t.line, t.col, where,
+		)
+	}
+
+	return off, nil
+}
+
+func (a *assembler) tokenize(line string) error {
+	a.toks = a.toks[:0]
+	a.pos  = 0
+
+	for i := 0; i < len(line); {
+		c := line[i]
+
+		switch {
+		case c == ' ' || c == '\t' || c == '\r':
+			i++
+
+		case c == ';':
+			return nil
+
+		case strings.IndexByte("[]()+*&,:#%", c) >= 0:
+			a.toks = append(a.toks, asm_token{ string(c), i + 1 })
+			i++
+
+		case is_asm_word(c) ||
+		     (c == '-' && i + 1 < len(line) && is_digit(line[i + 1])):
+			start := i
+
+			for i++; i < len(line) && is_asm_word(line[i]); i++ {
+			}
+
+			a.toks = append(a.toks, asm_token{ line[start:i], start + 1 })
+
+		default:
+			return a.error_at(i + 1, "Unexpected character '%c'", c)
+		}
+	}
+
+	return nil
+}
+
+func is_asm_word(c byte) bool {
+	return c == '_' || is_digit(c) ||
+	       (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+func is_digit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func (a *assembler) error_at(col int, format string, args ...interface{}) error {
+	msg := fmt.Sprintf(format, args...)
+	return fmt.Errorf("%d:%d: %s", a.line, col, msg)
+}
+
+func (a *assembler) error(format string, args ...interface{}) error {
+	col := a.eol
+
+	if a.pos < len(a.toks) {
+		col = a.toks[a.pos].col
+	}
+
+	return a.error_at(col, format, args...)
+}
+
+func (a *assembler) peek() string {
+	if a.pos < len(a.toks) {
+		return a.toks[a.pos].text
+	}
+
+	return ""
+}
+
+func (a *assembler) next() string {
+	tok := a.peek()
+	a.pos++
+	return tok
+}
+
+func (a *assembler) accept(text string) bool {
+	if a.pos < len(a.toks) && a.toks[a.pos].text == text {
+		a.pos++
+		return true
+	}
+
+	return false
+}
+
+func (a *assembler) expect(text string) error {
+	if !a.accept(text) {
+		return a.unexpected("'" + text + "'")
+	}
+
+	return nil
+}
+
+func (a *assembler) unexpected(want string) error {
+	if a.pos >= len(a.toks) {
+		return a.error("Expected %s", want)
+	}
+
+	return a.error("Expected %s, found '%s'", want, a.peek())
+}
+
+func (a *assembler) number() (uint32, error) {
+	tok := a.peek()
+
+	neg := strings.HasPrefix(tok, "-")
+	str := strings.TrimPrefix(tok, "-")
+
+	base := 10
+
+	switch {
+	case strings.HasPrefix(str, "0x") || strings.HasPrefix(str, "0X"):
+		base, str = 16, str[2:]
+
+	case strings.HasPrefix(str, "0b") || strings.HasPrefix(str, "0B"):
+		base, str = 2, str[2:]
+
+	case len(str) > 1 && str[0] == '0':
+		base, str = 8, str[1:]
+	}
+
+	val, err := strconv.ParseUint(str, base, 32)
+	if err != nil {
+		return 0, a.unexpected("number")
+	}
+
+	a.pos++
+
+	if neg {
+		return uint32(-int64(val)), nil
+	}
+
+	return uint32(val), nil
+}
+
+/* "x" or "%x" (and the same for "a") */
+func (a *assembler) register(name string) bool {
+	if a.accept(name) {
+		return true
+	}
+
+	if a.peek() == "%" && a.pos + 1 < len(a.toks) &&
+	   a.toks[a.pos + 1].text == name {
+		a.pos += 2
+		return true
+	}
+
+	return false
+}
+
+/* "M[k]" */
+func (a *assembler) mem() (uint32, error) {
+	if err := a.expect("M"); err != nil {
+		return 0, err
+	}
+
+	if err := a.expect("["); err != nil {
+		return 0, err
+	}
+
+	k, err := a.number()
+	if err != nil {
+		return 0, err
+	}
+
+	return k, a.expect("]")
+}
+
+/* "4*([k]&0xf)" */
+func (a *assembler) msh() (uint32, error) {
+	mul, err := a.number()
+	if err != nil {
+		return 0, err
+	}
+
+	for _, t := range []string{ "*", "(", "[" } {
+		if err := a.expect(t); err != nil {
+			return 0, err
+		}
+	}
+
+	k, err := a.number()
+	if err != nil {
+		return 0, err
+	}
+
+	for _, t := range []string{ "]", "&" } {
+		if err := a.expect(t); err != nil {
+			return 0, err
+		}
+	}
+
+	mask, err := a.number()
+	if err != nil {
+		return 0, err
+	}
+
+	if mul != 4 || mask != 0xf {
+		return 0, a.error("Only 4*([k]&0xf) is supported")
+	}
+
+	return k, a.expect(")")
+}
+
+func (a *assembler) target() (*asm_target, error) {
+	if a.pos >= len(a.toks) {
+		return nil, a.unexpected("jump target")
+	}
+
+	tok := a.toks[a.pos]
+	t   := &asm_target{ line: a.line, col: tok.col }
+
+	if is_digit(tok.text[0]) {
+		abs, err := a.number()
+		if err != nil {
+			return nil, err
+		}
+
+		t.abs = int(abs)
+		return t, nil
+	}
+
+	if !is_asm_word(tok.text[0]) {
+		return nil, a.unexpected("jump target")
+	}
+
+	t.label = tok.text
+	a.pos++
+
+	return t, nil
+}
+
+func (a *assembler) parse_line() error {
+	/* instruction number, as printed by tcpdump -d */
+	if a.accept("(") {
+		if _, err := strconv.ParseUint(a.peek(), 10, 32); err != nil {
+			return a.unexpected("instruction number")
+		}
+
+		a.pos++
+
+		if err := a.expect(")"); err != nil {
+			return err
+		}
+	}
+
+	if a.pos + 1 < len(a.toks) && a.toks[a.pos + 1].text == ":" {
+		tok := a.toks[a.pos]
+
+		if !is_asm_word(tok.text[0]) || is_digit(tok.text[0]) {
+			return a.error("Invalid label '%s'", tok.text)
+		}
+
+		if _, ok := a.labels[tok.text]; ok {
+			return a.error("Duplicate label '%s'", tok.text)
+		}
+
+		a.labels[tok.text] = len(a.insns)
+		a.pos += 2
+	}
+
+	if a.pos >= len(a.toks) {
+		return nil
+	}
+
+	insn := asm_insn{ line: a.line }
+
+	err := a.parse_insn(&insn)
+	if err != nil {
+		return err
+	}
+
+	if a.pos < len(a.toks) {
+		return a.error("Unexpected '%s'", a.peek())
+	}
+
+	a.insns = append(a.insns, insn)
+	return nil
+}
+
+var asm_sizes = map[string]Size{
+	"ld":  Word,
+	"ldh": Half,
+	"ldb": Byte,
+}
+
+var asm_alu = map[string]uint16{
+	"add": bpf_add,
+	"sub": bpf_sub,
+	"mul": bpf_mul,
+	"div": bpf_div,
+	"and": bpf_and,
+	"or":  bpf_or,
+	"lsh": bpf_lsh,
+	"rsh": bpf_rsh,
+	"mod": bpf_mod,
+	"xor": bpf_xor,
+}
+
+var asm_jumps = map[string]uint16{
+	"jeq":  bpf_jeq,
+	"jgt":  bpf_jgt,
+	"jge":  bpf_jge,
+	"jset": bpf_jset,
+	"jne":  bpf_jeq,
+	"jneq": bpf_jeq,
+	"jlt":  bpf_jge,
+	"jle":  bpf_jgt,
+}
+
+func (a *assembler) parse_insn(insn *asm_insn) error {
+	op := strings.ToLower(a.peek())
+	a.pos++
+
+	var err error
+
+	switch op {
+	case "ld", "ldh", "ldb":
+		return a.parse_ld(insn, asm_sizes[op])
+
+	case "ldi":
+		a.accept("#")
+		insn.code = uint16(LD) | uint16(IMM)
+		insn.k, err = a.number()
+
+	case "ldx", "ldxb", "ldxi":
+		return a.parse_ldx(insn, op)
+
+	case "st", "stx":
+		insn.code = uint16(ST)
+		if op == "stx" {
+			insn.code = uint16(STX)
+		}
+
+		insn.k, err = a.mem()
+
+	case "ja", "jmp":
+		insn.code = uint16(JMP) | bpf_ja
+		insn.jt, err = a.target()
+
+	case "jeq", "jgt", "jge", "jset", "jne", "jneq", "jlt", "jle":
+		return a.parse_jump(insn, op)
+
+	case "add", "sub", "mul", "div", "and", "or", "lsh", "rsh", "mod", "xor":
+		insn.code = uint16(ALU) | asm_alu[op]
+
+		if a.register("x") {
+			insn.code |= uint16(Index)
+			return nil
+		}
+
+		if err := a.expect("#"); err != nil {
+			return err
+		}
+
+		insn.k, err = a.number()
+
+	case "neg":
+		insn.code = uint16(ALU) | bpf_neg
+
+	case "tax":
+		insn.code = uint16(MISC) | bpf_tax
+
+	case "txa":
+		insn.code = uint16(MISC) | bpf_txa
+
+	case "ret":
+		insn.code = uint16(RET)
+
+		switch {
+		case a.register("a"):
+			insn.code |= uint16(Acc)
+
+		case a.register("x"):
+			insn.code |= uint16(Index)
+
+		default:
+			if err := a.expect("#"); err != nil {
+				return err
+			}
+
+			insn.k, err = a.number()
+		}
+
+	default:
+		a.pos--
+		return a.error("Unknown instruction '%s'", a.peek())
+	}
+
+	return err
+}
+
+func (a *assembler) parse_ld(insn *asm_insn, size Size) error {
+	var err error
+
+	insn.code = uint16(LD) | uint16(size)
+
+	switch {
+	case a.accept("["):
+		if a.register("x") {
+			insn.code |= uint16(IND)
+
+			if err := a.expect("+"); err != nil {
+				return err
+			}
+		} else {
+			insn.code |= uint16(ABS)
+		}
+
+		insn.k, err = a.number()
+		if err != nil {
+			return err
+		}
+
+		return a.expect("]")
+
+	case a.peek() == "M" && size == Word:
+		insn.code |= uint16(MEM)
+		insn.k, err = a.mem()
+		return err
+	}
+
+	a.accept("#")
+
+	name := strings.ToLower(a.peek())
+
+	if k, ok := ext_ids[name]; ok {
+		insn.code |= uint16(ABS)
+		insn.k     = k
+		a.pos++
+		return nil
+	}
+
+	if size != Word {
+		return a.unexpected("packet offset")
+	}
+
+	if name == "len" || name == "pktlen" {
+		insn.code |= uint16(LEN)
+		a.pos++
+		return nil
+	}
+
+	insn.code |= uint16(IMM)
+	insn.k, err = a.number()
+	return err
+}
+
+func (a *assembler) parse_ldx(insn *asm_insn, op string) error {
+	var err error
+
+	insn.code = uint16(LDX)
+
+	tok := a.peek()
+
+	switch {
+	case op == "ldxb" || (op == "ldx" && tok != "" && is_digit(tok[0])):
+		insn.code |= uint16(Byte) | uint16(MSH)
+		insn.k, err = a.msh()
+
+	case op == "ldx" && tok == "M":
+		insn.code |= uint16(MEM)
+		insn.k, err = a.mem()
+
+	default:
+		a.accept("#")
+
+		name := strings.ToLower(a.peek())
+		if op == "ldx" && (name == "len" || name == "pktlen") {
+			insn.code |= uint16(LEN)
+			a.pos++
+			return nil
+		}
+
+		insn.code |= uint16(IMM)
+		insn.k, err = a.number()
+	}
+
+	return err
+}
+
+func (a *assembler) parse_jump(insn *asm_insn, op string) error {
+	var err error
+
+	insn.code = uint16(JMP) | asm_jumps[op]
+
+	if a.register("x") {
+		insn.code |= uint16(Index)
+	} else {
+		if err := a.expect("#"); err != nil {
+			return err
+		}
+
+		insn.k, err = a.number()
+		if err != nil {
+			return err
+		}
+	}
+
+	if a.accept("jt") {
+		insn.jt, err = a.target()
+		if err != nil {
+			return err
+		}
+
+		a.accept(",")
+
+		if a.accept("jf") {
+			insn.jf, err = a.target()
+			if err != nil {
+				return err
+			}
+		}
+	} else {
+		if err := a.expect(","); err != nil {
+			return err
+		}
+
+		insn.jt, err = a.target()
+		if err != nil {
+			return err
+		}
+
+		if a.accept(",") {
+			insn.jf, err = a.target()
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	switch op {
+	case "jne", "jneq", "jlt", "jle":
+		insn.jt, insn.jf = insn.jf, insn.jt
+	}
+
+	return nil
+}
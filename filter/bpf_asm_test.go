@@ -0,0 +1,177 @@
+/*
+ * Network packet analysis framework.
+ *
+ * Copyright (c) 2014, Alessandro Ghedini
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are
+ * met:
+ *
+ *     * Redistributions of source code must retain the above copyright
+ *       notice, this list of conditions and the following disclaimer.
+ *
+ *     * Redistributions in binary form must reproduce the above copyright
+ *       notice, this list of conditions and the following disclaimer in the
+ *       documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS
+ * IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO,
+ * THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR
+ * PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR
+ * CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+ * EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+ * PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+ * PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF
+ * LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+ * NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+ * SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package filter_test
+
+import "strings"
+import "testing"
+
+import "github.com/ghedo/go.pkt/filter"
+import "github.com/ghedo/go.pkt/packet"
+
+var test_asm_arp = `
+	ldh [12]          ; ethertype
+	jeq #0x806, accept, reject
+accept: ret #0x40000
+reject:
+	ret #0
+`
+
+func TestAssemble(t *testing.T) {
+	flt, err := filter.Assemble(test_asm_arp)
+	if err != nil {
+		t.Fatalf("Error assembling: %s", err)
+	}
+	defer flt.Cleanup()
+
+	if flt.String() != test_arp {
+		t.Fatalf("Program mismatch: %s", flt.String())
+	}
+}
+
+func TestAssembleRoundTrip(t *testing.T) {
+	exprs := []string{
+		"arp",
+		"ip and udp port 53",
+		"tcp[tcpflags] & (tcp-syn|tcp-ack) == tcp-syn",
+		"ip[2:2] - ((ip[0]&0xf)<<2) > 100 or len < 64",
+		"vlan 10 and host 192.168.1.1",
+	}
+
+	formats := []filter.Format{ filter.Mnemonic, filter.Assembly }
+
+	for _, expr := range exprs {
+		flt, err := filter.Compile(expr, packet.Eth, false)
+		if err != nil {
+			t.Fatalf("Error compiling '%s': %s", expr, err)
+		}
+
+		for _, format := range formats {
+			src := flt.Disassemble(format)
+
+			out, err := filter.Assemble(src)
+			if err != nil {
+				t.Fatalf("Error assembling '%s': %s\n%s", expr, err, src)
+			}
+
+			if out.String() != flt.String() {
+				t.Fatalf("Program mismatch for '%s':\n%s\nexpected:\n%s",
+				         expr, out.String(), flt.String())
+			}
+
+			out.Cleanup()
+		}
+
+		flt.Cleanup()
+	}
+
+	flt := build_disasm(t)
+	defer flt.Cleanup()
+
+	out, err := filter.Assemble(flt.Disassemble(filter.Assembly))
+	if err != nil {
+		t.Fatalf("Error assembling: %s", err)
+	}
+	defer out.Cleanup()
+
+	if out.String() != flt.String() {
+		t.Fatalf("Program mismatch: %s", out.String())
+	}
+}
+
+var test_asm_pseudo = `
+	ld #proto
+	jneq #0x800, drop
+	ld len
+	jlt #64, drop
+	jle x, drop
+	ldx 4*([14]&0xf)
+	ld [%x + 0]
+	jset #0x1, drop, keep
+keep:	ret a
+drop:	ret #0`
+
+var test_asm_pseudo_prog = `{ 0x20,   0,   0, 0xfffff000 },
+{ 0x15,   0,   7, 0x00000800 },
+{ 0x80,   0,   0, 0x00000000 },
+{ 0x35,   0,   5, 0x00000040 },
+{ 0x2d,   0,   4, 0x00000000 },
+{ 0xb1,   0,   0, 0x0000000e },
+{ 0x40,   0,   0, 0x00000000 },
+{ 0x45,   1,   0, 0x00000001 },
+{ 0x16,   0,   0, 0x00000000 },
+{ 0x06,   0,   0, 0x00000000 },`
+
+func TestAssemblePseudo(t *testing.T) {
+	flt, err := filter.Assemble(test_asm_pseudo)
+	if err != nil {
+		t.Fatalf("Error assembling: %s", err)
+	}
+	defer flt.Cleanup()
+
+	if flt.String() != test_asm_pseudo_prog {
+		t.Fatalf("Program mismatch: %s", flt.String())
+	}
+
+	if !flt.Validate() {
+		t.Fatalf("Invalid filter")
+	}
+}
+
+func TestAssembleError(t *testing.T) {
+	tests := []struct {
+		src string
+		err string
+	}{
+		{ "",                          "Empty program" },
+		{ "ldh [12]\nfoo #1",          "2:1: Unknown instruction 'foo'" },
+		{ "ldh [12",                   "1:8: Expected ']'" },
+		{ "ld #0x1g",                  "1:5: Expected number, found '0x1g'" },
+		{ "ret #0 x",                  "1:8: Unexpected 'x'" },
+		{ "ret @",                     "1:5: Unexpected character '@'" },
+		{ "ja nowhere\nret #0",        "1:4: Undefined label 'nowhere'" },
+		{ "l: ret #0\nja l",           "2:4: Backward jump to 'l'" },
+		{ "l: ret #0\nl: ret #0",      "2:1: Duplicate label 'l'" },
+		{ "jeq #1 jt 1 jf 7\nret #0",  "1:16: Jump to 7 out of range" },
+		{ "ldx 2*([14]&0xf)",          "Only 4*([k]&0xf) is supported" },
+		{ "ldh M[1]",                  "1:5: Expected packet offset" },
+	}
+
+	for _, test := range tests {
+		_, err := filter.Assemble(test.src)
+		if err == nil {
+			t.Fatalf("Expected error for '%s'", test.src)
+		}
+
+		if !strings.Contains(err.Error(), test.err) {
+			t.Fatalf("Error mismatch for '%s': %s", test.src, err)
+		}
+	}
+}
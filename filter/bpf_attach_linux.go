@@ -0,0 +1,108 @@
+/*
+ * Network packet analysis framework.
+ *
+ * Copyright (c) 2014, Alessandro Ghedini
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are
+ * met:
+ *
+ *     * Redistributions of source code must retain the above copyright
+ *       notice, this list of conditions and the following disclaimer.
+ *
+ *     * Redistributions in binary form must reproduce the above copyright
+ *       notice, this list of conditions and the following disclaimer in the
+ *       documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS
+ * IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO,
+ * THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR
+ * PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR
+ * CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+ * EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+ * PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+ * PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF
+ * LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+ * NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+ * SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package filter
+
+import "fmt"
+import "net"
+import "syscall"
+import "unsafe"
+
+// Attach the filter to the given socket with SO_ATTACH_FILTER. Only packets
+// that match the filter will be received on the socket. Any filter previously
+// attached to the socket is replaced.
+func (f *Filter) AttachFd(fd int) error {
+	if f.Len() == 0 || !f.Validate() {
+		return fmt.Errorf("Invalid filter")
+	}
+
+	/* same layout as struct sock_filter */
+	insns := f.insns()
+	prog  := unsafe.Slice(
+		(*syscall.SockFilter)(unsafe.Pointer(unsafe.SliceData(insns))),
+		len(insns),
+	)
+
+	err := syscall.AttachLsf(fd, prog)
+	if err != nil {
+		return fmt.Errorf("Could not attach filter: %s", err)
+	}
+
+	return nil
+}
+
+// Attach the filter to the socket underlying the given raw connection (e.g. as
+// returned by the SyscallConn() method of net.UDPConn, net.IPConn, ...).
+func (f *Filter) Attach(conn syscall.RawConn) error {
+	var err error
+
+	cerr := conn.Control(func(fd uintptr) {
+		err = f.AttachFd(int(fd))
+	})
+	if cerr != nil {
+		return fmt.Errorf("Could not access socket: %s", cerr)
+	}
+
+	return err
+}
+
+// Attach the filter to the given packet connection (e.g. as returned by
+// net.ListenPacket()). The connection must implement syscall.Conn.
+func (f *Filter) AttachConn(conn net.PacketConn) error {
+	sys_conn, ok := conn.(syscall.Conn)
+	if !ok {
+		return fmt.Errorf("Connection does not support raw access")
+	}
+
+	raw_conn, err := sys_conn.SyscallConn()
+	if err != nil {
+		return fmt.Errorf("Could not access socket: %s", err)
+	}
+
+	return f.Attach(raw_conn)
+}
+
+// Detach any filter attached to the socket underlying the given raw connection.
+func Detach(conn syscall.RawConn) error {
+	var err error
+
+	cerr := conn.Control(func(fd uintptr) {
+		err = syscall.DetachLsf(int(fd))
+	})
+	if cerr != nil {
+		return fmt.Errorf("Could not access socket: %s", cerr)
+	}
+
+	if err != nil {
+		return fmt.Errorf("Could not detach filter: %s", err)
+	}
+
+	return nil
+}
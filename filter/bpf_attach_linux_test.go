@@ -0,0 +1,102 @@
+/*
+ * Network packet analysis framework.
+ *
+ * Copyright (c) 2014, Alessandro Ghedini
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are
+ * met:
+ *
+ *     * Redistributions of source code must retain the above copyright
+ *       notice, this list of conditions and the following disclaimer.
+ *
+ *     * Redistributions in binary form must reproduce the above copyright
+ *       notice, this list of conditions and the following disclaimer in the
+ *       documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS
+ * IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO,
+ * THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR
+ * PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR
+ * CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+ * EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+ * PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+ * PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF
+ * LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+ * NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+ * SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package filter_test
+
+import "net"
+import "testing"
+import "time"
+
+import "github.com/ghedo/go.pkt/filter"
+
+func recv_udp(t *testing.T, conn net.PacketConn) bool {
+	_, err := conn.WriteTo([]byte("test"), conn.LocalAddr())
+	if err != nil {
+		t.Fatalf("Error sending: %s", err)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+
+	buf := make([]byte, 16)
+
+	_, _, err = conn.ReadFrom(buf)
+	return err == nil
+}
+
+func TestAttach(t *testing.T) {
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Skipf("Error listening: %s", err)
+	}
+	defer conn.Close()
+
+	drop := assemble(t, "ret #0")
+	defer drop.Cleanup()
+
+	err = drop.AttachConn(conn)
+	if err != nil {
+		t.Fatalf("Error attaching: %s", err)
+	}
+
+	if recv_udp(t, conn) {
+		t.Fatalf("Packet not filtered")
+	}
+
+	raw, err := conn.(*net.UDPConn).SyscallConn()
+	if err != nil {
+		t.Fatalf("Error getting raw conn: %s", err)
+	}
+
+	err = filter.Detach(raw)
+	if err != nil {
+		t.Fatalf("Error detaching: %s", err)
+	}
+
+	if !recv_udp(t, conn) {
+		t.Fatalf("Packet filtered")
+	}
+
+	keep := assemble(t, "ret #-1")
+	defer keep.Cleanup()
+
+	err = keep.Attach(raw)
+	if err != nil {
+		t.Fatalf("Error attaching: %s", err)
+	}
+
+	if !recv_udp(t, conn) {
+		t.Fatalf("Packet filtered")
+	}
+
+	empty, _ := filter.NewBuilder().Build()
+	if empty.Attach(raw) == nil {
+		t.Fatalf("Error expected")
+	}
+}
@@ -0,0 +1,61 @@
+/*
+ * Network packet analysis framework.
+ *
+ * Copyright (c) 2014, Alessandro Ghedini
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are
+ * met:
+ *
+ *     * Redistributions of source code must retain the above copyright
+ *       notice, this list of conditions and the following disclaimer.
+ *
+ *     * Redistributions in binary form must reproduce the above copyright
+ *       notice, this list of conditions and the following disclaimer in the
+ *       documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS
+ * IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO,
+ * THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR
+ * PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR
+ * CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+ * EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+ * PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+ * PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF
+ * LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+ * NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+ * SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+//go:build !linux
+
+package filter
+
+import "fmt"
+import "net"
+import "syscall"
+
+// Attach the filter to the given socket with SO_ATTACH_FILTER. This is only
+// supported on Linux.
+func (f *Filter) AttachFd(fd int) error {
+	return fmt.Errorf("Could not attach filter: not supported")
+}
+
+// Attach the filter to the socket underlying the given raw connection. This is
+// only supported on Linux.
+func (f *Filter) Attach(conn syscall.RawConn) error {
+	return f.AttachFd(-1)
+}
+
+// Attach the filter to the given packet connection. This is only supported on
+// Linux.
+func (f *Filter) AttachConn(conn net.PacketConn) error {
+	return f.AttachFd(-1)
+}
+
+// Detach any filter attached to the socket underlying the given raw connection.
+// This is only supported on Linux.
+func Detach(conn syscall.RawConn) error {
+	return fmt.Errorf("Could not detach filter: not supported")
+}
@@ -30,24 +30,25 @@
 
 package filter
 
-// #include "bpf_filter.h"
-import "C"
+import "fmt"
 
 // A Builder is used to compile a BPF filter from basic BPF instructions.
 type Builder struct {
-	filter    *Filter
-	labels    map[string]int
+	insns    []bpf_insn
+	labels   map[string]int
 
 	jumps_k  map[int]string
 	jumps_jt map[int]string
 	jumps_jf map[int]string
 }
 
+/* maximum offset that fits in the jt and jf fields */
+const max_cond_jump = 0xff
+
 // Allocate and initialize a new Builder.
 func NewBuilder() *Builder {
 	b := &Builder{}
 
-	b.filter   = &Filter{}
 	b.labels   = make(map[string]int)
 	b.jumps_k  = make(map[int]string)
 	b.jumps_jt = make(map[int]string)
@@ -56,43 +57,150 @@ func NewBuilder() *Builder {
 	return b
 }
 
-// Generate and return the Filter associated with the Builder.
-func (b *Builder) Build() *Filter {
-	prog := (*C.struct_bpf_program)(b.filter.Program())
-	flen := int(C.bpf_get_len(prog))
+// Generate and return the Filter associated with the Builder. An error is
+// returned if a jump refers to an undefined label, or to a label that doesn't
+// follow the jump itself (BPF only allows forward jumps). Conditional jumps
+// whose target is too far away to fit in the jt/jf offsets are automatically
+// rewritten to go through JA instructions (trampolines) inserted right after
+// them.
+func (b *Builder) Build() (*Filter, error) {
+	n := len(b.insns)
+
+	/* jump targets, as indices of the instructions added to the builder */
+	targets := make([][]int, n)
 
-	for i := 0; i < flen; i++ {
-		insn := C.bpf_get_insn(prog, C.int(i))
+	for i := range b.insns {
+		var lbls []string
 
 		if lbl, ok := b.jumps_k[i]; ok {
-			addr := b.labels[lbl]
-			if addr != 0 {
-				insn.k = C.bpf_u_int32(addr - i - 1)
+			lbls = []string{ lbl }
+		} else if lbl, ok := b.jumps_jt[i]; ok {
+			lbls = []string{ lbl, b.jumps_jf[i] }
+		}
+
+		for _, lbl := range lbls {
+			addr, err := b.resolve(i, lbl)
+			if err != nil {
+				return nil, err
 			}
+
+			targets[i] = append(targets[i], addr)
 		}
+	}
+
+	/*
+	 * Count the trampolines needed after each conditional jump. Adding
+	 * trampolines makes other jumps longer, so iterate until nothing
+	 * changes (the counts never decrease, so this terminates).
+	 */
+	tramps := make([][]int, n)
+	pos    := make([]int, n + 1)
+
+	for changed := true; changed; {
+		changed = false
+
+		for i, p := 0, 0; i <= n; i++ {
+			pos[i] = p
+
+			if i < n {
+				p += 1 + len(tramps[i])
+			}
+		}
+
+		for i := range b.insns {
+			if len(targets[i]) != 2 {
+				continue
+			}
+
+			for _, t := range targets[i] {
+				if pos[t] - pos[i] - 1 <= max_cond_jump ||
+				   has_target(tramps[i], t) {
+					continue
+				}
 
-		if lbl, ok := b.jumps_jt[i]; ok {
-			addr := b.labels[lbl]
-			if addr != 0 {
-				insn.jt = C.u_char(addr - i - 1)
+				tramps[i] = append(tramps[i], t)
+				changed   = true
 			}
 		}
+	}
+
+	flt := &Filter{}
+
+	for i, insn := range b.insns {
+		switch len(targets[i]) {
+		case 1:
+			insn.k = uint32(pos[targets[i][0]] - pos[i] - 1)
+
+		case 2:
+			off := make([]int, 2)
 
-		if lbl, ok := b.jumps_jf[i]; ok {
-			addr := b.labels[lbl]
-			if addr != 0  {
-				insn.jf = C.u_char(addr - i - 1)
+			for j, t := range targets[i] {
+				off[j] = pos[t] - pos[i] - 1
+
+				for s, tramp := range tramps[i] {
+					if tramp == t {
+						off[j] = s
+					}
+				}
 			}
+
+			insn.jt = uint8(off[0])
+			insn.jf = uint8(off[1])
+		}
+
+		flt.append_insn(Code(insn.code), insn.jt, insn.jf, insn.k)
+
+		for s, t := range tramps[i] {
+			k := uint32(pos[t] - (pos[i] + 1 + s) - 1)
+			flt.append_insn(JMP, 0, 0, k)
+		}
+	}
+
+	return flt, nil
+}
+
+func (b *Builder) resolve(i int, lbl string) (int, error) {
+	/* an empty label means the following instruction */
+	addr := i + 1
+
+	if lbl != "" {
+		var ok bool
+
+		addr, ok = b.labels[lbl]
+		if !ok {
+			return 0, fmt.Errorf("Undefined label '%s'", lbl)
+		}
+
+		if addr <= i {
+			return 0, fmt.Errorf("Backward jump to label '%s'", lbl)
 		}
 	}
 
-	return b.filter
+	if addr >= len(b.insns) {
+		return 0, fmt.Errorf("Jump past the end of the program")
+	}
+
+	return addr, nil
+}
+
+func has_target(list []int, val int) bool {
+	for _, v := range list {
+		if v == val {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (b *Builder) append_insn(code Code, k uint32) {
+	b.insns = append(b.insns, bpf_insn{ code: uint16(code), k: k })
 }
 
 // Define a new label at the next instruction position. Labels are used in jump
 // instructions to identify the jump target.
 func (b *Builder) Label(name string) *Builder {
-	b.labels[name] = b.filter.Len()
+	b.labels[name] = len(b.insns)
 	return b
 }
 
@@ -103,10 +211,18 @@ func (b *Builder) Label(name string) *Builder {
 // packet length or MEM (load a value from memory at the given offset).
 func (b *Builder) LD(s Size, m Mode, val uint32) *Builder {
 	code := Code(uint16(s) | uint16(m)) | LD
-	b.filter.append_insn(code, 0, 0, val)
+	b.append_insn(code, val)
 	return b
 }
 
+// Append an LD instruction to the filter, which loads the given Linux ancillary
+// field (one of the Ext* constants, e.g. ExtProto) into the accumulator.
+// Ancillary fields are only available to the Linux in-kernel filter, or when
+// running the filter with a Context.
+func (b *Builder) LDEXT(ext uint32) *Builder {
+	return b.LD(Word, ABS, ext)
+}
+
 // Append a LDX (load index) instruction to the filter, which loads a value of
 // size s into the index register. m represents the addressing mode of the
 // source operand and can be IMM (load a constant value), LEN (load the packet
@@ -114,21 +230,21 @@ func (b *Builder) LD(s Size, m Mode, val uint32) *Builder {
 // length of the IP header).
 func (b *Builder) LDX(s Size, m Mode, val uint32) *Builder {
 	code := Code(uint16(s) | uint16(m) | LDX)
-	b.filter.append_insn(code, 0, 0, val)
+	b.append_insn(code, val)
 	return b
 }
 
 // Append a ST (store) instruction to the filter, which stores the value of the
 // accumulator in memory at the given offset.
 func (b *Builder) ST(off uint32) *Builder {
-	b.filter.append_insn(ST, 0, 0, off)
+	b.append_insn(ST, off)
 	return b
 }
 
 // Append a STX (store index) instruction to the filter, which stores the value
 // of the index register in memory at the given offset.
 func (b *Builder) STX(off uint32) *Builder {
-	b.filter.append_insn(STX, 0, 0, off)
+	b.append_insn(STX, off)
 	return b
 }
 
@@ -138,7 +254,7 @@ func (b *Builder) STX(off uint32) *Builder {
 // value).
 func (b *Builder) ADD(s Src, val uint32) *Builder {
 	code := Code(uint16(s) | uint16(0x00) | ALU)
-	b.filter.append_insn(code, 0, 0, val)
+	b.append_insn(code, val)
 	return b
 }
 
@@ -148,7 +264,7 @@ func (b *Builder) ADD(s Src, val uint32) *Builder {
 // register value).
 func (b *Builder) SUB(s Src, val uint32) *Builder {
 	code := Code(uint16(s) | uint16(0x10) | ALU)
-	b.filter.append_insn(code, 0, 0, val)
+	b.append_insn(code, val)
 	return b
 }
 
@@ -158,7 +274,7 @@ func (b *Builder) SUB(s Src, val uint32) *Builder {
 // register value).
 func (b *Builder) MUL(s Src, val uint32) *Builder {
 	code := Code(uint16(s) | uint16(0x20) | ALU)
-	b.filter.append_insn(code, 0, 0, val)
+	b.append_insn(code, val)
 	return b
 }
 
@@ -168,27 +284,27 @@ func (b *Builder) MUL(s Src, val uint32) *Builder {
 // value).
 func (b *Builder) DIV(s Src, val uint32) *Builder {
 	code := Code(uint16(s) | uint16(0x30) | ALU)
-	b.filter.append_insn(code, 0, 0, val)
+	b.append_insn(code, val)
 	return b
 }
 
 // Append an AND instruction to the filter, which performs the binary "and"
 // between the accumulator and a value. s represents the source operand type and
 // can be either Const (which uses the supplied value) or Index (which uses the
-// index register value).
+// index register value). Note that older versions wrongly emitted BPF_OR.
 func (b *Builder) AND(s Src, val uint32) *Builder {
-	code := Code(uint16(s) | uint16(0x40) | ALU)
-	b.filter.append_insn(code, 0, 0, val)
+	code := Code(uint16(s) | uint16(0x50) | ALU)
+	b.append_insn(code, val)
 	return b
 }
 
 // Append an OR instruction to the filter, which performs the binary "or"
 // between the accumulator and a value. s represents the source operand type and
 // can be either Const (which uses the supplied value) or Index (which uses the
-// index register value).
+// index register value). Note that older versions wrongly emitted BPF_AND.
 func (b *Builder) OR(s Src, val uint32) *Builder {
-	code := Code(uint16(s) | uint16(0x50) | ALU)
-	b.filter.append_insn(code, 0, 0, val)
+	code := Code(uint16(s) | uint16(0x40) | ALU)
+	b.append_insn(code, val)
 	return b
 }
 
@@ -198,7 +314,7 @@ func (b *Builder) OR(s Src, val uint32) *Builder {
 // by the index register value).
 func (b *Builder) LSH(s Src, val uint32) *Builder {
 	code := Code(uint16(s) | uint16(0x60) | ALU)
-	b.filter.append_insn(code, 0, 0, val)
+	b.append_insn(code, val)
 	return b
 }
 
@@ -208,24 +324,44 @@ func (b *Builder) LSH(s Src, val uint32) *Builder {
 // by the index register value).
 func (b *Builder) RSH(s Src, val uint32) *Builder {
 	code := Code(uint16(s) | uint16(0x70) | ALU)
-	b.filter.append_insn(code, 0, 0, val)
+	b.append_insn(code, val)
+	return b
+}
+
+// Append a MOD instruction to the filter, which sets the accumulator to the
+// remainder of its division by a value. s represents the source operand type
+// and can be either Const (which divides by the supplied value) or Index (which
+// divides by the index register value). This is a Linux extension.
+func (b *Builder) MOD(s Src, val uint32) *Builder {
+	code := Code(uint16(s) | uint16(0x90) | ALU)
+	b.append_insn(code, val)
+	return b
+}
+
+// Append a XOR instruction to the filter, which performs the binary "exclusive
+// or" between the accumulator and a value. s represents the source operand type
+// and can be either Const (which uses the supplied value) or Index (which uses
+// the index register value). This is a Linux extension.
+func (b *Builder) XOR(s Src, val uint32) *Builder {
+	code := Code(uint16(s) | uint16(0xa0) | ALU)
+	b.append_insn(code, val)
 	return b
 }
 
 // Append a NEG instruction to the filter which negates the accumulator.
 func (b *Builder) NEG() *Builder {
 	code := Code(uint16(0x80) | ALU)
-	b.filter.append_insn(code, 0, 0, 0)
+	b.append_insn(code, 0)
 	return b
 }
 
 // Append a JA instruction to the filter, which performs a jump to the given
 // label.
 func (b *Builder) JA(j string) *Builder {
-	b.jumps_k[b.filter.Len()] = j
+	b.jumps_k[len(b.insns)] = j
 
 	code := Code(uint16(0x00) | JMP)
-	b.filter.append_insn(code, 0, 0, 0)
+	b.append_insn(code, 0)
 	return b
 }
 
@@ -233,11 +369,11 @@ func (b *Builder) JA(j string) *Builder {
 // if the accumulator value equals cmp (if s is Const) or the index register (if
 // s is Index), otherwise jumps to jf.
 func (b *Builder) JEQ(s Src, jt, jf string, cmp uint32) *Builder {
-	b.jumps_jt[b.filter.Len()] = jt
-	b.jumps_jf[b.filter.Len()] = jf
+	b.jumps_jt[len(b.insns)] = jt
+	b.jumps_jf[len(b.insns)] = jf
 
 	code := Code(uint16(s) | uint16(0x10) | JMP)
-	b.filter.append_insn(code, 0, 0, cmp)
+	b.append_insn(code, cmp)
 	return b
 }
 
@@ -245,11 +381,11 @@ func (b *Builder) JEQ(s Src, jt, jf string, cmp uint32) *Builder {
 // if the accumulator value is greater than cmp (if s is Const) or the index
 // register (if s is Index), otherwise jumps to jf.
 func (b *Builder) JGT(s Src, jt, jf string, cmp uint32) *Builder {
-	b.jumps_jt[b.filter.Len()] = jt
-	b.jumps_jf[b.filter.Len()] = jf
+	b.jumps_jt[len(b.insns)] = jt
+	b.jumps_jf[len(b.insns)] = jf
 
 	code := Code(uint16(s) | uint16(0x20) | JMP)
-	b.filter.append_insn(code, 0, 0, cmp)
+	b.append_insn(code, cmp)
 	return b
 }
 
@@ -257,31 +393,55 @@ func (b *Builder) JGT(s Src, jt, jf string, cmp uint32) *Builder {
 // if the accumulator value is greater than or equals cmp (if s is Const) or the
 // index register (if s is Index), otherwise jumps to jf.
 func (b *Builder) JGE(s Src, jt, jf string, cmp uint32) *Builder {
-	b.jumps_jt[b.filter.Len()] = jt
-	b.jumps_jf[b.filter.Len()] = jf
+	b.jumps_jt[len(b.insns)] = jt
+	b.jumps_jf[len(b.insns)] = jf
 
 	code := Code(uint16(s) | uint16(0x30) | JMP)
-	b.filter.append_insn(code, 0, 0, cmp)
+	b.append_insn(code, cmp)
 	return b
 }
 
 // Append a JSET instruction to the filter.
 func (b *Builder) JSET(s Src, jt, jf string, cmp uint32) *Builder {
-	b.jumps_jt[b.filter.Len()] = jt
-	b.jumps_jf[b.filter.Len()] = jf
+	b.jumps_jt[len(b.insns)] = jt
+	b.jumps_jf[len(b.insns)] = jf
 
 	code := Code(uint16(s) | uint16(0x40) | JMP)
-	b.filter.append_insn(code, 0, 0, cmp)
+	b.append_insn(code, cmp)
 	return b
 }
 
+// Append a JNE pseudo-instruction to the filter, which performs a jump to the
+// jt label if the accumulator value doesn't equal cmp (if s is Const) or the
+// index register (if s is Index), otherwise jumps to jf. This is a JEQ
+// instruction with the jump targets swapped.
+func (b *Builder) JNE(s Src, jt, jf string, cmp uint32) *Builder {
+	return b.JEQ(s, jf, jt, cmp)
+}
+
+// Append a JLT pseudo-instruction to the filter, which performs a jump to the
+// jt label if the accumulator value is less than cmp (if s is Const) or the
+// index register (if s is Index), otherwise jumps to jf. This is a JGE
+// instruction with the jump targets swapped.
+func (b *Builder) JLT(s Src, jt, jf string, cmp uint32) *Builder {
+	return b.JGE(s, jf, jt, cmp)
+}
+
+// Append a JLE pseudo-instruction to the filter, which performs a jump to the
+// jt label if the accumulator value is less than or equals cmp (if s is Const)
+// or the index register (if s is Index), otherwise jumps to jf. This is a JGT
+// instruction with the jump targets swapped.
+func (b *Builder) JLE(s Src, jt, jf string, cmp uint32) *Builder {
+	return b.JGT(s, jf, jt, cmp)
+}
+
 // Append a RET instruction to the filter, which terminates the filter program
 // and specifies the amount of the packet to accept. s represents the source
 // operand type and can be either Const (which returns the supplied value) or
 // Acc (which returns the accumulator value).
 func (b *Builder) RET(s Src, bytes uint32) *Builder {
 	code := Code(uint16(s) | RET)
-	b.filter.append_insn(code, 0, 0, bytes)
+	b.append_insn(code, bytes)
 	return b
 }
 
@@ -289,7 +449,7 @@ func (b *Builder) RET(s Src, bytes uint32) *Builder {
 // into the index register.
 func (b *Builder) TAX() *Builder {
 	code := Code(uint16(0x00) | MISC)
-	b.filter.append_insn(code, 0, 0, 0)
+	b.append_insn(code, 0)
 	return b
 }
 
@@ -297,6 +457,6 @@ func (b *Builder) TAX() *Builder {
 // value into the accumulator.
 func (b *Builder) TXA() *Builder {
 	code := Code(uint16(0x80) | MISC)
-	b.filter.append_insn(code, 0, 0, 0)
+	b.append_insn(code, 0)
 	return b
 }
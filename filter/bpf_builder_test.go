@@ -38,7 +38,11 @@ import "github.com/ghedo/go.pkt/filter"
 func TestEmpty(t *testing.T) {
 	bld := filter.NewBuilder()
 
-	flt := bld.Build()
+	flt, err := bld.Build()
+	if err != nil {
+		t.Fatalf("Error building: %s", err)
+	}
+
 	if flt.Len() != 0 {
 		t.Fatalf("Len mismatch: %d", flt.Len())
 	}
@@ -51,13 +55,16 @@ var test_arp = `{ 0x28,   0,   0, 0x0000000c },
 { 0x06,   0,   0, 0x00000000 },`
 
 func TestARP(t *testing.T) {
-	arp := filter.NewBuilder().
+	arp, err := filter.NewBuilder().
 		LD(filter.Half, filter.ABS, 12).
 		JEQ(filter.Const, "", "fail", 0x806).
 		RET(filter.Const, 0x40000).
 		Label("fail").
 		RET(filter.Const, 0x0).
 		Build()
+	if err != nil {
+		t.Fatalf("Error building: %s", err)
+	}
 
 	if arp.String() != test_arp {
 		t.Fatalf("Program mismatch: %s", arp.String())
@@ -80,7 +87,7 @@ var test_dns = `{ 0x00,   0,   0, 0x00000014 },
 { 0x06,   0,   0, 0x00000000 },`
 
 func TestDNS(t *testing.T) {
-	dns := filter.NewBuilder().
+	dns, err := filter.NewBuilder().
 		LD(filter.Word, filter.IMM, 20).
 		LDX(filter.Byte, filter.MSH, 0).
 		ADD(filter.Index, 0).
@@ -98,24 +105,167 @@ func TestDNS(t *testing.T) {
 		Label("lb_1").
 		RET(filter.Const, 0).
 		Build()
-
+	if err != nil {
+		t.Fatalf("Error building: %s", err)
+	}
 
 	if dns.String() != test_dns {
 		t.Fatalf("Program mismatch: %s", dns.String())
 	}
 }
 
+/* AND and OR used to emit each other's opcode */
+func TestBuildALUOps(t *testing.T) {
+	flt, err := filter.NewBuilder().
+		LD(filter.Word, filter.IMM, 0xf0).
+		AND(filter.Const, 0x3c).
+		OR(filter.Const, 0x01).
+		RET(filter.Acc, 0).
+		Build()
+	if err != nil {
+		t.Fatalf("Error building: %s", err)
+	}
+
+	insns := flt.Insns()
+	if insns[1].Code != 0x54 || insns[2].Code != 0x44 {
+		t.Fatalf("Opcode mismatch: %s", flt)
+	}
+
+	if flt.Filter(nil) != 0x31 {
+		t.Fatalf("Result mismatch: %#x", flt.Filter(nil))
+	}
+}
+
 func ExampleBuilder() {
 	// Build a filter to match ARP packets on top of Ethernet
-	flt := filter.NewBuilder().
+	flt, err := filter.NewBuilder().
 		LD(filter.Half, filter.ABS, 12).
 		JEQ(filter.Const, "", "fail", 0x806).
 		RET(filter.Const, 0x40000).
 		Label("fail").
 		RET(filter.Const, 0x0).
 		Build()
+	if err != nil {
+		log.Fatalf("Error building filter: %s", err)
+	}
 
 	if flt.Match([]byte("random data")) {
 		log.Println("MATCH!!!")
 	}
 }
+
+func TestBuildError(t *testing.T) {
+	tests := []struct {
+		bld *filter.Builder
+		err string
+	}{
+		{
+			filter.NewBuilder().
+				JEQ(filter.Const, "", "nowhere", 1).
+				RET(filter.Const, 0),
+			"Undefined label 'nowhere'",
+		},
+		{
+			filter.NewBuilder().
+				Label("start").
+				LD(filter.Word, filter.LEN, 0).
+				JA("start").
+				RET(filter.Const, 0),
+			"Backward jump to label 'start'",
+		},
+		{
+			filter.NewBuilder().
+				LD(filter.Word, filter.LEN, 0).
+				JGT(filter.Const, "", "end", 10).
+				RET(filter.Const, 0).
+				Label("end"),
+			"Jump past the end of the program",
+		},
+	}
+
+	for _, test := range tests {
+		_, err := test.bld.Build()
+		if err == nil || err.Error() != test.err {
+			t.Fatalf("Error mismatch: %v (expected %s)", err, test.err)
+		}
+	}
+}
+
+func TestBuildLongJump(t *testing.T) {
+	bld := filter.NewBuilder().
+		LD(filter.Half, filter.ABS, 12).
+		JEQ(filter.Const, "arp", "other", 0x806).
+		Label("other").
+		JGE(filter.Const, "", "far", 0x800)
+
+	for i := 0; i < 300; i++ {
+		bld.LD(filter.Word, filter.IMM, uint32(i))
+	}
+
+	flt, err := bld.
+		Label("arp").
+		RET(filter.Const, 0x40000).
+		Label("far").
+		RET(filter.Const, 1).
+		Build()
+	if err != nil {
+		t.Fatalf("Error building: %s", err)
+	}
+	defer flt.Cleanup()
+
+	/* one trampoline for the jt of the JEQ and one for the jf of the JGE */
+	if flt.Len() != 307 {
+		t.Fatalf("Len mismatch: %d", flt.Len())
+	}
+
+	if !flt.Validate() {
+		t.Fatalf("Invalid filter")
+	}
+
+	if flt.Filter(test_eth_arp) != 0x40000 {
+		t.Fatalf("Far jt not taken")
+	}
+
+	buf := append([]byte{}, test_eth_arp...)
+	buf[12], buf[13] = 0x00, 0x01
+
+	if flt.Filter(buf) != 1 {
+		t.Fatalf("Far jf not taken")
+	}
+
+	buf[12], buf[13] = 0x86, 0xdd
+
+	if flt.Filter(buf) != 0x40000 {
+		t.Fatalf("Fall through mismatch")
+	}
+}
+
+func TestBuildExtensions(t *testing.T) {
+	flt, err := filter.NewBuilder().
+		LD(filter.Word, filter.IMM, 1234).
+		MOD(filter.Const, 1000).
+		XOR(filter.Const, 0xff).
+		JNE(filter.Const, "fail", "", 234 ^ 0xff).
+		LDX(filter.Word, filter.IMM, 10).
+		JLT(filter.Index, "fail", "", 0).
+		JLE(filter.Index, "fail", "", 0).
+		LDEXT(filter.ExtProto).
+		RET(filter.Acc, 0).
+		Label("fail").
+		RET(filter.Const, 0).
+		Build()
+	if err != nil {
+		t.Fatalf("Error building: %s", err)
+	}
+	defer flt.Cleanup()
+
+	if !flt.Validate() {
+		t.Fatalf("Invalid filter")
+	}
+
+	ctx := &filter.Context{ Proto: 0x0806 }
+
+	if v := flt.Run(test_eth_arp, ctx); v != 0x0806 {
+		t.Fatalf("Result mismatch: %d", v)
+	}
+}
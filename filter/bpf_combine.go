@@ -0,0 +1,250 @@
+/*
+ * Network packet analysis framework.
+ *
+ * Copyright (c) 2014, Alessandro Ghedini
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are
+ * met:
+ *
+ *     * Redistributions of source code must retain the above copyright
+ *       notice, this list of conditions and the following disclaimer.
+ *
+ *     * Redistributions in binary form must reproduce the above copyright
+ *       notice, this list of conditions and the following disclaimer in the
+ *       documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS
+ * IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO,
+ * THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR
+ * PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR
+ * CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+ * EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+ * PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+ * PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF
+ * LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+ * NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+ * SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package filter
+
+import "fmt"
+
+// Combine the given filters into a new one that matches the packets that are
+// matched by both a and b. The new filter returns the result of b, unless a
+// rejects the packet, in which case b is not run at all.
+func And(a, b *Filter) (*Filter, error) {
+	return combine(a, b, true)
+}
+
+// Combine the given filters into a new one that matches the packets that are
+// matched by either a or b. The new filter returns the result of a if it
+// accepts the packet, otherwise it runs b and returns its result.
+//
+// Note that BPF aborts the whole program, rejecting the packet, when a load is
+// out of the packet's bounds. So if a does that, b is not run at all (libpcap
+// combines filter expressions the same way).
+func Or(a, b *Filter) (*Filter, error) {
+	return combine(a, b, false)
+}
+
+// Create a new filter that matches the packets that are not matched by the
+// given one. Matching packets are accepted whole (like the filters generated
+// by Compile() do).
+//
+// Note that BPF aborts the whole program, rejecting the packet, when a load is
+// out of the packet's bounds. So packets that make a abort this way are
+// rejected by the new filter as well (like libpcap does for "not" expressions).
+func Not(a *Filter) (*Filter, error) {
+	if !a.Validate() || a.Len() == 0 {
+		return nil, fmt.Errorf("Invalid filter")
+	}
+
+	prog := opt_decode(a.insns())
+	bld  := NewBuilder()
+
+	ret_a := false
+
+	for pc := range prog {
+		insn := &prog[pc]
+
+		bld.Label(fmt.Sprintf("a%d", pc))
+
+		switch insn.code {
+		case uint16(RET) | uint16(Const):
+			if insn.k == 0 {
+				bld.RET(Const, snap_len)
+			} else {
+				bld.RET(Const, 0)
+			}
+
+		case uint16(RET) | uint16(Acc):
+			bld.JEQ(Const, "accept", "reject", 0)
+			ret_a = true
+
+		default:
+			opt_emit(bld, insn, fmt.Sprintf("a%d", insn.jt),
+			         fmt.Sprintf("a%d", insn.jf))
+		}
+	}
+
+	if ret_a {
+		bld.Label("accept").RET(Const, snap_len)
+		bld.Label("reject").RET(Const, 0)
+	}
+
+	return bld.Build()
+}
+
+/*
+ * Append b to a, replacing the RET instructions of a with jumps to the start
+ * of b when a accepts (for and) or rejects (for or) the packet.
+ */
+func combine(a, b *Filter, and bool) (*Filter, error) {
+	if !a.Validate() || a.Len() == 0 || !b.Validate() || b.Len() == 0 {
+		return nil, fmt.Errorf("Invalid filter")
+	}
+
+	prog_a := opt_decode(a.insns())
+	prog_b := opt_decode(b.insns())
+
+	mem, err := relocate_mem(prog_a, prog_b)
+	if err != nil {
+		return nil, err
+	}
+
+	bld := NewBuilder()
+
+	ret_a  := false
+	reject := false
+
+	for pc := range prog_a {
+		insn := &prog_a[pc]
+
+		bld.Label(fmt.Sprintf("a%d", pc))
+
+		switch insn.code {
+		case uint16(RET) | uint16(Const):
+			if (insn.k != 0) == and {
+				bld.JA("b")
+			} else {
+				bld.RET(Const, insn.k)
+			}
+
+		case uint16(RET) | uint16(Acc):
+			if and {
+				bld.JEQ(Const, "reject", "b", 0)
+				reject = true
+			} else {
+				bld.JEQ(Const, "b", "ret_a", 0)
+				ret_a = true
+			}
+
+		default:
+			opt_emit(bld, insn, fmt.Sprintf("a%d", insn.jt),
+			         fmt.Sprintf("a%d", insn.jf))
+		}
+	}
+
+	if ret_a {
+		bld.Label("ret_a").RET(Acc, 0)
+	}
+
+	if reject {
+		bld.Label("reject").RET(Const, 0)
+	}
+
+	bld.Label("b")
+
+	/* the registers are expected to be zero at the start of a filter */
+	live, _ := opt_live(prog_b, false)
+
+	if live[0] & (1 << reg_a) != 0 {
+		bld.LD(Word, IMM, 0)
+	}
+
+	if live[0] & (1 << reg_x) != 0 {
+		bld.LDX(Word, IMM, 0)
+	}
+
+	for pc := range prog_b {
+		insn := prog_b[pc]
+
+		bld.Label(fmt.Sprintf("b%d", pc))
+
+		if uses_mem(&insn) {
+			insn.k = mem[insn.k]
+		}
+
+		opt_emit(bld, &insn, fmt.Sprintf("b%d", insn.jt),
+		         fmt.Sprintf("b%d", insn.jf))
+	}
+
+	return bld.Build()
+}
+
+/*
+ * Return the mapping of the scratch memory locations of b. Locations read by b
+ * before being written to are expected to be zero, so they are moved to ones
+ * that are not used by a (if any were written by a).
+ */
+func relocate_mem(prog_a, prog_b []opt_insn) ([mem_words]uint32, error) {
+	var mem [mem_words]uint32
+
+	for i := range mem {
+		mem[i] = uint32(i)
+	}
+
+	used_a := mem_slots(prog_a)
+	used_b := mem_slots(prog_b)
+
+	live, _ := opt_live(prog_b, false)
+
+	clash := (live[0] >> reg_mem) & used_a
+	taken := used_a | used_b
+
+	for i := uint32(0); i < mem_words; i++ {
+		if clash & (1 << i) == 0 {
+			continue
+		}
+
+		j := uint32(0)
+		for j < mem_words && taken & (1 << j) != 0 {
+			j++
+		}
+
+		if j == mem_words {
+			return mem, fmt.Errorf("Too many scratch memory locations")
+		}
+
+		mem[i]  = j
+		taken  |= 1 << j
+	}
+
+	return mem, nil
+}
+
+/* Return the scratch memory locations used by prog, as a bit mask. */
+func mem_slots(prog []opt_insn) uint32 {
+	var slots uint32
+
+	for pc := range prog {
+		if uses_mem(&prog[pc]) {
+			slots |= 1 << prog[pc].k
+		}
+	}
+
+	return slots
+}
+
+func uses_mem(insn *opt_insn) bool {
+	switch insn.code {
+	case uint16(ST), uint16(STX),
+	     uint16(LD) | uint16(MEM), uint16(LDX) | uint16(MEM):
+		return true
+	}
+
+	return false
+}
@@ -0,0 +1,262 @@
+/*
+ * Network packet analysis framework.
+ *
+ * Copyright (c) 2014, Alessandro Ghedini
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are
+ * met:
+ *
+ *     * Redistributions of source code must retain the above copyright
+ *       notice, this list of conditions and the following disclaimer.
+ *
+ *     * Redistributions in binary form must reproduce the above copyright
+ *       notice, this list of conditions and the following disclaimer in the
+ *       documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS
+ * IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO,
+ * THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR
+ * PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR
+ * CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+ * EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+ * PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+ * PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF
+ * LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+ * NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+ * SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package filter_test
+
+import "fmt"
+import "testing"
+
+import "github.com/ghedo/go.pkt/filter"
+import "github.com/ghedo/go.pkt/packet"
+
+func compile(t *testing.T, expr string) *filter.Filter {
+	flt, err := filter.Compile(expr, packet.Eth, false)
+	if err != nil {
+		t.Fatalf("Error compiling '%s': %s", expr, err)
+	}
+
+	return flt
+}
+
+func assemble(t *testing.T, src string) *filter.Filter {
+	flt, err := filter.Assemble(src)
+	if err != nil {
+		t.Fatalf("Error assembling: %s", err)
+	}
+
+	return flt
+}
+
+var combine_bufs = [][]byte{
+	test_eth_arp, test_eth_ipv4_udp, test_eth_ipv4_icmp, test_eth_ipv6_udp,
+}
+
+func TestCombine(t *testing.T) {
+	exprs := []string{ "arp", "ip", "udp", "icmp", "ip6", "udp port 8338" }
+
+	for _, a_expr := range exprs {
+		for _, b_expr := range exprs {
+			a := compile(t, a_expr)
+			b := compile(t, b_expr)
+
+			and, err := filter.And(a, b)
+			if err != nil {
+				t.Fatalf("Error combining: %s", err)
+			}
+
+			or, err := filter.Or(a, b)
+			if err != nil {
+				t.Fatalf("Error combining: %s", err)
+			}
+
+			not, err := filter.Not(a)
+			if err != nil {
+				t.Fatalf("Error combining: %s", err)
+			}
+
+			for _, flt := range []*filter.Filter{ and, or, not } {
+				if err := flt.Verify(); err != nil {
+					t.Fatalf("Invalid filter: %s\n%s", err, flt)
+				}
+			}
+
+			for _, buf := range combine_bufs {
+				ma := a.Match(buf)
+				mb := b.Match(buf)
+
+				if and.Match(buf) != (ma && mb) {
+					t.Fatalf("And mismatch for '%s' '%s'",
+					         a_expr, b_expr)
+				}
+
+				if or.Match(buf) != (ma || mb) {
+					t.Fatalf("Or mismatch for '%s' '%s'",
+					         a_expr, b_expr)
+				}
+
+				if not.Match(buf) == ma {
+					t.Fatalf("Not mismatch for '%s'", a_expr)
+				}
+			}
+
+			a.Cleanup()
+			b.Cleanup()
+			and.Cleanup()
+			or.Cleanup()
+			not.Cleanup()
+		}
+	}
+}
+
+func TestCombineRetA(t *testing.T) {
+	/* accept packets longer than 50 bytes, truncated to 40 */
+	a := assemble(t, `
+		ld #len
+		jgt #50, keep, drop
+	keep:	ld #40
+		ret a
+	drop:	ld #0
+		ret a`)
+	defer a.Cleanup()
+
+	b := assemble(t, `
+		ret #64`)
+	defer b.Cleanup()
+
+	tests := []struct {
+		comb  func() (*filter.Filter, error)
+		long  uint
+		short uint
+	}{
+		{ func() (*filter.Filter, error) { return filter.And(a, b) }, 64, 0 },
+		{ func() (*filter.Filter, error) { return filter.Or(a, b) }, 40, 64 },
+		{ func() (*filter.Filter, error) { return filter.Or(b, a) }, 64, 64 },
+		{ func() (*filter.Filter, error) { return filter.Not(a) }, 0, 0x40000 },
+	}
+
+	for _, test := range tests {
+		flt, err := test.comb()
+		if err != nil {
+			t.Fatalf("Error combining: %s", err)
+		}
+
+		if !flt.Validate() {
+			t.Fatalf("Invalid filter:\n%s", flt)
+		}
+
+		if v := flt.Filter(test_eth_ipv6_udp); v != test.long {
+			t.Fatalf("Result mismatch: %d (expected %d)", v, test.long)
+		}
+
+		if v := flt.Filter(test_eth_arp[:42]); v != test.short {
+			t.Fatalf("Result mismatch: %d (expected %d)", v, test.short)
+		}
+
+		flt.Cleanup()
+	}
+}
+
+func TestCombineShort(t *testing.T) {
+	/* loading past the end of short packets aborts the program */
+	a := assemble(t, `
+		ld [30]
+		jeq #0, ok, ok
+	ok:	ret #0`)
+	defer a.Cleanup()
+
+	b := assemble(t, `
+		ret #64`)
+	defer b.Cleanup()
+
+	or, err := filter.Or(a, b)
+	if err != nil {
+		t.Fatalf("Error combining: %s", err)
+	}
+	defer or.Cleanup()
+
+	not, err := filter.Not(a)
+	if err != nil {
+		t.Fatalf("Error combining: %s", err)
+	}
+	defer not.Cleanup()
+
+	for _, flt := range []*filter.Filter{ or, not } {
+		if !flt.Match(test_eth_arp) {
+			t.Fatalf("Long packet rejected:\n%s", flt)
+		}
+
+		if flt.Match(test_eth_arp[:20]) {
+			t.Fatalf("Short packet accepted:\n%s", flt)
+		}
+	}
+}
+
+func TestCombineMemory(t *testing.T) {
+	/* a uses M[0] and M[1], b expects M[1] to be zero */
+	a := assemble(t, `
+		ld #len
+		st M[0]
+		st M[1]
+		ret #1`)
+	defer a.Cleanup()
+
+	b := assemble(t, `
+		ld M[1]
+		add x
+		jeq #0, ok, fail
+	ok:	ret #1
+	fail:	ret #0`)
+	defer b.Cleanup()
+
+	flt, err := filter.And(a, b)
+	if err != nil {
+		t.Fatalf("Error combining: %s", err)
+	}
+	defer flt.Cleanup()
+
+	if !flt.Validate() {
+		t.Fatalf("Invalid filter:\n%s", flt)
+	}
+
+	if !flt.Match(test_eth_arp) {
+		t.Fatalf("Scratch memory not relocated:\n%s", flt)
+	}
+}
+
+func TestCombineError(t *testing.T) {
+	a := compile(t, "arp")
+	defer a.Cleanup()
+
+	empty, _ := filter.NewBuilder().Build()
+	defer empty.Cleanup()
+
+	if _, err := filter.And(a, empty); err == nil {
+		t.Fatalf("Error expected")
+	}
+
+	if _, err := filter.Not(empty); err == nil {
+		t.Fatalf("Error expected")
+	}
+
+	src := "ld #len\n"
+	for i := 0; i < 16; i++ {
+		src += fmt.Sprintf("st M[%d]\n", i)
+	}
+
+	full := assemble(t, src + "ret #1")
+	defer full.Cleanup()
+
+	b := assemble(t, "ld M[0]\nret a")
+	defer b.Cleanup()
+
+	if _, err := filter.And(full, b); err == nil {
+		t.Fatalf("Error expected")
+	}
+}
@@ -0,0 +1,294 @@
+/*
+ * Network packet analysis framework.
+ *
+ * Copyright (c) 2014, Alessandro Ghedini
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are
+ * met:
+ *
+ *     * Redistributions of source code must retain the above copyright
+ *       notice, this list of conditions and the following disclaimer.
+ *
+ *     * Redistributions in binary form must reproduce the above copyright
+ *       notice, this list of conditions and the following disclaimer in the
+ *       documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS
+ * IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO,
+ * THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR
+ * PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR
+ * CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+ * EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+ * PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+ * PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF
+ * LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+ * NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+ * SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package filter
+
+import "fmt"
+import "strings"
+
+// Output format of the disassembler.
+type Format int
+
+const (
+	Mnemonic Format = iota /* like tcpdump -d */
+	CArray                 /* like tcpdump -dd */
+	Decimal                /* like tcpdump -ddd */
+	Assembly               /* bpf_asm syntax */
+)
+
+var ext_names = map[uint32]string{
+	ExtProto:       "proto",
+	ExtType:        "type",
+	ExtIfIndex:     "ifidx",
+	ExtNLAttr:      "nla",
+	ExtNLAttrNest:  "nlan",
+	ExtMark:        "mark",
+	ExtQueue:       "queue",
+	ExtHaType:      "hatype",
+	ExtRxHash:      "rxhash",
+	ExtCPU:         "cpu",
+	ExtVlanTag:     "vlan_tci",
+	ExtVlanPresent: "vlan_pr",
+	ExtPayOffset:   "poff",
+	ExtRandom:      "rand",
+	ExtVlanTPID:    "vlan_tpid",
+}
+
+var alu_names = map[uint16]string{
+	bpf_add: "add",
+	bpf_sub: "sub",
+	bpf_mul: "mul",
+	bpf_div: "div",
+	bpf_or:  "or",
+	bpf_and: "and",
+	bpf_lsh: "lsh",
+	bpf_rsh: "rsh",
+	bpf_mod: "mod",
+	bpf_xor: "xor",
+}
+
+var jmp_names = map[uint16]string{
+	bpf_jeq:  "jeq",
+	bpf_jgt:  "jgt",
+	bpf_jge:  "jge",
+	bpf_jset: "jset",
+}
+
+// Disassemble the filter in the given format. The Mnemonic, CArray and Decimal
+// formats are the same used by tcpdump's -d, -dd and -ddd options, while the
+// Assembly format uses the bpf_asm syntax with labels as jump targets. Both the
+// Mnemonic and Assembly output can be parsed back by Assemble(). Loads of the
+// Linux ancillary fields use their bpf_asm names (e.g. "ld #proto").
+func (f *Filter) Disassemble(format Format) string {
+	insns := f.insns()
+
+	var lines []string
+
+	switch format {
+	case CArray:
+		for _, insn := range insns {
+			lines = append(lines, fmt.Sprintf(
+				"{ 0x%x, %d, %d, 0x%08x },",
+				insn.code, insn.jt, insn.jf, insn.k,
+			))
+		}
+
+	case Decimal:
+		lines = append(lines, fmt.Sprintf("%d", len(insns)))
+
+		for _, insn := range insns {
+			lines = append(lines, fmt.Sprintf(
+				"%d %d %d %d", insn.code, insn.jt, insn.jf, insn.k,
+			))
+		}
+
+	case Assembly:
+		targets := make(map[int]bool)
+
+		for pc := range insns {
+			insn := &insns[pc]
+
+			if insn.code & 0x07 != uint16(JMP) {
+				continue
+			}
+
+			if insn.code == uint16(JMP) | bpf_ja {
+				targets[pc + 1 + int(insn.k)] = true
+			} else {
+				targets[pc + 1 + int(insn.jt)] = true
+				targets[pc + 1 + int(insn.jf)] = true
+			}
+		}
+
+		for pc := range insns {
+			line := "\t" + disasm_insn(&insns[pc], pc, format)
+
+			if targets[pc] {
+				line = fmt.Sprintf("l%d:", pc) + line
+			}
+
+			lines = append(lines, line)
+		}
+
+	default:
+		for pc := range insns {
+			lines = append(lines, fmt.Sprintf(
+				"(%03d) %s", pc, disasm_insn(&insns[pc], pc, format),
+			))
+		}
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+func disasm_insn(insn *bpf_insn, pc int, format Format) string {
+	op, operand := disasm_op(insn, format)
+
+	class := insn.code & 0x07
+	jop   := insn.code & 0xf0
+
+	if class == uint16(JMP) && jop == bpf_ja {
+		target := pc + 1 + int(insn.k)
+
+		if format == Assembly {
+			return fmt.Sprintf("%-8s l%d", op, target)
+		}
+
+		return fmt.Sprintf("%-8s %d", op, target)
+	}
+
+	if class == uint16(JMP) {
+		jt := pc + 1 + int(insn.jt)
+		jf := pc + 1 + int(insn.jf)
+
+		if format == Assembly {
+			return fmt.Sprintf("%-8s %s, l%d, l%d", op, operand, jt, jf)
+		}
+
+		return fmt.Sprintf("%-8s %-16s jt %d\tjf %d", op, operand, jt, jf)
+	}
+
+	if operand == "" {
+		return op
+	}
+
+	return fmt.Sprintf("%-8s %s", op, operand)
+}
+
+func disasm_op(insn *bpf_insn, format Format) (string, string) {
+	k := insn.k
+
+	len_name := "#pktlen"
+	if format == Assembly {
+		len_name = "#len"
+	}
+
+	switch insn.code {
+	case uint16(RET) | uint16(Const):
+		return "ret", fmt.Sprintf("#%d", k)
+
+	case uint16(RET) | uint16(Acc):
+		return "ret", "a"
+
+	case uint16(RET) | uint16(Index):
+		return "ret", "x"
+
+	case uint16(LD) | uint16(Word) | uint16(ABS):
+		if name, ok := ext_names[k]; ok {
+			return "ld", "#" + name
+		}
+
+		return "ld", fmt.Sprintf("[%d]", k)
+
+	case uint16(LD) | uint16(Half) | uint16(ABS):
+		return "ldh", fmt.Sprintf("[%d]", k)
+
+	case uint16(LD) | uint16(Byte) | uint16(ABS):
+		return "ldb", fmt.Sprintf("[%d]", k)
+
+	case uint16(LD) | uint16(Word) | uint16(LEN):
+		return "ld", len_name
+
+	case uint16(LD) | uint16(Word) | uint16(IND):
+		return "ld", fmt.Sprintf("[x + %d]", k)
+
+	case uint16(LD) | uint16(Half) | uint16(IND):
+		return "ldh", fmt.Sprintf("[x + %d]", k)
+
+	case uint16(LD) | uint16(Byte) | uint16(IND):
+		return "ldb", fmt.Sprintf("[x + %d]", k)
+
+	case uint16(LD) | uint16(IMM):
+		return "ld", fmt.Sprintf("#0x%x", k)
+
+	case uint16(LDX) | uint16(IMM):
+		return "ldx", fmt.Sprintf("#0x%x", k)
+
+	case uint16(LDX) | uint16(Byte) | uint16(MSH):
+		return "ldxb", fmt.Sprintf("4*([%d]&0xf)", k)
+
+	case uint16(LD) | uint16(MEM):
+		return "ld", fmt.Sprintf("M[%d]", k)
+
+	case uint16(LDX) | uint16(MEM):
+		return "ldx", fmt.Sprintf("M[%d]", k)
+
+	case uint16(LDX) | uint16(Word) | uint16(LEN):
+		return "ldx", len_name
+
+	case uint16(ST):
+		return "st", fmt.Sprintf("M[%d]", k)
+
+	case uint16(STX):
+		return "stx", fmt.Sprintf("M[%d]", k)
+
+	case uint16(JMP) | bpf_ja:
+		return "ja", ""
+
+	case uint16(ALU) | bpf_neg:
+		return "neg", ""
+
+	case uint16(MISC) | bpf_tax:
+		return "tax", ""
+
+	case uint16(MISC) | bpf_txa:
+		return "txa", ""
+	}
+
+	operand := fmt.Sprintf("#%d", k)
+	if insn.code & uint16(Index) != 0 {
+		operand = "x"
+	}
+
+	switch insn.code & 0x07 {
+	case uint16(ALU):
+		/* like tcpdump, the bitwise operands are printed in hex */
+		switch insn.code {
+		case uint16(ALU) | bpf_and, uint16(ALU) | bpf_or,
+		     uint16(ALU) | bpf_xor:
+			operand = fmt.Sprintf("#0x%x", k)
+		}
+
+		if name, ok := alu_names[insn.code & 0xf0]; ok {
+			return name, operand
+		}
+
+	case uint16(JMP):
+		if insn.code & uint16(Index) == 0 {
+			operand = fmt.Sprintf("#0x%x", k)
+		}
+
+		if name, ok := jmp_names[insn.code & 0xf0]; ok {
+			return name, operand
+		}
+	}
+
+	return "unimp", fmt.Sprintf("0x%x", insn.code)
+}
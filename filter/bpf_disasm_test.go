@@ -0,0 +1,146 @@
+/*
+ * Network packet analysis framework.
+ *
+ * Copyright (c) 2014, Alessandro Ghedini
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are
+ * met:
+ *
+ *     * Redistributions of source code must retain the above copyright
+ *       notice, this list of conditions and the following disclaimer.
+ *
+ *     * Redistributions in binary form must reproduce the above copyright
+ *       notice, this list of conditions and the following disclaimer in the
+ *       documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS
+ * IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO,
+ * THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR
+ * PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR
+ * CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+ * EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+ * PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+ * PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF
+ * LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+ * NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+ * SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package filter_test
+
+import "testing"
+
+import "github.com/ghedo/go.pkt/filter"
+
+func build_disasm(t *testing.T) *filter.Filter {
+	return must_build(t, filter.NewBuilder().
+		LD(filter.Half, filter.ABS, 12).
+		JEQ(filter.Const, "", "fail", 0x800).
+		LDX(filter.Byte, filter.MSH, 14).
+		LD(filter.Half, filter.IND, 16).
+		JSET(filter.Const, "fail", "", 0x1fff).
+		LD(filter.Word, filter.ABS, filter.ExtProto).
+		ST(1).
+		ADD(filter.Index, 0).
+		LD(filter.Word, filter.LEN, 0).
+		RET(filter.Const, 0x40000).
+		Label("fail").
+		RET(filter.Const, 0x0))
+}
+
+var test_disasm_mnemonic = `(000) ldh      [12]
+(001) jeq      #0x800           jt 2	jf 10
+(002) ldxb     4*([14]&0xf)
+(003) ldh      [x + 16]
+(004) jset     #0x1fff          jt 10	jf 5
+(005) ld       #proto
+(006) st       M[1]
+(007) add      x
+(008) ld       #pktlen
+(009) ret      #262144
+(010) ret      #0`
+
+var test_disasm_carray = `{ 0x28, 0, 0, 0x0000000c },
+{ 0x15, 0, 8, 0x00000800 },
+{ 0xb1, 0, 0, 0x0000000e },
+{ 0x48, 0, 0, 0x00000010 },
+{ 0x45, 5, 0, 0x00001fff },
+{ 0x20, 0, 0, 0xfffff000 },
+{ 0x2, 0, 0, 0x00000001 },
+{ 0xc, 0, 0, 0x00000000 },
+{ 0x80, 0, 0, 0x00000000 },
+{ 0x6, 0, 0, 0x00040000 },
+{ 0x6, 0, 0, 0x00000000 },`
+
+var test_disasm_decimal = `11
+40 0 0 12
+21 0 8 2048
+177 0 0 14
+72 0 0 16
+69 5 0 8191
+32 0 0 4294963200
+2 0 0 1
+12 0 0 0
+128 0 0 0
+6 0 0 262144
+6 0 0 0`
+
+var test_disasm_assembly = `	ldh      [12]
+	jeq      #0x800, l2, l10
+l2:	ldxb     4*([14]&0xf)
+	ldh      [x + 16]
+	jset     #0x1fff, l10, l5
+l5:	ld       #proto
+	st       M[1]
+	add      x
+	ld       #len
+	ret      #262144
+l10:	ret      #0`
+
+func TestDisassemble(t *testing.T) {
+	flt := build_disasm(t)
+	defer flt.Cleanup()
+
+	tests := []struct {
+		format filter.Format
+		out    string
+	}{
+		{ filter.Mnemonic, test_disasm_mnemonic },
+		{ filter.CArray,   test_disasm_carray   },
+		{ filter.Decimal,  test_disasm_decimal  },
+		{ filter.Assembly, test_disasm_assembly },
+	}
+
+	for _, test := range tests {
+		out := flt.Disassemble(test.format)
+		if out != test.out {
+			t.Fatalf("Disassembly mismatch:\n%s\nexpected:\n%s", out, test.out)
+		}
+	}
+}
+
+var test_disasm_alu = `(000) ldx      #0x2a
+(001) ld       #0xf0
+(002) and      #0xff
+(003) or       #0x100
+(004) xor      #0x1
+(005) lsh      #4
+(006) ret      x`
+
+func TestDisassembleALU(t *testing.T) {
+	flt, err := filter.Assemble(test_disasm_alu)
+	if err != nil {
+		t.Fatalf("Error assembling: %s", err)
+	}
+
+	out := flt.Disassemble(filter.Mnemonic)
+	if out != test_disasm_alu {
+		t.Fatalf("Disassembly mismatch:\n%s\nexpected:\n%s", out, test_disasm_alu)
+	}
+
+	if flt.Run(nil, nil) != 0x2a {
+		t.Fatalf("Result mismatch: %d", flt.Run(nil, nil))
+	}
+}
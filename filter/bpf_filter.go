@@ -34,17 +34,29 @@
 // capture package) or directly run against binary data.
 package filter
 
-// #include <stdlib.h>
-// #include "bpf_filter.h"
-import "C"
-
 import "fmt"
 import "strings"
 import "syscall"
-import "unsafe"
 
 type Filter struct {
-	program C.struct_bpf_program
+	prog []bpf_insn
+}
+
+// A single BPF instruction. This has the same layout as struct bpf_insn (and
+// struct sock_filter on Linux).
+type Insn struct {
+	Code uint16
+	Jt   uint8
+	Jf   uint8
+	K    uint32
+}
+
+/* same layout as struct bpf_insn */
+type bpf_insn struct {
+	code uint16
+	jt   uint8
+	jf   uint8
+	k    uint32
 }
 
 type Code uint16
@@ -89,66 +101,57 @@ const (
 
 // Try to match the given buffer against the filter.
 func (f *Filter) Match(buf []byte) bool {
-	cbuf := (*C.char)(unsafe.Pointer(&buf[0]))
-	blen := C.uint(len(buf))
-
-	if C.bpf_filter(f.program.bf_insns, cbuf, blen, blen) > 0 {
-		return true
-	}
-
-	return false
+	return run(f.insns(), buf, nil, nil) > 0
 }
 
 // Run filter on the given buffer and return its result.
 func (f *Filter) Filter(buf []byte) uint {
-	cbuf := (*C.char)(unsafe.Pointer(&buf[0]))
-	blen := C.uint(len(buf))
-
-	rc := C.bpf_filter(f.program.bf_insns, cbuf, blen, blen)
-	return uint(rc)
+	return uint(run(f.insns(), buf, nil, nil))
 }
 
 // Validate the filter. The constraints are that each jump be forward and to a
 // valid code. The code must terminate with either an accept or reject.
 func (f *Filter) Validate() bool {
-	if C.bpf_validate(f.program.bf_insns, C.int(f.program.bf_len)) > 0 {
-		return true
-	}
-
-	return false
+	return validate(f.insns())
 }
 
 // Deallocate the filter.
 func (f *Filter) Cleanup() {
-	f.program.bf_len = 0
-
-	if f.program.bf_insns != nil {
-		C.free(unsafe.Pointer(f.program.bf_insns))
-		f.program.bf_insns = nil
-	}
+	f.prog = nil
 }
 
 // Return the number of instructions in the filter.
 func (f *Filter) Len() int {
-	prog := (*C.struct_bpf_program)(f.Program())
-	flen := C.bpf_get_len(prog)
-	return int(flen)
+	return len(f.prog)
 }
 
-// Return the compiled BPF program.
-func (f *Filter) Program() unsafe.Pointer {
-	return unsafe.Pointer(&f.program)
+// Create a new filter from the given BPF instructions. The instructions are
+// copied, so the slice can be reused afterwards.
+func FromInsns(insns []Insn) *Filter {
+	f := &Filter{}
+
+	for _, insn := range insns {
+		f.append_insn(Code(insn.Code), insn.Jt, insn.Jf, insn.K)
+	}
+
+	return f
 }
 
-func (f *Filter) String() string {
-	var insns []string
+// Return a copy of the filter's BPF instructions.
+func (f *Filter) Insns() []Insn {
+	insns := make([]Insn, f.Len())
+
+	for i, insn := range f.insns() {
+		insns[i] = Insn{ insn.code, insn.jt, insn.jf, insn.k }
+	}
 
-	prog := (*C.struct_bpf_program)(f.Program())
-	flen := C.bpf_get_len(prog)
+	return insns
+}
 
-	for i := C.int(0); i < flen; i++ {
-		insn := C.bpf_get_insn(prog, i)
+func (f *Filter) String() string {
+	var insns []string
 
+	for _, insn := range f.prog {
 		str := fmt.Sprintf(
 			"{ 0x%.2x, %3d, %3d, 0x%.8x },",
 			insn.code, insn.jt, insn.jf, insn.k,
@@ -160,9 +163,11 @@ func (f *Filter) String() string {
 	return strings.Join(insns, "\n")
 }
 
+/* Return the filter's instructions, without copying them. */
+func (f *Filter) insns() []bpf_insn {
+	return f.prog
+}
+
 func (f *Filter) append_insn(code Code, jt, jf uint8, k uint32) {
-	prog := (*C.struct_bpf_program)(f.Program())
-	C.bpf_append_insn(
-		prog, C.ushort(code), C.uchar(jt), C.uchar(jf), C.uint(k),
-	)
+	f.prog = append(f.prog, bpf_insn{ uint16(code), jt, jf, k })
 }
@@ -0,0 +1,425 @@
+/*
+ * Network packet analysis framework.
+ *
+ * Copyright (c) 2014, Alessandro Ghedini
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are
+ * met:
+ *
+ *     * Redistributions of source code must retain the above copyright
+ *       notice, this list of conditions and the following disclaimer.
+ *
+ *     * Redistributions in binary form must reproduce the above copyright
+ *       notice, this list of conditions and the following disclaimer in the
+ *       documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS
+ * IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO,
+ * THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR
+ * PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR
+ * CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+ * EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+ * PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+ * PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF
+ * LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+ * NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+ * SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package filter
+
+import "encoding/binary"
+import "fmt"
+
+// A filter translated into Go code (see Filter.Func()).
+type Func func(buf []byte) uint
+
+/*
+ * Each instruction is translated into a closure that executes it and then
+ * calls the closure of the next instruction (or of the jump target). Since
+ * jumps are forward only, the closures are built starting from the end of the
+ * program, so that the targets are always known.
+ */
+type func_node func(buf []byte, a, x uint32, mem *[mem_words]uint32) uint32
+
+// Translate the filter into a Go function, which gives the same results as
+// Filter() without the interpretation overhead. The filter must be valid.
+func (f *Filter) Func() (Func, error) {
+	insns := f.insns()
+
+	if len(insns) == 0 {
+		return func(buf []byte) uint { return 0xffffffff }, nil
+	}
+
+	if !validate(insns) {
+		return nil, fmt.Errorf("Invalid filter")
+	}
+
+	nodes := make([]func_node, len(insns) + 1)
+	nodes[len(insns)] = func_reject
+
+	uses_mem := false
+
+	for pc := len(insns) - 1; pc >= 0; pc-- {
+		insn := &insns[pc]
+
+		switch insn.code {
+		case uint16(LD) | uint16(MEM), uint16(LDX) | uint16(MEM),
+		     uint16(ST), uint16(STX):
+			uses_mem = true
+		}
+
+		nodes[pc] = func_insn(insns, nodes, pc)
+	}
+
+	entry := nodes[0]
+
+	if !uses_mem {
+		return func(buf []byte) uint {
+			return uint(entry(buf, 0, 0, nil))
+		}, nil
+	}
+
+	return func(buf []byte) uint {
+		var mem [mem_words]uint32
+		return uint(entry(buf, 0, 0, &mem))
+	}, nil
+}
+
+// Try to match the given buffer against the filter function.
+func (fn Func) Match(buf []byte) bool {
+	return fn(buf) > 0
+}
+
+func func_reject(buf []byte, a, x uint32, mem *[mem_words]uint32) uint32 {
+	return 0
+}
+
+func func_insn(insns []bpf_insn, nodes []func_node, pc int) func_node {
+	insn := insns[pc]
+	next := nodes[pc + 1]
+	k    := insn.k
+
+	switch insn.code {
+	case uint16(RET) | uint16(Const):
+		return func(buf []byte, a, x uint32, mem *[mem_words]uint32) uint32 {
+			return k
+		}
+
+	case uint16(RET) | uint16(Acc):
+		return func(buf []byte, a, x uint32, mem *[mem_words]uint32) uint32 {
+			return a
+		}
+
+	case uint16(LD) | uint16(Word) | uint16(ABS):
+		return func(buf []byte, a, x uint32, mem *[mem_words]uint32) uint32 {
+			if uint64(k) + 4 > uint64(len(buf)) {
+				return 0
+			}
+
+			return next(buf, binary.BigEndian.Uint32(buf[k:]), x, mem)
+		}
+
+	case uint16(LD) | uint16(Half) | uint16(ABS):
+		/* the most common case, fuse it with the following JEQ */
+		if pc + 1 < len(insns) &&
+		   insns[pc + 1].code == uint16(JMP) | bpf_jeq | uint16(Const) {
+			jeq := insns[pc + 1]
+			jt  := nodes[pc + 2 + int(jeq.jt)]
+			jf  := nodes[pc + 2 + int(jeq.jf)]
+
+			return func(buf []byte, a, x uint32, mem *[mem_words]uint32) uint32 {
+				if uint64(k) + 2 > uint64(len(buf)) {
+					return 0
+				}
+
+				a = uint32(binary.BigEndian.Uint16(buf[k:]))
+
+				if a == jeq.k {
+					return jt(buf, a, x, mem)
+				}
+
+				return jf(buf, a, x, mem)
+			}
+		}
+
+		return func(buf []byte, a, x uint32, mem *[mem_words]uint32) uint32 {
+			if uint64(k) + 2 > uint64(len(buf)) {
+				return 0
+			}
+
+			a = uint32(binary.BigEndian.Uint16(buf[k:]))
+			return next(buf, a, x, mem)
+		}
+
+	case uint16(LD) | uint16(Byte) | uint16(ABS):
+		return func(buf []byte, a, x uint32, mem *[mem_words]uint32) uint32 {
+			if uint64(k) >= uint64(len(buf)) {
+				return 0
+			}
+
+			return next(buf, uint32(buf[k]), x, mem)
+		}
+
+	case uint16(LD) | uint16(Word) | uint16(IND):
+		return func(buf []byte, a, x uint32, mem *[mem_words]uint32) uint32 {
+			off := uint64(x) + uint64(k)
+			if off + 4 > uint64(len(buf)) {
+				return 0
+			}
+
+			return next(buf, binary.BigEndian.Uint32(buf[off:]), x, mem)
+		}
+
+	case uint16(LD) | uint16(Half) | uint16(IND):
+		return func(buf []byte, a, x uint32, mem *[mem_words]uint32) uint32 {
+			off := uint64(x) + uint64(k)
+			if off + 2 > uint64(len(buf)) {
+				return 0
+			}
+
+			a = uint32(binary.BigEndian.Uint16(buf[off:]))
+			return next(buf, a, x, mem)
+		}
+
+	case uint16(LD) | uint16(Byte) | uint16(IND):
+		return func(buf []byte, a, x uint32, mem *[mem_words]uint32) uint32 {
+			off := uint64(x) + uint64(k)
+			if off >= uint64(len(buf)) {
+				return 0
+			}
+
+			return next(buf, uint32(buf[off]), x, mem)
+		}
+
+	case uint16(LD) | uint16(Word) | uint16(LEN):
+		return func(buf []byte, a, x uint32, mem *[mem_words]uint32) uint32 {
+			return next(buf, uint32(len(buf)), x, mem)
+		}
+
+	case uint16(LDX) | uint16(Word) | uint16(LEN):
+		return func(buf []byte, a, x uint32, mem *[mem_words]uint32) uint32 {
+			return next(buf, a, uint32(len(buf)), mem)
+		}
+
+	case uint16(LDX) | uint16(Byte) | uint16(MSH):
+		return func(buf []byte, a, x uint32, mem *[mem_words]uint32) uint32 {
+			if uint64(k) >= uint64(len(buf)) {
+				return 0
+			}
+
+			return next(buf, a, uint32(buf[k] & 0xf) << 2, mem)
+		}
+
+	case uint16(LD) | uint16(IMM):
+		return func(buf []byte, a, x uint32, mem *[mem_words]uint32) uint32 {
+			return next(buf, k, x, mem)
+		}
+
+	case uint16(LDX) | uint16(IMM):
+		return func(buf []byte, a, x uint32, mem *[mem_words]uint32) uint32 {
+			return next(buf, a, k, mem)
+		}
+
+	case uint16(LD) | uint16(MEM):
+		return func(buf []byte, a, x uint32, mem *[mem_words]uint32) uint32 {
+			return next(buf, mem[k], x, mem)
+		}
+
+	case uint16(LDX) | uint16(MEM):
+		return func(buf []byte, a, x uint32, mem *[mem_words]uint32) uint32 {
+			return next(buf, a, mem[k], mem)
+		}
+
+	case uint16(ST):
+		return func(buf []byte, a, x uint32, mem *[mem_words]uint32) uint32 {
+			mem[k] = a
+			return next(buf, a, x, mem)
+		}
+
+	case uint16(STX):
+		return func(buf []byte, a, x uint32, mem *[mem_words]uint32) uint32 {
+			mem[k] = x
+			return next(buf, a, x, mem)
+		}
+
+	case uint16(JMP) | bpf_ja:
+		return nodes[pc + 1 + int(k)]
+
+	case uint16(MISC) | bpf_tax:
+		return func(buf []byte, a, x uint32, mem *[mem_words]uint32) uint32 {
+			return next(buf, a, a, mem)
+		}
+
+	case uint16(MISC) | bpf_txa:
+		return func(buf []byte, a, x uint32, mem *[mem_words]uint32) uint32 {
+			return next(buf, x, x, mem)
+		}
+
+	case uint16(ALU) | bpf_neg:
+		return func(buf []byte, a, x uint32, mem *[mem_words]uint32) uint32 {
+			return next(buf, -a, x, mem)
+		}
+	}
+
+	switch Code(insn.code & 0x07) {
+	case JMP:
+		return func_jump(insn, nodes[pc + 1 + int(insn.jt)],
+		                 nodes[pc + 1 + int(insn.jf)])
+
+	case ALU:
+		return func_alu(insn, next)
+	}
+
+	return func_reject
+}
+
+func func_jump(insn bpf_insn, jt, jf func_node) func_node {
+	k := insn.k
+
+	switch insn.code & 0xf8 {
+	case bpf_jeq | uint16(Const):
+		return func(buf []byte, a, x uint32, mem *[mem_words]uint32) uint32 {
+			if a == k {
+				return jt(buf, a, x, mem)
+			}
+
+			return jf(buf, a, x, mem)
+		}
+
+	case bpf_jgt | uint16(Const):
+		return func(buf []byte, a, x uint32, mem *[mem_words]uint32) uint32 {
+			if a > k {
+				return jt(buf, a, x, mem)
+			}
+
+			return jf(buf, a, x, mem)
+		}
+
+	case bpf_jge | uint16(Const):
+		return func(buf []byte, a, x uint32, mem *[mem_words]uint32) uint32 {
+			if a >= k {
+				return jt(buf, a, x, mem)
+			}
+
+			return jf(buf, a, x, mem)
+		}
+
+	case bpf_jset | uint16(Const):
+		return func(buf []byte, a, x uint32, mem *[mem_words]uint32) uint32 {
+			if a & k != 0 {
+				return jt(buf, a, x, mem)
+			}
+
+			return jf(buf, a, x, mem)
+		}
+
+	case bpf_jeq | uint16(Index):
+		return func(buf []byte, a, x uint32, mem *[mem_words]uint32) uint32 {
+			if a == x {
+				return jt(buf, a, x, mem)
+			}
+
+			return jf(buf, a, x, mem)
+		}
+
+	case bpf_jgt | uint16(Index):
+		return func(buf []byte, a, x uint32, mem *[mem_words]uint32) uint32 {
+			if a > x {
+				return jt(buf, a, x, mem)
+			}
+
+			return jf(buf, a, x, mem)
+		}
+
+	case bpf_jge | uint16(Index):
+		return func(buf []byte, a, x uint32, mem *[mem_words]uint32) uint32 {
+			if a >= x {
+				return jt(buf, a, x, mem)
+			}
+
+			return jf(buf, a, x, mem)
+		}
+
+	case bpf_jset | uint16(Index):
+		return func(buf []byte, a, x uint32, mem *[mem_words]uint32) uint32 {
+			if a & x != 0 {
+				return jt(buf, a, x, mem)
+			}
+
+			return jf(buf, a, x, mem)
+		}
+	}
+
+	return func_reject
+}
+
+func func_alu(insn bpf_insn, next func_node) func_node {
+	k := insn.k
+
+	if insn.code & uint16(Index) == 0 {
+		switch insn.code & 0xf0 {
+		case bpf_div, bpf_mod:
+			if k == 0 {
+				return func_reject
+			}
+		}
+
+		return func(buf []byte, a, x uint32, mem *[mem_words]uint32) uint32 {
+			return next(buf, alu(insn.code, a, k), x, mem)
+		}
+	}
+
+	switch insn.code & 0xf0 {
+	case bpf_div, bpf_mod:
+		return func(buf []byte, a, x uint32, mem *[mem_words]uint32) uint32 {
+			if x == 0 {
+				return 0
+			}
+
+			return next(buf, alu(insn.code, a, x), x, mem)
+		}
+	}
+
+	return func(buf []byte, a, x uint32, mem *[mem_words]uint32) uint32 {
+		return next(buf, alu(insn.code, a, x), x, mem)
+	}
+}
+
+func alu(code uint16, a, v uint32) uint32 {
+	switch code & 0xf0 {
+	case bpf_add:
+		return a + v
+
+	case bpf_sub:
+		return a - v
+
+	case bpf_mul:
+		return a * v
+
+	case bpf_div:
+		return a / v
+
+	case bpf_mod:
+		return a % v
+
+	case bpf_and:
+		return a & v
+
+	case bpf_xor:
+		return a ^ v
+
+	case bpf_or:
+		return a | v
+
+	case bpf_lsh:
+		return a << (v & 31)
+
+	case bpf_rsh:
+		return a >> (v & 31)
+	}
+
+	return 0
+}
@@ -0,0 +1,147 @@
+/*
+ * Network packet analysis framework.
+ *
+ * Copyright (c) 2014, Alessandro Ghedini
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are
+ * met:
+ *
+ *     * Redistributions of source code must retain the above copyright
+ *       notice, this list of conditions and the following disclaimer.
+ *
+ *     * Redistributions in binary form must reproduce the above copyright
+ *       notice, this list of conditions and the following disclaimer in the
+ *       documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS
+ * IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO,
+ * THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR
+ * PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR
+ * CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+ * EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+ * PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+ * PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF
+ * LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+ * NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+ * SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package filter_test
+
+import "math/rand"
+import "testing"
+
+import "github.com/ghedo/go.pkt/filter"
+import "github.com/ghedo/go.pkt/packet"
+
+func TestFuncCompare(t *testing.T) {
+	if !filter.HaveC {
+		t.Skip("C implementation not available")
+	}
+
+	r := rand.New(rand.NewSource(4))
+
+	for i := 0; i < 5000; i++ {
+		f := random_filter(r, 1 + r.Intn(40), true)
+
+		if !f.Validate() {
+			f.Cleanup()
+			continue
+		}
+
+		fn, err := f.Func()
+		if err != nil {
+			t.Fatalf("Error translating: %s\n%s", err, f)
+		}
+
+		for j := 0; j < 10; j++ {
+			buf := make([]byte, r.Intn(80))
+			r.Read(buf)
+
+			if fn(buf) != f.FilterC(buf) {
+				t.Fatalf("Result mismatch (%d != %d) for %x:\n%s",
+				         fn(buf), f.FilterC(buf), buf, f)
+			}
+		}
+
+		f.Cleanup()
+	}
+}
+
+func TestFuncCompile(t *testing.T) {
+	for _, test := range compile_tests {
+		flt, err := filter.Compile(test.expr, test.link, true)
+		if err != nil {
+			t.Fatalf("Error compiling '%s': %s", test.expr, err)
+		}
+
+		fn, err := flt.Func()
+		if err != nil {
+			t.Fatalf("Error translating '%s': %s", test.expr, err)
+		}
+
+		if fn.Match(test.buf) != test.match {
+			t.Fatalf("Match mismatch for '%s' (expected %v)",
+			         test.expr, test.match)
+		}
+
+		flt.Cleanup()
+	}
+}
+
+func TestFuncInvalid(t *testing.T) {
+	flt := &filter.Filter{}
+	flt.AppendInsn(0x28, 0, 0, 12)
+	defer flt.Cleanup()
+
+	_, err := flt.Func()
+	if err == nil {
+		t.Fatalf("Error expected")
+	}
+}
+
+var bench_exprs = []string{
+	"arp",
+	"tcp",
+	"udp port 53",
+	"tcp[tcpflags] & tcp-syn != 0",
+	"host 192.168.1.1 and not port 22",
+}
+
+func BenchmarkFunc(b *testing.B) {
+	for _, expr := range bench_exprs {
+		flt, err := filter.Compile(expr, packet.Eth, true)
+		if err != nil {
+			b.Fatalf("Error compiling '%s': %s", expr, err)
+		}
+
+		fn, err := flt.Func()
+		if err != nil {
+			b.Fatalf("Error translating '%s': %s", expr, err)
+		}
+
+		if filter.HaveC {
+			b.Run(expr + "/c", func(b *testing.B) {
+				for n := 0; n < b.N; n++ {
+					flt.FilterC(test_eth_ipv4_tcp)
+				}
+			})
+		}
+
+		b.Run(expr + "/vm", func(b *testing.B) {
+			for n := 0; n < b.N; n++ {
+				flt.Filter(test_eth_ipv4_tcp)
+			}
+		})
+
+		b.Run(expr + "/func", func(b *testing.B) {
+			for n := 0; n < b.N; n++ {
+				fn(test_eth_ipv4_tcp)
+			}
+		})
+
+		flt.Cleanup()
+	}
+}
@@ -0,0 +1,943 @@
+/*
+ * Network packet analysis framework.
+ *
+ * Copyright (c) 2014, Alessandro Ghedini
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are
+ * met:
+ *
+ *     * Redistributions of source code must retain the above copyright
+ *       notice, this list of conditions and the following disclaimer.
+ *
+ *     * Redistributions in binary form must reproduce the above copyright
+ *       notice, this list of conditions and the following disclaimer in the
+ *       documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS
+ * IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO,
+ * THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR
+ * PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR
+ * CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+ * EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+ * PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+ * PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF
+ * LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+ * NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+ * SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package filter
+
+import "fmt"
+
+// Statistics about the optimization performed by Optimize().
+type OptStats struct {
+	Before int /* number of instructions before the optimization */
+	After  int /* number of instructions after the optimization */
+}
+
+func (s OptStats) String() string {
+	return fmt.Sprintf("%d -> %d instructions", s.Before, s.After)
+}
+
+/* an instruction with absolute jump targets (jt is also the JA target) */
+type opt_insn struct {
+	code uint16
+	k    uint32
+	jt   int
+	jf   int
+	nop  bool
+	safe bool /* packet load that is known not to fail */
+}
+
+/* symbolic value of a register or of a scratch memory location */
+type opt_val struct {
+	kind uint8
+	size uint16
+	k    uint32
+}
+
+const (
+	val_unknown uint8 = iota /* k identifies the value */
+	val_const
+	val_abs                  /* packet data at offset k */
+	val_len
+	val_msh                  /* IP header length at offset k */
+)
+
+/* the registers tracked by the optimizer: A, X and the scratch memory */
+const (
+	reg_a    = 0
+	reg_x    = 1
+	reg_mem  = 2
+	opt_regs = reg_mem + mem_words
+)
+
+/* a value known to be equal (or not equal) to a constant */
+type opt_fact struct {
+	val opt_val
+	eq  bool
+	k   uint32
+}
+
+/* upper bound on the number of facts tracked for each instruction */
+const opt_max_facts = 16
+
+type opt_state struct {
+	reached bool
+	regs    [opt_regs]opt_val
+	facts   []opt_fact /* never modified in place, as it's shared */
+	min_len uint32     /* packet length known to be available */
+}
+
+/* upper bound on the number of optimization passes */
+const opt_max_passes = 32
+
+// Optimize the filter and return the optimized program, which needs to be
+// deallocated separately from the original one. The optimizer folds and
+// propagates constants, removes redundant loads and stores (e.g. loading the
+// same packet data twice), threads jumps whose outcome is known at their target
+// and eliminates dead and unreachable code. Far jumps are handled like Builder
+// does. The filter must pass Verify(), otherwise an error is returned.
+func (f *Filter) Optimize() (*Filter, OptStats, error) {
+	insns := f.insns()
+	stats := OptStats{ Before: len(insns) }
+
+	if err := verify(insns); err != nil {
+		return nil, stats, fmt.Errorf("Could not optimize filter: %s", err)
+	}
+
+	prog := opt_decode(insns)
+
+	for i := 0; i < opt_max_passes; i++ {
+		changed := opt_values(prog)
+
+		prog = opt_compact(prog)
+
+		if opt_dead(prog) {
+			changed = true
+			prog    = opt_compact(prog)
+		}
+
+		if !changed {
+			break
+		}
+	}
+
+	out, err := opt_encode(prog)
+	if err != nil {
+		return nil, stats, fmt.Errorf("Could not optimize filter: %s", err)
+	}
+
+	stats.After = out.Len()
+
+	return out, stats, nil
+}
+
+/* Convert the given instructions to use absolute jump targets. */
+func opt_decode(insns []bpf_insn) []opt_insn {
+	prog := make([]opt_insn, len(insns))
+
+	for pc, insn := range insns {
+		prog[pc] = opt_insn{ code: insn.code, k: insn.k }
+
+		switch {
+		case insn.code == uint16(JMP) | bpf_ja:
+			prog[pc].jt = pc + 1 + int(insn.k)
+
+		case insn.code & 0x07 == uint16(JMP):
+			prog[pc].jt = pc + 1 + int(insn.jt)
+			prog[pc].jf = pc + 1 + int(insn.jf)
+		}
+	}
+
+	return prog
+}
+
+/*
+ * Forward pass that computes the symbolic value of every register before each
+ * instruction and uses it to fold constants, remove redundant instructions,
+ * resolve and thread jumps and mark unreachable code. Jumps are forward only,
+ * so every predecessor of an instruction is visited before it.
+ */
+func opt_values(prog []opt_insn) bool {
+	n := len(prog)
+
+	states := make([]opt_state, n)
+
+	/* A and X start at zero, the scratch memory is never read before
+	 * being written to in verified programs */
+	states[0].reached = true
+	for r := range states[0].regs {
+		states[0].regs[r] = opt_val{ val_unknown, 0, uint32(r) }
+	}
+
+	states[0].regs[reg_a] = opt_val{ val_const, 0, 0 }
+	states[0].regs[reg_x] = opt_val{ val_const, 0, 0 }
+
+	changed := false
+
+	for pc := range prog {
+		insn := &prog[pc]
+		s    := &states[pc]
+
+		if !s.reached {
+			if !insn.nop {
+				insn.nop = true
+				changed  = true
+			}
+
+			continue
+		}
+
+		if insn.nop {
+			opt_meet(states, pc + 1, s)
+			continue
+		}
+
+		out := *s
+
+		insn.safe = false
+
+		if end, ok := opt_load_end(insn); ok {
+			insn.safe = end <= uint64(s.min_len)
+
+			if end > uint64(out.min_len) {
+				out.min_len = uint32(end)
+			}
+		}
+
+		if reg, val, ok := opt_eval(insn, s, pc); ok {
+			if opt_simplify(insn, s, val) {
+				changed = true
+			}
+
+			out.regs[reg] = val
+		}
+
+		switch {
+		case insn.nop:
+
+		case insn.code & 0x07 == uint16(JMP):
+			if opt_jump(prog, pc, s) {
+				changed = true
+			}
+
+		case insn.code == uint16(RET) | uint16(Acc):
+			if k, ok := opt_const_a(s); ok {
+				insn.code = uint16(RET) | uint16(Const)
+				insn.k    = k
+				changed   = true
+			}
+		}
+
+		switch {
+		case insn.nop:
+			opt_meet(states, pc + 1, &out)
+
+		case insn.code & 0x07 == uint16(RET):
+
+		case insn.code == uint16(JMP) | bpf_ja:
+			opt_meet(states, insn.jt, &out)
+
+		case insn.code & 0x07 == uint16(JMP):
+			jt, jf := opt_edges(insn, &out)
+			opt_meet(states, insn.jt, &jt)
+			opt_meet(states, insn.jf, &jf)
+
+		default:
+			opt_meet(states, pc + 1, &out)
+		}
+	}
+
+	return changed
+}
+
+/* Merge the state s into the state of the instruction at pc. */
+func opt_meet(states []opt_state, pc int, s *opt_state) {
+	dst := &states[pc]
+
+	if !dst.reached {
+		*dst = *s
+		dst.reached = true
+		return
+	}
+
+	for r := range dst.regs {
+		if dst.regs[r] != s.regs[r] {
+			dst.regs[r] = opt_join(pc, r)
+		}
+	}
+
+	if s.min_len < dst.min_len {
+		dst.min_len = s.min_len
+	}
+
+	var facts []opt_fact
+
+	for _, f := range dst.facts {
+		for _, g := range s.facts {
+			if f == g {
+				facts = append(facts, f)
+				break
+			}
+		}
+	}
+
+	dst.facts = facts
+}
+
+/* Return the end of the packet data read by insn, if it's a fixed offset. */
+func opt_load_end(insn *opt_insn) (uint64, bool) {
+	switch insn.code {
+	case uint16(LD) | uint16(Word) | uint16(ABS):
+		if insn.k >= LinkOffset {
+			return 0, false
+		}
+
+		return uint64(insn.k) + 4, true
+
+	case uint16(LD) | uint16(Half) | uint16(ABS):
+		if insn.k >= LinkOffset {
+			return 0, false
+		}
+
+		return uint64(insn.k) + 2, true
+
+	case uint16(LD) | uint16(Byte) | uint16(ABS),
+	     uint16(LDX) | uint16(Byte) | uint16(MSH):
+		if insn.k >= LinkOffset {
+			return 0, false
+		}
+
+		return uint64(insn.k) + 1, true
+	}
+
+	return 0, false
+}
+
+/* Return a copy of s with the given fact about the value of A. */
+func opt_learn(s opt_state, eq bool, k uint32) opt_state {
+	a := s.regs[reg_a]
+
+	if a.kind == val_const || len(s.facts) >= opt_max_facts {
+		return s
+	}
+
+	facts := make([]opt_fact, len(s.facts), len(s.facts) + 1)
+	copy(facts, s.facts)
+
+	s.facts = append(facts, opt_fact{ a, eq, k })
+	return s
+}
+
+/* Return whether A is known to be equal (or not equal) to k in state s. */
+func opt_known(s *opt_state, eq bool, k uint32) bool {
+	for _, f := range s.facts {
+		if f.val == s.regs[reg_a] && f.eq == eq && f.k == k {
+			return true
+		}
+	}
+
+	return false
+}
+
+/* Return the value of A in state s, if known. */
+func opt_const_a(s *opt_state) (uint32, bool) {
+	if s.regs[reg_a].kind == val_const {
+		return s.regs[reg_a].k, true
+	}
+
+	for _, f := range s.facts {
+		if f.val == s.regs[reg_a] && f.eq {
+			return f.k, true
+		}
+	}
+
+	return 0, false
+}
+
+/* Return the state on the jt and jf edges of a conditional jump. */
+func opt_edges(insn *opt_insn, s *opt_state) (opt_state, opt_state) {
+	if insn.code == uint16(JMP) | bpf_jeq | uint16(Const) {
+		return opt_learn(*s, true, insn.k), opt_learn(*s, false, insn.k)
+	}
+
+	return *s, *s
+}
+
+/* unique value numbers for the results of the instruction at pc */
+func opt_result(pc, reg int) opt_val {
+	return opt_val{ val_unknown, 0, uint32((pc + 1) * 64 + reg) }
+}
+
+/* unique value numbers for values merged from different paths at pc */
+func opt_join(pc, reg int) opt_val {
+	return opt_val{ val_unknown, 0, uint32((pc + 1) * 64 + 32 + reg) }
+}
+
+/* Return the register written by insn, and the value it writes. */
+func opt_eval(insn *opt_insn, s *opt_state, pc int) (int, opt_val, bool) {
+	a := s.regs[reg_a]
+	x := s.regs[reg_x]
+
+	a_k, a_const := opt_const_a(s)
+
+	switch insn.code & 0x07 {
+	case uint16(LD):
+		switch insn.code & 0xe0 {
+		case uint16(IMM):
+			return reg_a, opt_val{ val_const, 0, insn.k }, true
+
+		case uint16(ABS):
+			/* the Linux extensions may not be constant */
+			if insn.k >= LinkOffset {
+				return reg_a, opt_result(pc, reg_a), true
+			}
+
+			size := insn.code & 0x18
+			return reg_a, opt_val{ val_abs, size, insn.k }, true
+
+		case uint16(LEN):
+			return reg_a, opt_val{ val_len, 0, 0 }, true
+
+		case uint16(MEM):
+			return reg_a, s.regs[reg_mem + int(insn.k)], true
+		}
+
+		return reg_a, opt_result(pc, reg_a), true
+
+	case uint16(LDX):
+		switch insn.code & 0xe0 {
+		case uint16(IMM):
+			return reg_x, opt_val{ val_const, 0, insn.k }, true
+
+		case uint16(LEN):
+			return reg_x, opt_val{ val_len, 0, 0 }, true
+
+		case uint16(MEM):
+			return reg_x, s.regs[reg_mem + int(insn.k)], true
+
+		case uint16(MSH):
+			return reg_x, opt_val{ val_msh, 0, insn.k }, true
+		}
+
+	case uint16(ST):
+		return reg_mem + int(insn.k), a, true
+
+	case uint16(STX):
+		return reg_mem + int(insn.k), x, true
+
+	case uint16(ALU):
+		op := insn.code & 0xf0
+
+		v := opt_val{ val_const, 0, insn.k }
+		if insn.code & uint16(Index) != 0 {
+			v = x
+		}
+
+		if a_const && (op == bpf_neg || v.kind == val_const) {
+			if res, ok := alu_eval(op, a_k, v.k); ok {
+				return reg_a, opt_val{ val_const, 0, res }, true
+			}
+		}
+
+		if v.kind == val_const && v.k == 0 &&
+		   (op == bpf_mul || op == bpf_and) {
+			return reg_a, opt_val{ val_const, 0, 0 }, true
+		}
+
+		if v.kind == val_const && alu_identity(op, v.k) {
+			return reg_a, a, true
+		}
+
+		return reg_a, opt_result(pc, reg_a), true
+
+	case uint16(MISC):
+		if insn.code & 0xf8 == bpf_txa {
+			return reg_a, x, true
+		}
+
+		return reg_x, a, true
+	}
+
+	return 0, opt_val{}, false
+}
+
+/*
+ * Replace insn, which writes val to a register, with a simpler equivalent
+ * instruction (or remove it) if possible.
+ */
+func opt_simplify(insn *opt_insn, s *opt_state, val opt_val) bool {
+	reg := reg_a
+
+	switch insn.code & 0x07 {
+	case uint16(LDX):
+		reg = reg_x
+
+	case uint16(ST), uint16(STX):
+		reg = reg_mem + int(insn.k)
+
+	case uint16(MISC):
+		if insn.code & 0xf8 != bpf_txa {
+			reg = reg_x
+		}
+	}
+
+	/* the register already holds the value */
+	if s.regs[reg] == val {
+		insn.nop = true
+		return true
+	}
+
+	if reg == reg_a && val.kind == val_const && opt_known(s, true, val.k) {
+		insn.nop = true
+		return true
+	}
+
+	/* replace arithmetic on constants with a load */
+	if insn.code & 0x07 == uint16(ALU) && val.kind == val_const {
+		insn.code = uint16(LD) | uint16(IMM)
+		insn.k    = val.k
+		return true
+	}
+
+	/* division by a register known to be zero rejects the packet */
+	if insn.code & 0x07 == uint16(ALU) && insn.code & uint16(Index) != 0 {
+		op := insn.code & 0xf0
+		x  := s.regs[reg_x]
+
+		if x.kind == val_const && x.k == 0 &&
+		   (op == bpf_div || op == bpf_mod) {
+			insn.code = uint16(RET) | uint16(Const)
+			insn.k    = 0
+			return true
+		}
+	}
+
+	return false
+}
+
+/*
+ * Resolve the conditional jump at pc if its outcome is known, and thread its
+ * edges through jumps whose outcome is known on each edge.
+ */
+func opt_jump(prog []opt_insn, pc int, s *opt_state) bool {
+	insn    := &prog[pc]
+	changed := false
+
+	if insn.code != uint16(JMP) | bpf_ja {
+		if taken, ok := opt_decide(insn, s); ok {
+			if !taken {
+				insn.jt = insn.jf
+			}
+
+			insn.code = uint16(JMP) | bpf_ja
+			insn.jf   = 0
+			changed   = true
+		}
+	}
+
+	if insn.code == uint16(JMP) | bpf_ja {
+		t := opt_thread(prog, insn.jt, s)
+
+		if t != insn.jt {
+			insn.jt = t
+			changed = true
+		}
+	} else {
+		jt, jf := opt_edges(insn, s)
+
+		t := opt_thread(prog, insn.jt, &jt)
+		f := opt_thread(prog, insn.jf, &jf)
+
+		if t != insn.jt || f != insn.jf {
+			insn.jt, insn.jf = t, f
+			changed = true
+		}
+
+		if insn.jt == insn.jf {
+			insn.code = uint16(JMP) | bpf_ja
+			changed   = true
+		}
+	}
+
+	if insn.code == uint16(JMP) | bpf_ja && insn.jt == pc + 1 {
+		insn.nop = true
+		changed  = true
+	}
+
+	return changed
+}
+
+/* Follow jumps starting at t whose outcome is known in state s. */
+func opt_thread(prog []opt_insn, t int, s *opt_state) int {
+	for !prog[t].nop && prog[t].code & 0x07 == uint16(JMP) {
+		insn := &prog[t]
+
+		if insn.code == uint16(JMP) | bpf_ja {
+			t = insn.jt
+			continue
+		}
+
+		taken, ok := opt_decide(insn, s)
+		if !ok {
+			break
+		}
+
+		if taken {
+			t = insn.jt
+		} else {
+			t = insn.jf
+		}
+	}
+
+	return t
+}
+
+/* Return the outcome of the conditional jump insn in state s, if known. */
+func opt_decide(insn *opt_insn, s *opt_state) (bool, bool) {
+	op := insn.code & 0xf0
+	a  := s.regs[reg_a]
+
+	v := opt_val{ val_const, 0, insn.k }
+	if insn.code & uint16(Index) != 0 {
+		v = s.regs[reg_x]
+	}
+
+	if a_k, ok := opt_const_a(s); ok && v.kind == val_const {
+		return jmp_eval(op, a_k, v.k), true
+	}
+
+	if a == v {
+		switch op {
+		case bpf_jeq, bpf_jge:
+			return true, true
+
+		case bpf_jgt:
+			return false, true
+		}
+	}
+
+	if op == bpf_jeq && v.kind == val_const && opt_known(s, false, v.k) {
+		return false, true
+	}
+
+	return false, false
+}
+
+/*
+ * Backward pass that removes instructions whose result is never used. Loads
+ * that may fail (and thus reject the packet) are never removed.
+ */
+func opt_dead(prog []opt_insn) bool {
+	_, changed := opt_live(prog, true)
+	return changed
+}
+
+/*
+ * Return the registers live before each instruction (as bit masks), removing
+ * the instructions whose result is not used if remove is true.
+ */
+func opt_live(prog []opt_insn, remove bool) ([]uint32, bool) {
+	n := len(prog)
+
+	live    := make([]uint32, n + 1)
+	changed := false
+
+	for pc := n - 1; pc >= 0; pc-- {
+		insn := &prog[pc]
+
+		var out uint32
+
+		switch {
+		case insn.code & 0x07 == uint16(RET):
+
+		case insn.code == uint16(JMP) | bpf_ja:
+			out = live[insn.jt]
+
+		case insn.code & 0x07 == uint16(JMP):
+			out = live[insn.jt] | live[insn.jf]
+
+		default:
+			out = live[pc + 1]
+		}
+
+		use, def, removable := opt_uses(insn)
+
+		if remove && removable && def & out == 0 {
+			insn.nop = true
+			changed  = true
+
+			live[pc] = out
+			continue
+		}
+
+		live[pc] = (out &^ def) | use
+	}
+
+	return live, changed
+}
+
+/*
+ * Return the registers used and defined by insn (as bit masks), and whether it
+ * can be removed if its result is not used.
+ */
+func opt_uses(insn *opt_insn) (uint32, uint32, bool) {
+	const a = 1 << reg_a
+	const x = 1 << reg_x
+
+	m := uint32(1) << (reg_mem + insn.k % mem_words)
+
+	switch insn.code & 0x07 {
+	case uint16(LD):
+		switch insn.code & 0xe0 {
+		case uint16(IMM), uint16(LEN):
+			return 0, a, true
+
+		case uint16(MEM):
+			return m, a, true
+
+		case uint16(IND):
+			return x, a, false
+		}
+
+		return 0, a, insn.safe
+
+	case uint16(LDX):
+		switch insn.code & 0xe0 {
+		case uint16(IMM), uint16(LEN):
+			return 0, x, true
+
+		case uint16(MEM):
+			return m, x, true
+		}
+
+		return 0, x, insn.safe
+
+	case uint16(ST):
+		return a, m, true
+
+	case uint16(STX):
+		return x, m, true
+
+	case uint16(ALU):
+		if insn.code & uint16(Index) == 0 {
+			return a, a, true
+		}
+
+		/* division by X may reject the packet */
+		op := insn.code & 0xf0
+		return a | x, a, op != bpf_div && op != bpf_mod
+
+	case uint16(JMP):
+		if insn.code == uint16(JMP) | bpf_ja {
+			return 0, 0, false
+		}
+
+		if insn.code & uint16(Index) != 0 {
+			return a | x, 0, false
+		}
+
+		return a, 0, false
+
+	case uint16(RET):
+		if insn.code & 0x18 == uint16(Acc) {
+			return a, 0, false
+		}
+
+		return 0, 0, false
+
+	case uint16(MISC):
+		if insn.code & 0xf8 == bpf_txa {
+			return x, a, true
+		}
+
+		return a, x, true
+	}
+
+	return 0, 0, false
+}
+
+/* Remove the nop instructions and update the jump targets accordingly. */
+func opt_compact(prog []opt_insn) []opt_insn {
+	n := len(prog)
+
+	/* new index of the first instruction kept at or after each index */
+	index := make([]int, n + 1)
+	index[n] = n
+
+	kept := 0
+	for pc := range prog {
+		if !prog[pc].nop {
+			kept++
+		}
+	}
+
+	next := kept
+	for pc := n - 1; pc >= 0; pc-- {
+		if !prog[pc].nop {
+			next--
+		}
+
+		index[pc] = next
+	}
+
+	out := make([]opt_insn, 0, kept)
+
+	for pc := range prog {
+		if prog[pc].nop {
+			continue
+		}
+
+		insn := prog[pc]
+		insn.jt = index[insn.jt]
+		insn.jf = index[insn.jf]
+
+		out = append(out, insn)
+	}
+
+	return out
+}
+
+func opt_encode(prog []opt_insn) (*Filter, error) {
+	targets := make(map[int]bool)
+
+	for _, insn := range prog {
+		if insn.code & 0x07 == uint16(JMP) {
+			targets[insn.jt] = true
+			targets[insn.jf] = true
+		}
+	}
+
+	b := NewBuilder()
+
+	for pc := range prog {
+		if targets[pc] {
+			b.Label(fmt.Sprintf("l%d", pc))
+		}
+
+		insn := &prog[pc]
+
+		jt := fmt.Sprintf("l%d", insn.jt)
+		jf := fmt.Sprintf("l%d", insn.jf)
+
+		opt_emit(b, insn, jt, jf)
+	}
+
+	return b.Build()
+}
+
+/* Append insn to the builder, using the given labels as jump targets. */
+func opt_emit(b *Builder, insn *opt_insn, jt, jf string) {
+	s := Src(insn.code & uint16(Index))
+
+	switch {
+	case insn.code == uint16(JMP) | bpf_ja:
+		b.JA(jt)
+
+	case insn.code & 0x07 == uint16(JMP):
+		switch insn.code & 0xf0 {
+		case bpf_jeq:
+			b.JEQ(s, jt, jf, insn.k)
+
+		case bpf_jgt:
+			b.JGT(s, jt, jf, insn.k)
+
+		case bpf_jge:
+			b.JGE(s, jt, jf, insn.k)
+
+		case bpf_jset:
+			b.JSET(s, jt, jf, insn.k)
+		}
+
+	default:
+		b.append_insn(Code(insn.code), insn.k)
+	}
+}
+
+func alu_eval(op uint16, a, v uint32) (uint32, bool) {
+	switch op {
+	case bpf_add:
+		return a + v, true
+
+	case bpf_sub:
+		return a - v, true
+
+	case bpf_mul:
+		return a * v, true
+
+	case bpf_div:
+		if v == 0 {
+			return 0, false
+		}
+
+		return a / v, true
+
+	case bpf_mod:
+		if v == 0 {
+			return 0, false
+		}
+
+		return a % v, true
+
+	case bpf_or:
+		return a | v, true
+
+	case bpf_and:
+		return a & v, true
+
+	case bpf_xor:
+		return a ^ v, true
+
+	case bpf_lsh:
+		return a << (v & 31), true
+
+	case bpf_rsh:
+		return a >> (v & 31), true
+
+	case bpf_neg:
+		return -a, true
+	}
+
+	return 0, false
+}
+
+/* Return whether the ALU operation op with operand v leaves A unchanged. */
+func alu_identity(op uint16, v uint32) bool {
+	switch op {
+	case bpf_add, bpf_sub, bpf_or, bpf_xor:
+		return v == 0
+
+	case bpf_lsh, bpf_rsh:
+		return v & 31 == 0
+
+	case bpf_mul, bpf_div:
+		return v == 1
+
+	case bpf_and:
+		return v == 0xffffffff
+	}
+
+	return false
+}
+
+func jmp_eval(op uint16, a, v uint32) bool {
+	switch op {
+	case bpf_jeq:
+		return a == v
+
+	case bpf_jgt:
+		return a > v
+
+	case bpf_jge:
+		return a >= v
+
+	case bpf_jset:
+		return a & v != 0
+	}
+
+	return false
+}
@@ -0,0 +1,188 @@
+/*
+ * Network packet analysis framework.
+ *
+ * Copyright (c) 2014, Alessandro Ghedini
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are
+ * met:
+ *
+ *     * Redistributions of source code must retain the above copyright
+ *       notice, this list of conditions and the following disclaimer.
+ *
+ *     * Redistributions in binary form must reproduce the above copyright
+ *       notice, this list of conditions and the following disclaimer in the
+ *       documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS
+ * IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO,
+ * THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR
+ * PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR
+ * CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+ * EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+ * PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+ * PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF
+ * LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+ * NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+ * SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package filter_test
+
+import "math/rand"
+import "testing"
+
+import "github.com/ghedo/go.pkt/filter"
+import "github.com/ghedo/go.pkt/packet"
+
+func optimize(t *testing.T, src string) (*filter.Filter, filter.OptStats) {
+	flt, err := filter.Assemble(src)
+	if err != nil {
+		t.Fatalf("Error assembling: %s", err)
+	}
+	defer flt.Cleanup()
+
+	opt, stats, err := flt.Optimize()
+	if err != nil {
+		t.Fatalf("Error optimizing: %s", err)
+	}
+
+	return opt, stats
+}
+
+func TestOptimize(t *testing.T) {
+	tests := []struct {
+		src string
+		out string
+	}{
+		/* constant folding */
+		{ "ld #6\nmul #7\nadd #0\nret a",
+		  "(000) ret      #42" },
+
+		/* redundant loads and jump threading */
+		{ "ldh [12]\njeq #0x800, l1, drop\nl1: ldh [12]\njeq #0x800, l2, drop\n" +
+		  "l2: ldb [23]\njeq #6, keep, drop\nkeep: ret #1\ndrop: ret #0",
+		  "(000) ldh      [12]\n" +
+		  "(001) jeq      #0x800           jt 2\tjf 5\n" +
+		  "(002) ldb      [23]\n" +
+		  "(003) jeq      #0x6             jt 4\tjf 5\n" +
+		  "(004) ret      #1\n" +
+		  "(005) ret      #0" },
+
+		/* dead code (the unused store and the unreachable return) */
+		{ "ld #1\nst M[0]\nld len\nja l1\nret #5\nl1: ret a",
+		  "(000) ld       #pktlen\n(001) ret      a" },
+
+		/* known inequality */
+		{ "ldh [12]\njeq #0x800, l1, l2\nl1: ret #1\n" +
+		  "l2: ldb [0]\nldh [12]\njeq #0x800, l3, l4\nl3: ret #2\nl4: ret #0",
+		  "(000) ldh      [12]\n" +
+		  "(001) jeq      #0x800           jt 2\tjf 3\n" +
+		  "(002) ret      #1\n" +
+		  "(003) ret      #0" },
+	}
+
+	for _, test := range tests {
+		opt, _ := optimize(t, test.src)
+
+		out := opt.Disassemble(filter.Mnemonic)
+		if out != test.out {
+			t.Fatalf("Program mismatch:\n%s\nexpected:\n%s", out, test.out)
+		}
+
+		opt.Cleanup()
+	}
+}
+
+func TestOptimizeStats(t *testing.T) {
+	flt, err := filter.Compile("ip and udp port 53", packet.Eth, false)
+	if err != nil {
+		t.Fatalf("Error compiling: %s", err)
+	}
+	defer flt.Cleanup()
+
+	opt, stats, err := flt.Optimize()
+	if err != nil {
+		t.Fatalf("Error optimizing: %s", err)
+	}
+	defer opt.Cleanup()
+
+	if stats.Before != flt.Len() || stats.After != opt.Len() {
+		t.Fatalf("Stats mismatch: %s", stats)
+	}
+
+	if stats.After >= stats.Before {
+		t.Fatalf("Filter not optimized: %s", stats)
+	}
+
+	tests := [][]byte{
+		test_eth_arp, test_eth_ipv4_udp, test_eth_ipv4_tcp,
+		test_eth_ipv6_udp, test_eth_ipv4_icmp,
+	}
+
+	for _, buf := range tests {
+		if opt.Filter(buf) != flt.Filter(buf) {
+			t.Fatalf("Result mismatch for %x", buf)
+		}
+	}
+}
+
+func TestOptimizeCompare(t *testing.T) {
+	r := rand.New(rand.NewSource(3))
+
+	optimized := 0
+
+	for i := 0; i < 5000; i++ {
+		f := random_filter(r, 1 + r.Intn(40), true)
+
+		if f.Verify() != nil {
+			f.Cleanup()
+			continue
+		}
+
+		opt, stats, err := f.Optimize()
+		if err != nil {
+			t.Fatalf("Error optimizing: %s\n%s", err, f)
+		}
+
+		if err := opt.Verify(); err != nil {
+			t.Fatalf("Invalid optimized filter: %s\n%s", err, opt)
+		}
+
+		if stats.After < stats.Before {
+			optimized++
+		}
+
+		for j := 0; j < 10; j++ {
+			buf := make([]byte, r.Intn(80))
+			r.Read(buf)
+
+			if f.Filter(buf) != opt.Filter(buf) {
+				t.Fatalf("Result mismatch (%d != %d) for %x:\n%s\n%s",
+				         f.Filter(buf), opt.Filter(buf), buf,
+				         f.Disassemble(filter.Mnemonic),
+				         opt.Disassemble(filter.Mnemonic))
+			}
+		}
+
+		opt.Cleanup()
+		f.Cleanup()
+	}
+
+	if optimized == 0 {
+		t.Fatalf("No filter was optimized")
+	}
+}
+
+func TestOptimizeInvalid(t *testing.T) {
+	flt, err := filter.Assemble("ld M[0]\nret a")
+	if err != nil {
+		t.Fatalf("Error assembling: %s", err)
+	}
+	defer flt.Cleanup()
+
+	if _, _, err := flt.Optimize(); err == nil {
+		t.Fatalf("Invalid filter optimized")
+	}
+}
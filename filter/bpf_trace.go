@@ -0,0 +1,405 @@
+/*
+ * Network packet analysis framework.
+ *
+ * Copyright (c) 2014, Alessandro Ghedini
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are
+ * met:
+ *
+ *     * Redistributions of source code must retain the above copyright
+ *       notice, this list of conditions and the following disclaimer.
+ *
+ *     * Redistributions in binary form must reproduce the above copyright
+ *       notice, this list of conditions and the following disclaimer in the
+ *       documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS
+ * IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO,
+ * THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR
+ * PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR
+ * CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+ * EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+ * PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+ * PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF
+ * LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+ * NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+ * SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package filter
+
+import "encoding/binary"
+import "fmt"
+import "strings"
+
+import "github.com/ghedo/go.pkt/packet"
+
+// A single executed instruction of a filter trace.
+type TraceStep struct {
+	PC    int               /* index of the instruction */
+	Insn  Insn
+	A     uint32            /* accumulator after the instruction */
+	X     uint32            /* index register after the instruction */
+	Mem   [mem_words]uint32 /* scratch memory after the instruction */
+	Taken bool              /* whether a conditional jump was taken */
+}
+
+// The execution trace of a filter on a single packet (see Filter.Trace()).
+type Trace struct {
+	Steps  []TraceStep
+	Result uint
+	buf    []byte
+}
+
+// Run the filter on the given buffer like Filter() does, and return the
+// sequence of the executed instructions, together with the state of the BPF
+// machine after each of them.
+func (f *Filter) Trace(buf []byte) *Trace {
+	tr := &Trace{ buf: buf }
+	tr.Result = uint(run(f.insns(), buf, nil, tr))
+	return tr
+}
+
+// Return whether the filter was interrupted by an invalid operation (e.g. an
+// out-of-bounds load or a division by zero) instead of a RET instruction.
+func (t *Trace) Fault() bool {
+	if len(t.Steps) == 0 {
+		return false
+	}
+
+	last := t.Steps[len(t.Steps) - 1]
+	return Code(last.Insn.Code & 0x07) != RET
+}
+
+func (t *Trace) String() string {
+	return t.Annotate(packet.None)
+}
+
+// Format the trace, annotating the packet loads with the protocol fields they
+// touch (e.g. "ldb [23] ipv4.proto"). The fields are found by decoding the
+// traced packet as the given link type.
+func (t *Trace) Annotate(link_type packet.Type) string {
+	var lines []string
+
+	fields := trace_fields(t.buf, link_type)
+
+	for _, step := range t.Steps {
+		insn := bpf_insn{ step.Insn.Code, step.Insn.Jt, step.Insn.Jf,
+		                  step.Insn.K }
+
+		op, operand := disasm_op(&insn, Mnemonic)
+
+		if off, ok := trace_load(&insn, &step); ok {
+			if name := field_name(fields, off); name != "" {
+				operand += " " + name
+			}
+		}
+
+		lines = append(lines, fmt.Sprintf(
+			"(%03d) %-8s %-24s %s", step.PC, op, operand,
+			trace_state(&insn, &step),
+		))
+	}
+
+	if t.Fault() {
+		lines = append(lines, "fault, packet rejected")
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+func (t *Trace) step(pc int, insn *bpf_insn, a, x uint32, mem *[mem_words]uint32) {
+	/* the state before this instruction is the state after the previous */
+	if n := len(t.Steps); n > 0 {
+		t.Steps[n - 1].A   = a
+		t.Steps[n - 1].X   = x
+		t.Steps[n - 1].Mem = *mem
+	}
+
+	step := TraceStep{
+		PC:   pc,
+		Insn: Insn{ insn.code, insn.jt, insn.jf, insn.k },
+		A:    a,
+		X:    x,
+		Mem:  *mem,
+	}
+
+	if Code(insn.code & 0x07) == JMP && insn.code & 0xf0 != bpf_ja {
+		v := insn.k
+		if Src(insn.code & 0x08) == Index {
+			v = x
+		}
+
+		step.Taken = jump_cond(insn.code, a, v)
+	}
+
+	t.Steps = append(t.Steps, step)
+}
+
+func jump_cond(code uint16, a, v uint32) bool {
+	switch code & 0xf0 {
+	case bpf_jeq:
+		return a == v
+
+	case bpf_jgt:
+		return a > v
+
+	case bpf_jge:
+		return a >= v
+
+	case bpf_jset:
+		return a & v != 0
+	}
+
+	return false
+}
+
+/* Return the packet offset of the load executed by step, if any. */
+func trace_load(insn *bpf_insn, step *TraceStep) (uint32, bool) {
+	switch {
+	case insn.code & 0xe7 == uint16(LD) | uint16(ABS):
+		return insn.k, insn.k < ExtOffset
+
+	case insn.code & 0xe7 == uint16(LD) | uint16(IND):
+		return step.X + insn.k, true
+
+	case insn.code == uint16(LDX) | uint16(Byte) | uint16(MSH):
+		return insn.k, true
+	}
+
+	return 0, false
+}
+
+func trace_state(insn *bpf_insn, step *TraceStep) string {
+	switch Code(insn.code & 0x07) {
+	case RET:
+		if step.Insn.Code == uint16(RET) | uint16(Acc) {
+			return fmt.Sprintf("=> %d", step.A)
+		}
+
+		return fmt.Sprintf("=> %d", insn.k)
+
+	case JMP:
+		if insn.code & 0xf0 == bpf_ja {
+			return fmt.Sprintf("-> %d", step.PC + 1 + int(insn.k))
+		}
+
+		if step.Taken {
+			return fmt.Sprintf("-> %d (true)", step.PC + 1 + int(insn.jt))
+		}
+
+		return fmt.Sprintf("-> %d (false)", step.PC + 1 + int(insn.jf))
+
+	case ST, STX:
+		return fmt.Sprintf("M[%d] = 0x%x", insn.k, step.Mem[insn.k % mem_words])
+	}
+
+	return fmt.Sprintf("A = 0x%x, X = 0x%x", step.A, step.X)
+}
+
+type trace_field struct {
+	name string
+	off  uint32
+	size uint32
+}
+
+var link_fields = map[packet.Type][]trace_field{
+	packet.Eth: {
+		{ "eth.dst", 0, 6 }, { "eth.src", 6, 6 }, { "eth.type", 12, 2 },
+	},
+
+	packet.SLL: {
+		{ "sll.pkttype", 0, 2 }, { "sll.hatype", 2, 2 },
+		{ "sll.halen", 4, 2 }, { "sll.addr", 6, 8 }, { "sll.proto", 14, 2 },
+	},
+
+	packet.SLL2: {
+		{ "sll.proto", 0, 2 }, { "sll.ifindex", 4, 4 },
+		{ "sll.hatype", 8, 2 }, { "sll.pkttype", 10, 1 },
+		{ "sll.halen", 11, 1 }, { "sll.addr", 12, 8 },
+	},
+
+	packet.PPP: {
+		{ "ppp.addr", 0, 1 }, { "ppp.ctrl", 1, 1 }, { "ppp.proto", 2, 2 },
+	},
+
+	packet.Loopback: {
+		{ "null.family", 0, 4 },
+	},
+}
+
+var vlan_fields = []trace_field{
+	{ "vlan.tci", 0, 2 }, { "vlan.type", 2, 2 },
+}
+
+var arp_fields = []trace_field{
+	{ "arp.htype", 0, 2 }, { "arp.ptype", 2, 2 }, { "arp.hlen", 4, 1 },
+	{ "arp.plen", 5, 1 }, { "arp.op", 6, 2 }, { "arp.sha", 8, 6 },
+	{ "arp.spa", 14, 4 }, { "arp.tha", 18, 6 }, { "arp.tpa", 24, 4 },
+}
+
+var ipv4_fields = []trace_field{
+	{ "ipv4.ihl", 0, 1 }, { "ipv4.tos", 1, 1 }, { "ipv4.len", 2, 2 },
+	{ "ipv4.id", 4, 2 }, { "ipv4.frag", 6, 2 }, { "ipv4.ttl", 8, 1 },
+	{ "ipv4.proto", 9, 1 }, { "ipv4.csum", 10, 2 }, { "ipv4.src", 12, 4 },
+	{ "ipv4.dst", 16, 4 },
+}
+
+var ipv6_fields = []trace_field{
+	{ "ipv6.flow", 0, 4 }, { "ipv6.plen", 4, 2 }, { "ipv6.next", 6, 1 },
+	{ "ipv6.hlim", 7, 1 }, { "ipv6.src", 8, 16 }, { "ipv6.dst", 24, 16 },
+}
+
+var tcp_fields = []trace_field{
+	{ "tcp.sport", 0, 2 }, { "tcp.dport", 2, 2 }, { "tcp.seq", 4, 4 },
+	{ "tcp.ack", 8, 4 }, { "tcp.off", 12, 1 }, { "tcp.flags", 13, 1 },
+	{ "tcp.win", 14, 2 }, { "tcp.csum", 16, 2 }, { "tcp.urg", 18, 2 },
+}
+
+var udp_fields = []trace_field{
+	{ "udp.sport", 0, 2 }, { "udp.dport", 2, 2 }, { "udp.len", 4, 2 },
+	{ "udp.csum", 6, 2 },
+}
+
+var icmp_fields = []trace_field{
+	{ "icmp.type", 0, 1 }, { "icmp.code", 1, 1 }, { "icmp.csum", 2, 2 },
+}
+
+var icmp6_fields = []trace_field{
+	{ "icmp6.type", 0, 1 }, { "icmp6.code", 1, 1 }, { "icmp6.csum", 2, 2 },
+}
+
+/* Return the protocol fields of the packet in buf, at their absolute offset. */
+func trace_fields(buf []byte, link_type packet.Type) []trace_field {
+	var fields []trace_field
+
+	link, err := link_info_for(link_type)
+	if err != nil {
+		return nil
+	}
+
+	fields = append(fields, link_fields[link_type]...)
+
+	off := link.off_nl
+	typ := uint16(0)
+
+	switch link.kind {
+	case link_ethertype:
+		if uint32(len(buf)) < off {
+			return fields
+		}
+
+		typ = binary.BigEndian.Uint16(buf[link.off_type:])
+
+		for typ == 0x8100 && link_type == packet.Eth &&
+		    uint32(len(buf)) >= off + 4 {
+			fields = append(fields, fields_at(vlan_fields, off)...)
+			typ  = binary.BigEndian.Uint16(buf[off + 2:])
+			off += 4
+		}
+
+	case link_ppp:
+		if uint32(len(buf)) < off {
+			return fields
+		}
+
+		switch binary.BigEndian.Uint16(buf[link.off_type:]) {
+		case 0x0021:
+			typ = 0x0800
+
+		case 0x0057:
+			typ = 0x86dd
+		}
+
+	case link_ipv4:
+		typ = 0x0800
+
+	case link_ipv6:
+		typ = 0x86dd
+
+	case link_null, link_ip:
+		if uint32(len(buf)) <= off {
+			return fields
+		}
+
+		switch buf[off] >> 4 {
+		case 4:
+			typ = 0x0800
+
+		case 6:
+			typ = 0x86dd
+		}
+	}
+
+	proto := uint8(0)
+
+	switch typ {
+	case 0x0806:
+		return append(fields, fields_at(arp_fields, off)...)
+
+	case 0x0800:
+		fields = append(fields, fields_at(ipv4_fields, off)...)
+
+		if uint32(len(buf)) < off + 20 {
+			return fields
+		}
+
+		proto = buf[off + 9]
+		off  += uint32(buf[off] & 0xf) << 2
+
+	case 0x86dd:
+		fields = append(fields, fields_at(ipv6_fields, off)...)
+
+		if uint32(len(buf)) < off + 40 {
+			return fields
+		}
+
+		proto = buf[off + 6]
+		off  += 40
+	}
+
+	switch proto {
+	case 1:
+		fields = append(fields, fields_at(icmp_fields, off)...)
+
+	case 6:
+		fields = append(fields, fields_at(tcp_fields, off)...)
+
+	case 17:
+		fields = append(fields, fields_at(udp_fields, off)...)
+
+	case 58:
+		fields = append(fields, fields_at(icmp6_fields, off)...)
+	}
+
+	return fields
+}
+
+func fields_at(fields []trace_field, off uint32) []trace_field {
+	var out []trace_field
+
+	for _, f := range fields {
+		out = append(out, trace_field{ f.name, f.off + off, f.size })
+	}
+
+	return out
+}
+
+/* Return the name of the field touched by a load at off. */
+func field_name(fields []trace_field, off uint32) string {
+	for _, f := range fields {
+		if off < f.off || off >= f.off + f.size {
+			continue
+		}
+
+		if off == f.off {
+			return f.name
+		}
+
+		return fmt.Sprintf("%s+%d", f.name, off - f.off)
+	}
+
+	return ""
+}
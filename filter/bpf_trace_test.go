@@ -0,0 +1,126 @@
+/*
+ * Network packet analysis framework.
+ *
+ * Copyright (c) 2014, Alessandro Ghedini
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are
+ * met:
+ *
+ *     * Redistributions of source code must retain the above copyright
+ *       notice, this list of conditions and the following disclaimer.
+ *
+ *     * Redistributions in binary form must reproduce the above copyright
+ *       notice, this list of conditions and the following disclaimer in the
+ *       documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS
+ * IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO,
+ * THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR
+ * PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR
+ * CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+ * EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+ * PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+ * PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF
+ * LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+ * NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+ * SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package filter_test
+
+import "testing"
+
+import "github.com/ghedo/go.pkt/filter"
+import "github.com/ghedo/go.pkt/packet"
+
+var test_trace_udp = `(000) ldh      [12] eth.type            A = 0x800, X = 0x0
+(001) jeq      #0x800                   -> 2 (true)
+(002) ldb      [23] ipv4.proto          A = 0x11, X = 0x0
+(003) jeq      #0x11                    -> 4 (true)
+(004) ldxb     4*([14]&0xf) ipv4.ihl    A = 0x11, X = 0x14
+(005) ldh      [x + 16] udp.dport       A = 0x2092, X = 0x14
+(006) st       M[0]                     M[0] = 0x2092
+(007) jgt      #0x400                   -> 8 (true)
+(008) ret      #1                       => 1`
+
+var test_trace_fault = `(000) ldh      [12] eth.type            A = 0x800, X = 0x0
+(001) ldb      [23] ipv4.proto          A = 0x800, X = 0x0
+fault, packet rejected`
+
+func TestTrace(t *testing.T) {
+	flt := assemble(t, `
+		ldh [12]
+		jeq #0x800, ip, drop
+	ip:	ldb [23]
+		jeq #17, udp, drop
+	udp:	ldxb 4*([14]&0xf)
+		ldh [x + 16]
+		st M[0]
+		jgt #1024, keep, drop
+	keep:	ret #1
+	drop:	ret #0`)
+	defer flt.Cleanup()
+
+	tr := flt.Trace(test_eth_ipv4_udp)
+
+	if tr.Result != 1 || tr.Fault() {
+		t.Fatalf("Result mismatch: %d", tr.Result)
+	}
+
+	if len(tr.Steps) != 9 {
+		t.Fatalf("Steps mismatch: %d", len(tr.Steps))
+	}
+
+	if tr.Steps[6].Mem[0] != 8338 || tr.Steps[5].Mem[0] != 0 {
+		t.Fatalf("Memory mismatch")
+	}
+
+	if !tr.Steps[7].Taken || tr.Steps[7].PC != 7 {
+		t.Fatalf("Branch mismatch")
+	}
+
+	if tr.Annotate(packet.Eth) != test_trace_udp {
+		t.Fatalf("Trace mismatch:\n%s", tr.Annotate(packet.Eth))
+	}
+
+	tr = flt.Trace(test_eth_arp)
+
+	if tr.Result != 0 || len(tr.Steps) != 3 || tr.Steps[1].Taken {
+		t.Fatalf("Trace mismatch:\n%s", tr)
+	}
+}
+
+func TestTraceFault(t *testing.T) {
+	flt := assemble(t, `
+		ldh [12]
+		ldb [23]
+		ret a`)
+	defer flt.Cleanup()
+
+	tr := flt.Trace(test_eth_ipv4_udp[:20])
+
+	if tr.Result != 0 || !tr.Fault() {
+		t.Fatalf("Fault expected")
+	}
+
+	if tr.Annotate(packet.Eth) != test_trace_fault {
+		t.Fatalf("Trace mismatch:\n%s", tr.Annotate(packet.Eth))
+	}
+}
+
+func TestTraceCompare(t *testing.T) {
+	for _, test := range compile_tests {
+		flt, err := filter.Compile(test.expr, test.link, true)
+		if err != nil {
+			t.Fatalf("Error compiling '%s': %s", test.expr, err)
+		}
+
+		if flt.Trace(test.buf).Result != flt.Filter(test.buf) {
+			t.Fatalf("Result mismatch for '%s'", test.expr)
+		}
+
+		flt.Cleanup()
+	}
+}
@@ -0,0 +1,169 @@
+/*
+ * Network packet analysis framework.
+ *
+ * Copyright (c) 2014, Alessandro Ghedini
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are
+ * met:
+ *
+ *     * Redistributions of source code must retain the above copyright
+ *       notice, this list of conditions and the following disclaimer.
+ *
+ *     * Redistributions in binary form must reproduce the above copyright
+ *       notice, this list of conditions and the following disclaimer in the
+ *       documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS
+ * IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO,
+ * THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR
+ * PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR
+ * CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+ * EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+ * PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+ * PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF
+ * LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+ * NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+ * SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package filter
+
+import "fmt"
+
+// A VerifyError describes why a filter program was rejected by Verify().
+type VerifyError struct {
+	PC     int
+	Reason string
+}
+
+func (e *VerifyError) Error() string {
+	return fmt.Sprintf("Invalid instruction %d: %s", e.PC, e.Reason)
+}
+
+// Verify the filter. This performs the same checks as Validate(), and also
+// rejects programs that read scratch memory locations that haven't been written
+// to on every path leading to the read (like the Linux in-kernel checker does).
+// The returned error is a *VerifyError that describes the first problem found.
+func (f *Filter) Verify() error {
+	return verify(f.insns())
+}
+
+func verify(insns []bpf_insn) error {
+	n := len(insns)
+
+	if n == 0 {
+		return &VerifyError{ 0, "Empty program" }
+	}
+
+	for pc := range insns {
+		insn := &insns[pc]
+
+		if !valid_code(insn.code) {
+			return &VerifyError{
+				pc, fmt.Sprintf("Unknown opcode 0x%02x", insn.code),
+			}
+		}
+
+		switch {
+		case insn.code == uint16(JMP) | bpf_ja:
+			if uint64(pc) + 1 + uint64(insn.k) >= uint64(n) {
+				return &VerifyError{
+					pc, fmt.Sprintf("Jump out of range (%d)", insn.k),
+				}
+			}
+
+		case insn.code & 0x07 == uint16(JMP):
+			if pc + 1 + int(max(insn.jt, insn.jf)) >= n {
+				return &VerifyError{
+					pc, fmt.Sprintf("Jump out of range (%d, %d)",
+					                insn.jt, insn.jf),
+				}
+			}
+
+		case insn.code == uint16(ST) || insn.code == uint16(STX) ||
+		     insn.code == uint16(LD) | uint16(MEM) ||
+		     insn.code == uint16(LDX) | uint16(MEM):
+			if insn.k >= mem_words {
+				return &VerifyError{
+					pc, fmt.Sprintf("Invalid scratch memory M[%d]",
+					                insn.k),
+				}
+			}
+
+		case insn.code == uint16(ALU) | bpf_div | uint16(Const) ||
+		     insn.code == uint16(ALU) | bpf_mod | uint16(Const):
+			if insn.k == 0 {
+				return &VerifyError{ pc, "Division by zero" }
+			}
+		}
+	}
+
+	if insns[n - 1].code & 0x07 != uint16(RET) {
+		return &VerifyError{ n - 1, "Missing return at end of program" }
+	}
+
+	/*
+	 * Track the scratch memory locations written on every path leading to
+	 * each instruction. Jumps are forward only, so a single pass in
+	 * program order visits every predecessor before its successors.
+	 */
+	reached := make([]bool, n)
+	written := make([]uint16, n)
+
+	reached[0] = true
+
+	for pc := range insns {
+		if !reached[pc] {
+			continue
+		}
+
+		insn := &insns[pc]
+		mem  := written[pc]
+
+		switch insn.code {
+		case uint16(LD) | uint16(MEM), uint16(LDX) | uint16(MEM):
+			if mem & (1 << insn.k) == 0 {
+				return &VerifyError{
+					pc, fmt.Sprintf(
+						"Read of uninitialized scratch memory M[%d]",
+						insn.k,
+					),
+				}
+			}
+
+		case uint16(ST), uint16(STX):
+			mem |= 1 << insn.k
+		}
+
+		for _, succ := range successors(insns, pc) {
+			if reached[succ] {
+				written[succ] &= mem
+			} else {
+				reached[succ] = true
+				written[succ] = mem
+			}
+		}
+	}
+
+	return nil
+}
+
+/* Return the indices of the instructions that may follow the one at pc. */
+func successors(insns []bpf_insn, pc int) []int {
+	insn := &insns[pc]
+
+	switch {
+	case insn.code & 0x07 == uint16(RET):
+		return nil
+
+	case insn.code == uint16(JMP) | bpf_ja:
+		return []int{ pc + 1 + int(insn.k) }
+
+	case insn.code & 0x07 == uint16(JMP):
+		return []int{ pc + 1 + int(insn.jt), pc + 1 + int(insn.jf) }
+	}
+
+	return []int{ pc + 1 }
+}
@@ -0,0 +1,102 @@
+/*
+ * Network packet analysis framework.
+ *
+ * Copyright (c) 2014, Alessandro Ghedini
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are
+ * met:
+ *
+ *     * Redistributions of source code must retain the above copyright
+ *       notice, this list of conditions and the following disclaimer.
+ *
+ *     * Redistributions in binary form must reproduce the above copyright
+ *       notice, this list of conditions and the following disclaimer in the
+ *       documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS
+ * IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO,
+ * THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR
+ * PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR
+ * CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+ * EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+ * PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+ * PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF
+ * LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+ * NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+ * SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package filter_test
+
+import "testing"
+
+import "github.com/ghedo/go.pkt/filter"
+
+func TestVerify(t *testing.T) {
+	tests := []struct {
+		src string
+		pc  int
+		err string
+	}{
+		{ "ldh [12]\njeq #1 jt 2 jf 2\nret #0",
+		  -1, "" },
+		{ "ld M[3]\nret a",
+		  0, "Read of uninitialized scratch memory M[3]" },
+		{ "ldh [12]\njeq #1, l1, l2\nl1: st M[1]\nl2: ld M[1]\nret a",
+		  3, "Read of uninitialized scratch memory M[1]" },
+		{ "st M[1]\nldh [12]\njeq #1, l1, l2\nl1: ret #1\nl2: ld M[1]\nret a",
+		  -1, "" },
+		{ "ld #1\ndiv #0\nret a",
+		  1, "Division by zero" },
+		{ "ld #1\nmod #0\nret a",
+		  1, "Division by zero" },
+		{ "ldh [12]",
+		  0, "Missing return at end of program" },
+	}
+
+	for _, test := range tests {
+		flt, err := filter.Assemble(test.src)
+		if err != nil {
+			t.Fatalf("Error assembling: %s", err)
+		}
+
+		err = flt.Verify()
+		flt.Cleanup()
+
+		if test.pc < 0 {
+			if err != nil {
+				t.Fatalf("Unexpected error: %s", err)
+			}
+
+			continue
+		}
+
+		verr, ok := err.(*filter.VerifyError)
+		if !ok {
+			t.Fatalf("Expected VerifyError for:\n%s\ngot: %v", test.src, err)
+		}
+
+		if verr.PC != test.pc || verr.Reason != test.err {
+			t.Fatalf("Error mismatch: %s", verr)
+		}
+	}
+
+	/* out-of-range jumps can't be assembled, so build them directly */
+	flt := &filter.Filter{}
+	defer flt.Cleanup()
+
+	flt.AppendInsn(0x15, 0, 3, 1)
+	flt.AppendInsn(0x06, 0, 0, 0)
+
+	err := flt.Verify()
+	if err == nil || err.Error() != "Invalid instruction 0: Jump out of range (0, 3)" {
+		t.Fatalf("Error mismatch: %v", err)
+	}
+
+	empty := &filter.Filter{}
+	if empty.Verify() == nil {
+		t.Fatalf("Empty program verified")
+	}
+}
@@ -0,0 +1,594 @@
+/*
+ * Network packet analysis framework.
+ *
+ * Copyright (c) 2014, Alessandro Ghedini
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are
+ * met:
+ *
+ *     * Redistributions of source code must retain the above copyright
+ *       notice, this list of conditions and the following disclaimer.
+ *
+ *     * Redistributions in binary form must reproduce the above copyright
+ *       notice, this list of conditions and the following disclaimer in the
+ *       documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS
+ * IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO,
+ * THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR
+ * PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR
+ * CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+ * EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+ * PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+ * PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF
+ * LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+ * NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+ * SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package filter
+
+import "encoding/binary"
+import "math/rand"
+
+// Offsets of the Linux ancillary fields, which can be loaded into the
+// accumulator with an LD instruction in ABS mode (e.g. "ld #proto").
+const (
+	ExtOffset      uint32 = 0xfffff000
+	ExtProto              = ExtOffset + 0
+	ExtType               = ExtOffset + 4
+	ExtIfIndex            = ExtOffset + 8
+	ExtNLAttr             = ExtOffset + 12
+	ExtNLAttrNest         = ExtOffset + 16
+	ExtMark               = ExtOffset + 20
+	ExtQueue              = ExtOffset + 24
+	ExtHaType             = ExtOffset + 28
+	ExtRxHash             = ExtOffset + 32
+	ExtCPU                = ExtOffset + 36
+	ExtXorX               = ExtOffset + 40
+	ExtVlanTag            = ExtOffset + 44
+	ExtVlanPresent        = ExtOffset + 48
+	ExtPayOffset          = ExtOffset + 52
+	ExtRandom             = ExtOffset + 56
+	ExtVlanTPID           = ExtOffset + 60
+)
+
+// Base offsets of the Linux negative packet offsets, which load packet data
+// relative to the start of the network header or of the link-layer header.
+const (
+	NetOffset  uint32 = 0xfff00000
+	LinkOffset        = 0xffe00000
+)
+
+/* number of scratch memory words */
+const mem_words = 16
+
+/* ALU, JMP and MISC operations */
+const (
+	bpf_add  uint16 = 0x00
+	bpf_sub         = 0x10
+	bpf_mul         = 0x20
+	bpf_div         = 0x30
+	bpf_or          = 0x40
+	bpf_and         = 0x50
+	bpf_lsh         = 0x60
+	bpf_rsh         = 0x70
+	bpf_neg         = 0x80
+	bpf_mod         = 0x90
+	bpf_xor         = 0xa0
+
+	bpf_ja          = 0x00
+	bpf_jeq         = 0x10
+	bpf_jgt         = 0x20
+	bpf_jge         = 0x30
+	bpf_jset        = 0x40
+
+	bpf_tax         = 0x00
+	bpf_txa         = 0x80
+)
+
+// Packet metadata used by the Linux extensions (ancillary fields and negative
+// packet offsets) when running a filter in user-space.
+type Context struct {
+	WireLen     uint32
+	Proto       uint16
+	Type        uint32
+	IfIndex     uint32
+	Mark        uint32
+	Queue       uint32
+	HaType      uint16
+	RxHash      uint32
+	CPU         uint32
+	VlanTag     uint16
+	VlanPresent bool
+	VlanTPID    uint16
+	NetOffset   uint32
+	PayOffset   uint32
+	Random      func() uint32
+}
+
+// Run the filter on the given buffer, using the given context for the Linux
+// extensions, and return its result. If ctx is nil, the extensions are not
+// supported and the filter behaves exactly like the in-kernel BSD BPF machine
+// (i.e. out-of-range loads reject the packet).
+func (f *Filter) Run(buf []byte, ctx *Context) uint {
+	return uint(run(f.insns(), buf, ctx, nil))
+}
+
+func run(insns []bpf_insn, buf []byte, ctx *Context, tr *Trace) uint32 {
+	var a, x uint32
+	var mem [mem_words]uint32
+
+	if len(insns) == 0 {
+		return 0xffffffff
+	}
+
+	wirelen := uint32(len(buf))
+	if ctx != nil && ctx.WireLen != 0 {
+		wirelen = ctx.WireLen
+	}
+
+	for pc := 0; pc < len(insns); pc++ {
+		insn := &insns[pc]
+
+		if tr != nil {
+			tr.step(pc, insn, a, x, &mem)
+		}
+
+		switch insn.code {
+		case uint16(RET) | uint16(Const):
+			return insn.k
+
+		case uint16(RET) | uint16(Acc):
+			return a
+
+		/* rejected by Validate(), like libpcap and Linux do */
+		case uint16(RET) | uint16(Index):
+			return x
+
+		case uint16(LD) | uint16(Word) | uint16(ABS),
+		     uint16(LD) | uint16(Half) | uint16(ABS),
+		     uint16(LD) | uint16(Byte) | uint16(ABS):
+			if ctx != nil && insn.k >= ExtOffset {
+				v, ok := load_ext(insn.k, a, x, buf, ctx)
+				if !ok {
+					return 0
+				}
+
+				a = v
+				continue
+			}
+
+			v, ok := load(insn.code, insn.k, buf, ctx)
+			if !ok {
+				return 0
+			}
+
+			a = v
+
+		case uint16(LD) | uint16(Word) | uint16(IND),
+		     uint16(LD) | uint16(Half) | uint16(IND),
+		     uint16(LD) | uint16(Byte) | uint16(IND):
+			off := uint64(x) + uint64(insn.k)
+
+			if ctx != nil && int32(x + insn.k) < 0 {
+				off = uint64(x + insn.k)
+			}
+
+			if off > 0xffffffff {
+				return 0
+			}
+
+			v, ok := load(insn.code, uint32(off), buf, ctx)
+			if !ok {
+				return 0
+			}
+
+			a = v
+
+		case uint16(LD) | uint16(Word) | uint16(LEN):
+			a = wirelen
+
+		case uint16(LDX) | uint16(Word) | uint16(LEN):
+			x = wirelen
+
+		case uint16(LDX) | uint16(Byte) | uint16(MSH):
+			if insn.k >= uint32(len(buf)) {
+				return 0
+			}
+
+			x = uint32(buf[insn.k] & 0xf) << 2
+
+		case uint16(LD) | uint16(IMM):
+			a = insn.k
+
+		case uint16(LDX) | uint16(IMM):
+			x = insn.k
+
+		case uint16(LD) | uint16(MEM):
+			if insn.k >= mem_words {
+				return 0
+			}
+
+			a = mem[insn.k]
+
+		case uint16(LDX) | uint16(MEM):
+			if insn.k >= mem_words {
+				return 0
+			}
+
+			x = mem[insn.k]
+
+		case uint16(ST):
+			if insn.k >= mem_words {
+				return 0
+			}
+
+			mem[insn.k] = a
+
+		case uint16(STX):
+			if insn.k >= mem_words {
+				return 0
+			}
+
+			mem[insn.k] = x
+
+		case uint16(JMP) | bpf_ja:
+			pc += int(insn.k)
+
+		case uint16(JMP) | bpf_jgt | uint16(Const):
+			pc += branch(a > insn.k, insn)
+
+		case uint16(JMP) | bpf_jge | uint16(Const):
+			pc += branch(a >= insn.k, insn)
+
+		case uint16(JMP) | bpf_jeq | uint16(Const):
+			pc += branch(a == insn.k, insn)
+
+		case uint16(JMP) | bpf_jset | uint16(Const):
+			pc += branch(a & insn.k != 0, insn)
+
+		case uint16(JMP) | bpf_jgt | uint16(Index):
+			pc += branch(a > x, insn)
+
+		case uint16(JMP) | bpf_jge | uint16(Index):
+			pc += branch(a >= x, insn)
+
+		case uint16(JMP) | bpf_jeq | uint16(Index):
+			pc += branch(a == x, insn)
+
+		case uint16(JMP) | bpf_jset | uint16(Index):
+			pc += branch(a & x != 0, insn)
+
+		case uint16(ALU) | bpf_add | uint16(Index):
+			a += x
+
+		case uint16(ALU) | bpf_sub | uint16(Index):
+			a -= x
+
+		case uint16(ALU) | bpf_mul | uint16(Index):
+			a *= x
+
+		case uint16(ALU) | bpf_div | uint16(Index):
+			if x == 0 {
+				return 0
+			}
+
+			a /= x
+
+		case uint16(ALU) | bpf_mod | uint16(Index):
+			if x == 0 {
+				return 0
+			}
+
+			a %= x
+
+		case uint16(ALU) | bpf_and | uint16(Index):
+			a &= x
+
+		case uint16(ALU) | bpf_xor | uint16(Index):
+			a ^= x
+
+		case uint16(ALU) | bpf_or | uint16(Index):
+			a |= x
+
+		case uint16(ALU) | bpf_lsh | uint16(Index):
+			a <<= x & 31
+
+		case uint16(ALU) | bpf_rsh | uint16(Index):
+			a >>= x & 31
+
+		case uint16(ALU) | bpf_add | uint16(Const):
+			a += insn.k
+
+		case uint16(ALU) | bpf_sub | uint16(Const):
+			a -= insn.k
+
+		case uint16(ALU) | bpf_mul | uint16(Const):
+			a *= insn.k
+
+		case uint16(ALU) | bpf_div | uint16(Const):
+			if insn.k == 0 {
+				return 0
+			}
+
+			a /= insn.k
+
+		case uint16(ALU) | bpf_mod | uint16(Const):
+			if insn.k == 0 {
+				return 0
+			}
+
+			a %= insn.k
+
+		case uint16(ALU) | bpf_and | uint16(Const):
+			a &= insn.k
+
+		case uint16(ALU) | bpf_xor | uint16(Const):
+			a ^= insn.k
+
+		case uint16(ALU) | bpf_or | uint16(Const):
+			a |= insn.k
+
+		case uint16(ALU) | bpf_lsh | uint16(Const):
+			a <<= insn.k & 31
+
+		case uint16(ALU) | bpf_rsh | uint16(Const):
+			a >>= insn.k & 31
+
+		case uint16(ALU) | bpf_neg:
+			a = -a
+
+		case uint16(MISC) | bpf_tax:
+			x = a
+
+		case uint16(MISC) | bpf_txa:
+			a = x
+
+		default:
+			return 0
+		}
+	}
+
+	/* the program fell off its end, which Validate() doesn't allow */
+	return 0
+}
+
+func branch(cond bool, insn *bpf_insn) int {
+	if cond {
+		return int(insn.jt)
+	}
+
+	return int(insn.jf)
+}
+
+func load(code uint16, off uint32, buf []byte, ctx *Context) (uint32, bool) {
+	if ctx != nil && int32(off) < 0 {
+		switch {
+		case off >= ExtOffset:
+			return 0, false
+
+		case off >= NetOffset:
+			off = off - NetOffset + ctx.NetOffset
+
+		case off >= LinkOffset:
+			off = off - LinkOffset
+
+		default:
+			return 0, false
+		}
+	}
+
+	size := uint64(4)
+
+	switch Size(code & 0x18) {
+	case Half:
+		size = 2
+
+	case Byte:
+		size = 1
+	}
+
+	if uint64(off) + size > uint64(len(buf)) {
+		return 0, false
+	}
+
+	switch size {
+	case 4:
+		return binary.BigEndian.Uint32(buf[off:]), true
+
+	case 2:
+		return uint32(binary.BigEndian.Uint16(buf[off:])), true
+
+	default:
+		return uint32(buf[off]), true
+	}
+}
+
+func load_ext(k, a, x uint32, buf []byte, ctx *Context) (uint32, bool) {
+	switch k {
+	case ExtProto:
+		return uint32(ctx.Proto), true
+
+	case ExtType:
+		return ctx.Type, true
+
+	case ExtIfIndex:
+		return ctx.IfIndex, true
+
+	case ExtNLAttr:
+		return find_nlattr(buf, a, x), true
+
+	case ExtNLAttrNest:
+		if uint64(a) + 4 > uint64(len(buf)) {
+			return 0, true
+		}
+
+		nla_len := uint32(binary.LittleEndian.Uint16(buf[a:]))
+		if nla_len < 4 || uint64(a) + uint64(nla_len) > uint64(len(buf)) {
+			return 0, true
+		}
+
+		off := find_nlattr(buf[:a + nla_len], a + 4, x)
+		return off, true
+
+	case ExtMark:
+		return ctx.Mark, true
+
+	case ExtQueue:
+		return ctx.Queue, true
+
+	case ExtHaType:
+		return uint32(ctx.HaType), true
+
+	case ExtRxHash:
+		return ctx.RxHash, true
+
+	case ExtCPU:
+		return ctx.CPU, true
+
+	case ExtXorX:
+		return a ^ x, true
+
+	case ExtVlanTag:
+		return uint32(ctx.VlanTag), true
+
+	case ExtVlanPresent:
+		if ctx.VlanPresent {
+			return 1, true
+		}
+
+		return 0, true
+
+	case ExtPayOffset:
+		return ctx.PayOffset, true
+
+	case ExtRandom:
+		if ctx.Random != nil {
+			return ctx.Random(), true
+		}
+
+		return rand.Uint32(), true
+
+	case ExtVlanTPID:
+		return uint32(ctx.VlanTPID), true
+	}
+
+	return 0, false
+}
+
+/* Return the offset of the netlink attribute of type t among the attributes
+ * starting at offset off, or 0 if there's no such attribute. Netlink uses the
+ * host byte order, which is assumed to be little-endian. */
+func find_nlattr(buf []byte, off, t uint32) uint32 {
+	if off > uint32(len(buf)) {
+		return 0
+	}
+
+	for uint64(off) + 4 <= uint64(len(buf)) {
+		nla_len  := uint32(binary.LittleEndian.Uint16(buf[off:]))
+		nla_type := uint32(binary.LittleEndian.Uint16(buf[off + 2:]))
+
+		if nla_len < 4 || uint64(off) + uint64(nla_len) > uint64(len(buf)) {
+			return 0
+		}
+
+		if nla_type & 0x3fff == t {
+			return off
+		}
+
+		off += (nla_len + 3) &^ 3
+	}
+
+	return 0
+}
+
+/* Check that the given program is valid, like bpf_validate() does. */
+func validate(insns []bpf_insn) bool {
+	if len(insns) == 0 {
+		return true
+	}
+
+	for i := range insns {
+		insn := &insns[i]
+
+		if !valid_code(insn.code) {
+			return false
+		}
+
+		switch {
+		case insn.code & 0x07 == uint16(JMP):
+			var off uint32
+
+			if insn.code == uint16(JMP) | bpf_ja {
+				off = insn.k
+			} else {
+				off = uint32(max(insn.jt, insn.jf))
+			}
+
+			if uint64(off) >= uint64(len(insns) - i - 1) {
+				return false
+			}
+
+		case insn.code == uint16(ST) || insn.code == uint16(STX) ||
+		     insn.code == uint16(LD) | uint16(MEM) ||
+		     insn.code == uint16(LDX) | uint16(MEM):
+			if insn.k >= mem_words {
+				return false
+			}
+
+		case insn.code == uint16(ALU) | bpf_div | uint16(Const) ||
+		     insn.code == uint16(ALU) | bpf_mod | uint16(Const):
+			if insn.k == 0 {
+				return false
+			}
+		}
+	}
+
+	return insns[len(insns) - 1].code & 0x07 == uint16(RET)
+}
+
+func valid_code(code uint16) bool {
+	switch code {
+	case uint16(RET) | uint16(Const), uint16(RET) | uint16(Acc),
+	     uint16(LD) | uint16(Word) | uint16(ABS),
+	     uint16(LD) | uint16(Half) | uint16(ABS),
+	     uint16(LD) | uint16(Byte) | uint16(ABS),
+	     uint16(LD) | uint16(Word) | uint16(IND),
+	     uint16(LD) | uint16(Half) | uint16(IND),
+	     uint16(LD) | uint16(Byte) | uint16(IND),
+	     uint16(LD) | uint16(Word) | uint16(LEN),
+	     uint16(LDX) | uint16(Word) | uint16(LEN),
+	     uint16(LDX) | uint16(Byte) | uint16(MSH),
+	     uint16(LD) | uint16(IMM), uint16(LDX) | uint16(IMM),
+	     uint16(LD) | uint16(MEM), uint16(LDX) | uint16(MEM),
+	     uint16(ST), uint16(STX),
+	     uint16(JMP) | bpf_ja,
+	     uint16(MISC) | bpf_tax, uint16(MISC) | bpf_txa,
+	     uint16(ALU) | bpf_neg:
+		return true
+	}
+
+	switch code & 0x07 {
+	case uint16(JMP):
+		switch code &^ uint16(Index) {
+		case uint16(JMP) | bpf_jeq, uint16(JMP) | bpf_jgt,
+		     uint16(JMP) | bpf_jge, uint16(JMP) | bpf_jset:
+			return true
+		}
+
+	case uint16(ALU):
+		switch code &^ uint16(Index) {
+		case uint16(ALU) | bpf_add, uint16(ALU) | bpf_sub,
+		     uint16(ALU) | bpf_mul, uint16(ALU) | bpf_div,
+		     uint16(ALU) | bpf_and, uint16(ALU) | bpf_or,
+		     uint16(ALU) | bpf_lsh, uint16(ALU) | bpf_rsh,
+		     uint16(ALU) | bpf_mod, uint16(ALU) | bpf_xor:
+			return true
+		}
+	}
+
+	return false
+}
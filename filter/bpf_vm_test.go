@@ -0,0 +1,279 @@
+/*
+ * Network packet analysis framework.
+ *
+ * Copyright (c) 2014, Alessandro Ghedini
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are
+ * met:
+ *
+ *     * Redistributions of source code must retain the above copyright
+ *       notice, this list of conditions and the following disclaimer.
+ *
+ *     * Redistributions in binary form must reproduce the above copyright
+ *       notice, this list of conditions and the following disclaimer in the
+ *       documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS
+ * IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO,
+ * THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR
+ * PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR
+ * CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+ * EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+ * PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+ * PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF
+ * LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+ * NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+ * SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package filter_test
+
+import "math/rand"
+import "testing"
+
+import "github.com/ghedo/go.pkt/filter"
+
+var test_codes = []uint16{
+	0x00, 0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x0c, 0x14, 0x15, 0x16,
+	0x1c, 0x1d, 0x20, 0x24, 0x25, 0x28, 0x2c, 0x2d, 0x30, 0x34, 0x35, 0x3c,
+	0x3d, 0x40, 0x44, 0x45, 0x48, 0x4c, 0x4d, 0x50, 0x54, 0x5c, 0x60, 0x61,
+	0x64, 0x6c, 0x74, 0x7c, 0x80, 0x81, 0x84, 0x87, 0x94, 0x9c, 0xa4, 0xac,
+	0xb1,
+}
+
+func must_build(t testing.TB, b *filter.Builder) *filter.Filter {
+	f, err := b.Build()
+	if err != nil {
+		t.Fatalf("Error building filter: %s", err)
+	}
+
+	return f
+}
+
+func random_filter(r *rand.Rand, n int, valid bool) *filter.Filter {
+	f := &filter.Filter{}
+
+	for i := 0; i < n; i++ {
+		code := test_codes[r.Intn(len(test_codes))]
+		left := n - i - 1
+
+		if !valid && r.Intn(20) == 0 {
+			code = uint16(r.Intn(0x100))
+		}
+
+		if i == n - 1 {
+			code = 0x06 + uint16(r.Intn(2)) * 0x10
+		}
+
+		var jt, jf uint8
+		var k uint32
+
+		switch r.Intn(4) {
+		case 0:
+			k = uint32(r.Intn(16))
+
+		case 1:
+			k = uint32(r.Intn(80))
+
+		case 2:
+			k = r.Uint32()
+
+		case 3:
+			k = uint32(r.Intn(40))
+		}
+
+		switch {
+		case code == 0x05:
+			k = uint32(r.Intn(max(left, 1)))
+
+		case code & 0x07 == 0x05:
+			jt = uint8(r.Intn(max(min(left, 256), 1)))
+			jf = uint8(r.Intn(max(min(left, 256), 1)))
+
+		case code == 0x02 || code == 0x03 || code == 0x60 || code == 0x61:
+			k %= 16
+
+		case (code == 0x34 || code == 0x94) && k == 0:
+			k = 1
+		}
+
+		if !valid && r.Intn(20) == 0 {
+			jt = uint8(r.Intn(256))
+			k  = r.Uint32()
+		}
+
+		f.AppendInsn(code, jt, jf, k)
+	}
+
+	return f
+}
+
+func TestRunCompare(t *testing.T) {
+	if !filter.HaveC {
+		t.Skip("C implementation not available")
+	}
+
+	r := rand.New(rand.NewSource(1))
+
+	for i := 0; i < 5000; i++ {
+		f := random_filter(r, 1 + r.Intn(40), true)
+
+		if !f.ValidateC() {
+			continue
+		}
+
+		if !f.Validate() {
+			t.Fatalf("Validate mismatch:\n%s", f)
+		}
+
+		for j := 0; j < 10; j++ {
+			buf := make([]byte, r.Intn(80))
+			r.Read(buf)
+
+			if f.Filter(buf) != f.FilterC(buf) {
+				t.Fatalf("Result mismatch (%d != %d) for %x:\n%s",
+				         f.Filter(buf), f.FilterC(buf), buf, f)
+			}
+		}
+
+		f.Cleanup()
+	}
+}
+
+func TestValidateCompare(t *testing.T) {
+	if !filter.HaveC {
+		t.Skip("C implementation not available")
+	}
+
+	r := rand.New(rand.NewSource(2))
+
+	for i := 0; i < 20000; i++ {
+		f := random_filter(r, 1 + r.Intn(20), false)
+
+		if f.Validate() != f.ValidateC() {
+			t.Fatalf("Validate mismatch (%v):\n%s", f.Validate(), f)
+		}
+
+		f.Cleanup()
+	}
+}
+
+func TestRunDivZero(t *testing.T) {
+	f := must_build(t, filter.NewBuilder().
+		LDX(filter.Word, filter.IMM, 0).
+		LD(filter.Word, filter.IMM, 10).
+		DIV(filter.Index, 0).
+		RET(filter.Const, 1))
+
+	if f.Filter(test_eth_arp) != 0 {
+		t.Fatalf("Division by zero didn't reject the packet")
+	}
+
+	if filter.HaveC && f.FilterC(test_eth_arp) != 0 {
+		t.Fatalf("Division by zero didn't reject the packet (C)")
+	}
+}
+
+func TestRunExt(t *testing.T) {
+	ctx := &filter.Context{
+		Proto:       0x0806,
+		Type:        4,
+		IfIndex:     7,
+		Mark:        0x1234,
+		VlanTag:     0x87,
+		VlanPresent: true,
+		NetOffset:   14,
+		Random:      func() uint32 { return 42 },
+	}
+
+	tests := []struct {
+		k   uint32
+		val uint
+	}{
+		{ filter.ExtProto,       0x0806 },
+		{ filter.ExtType,        4 },
+		{ filter.ExtIfIndex,     7 },
+		{ filter.ExtMark,        0x1234 },
+		{ filter.ExtVlanTag,     0x87 },
+		{ filter.ExtVlanPresent, 1 },
+		{ filter.ExtRandom,      42 },
+	}
+
+	for _, test := range tests {
+		f := must_build(t, filter.NewBuilder().
+			LD(filter.Word, filter.ABS, test.k).
+			RET(filter.Acc, 0))
+
+		if v := f.Run(test_eth_arp, ctx); v != test.val {
+			t.Fatalf("Ext 0x%x mismatch: %d", test.k, v)
+		}
+
+		if v := f.Run(test_eth_arp, nil); v != 0 {
+			t.Fatalf("Ext 0x%x without context: %d", test.k, v)
+		}
+	}
+
+	/* ARP operation, relative to the network header */
+	f := must_build(t, filter.NewBuilder().
+		LD(filter.Half, filter.ABS, filter.NetOffset + 6).
+		RET(filter.Acc, 0))
+
+	if v := f.Run(test_eth_arp, ctx); v != 1 {
+		t.Fatalf("Net offset mismatch: %d", v)
+	}
+
+	f = must_build(t, filter.NewBuilder().
+		LD(filter.Half, filter.ABS, filter.LinkOffset + 12).
+		RET(filter.Acc, 0))
+
+	if v := f.Run(test_eth_arp, ctx); v != 0x0806 {
+		t.Fatalf("Link offset mismatch: %d", v)
+	}
+}
+
+func TestRunNLAttr(t *testing.T) {
+	/* two attributes: type 1 (len 8) and type 5 (len 6, padded to 8) */
+	buf := []byte{
+		0x08, 0x00, 0x01, 0x00, 0xaa, 0xbb, 0xcc, 0xdd,
+		0x06, 0x00, 0x05, 0x00, 0x11, 0x22, 0x00, 0x00,
+	}
+
+	f := must_build(t, filter.NewBuilder().
+		LD(filter.Word, filter.IMM, 0).
+		LDX(filter.Word, filter.IMM, 5).
+		LD(filter.Word, filter.ABS, filter.ExtNLAttr).
+		RET(filter.Acc, 0))
+
+	if v := f.Run(buf, &filter.Context{}); v != 8 {
+		t.Fatalf("NLAttr mismatch: %d", v)
+	}
+}
+
+func BenchmarkMatchC(b *testing.B) {
+	test_filter := must_build(b, filter.NewBuilder().
+		LD(filter.Half, filter.ABS, 12).
+		JEQ(filter.Const, "", "fail", 0x800).
+		LD(filter.Byte, filter.ABS, 23).
+		JEQ(filter.Const, "", "fail", 0x06).
+		RET(filter.Const, 0x40000).
+		Label("fail").
+		RET(filter.Const, 0x0))
+
+	b.Run("go", func(b *testing.B) {
+		for n := 0; n < b.N; n++ {
+			test_filter.Match(test_eth_ipv4_tcp)
+		}
+	})
+
+	if !filter.HaveC {
+		return
+	}
+
+	b.Run("c", func(b *testing.B) {
+		for n := 0; n < b.N; n++ {
+			test_filter.FilterC(test_eth_ipv4_tcp)
+		}
+	})
+}
@@ -0,0 +1,78 @@
+/*
+ * Network packet analysis framework.
+ *
+ * Copyright (c) 2014, Alessandro Ghedini
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are
+ * met:
+ *
+ *     * Redistributions of source code must retain the above copyright
+ *       notice, this list of conditions and the following disclaimer.
+ *
+ *     * Redistributions in binary form must reproduce the above copyright
+ *       notice, this list of conditions and the following disclaimer in the
+ *       documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS
+ * IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO,
+ * THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR
+ * PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR
+ * CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+ * EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+ * PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+ * PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF
+ * LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+ * NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+ * SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package filter
+
+import "fmt"
+
+import "golang.org/x/net/bpf"
+
+// Create a new filter from the given golang.org/x/net/bpf raw instructions.
+func FromRawInstructions(raw []bpf.RawInstruction) *Filter {
+	f := &Filter{}
+
+	for _, insn := range raw {
+		f.append_insn(Code(insn.Op), insn.Jt, insn.Jf, insn.K)
+	}
+
+	return f
+}
+
+// Create a new filter from the given golang.org/x/net/bpf instructions.
+func FromInstructions(insns []bpf.Instruction) (*Filter, error) {
+	raw, err := bpf.Assemble(insns)
+	if err != nil {
+		return nil, fmt.Errorf("Could not assemble filter: %s", err)
+	}
+
+	return FromRawInstructions(raw), nil
+}
+
+// Return the filter's instructions as golang.org/x/net/bpf raw instructions.
+func (f *Filter) RawInstructions() []bpf.RawInstruction {
+	raw := make([]bpf.RawInstruction, f.Len())
+
+	for i, insn := range f.insns() {
+		raw[i] = bpf.RawInstruction{
+			Op: insn.code, Jt: insn.jt, Jf: insn.jf, K: insn.k,
+		}
+	}
+
+	return raw
+}
+
+// Return the filter's instructions as golang.org/x/net/bpf instructions. The
+// instructions that golang.org/x/net/bpf does not know about (e.g. some of the
+// Linux extensions) are returned as bpf.RawInstruction, so that the result can
+// always be converted back to the same filter.
+func (f *Filter) Instructions() []bpf.Instruction {
+	insns, _ := bpf.Disassemble(f.RawInstructions())
+	return insns
+}
@@ -0,0 +1,102 @@
+/*
+ * Network packet analysis framework.
+ *
+ * Copyright (c) 2014, Alessandro Ghedini
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are
+ * met:
+ *
+ *     * Redistributions of source code must retain the above copyright
+ *       notice, this list of conditions and the following disclaimer.
+ *
+ *     * Redistributions in binary form must reproduce the above copyright
+ *       notice, this list of conditions and the following disclaimer in the
+ *       documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS
+ * IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO,
+ * THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR
+ * PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR
+ * CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+ * EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+ * PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+ * PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF
+ * LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+ * NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+ * SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package filter_test
+
+import "testing"
+
+import "golang.org/x/net/bpf"
+
+import "github.com/ghedo/go.pkt/filter"
+
+func TestInsns(t *testing.T) {
+	flt := compile(t, "udp port 53")
+	defer flt.Cleanup()
+
+	insns := flt.Insns()
+	if len(insns) != flt.Len() {
+		t.Fatalf("Len mismatch: %d", len(insns))
+	}
+
+	cpy := filter.FromInsns(insns)
+	defer cpy.Cleanup()
+
+	if cpy.String() != flt.String() {
+		t.Fatalf("Program mismatch:\n%s", cpy)
+	}
+}
+
+func TestFromInstructions(t *testing.T) {
+	flt, err := filter.FromInstructions([]bpf.Instruction{
+		bpf.LoadAbsolute{ Off: 12, Size: 2 },
+		bpf.JumpIf{ Cond: bpf.JumpEqual, Val: 0x806, SkipFalse: 1 },
+		bpf.RetConstant{ Val: 0x40000 },
+		bpf.RetConstant{ Val: 0 },
+	})
+	if err != nil {
+		t.Fatalf("Error converting: %s", err)
+	}
+	defer flt.Cleanup()
+
+	if flt.String() != test_arp {
+		t.Fatalf("Program mismatch:\n%s", flt)
+	}
+
+	_, err = filter.FromInstructions([]bpf.Instruction{
+		bpf.LoadAbsolute{ Off: 12, Size: 3 },
+	})
+	if err == nil {
+		t.Fatalf("Error expected")
+	}
+}
+
+func TestInstructionsRoundTrip(t *testing.T) {
+	for _, expr := range []string{ "arp", "udp port 53", "tcp[13] & 2 != 0" } {
+		flt := compile(t, expr)
+
+		raw := filter.FromRawInstructions(flt.RawInstructions())
+		if raw.String() != flt.String() {
+			t.Fatalf("Raw mismatch for '%s':\n%s", expr, raw)
+		}
+
+		cpy, err := filter.FromInstructions(flt.Instructions())
+		if err != nil {
+			t.Fatalf("Error converting '%s': %s", expr, err)
+		}
+
+		if cpy.String() != flt.String() {
+			t.Fatalf("Program mismatch for '%s':\n%s", expr, cpy)
+		}
+
+		flt.Cleanup()
+		raw.Cleanup()
+		cpy.Cleanup()
+	}
+}
@@ -0,0 +1,854 @@
+/*
+ * Network packet analysis framework.
+ *
+ * Copyright (c) 2014, Alessandro Ghedini
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are
+ * met:
+ *
+ *     * Redistributions of source code must retain the above copyright
+ *       notice, this list of conditions and the following disclaimer.
+ *
+ *     * Redistributions in binary form must reproduce the above copyright
+ *       notice, this list of conditions and the following disclaimer in the
+ *       documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS
+ * IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO,
+ * THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR
+ * PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR
+ * CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+ * EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+ * PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+ * PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF
+ * LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+ * NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+ * SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package filter
+
+import "encoding/binary"
+import "fmt"
+import "net"
+
+import "github.com/ghedo/go.pkt/packet"
+
+/* value returned by the compiled filters for accepted packets */
+const snap_len = 0x40000
+
+type node interface{}
+
+type n_and struct {
+	l, r node
+}
+
+type n_or struct {
+	l, r node
+}
+
+type n_not struct {
+	n node
+}
+
+type n_const bool
+
+/* Compare a packet field with a constant. If msh is set, the field offset is
+ * relative to the end of the IPv4 header found at nl. */
+type n_cmp struct {
+	size Size
+	off  uint32
+	msh  bool
+	nl   uint32
+	mask uint32
+	op   uint16
+	k    uint32
+}
+
+type n_rel struct {
+	op   string
+	l, r arith
+}
+
+type arith interface{}
+
+type a_const uint32
+
+type a_len struct{}
+
+type a_load struct {
+	idx  arith
+	size Size
+	off  uint32
+	msh  bool
+	nl   uint32
+}
+
+type a_bin struct {
+	op   string
+	l, r arith
+}
+
+type a_neg struct {
+	a arith
+}
+
+// Compile the given tcpdump-like expression to a BPF filter for packets of the
+// given link type. This supports the most common primitives of the pcap-filter
+// language: "host", "net", "port", "portrange" (with the "src" and "dst"
+// qualifiers), "ether", "ip", "ip6", "arp", "rarp", "tcp", "udp", "sctp",
+// "icmp", "icmp6", "igmp", "proto", "vlan", "less", "greater", "broadcast",
+// "multicast" and relations between arithmetic expressions that load packet
+// data (e.g. "tcp[tcpflags] & tcp-syn != 0"). Host names are not resolved. If
+// optimize is true, the generated program is passed through Optimize().
+//
+// The supported link types are Ethernet, SLL, SLL2, PPP, NULL/loopback and raw
+// IP. Differently from libpcap, RadioTap and 802.11 captures can't be filtered
+// yet, and CompileLibpcap() needs to be used for them.
+func Compile(filter string, link_type packet.Type, optimize bool) (*Filter, error) {
+	link, err := link_info_for(link_type)
+	if err != nil {
+		return nil, err
+	}
+
+	toks, err := tokenize(filter)
+	if err != nil {
+		return nil, fmt.Errorf("Could not compile filter: %s", err)
+	}
+
+	b := NewBuilder()
+
+	/* an empty expression matches everything */
+	if len(toks) == 0 {
+		return b.RET(Const, snap_len).Build()
+	}
+
+	p := &parser{ expr: filter, toks: toks, link: link }
+
+	root, err := p.parse_expr()
+	if err == nil && p.peek() != nil {
+		err = p.error("Unexpected '%s'", p.peek().text)
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("Could not compile filter: %s", err)
+	}
+
+	g := &generator{ b: b }
+
+	err = g.node(simplify(root), "accept", "reject")
+	if err != nil {
+		return nil, fmt.Errorf("Could not compile filter: %s", err)
+	}
+
+	b.Label("accept").RET(Const, snap_len)
+	b.Label("reject").RET(Const, 0)
+
+	flt, err := b.Build()
+	if err != nil {
+		return nil, fmt.Errorf("Could not compile filter: %s", err)
+	}
+
+	if optimize {
+		opt, _, err := flt.Optimize()
+		flt.Cleanup()
+
+		if err != nil {
+			return nil, fmt.Errorf("Could not compile filter: %s", err)
+		}
+
+		flt = opt
+	}
+
+	return flt, nil
+}
+
+func link_info_for(link_type packet.Type) (link_info, error) {
+	link := link_info{ typ: link_type }
+
+	switch link_type {
+	case packet.Eth:
+		link.kind, link.off_type, link.off_nl = link_ethertype, 12, 14
+
+	case packet.SLL:
+		link.kind, link.off_type, link.off_nl = link_ethertype, 14, 16
+
+	case packet.SLL2:
+		link.kind, link.off_type, link.off_nl = link_ethertype, 0, 20
+
+	case packet.PPP:
+		link.kind, link.off_type, link.off_nl = link_ppp, 2, 4
+
+	case packet.Loopback:
+		link.kind, link.off_type, link.off_nl = link_null, 0, 4
+
+	case packet.IP:
+		link.kind = link_ip
+
+	case packet.IPv4:
+		link.kind = link_ipv4
+
+	case packet.IPv6:
+		link.kind = link_ipv6
+
+	default:
+		/* TODO: RadioTap and WiFi need an 802.11 header parser */
+		return link, fmt.Errorf("Unsupported link type %s", link_type)
+	}
+
+	return link, nil
+}
+
+/* Check the network protocol (identified by its EtherType). */
+func (p *parser) ether_type(typ uint16) node {
+	link := &p.link
+
+	switch link.kind {
+	case link_ethertype:
+		return &n_cmp{
+			size: Half, off: link.off_type, op: bpf_jeq, k: uint32(typ),
+		}
+
+	case link_ppp:
+		var proto uint32
+
+		switch typ {
+		case 0x0800:
+			proto = 0x0021
+
+		case 0x86dd:
+			proto = 0x0057
+
+		default:
+			return n_const(false)
+		}
+
+		return &n_cmp{ size: Half, off: link.off_type, op: bpf_jeq, k: proto }
+
+	case link_null:
+		var families []uint32
+
+		switch typ {
+		case 0x0800:
+			families = []uint32{ 2 }
+
+		case 0x86dd:
+			families = []uint32{ 10, 24, 28, 30 }
+
+		default:
+			return n_const(false)
+		}
+
+		/* the family is in the byte order of the capturing host */
+		var n node = n_const(false)
+
+		for _, family := range families {
+			swapped := family << 24
+
+			n = &n_or{ n, &n_or{
+				&n_cmp{ size: Word, off: 0, op: bpf_jeq, k: family },
+				&n_cmp{ size: Word, off: 0, op: bpf_jeq, k: swapped },
+			} }
+		}
+
+		return n
+
+	case link_ip:
+		switch typ {
+		case 0x0800:
+			return &n_cmp{
+				size: Byte, off: 0, mask: 0xf0, op: bpf_jeq, k: 0x40,
+			}
+
+		case 0x86dd:
+			return &n_cmp{
+				size: Byte, off: 0, mask: 0xf0, op: bpf_jeq, k: 0x60,
+			}
+		}
+
+	case link_ipv4:
+		return n_const(typ == 0x0800)
+
+	case link_ipv6:
+		return n_const(typ == 0x86dd)
+	}
+
+	return n_const(false)
+}
+
+func (p *parser) ip_proto(proto uint32) node {
+	return &n_and{
+		p.ether_type(0x0800),
+		&n_cmp{ size: Byte, off: p.link.off_nl + 9, op: bpf_jeq, k: proto },
+	}
+}
+
+func (p *parser) ip6_proto(proto uint32) node {
+	return &n_and{
+		p.ether_type(0x86dd),
+		&n_cmp{ size: Byte, off: p.link.off_nl + 6, op: bpf_jeq, k: proto },
+	}
+}
+
+/* Check that the IPv4 packet is not a fragment (other than the first). */
+func (p *parser) not_frag() node {
+	return &n_not{
+		&n_cmp{ size: Half, off: p.link.off_nl + 6, op: bpf_jset, k: 0x1fff },
+	}
+}
+
+func (p *parser) proto_node(proto string) (node, error) {
+	switch proto {
+	case "ip":
+		return p.ether_type(0x0800), nil
+
+	case "ip6":
+		return p.ether_type(0x86dd), nil
+
+	case "arp":
+		return p.ether_type(0x0806), nil
+
+	case "rarp":
+		return p.ether_type(0x8035), nil
+
+	case "tcp", "udp", "sctp":
+		num := proto_numbers[proto]
+		return &n_or{ p.ip_proto(num), p.ip6_proto(num) }, nil
+
+	case "icmp", "igmp":
+		return p.ip_proto(proto_numbers[proto]), nil
+
+	case "icmp6":
+		return p.ip6_proto(58), nil
+	}
+
+	return nil, fmt.Errorf("Invalid use of '%s'", proto)
+}
+
+func dir_node(dir int, src, dst node) node {
+	switch dir {
+	case dir_src:
+		return src
+
+	case dir_dst:
+		return dst
+
+	case dir_and:
+		return &n_and{ src, dst }
+	}
+
+	return &n_or{ src, dst }
+}
+
+/* Compare the 4, 6 or 16 bytes at off with addr, masked with mask. */
+func cmp_bytes(off uint32, addr, mask []byte) node {
+	var n node
+
+	for i := 0; i < len(addr); {
+		var c *n_cmp
+
+		switch len(addr) - i {
+		case 2:
+			c = &n_cmp{ size: Half, off: off + uint32(i), op: bpf_jeq }
+			c.k    = uint32(binary.BigEndian.Uint16(addr[i:]))
+			c.mask = 0xffff
+
+			if mask != nil {
+				c.mask = uint32(binary.BigEndian.Uint16(mask[i:]))
+			}
+
+			i += 2
+
+		default:
+			c = &n_cmp{ size: Word, off: off + uint32(i), op: bpf_jeq }
+			c.k    = binary.BigEndian.Uint32(addr[i:])
+			c.mask = 0xffffffff
+
+			if mask != nil {
+				c.mask = binary.BigEndian.Uint32(mask[i:])
+			}
+
+			i += 4
+		}
+
+		if c.mask == 0 {
+			continue
+		}
+
+		c.k &= c.mask
+
+		if (c.size == Word && c.mask == 0xffffffff) ||
+		   (c.size == Half && c.mask == 0xffff) {
+			c.mask = 0
+		}
+
+		if n == nil {
+			n = c
+		} else {
+			n = &n_and{ n, c }
+		}
+	}
+
+	if n == nil {
+		return n_const(true)
+	}
+
+	return n
+}
+
+/* "host" and "net" primitives. mask is nil for hosts. */
+func (p *parser) host_node(q *qualifiers, ip net.IP, mask net.IPMask) (node, error) {
+	nl := p.link.off_nl
+
+	if ip4 := ip.To4(); ip4 != nil {
+		if mask != nil && len(mask) == 16 {
+			mask = mask[12:]
+		}
+
+		ip_node := &n_and{ p.ether_type(0x0800), dir_node(q.dir,
+			cmp_bytes(nl + 12, ip4, mask), cmp_bytes(nl + 16, ip4, mask),
+		) }
+
+		arp_node := func(typ uint16) node {
+			return &n_and{ p.ether_type(typ), dir_node(q.dir,
+				cmp_bytes(nl + 14, ip4, mask),
+				cmp_bytes(nl + 24, ip4, mask),
+			) }
+		}
+
+		switch q.proto {
+		case "":
+			return &n_or{ &n_or{ ip_node, arp_node(0x0806) },
+			              arp_node(0x8035) }, nil
+
+		case "ip":
+			return ip_node, nil
+
+		case "arp":
+			return arp_node(0x0806), nil
+
+		case "rarp":
+			return arp_node(0x8035), nil
+		}
+	} else {
+		switch q.proto {
+		case "", "ip6":
+			return &n_and{ p.ether_type(0x86dd), dir_node(q.dir,
+				cmp_bytes(nl + 8, ip, mask),
+				cmp_bytes(nl + 24, ip, mask),
+			) }, nil
+		}
+	}
+
+	return nil, fmt.Errorf("Invalid qualifier '%s %s'", q.proto, q.typ)
+}
+
+func (p *parser) ether_host(mac net.HardwareAddr, dir int) (node, error) {
+	if p.link.typ != packet.Eth {
+		return nil, fmt.Errorf("'ether host' requires Ethernet")
+	}
+
+	if len(mac) != 6 {
+		return nil, fmt.Errorf("Invalid MAC address '%s'", mac)
+	}
+
+	return dir_node(dir, cmp_bytes(6, mac, nil), cmp_bytes(0, mac, nil)), nil
+}
+
+func (p *parser) port_node(q *qualifiers, lo, hi uint32) (node, error) {
+	var protos []uint32
+
+	switch q.proto {
+	case "":
+		protos = []uint32{ 6, 17, 132 }
+
+	case "tcp", "udp", "sctp":
+		protos = []uint32{ proto_numbers[q.proto] }
+
+	default:
+		return nil, fmt.Errorf("Invalid qualifier '%s %s'", q.proto, q.typ)
+	}
+
+	nl := p.link.off_nl
+
+	port_cmp := func(c n_cmp) node {
+		if lo == hi {
+			c.op, c.k = bpf_jeq, lo
+			return &c
+		}
+
+		ge  := c
+		le  := c
+
+		ge.op, ge.k = bpf_jge, lo
+		le.op, le.k = bpf_jgt, hi
+
+		return &n_and{ &ge, &n_not{ &le } }
+	}
+
+	var ip_protos, ip6_protos node = n_const(false), n_const(false)
+
+	for _, proto := range protos {
+		ip_protos = &n_or{ ip_protos, &n_cmp{
+			size: Byte, off: nl + 9, op: bpf_jeq, k: proto,
+		} }
+
+		ip6_protos = &n_or{ ip6_protos, &n_cmp{
+			size: Byte, off: nl + 6, op: bpf_jeq, k: proto,
+		} }
+	}
+
+	ip_node := &n_and{ &n_and{ &n_and{ p.ether_type(0x0800), ip_protos },
+	                           p.not_frag() },
+		dir_node(q.dir,
+			port_cmp(n_cmp{ size: Half, off: nl, msh: true, nl: nl }),
+			port_cmp(n_cmp{ size: Half, off: nl + 2, msh: true, nl: nl }),
+		),
+	}
+
+	ip6_node := &n_and{ &n_and{ p.ether_type(0x86dd), ip6_protos },
+		dir_node(q.dir,
+			port_cmp(n_cmp{ size: Half, off: nl + 40 }),
+			port_cmp(n_cmp{ size: Half, off: nl + 42 }),
+		),
+	}
+
+	return &n_or{ ip_node, ip6_node }, nil
+}
+
+func (p *parser) ip_multicast() node {
+	return &n_and{ p.ether_type(0x0800), &n_cmp{
+		size: Byte, off: p.link.off_nl + 16, op: bpf_jge, k: 224,
+	} }
+}
+
+func (p *parser) ip6_multicast() node {
+	return &n_and{ p.ether_type(0x86dd), &n_cmp{
+		size: Byte, off: p.link.off_nl + 24, op: bpf_jeq, k: 0xff,
+	} }
+}
+
+/* Remove the constant nodes (e.g. the link-type checks that are always true
+ * for raw IP link types). */
+func simplify(n node) node {
+	switch n := n.(type) {
+	case *n_and:
+		l, r := simplify(n.l), simplify(n.r)
+
+		if c, ok := l.(n_const); ok {
+			if !c {
+				return c
+			}
+
+			return r
+		}
+
+		if c, ok := r.(n_const); ok && bool(c) {
+			return l
+		}
+
+		return &n_and{ l, r }
+
+	case *n_or:
+		l, r := simplify(n.l), simplify(n.r)
+
+		if c, ok := l.(n_const); ok {
+			if c {
+				return c
+			}
+
+			return r
+		}
+
+		if c, ok := r.(n_const); ok && !bool(c) {
+			return l
+		}
+
+		return &n_or{ l, r }
+
+	case *n_not:
+		inner := simplify(n.n)
+
+		if c, ok := inner.(n_const); ok {
+			return !c
+		}
+
+		return &n_not{ inner }
+	}
+
+	return n
+}
+
+type generator struct {
+	b      *Builder
+	labels int
+	mem    uint32
+}
+
+func (g *generator) label() string {
+	g.labels++
+	return fmt.Sprintf("L%d", g.labels)
+}
+
+/* Generate the code for n, jumping to the t label if it matches and to f
+ * otherwise. */
+func (g *generator) node(n node, t, f string) error {
+	switch n := n.(type) {
+	case *n_and:
+		next := g.label()
+
+		if err := g.node(n.l, next, f); err != nil {
+			return err
+		}
+
+		g.b.Label(next)
+		return g.node(n.r, t, f)
+
+	case *n_or:
+		next := g.label()
+
+		if err := g.node(n.l, t, next); err != nil {
+			return err
+		}
+
+		g.b.Label(next)
+		return g.node(n.r, t, f)
+
+	case *n_not:
+		return g.node(n.n, f, t)
+
+	case n_const:
+		if n {
+			g.b.JA(t)
+		} else {
+			g.b.JA(f)
+		}
+
+	case *n_cmp:
+		if n.msh {
+			g.b.LDX(Byte, MSH, n.nl)
+			g.b.LD(n.size, IND, n.off)
+		} else {
+			g.b.LD(n.size, ABS, n.off)
+		}
+
+		if n.mask != 0 {
+			g.b.AND(Const, n.mask)
+		}
+
+		g.jump(n.op, Const, t, f, n.k)
+
+	case *n_rel:
+		return g.rel(n, t, f)
+
+	default:
+		return fmt.Errorf("Unknown node %T", n)
+	}
+
+	return nil
+}
+
+func (g *generator) jump(op uint16, s Src, t, f string, k uint32) {
+	switch op {
+	case bpf_jeq:
+		g.b.JEQ(s, t, f, k)
+
+	case bpf_jgt:
+		g.b.JGT(s, t, f, k)
+
+	case bpf_jge:
+		g.b.JGE(s, t, f, k)
+
+	case bpf_jset:
+		g.b.JSET(s, t, f, k)
+	}
+}
+
+func (g *generator) rel(n *n_rel, t, f string) error {
+	var op uint16
+
+	switch n.op {
+	case "=", "==":
+		op = bpf_jeq
+
+	case "!=":
+		op, t, f = bpf_jeq, f, t
+
+	case ">":
+		op = bpf_jgt
+
+	case ">=":
+		op = bpf_jge
+
+	case "<":
+		op, t, f = bpf_jge, f, t
+
+	case "<=":
+		op, t, f = bpf_jgt, f, t
+	}
+
+	if k, ok := n.r.(a_const); ok {
+		if err := g.arith(n.l); err != nil {
+			return err
+		}
+
+		g.jump(op, Const, t, f, uint32(k))
+		return nil
+	}
+
+	mem, err := g.arith_mem(n.r)
+	if err != nil {
+		return err
+	}
+
+	if err := g.arith(n.l); err != nil {
+		return err
+	}
+
+	g.b.LDX(Word, MEM, mem)
+	g.mem--
+
+	g.jump(op, Index, t, f, 0)
+	return nil
+}
+
+/* Generate the code for a and store its value in a new scratch memory slot,
+ * which must be released by the caller. */
+func (g *generator) arith_mem(a arith) (uint32, error) {
+	if err := g.arith(a); err != nil {
+		return 0, err
+	}
+
+	if g.mem >= mem_words {
+		return 0, fmt.Errorf("Expression too complex")
+	}
+
+	g.b.ST(g.mem)
+	g.mem++
+
+	return g.mem - 1, nil
+}
+
+/* Generate the code that loads the value of a in the accumulator. */
+func (g *generator) arith(a arith) error {
+	switch a := a.(type) {
+	case a_const:
+		g.b.LD(Word, IMM, uint32(a))
+
+	case *a_len:
+		g.b.LD(Word, LEN, 0)
+
+	case *a_neg:
+		if err := g.arith(a.a); err != nil {
+			return err
+		}
+
+		g.b.NEG()
+
+	case *a_load:
+		if k, ok := a.idx.(a_const); ok {
+			if a.msh {
+				g.b.LDX(Byte, MSH, a.nl)
+				g.b.LD(a.size, IND, a.off + uint32(k))
+			} else {
+				g.b.LD(a.size, ABS, a.off + uint32(k))
+			}
+
+			break
+		}
+
+		if a.msh {
+			mem, err := g.arith_mem(a.idx)
+			if err != nil {
+				return err
+			}
+
+			g.b.LDX(Byte, MSH, a.nl)
+			g.b.LD(Word, MEM, mem)
+			g.b.ADD(Index, 0)
+			g.mem--
+		} else if err := g.arith(a.idx); err != nil {
+			return err
+		}
+
+		g.b.TAX()
+		g.b.LD(a.size, IND, a.off)
+
+	case *a_bin:
+		return g.arith_bin(a)
+
+	default:
+		return fmt.Errorf("Unknown expression %T", a)
+	}
+
+	return nil
+}
+
+func (g *generator) arith_bin(a *a_bin) error {
+	var op func(s Src, val uint32) *Builder
+
+	switch a.op {
+	case "+":
+		op = g.b.ADD
+
+	case "-":
+		op = g.b.SUB
+
+	case "*":
+		op = g.b.MUL
+
+	case "/":
+		op = g.b.DIV
+
+	case "&":
+		op = g.b.AND
+
+	case "|":
+		op = g.b.OR
+
+	case "%":
+		op = g.b.MOD
+
+	case "^":
+		op = g.b.XOR
+
+	case "<<":
+		op = g.b.LSH
+
+	case ">>":
+		op = g.b.RSH
+
+	default:
+		return fmt.Errorf("Unsupported operator '%s'", a.op)
+	}
+
+	if k, ok := a.r.(a_const); ok {
+		if (a.op == "/" || a.op == "%") && k == 0 {
+			return fmt.Errorf("Division by zero")
+		}
+
+		if err := g.arith(a.l); err != nil {
+			return err
+		}
+
+		op(Const, uint32(k))
+		return nil
+	}
+
+	mem, err := g.arith_mem(a.r)
+	if err != nil {
+		return err
+	}
+
+	if err := g.arith(a.l); err != nil {
+		return err
+	}
+
+	g.b.LDX(Word, MEM, mem)
+	g.mem--
+
+	op(Index, 0)
+	return nil
+}
@@ -0,0 +1,1122 @@
+/*
+ * Network packet analysis framework.
+ *
+ * Copyright (c) 2014, Alessandro Ghedini
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are
+ * met:
+ *
+ *     * Redistributions of source code must retain the above copyright
+ *       notice, this list of conditions and the following disclaimer.
+ *
+ *     * Redistributions in binary form must reproduce the above copyright
+ *       notice, this list of conditions and the following disclaimer in the
+ *       documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS
+ * IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO,
+ * THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR
+ * PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR
+ * CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+ * EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+ * PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+ * PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF
+ * LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+ * NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+ * SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package filter
+
+import "fmt"
+import "net"
+import "strconv"
+import "strings"
+
+import "github.com/ghedo/go.pkt/packet"
+
+type token struct {
+	op   bool
+	text string
+	pos  int
+}
+
+type link_kind int
+
+const (
+	link_ethertype link_kind = iota
+	link_ppp
+	link_null
+	link_ip
+	link_ipv4
+	link_ipv6
+)
+
+/* Offsets of the link-layer type field and of the network-layer header. These
+ * are incremented by "vlan" for the rest of the expression. */
+type link_info struct {
+	typ      packet.Type
+	kind     link_kind
+	off_type uint32
+	off_nl   uint32
+}
+
+const (
+	dir_any = iota /* src or dst */
+	dir_src
+	dir_dst
+	dir_and        /* src and dst */
+)
+
+type qualifiers struct {
+	proto string
+	dir   int
+	typ   string
+}
+
+type parser struct {
+	expr string
+	toks []token
+	pos  int
+	link link_info
+	last *qualifiers
+}
+
+var proto_numbers = map[string]uint32{
+	"icmp":   1,
+	"igmp":   2,
+	"tcp":    6,
+	"udp":    17,
+	"icmp6":  58,
+	"sctp":   132,
+}
+
+var arith_constants = map[string]uint32{
+	"tcpflags":            13,
+	"tcp-fin":             0x01,
+	"tcp-syn":             0x02,
+	"tcp-rst":             0x04,
+	"tcp-push":            0x08,
+	"tcp-ack":             0x10,
+	"tcp-urg":             0x20,
+	"tcp-ece":             0x40,
+	"tcp-cwr":             0x80,
+	"icmptype":            0,
+	"icmpcode":            1,
+	"icmp-echoreply":      0,
+	"icmp-unreach":        3,
+	"icmp-sourcequench":   4,
+	"icmp-redirect":       5,
+	"icmp-echo":           8,
+	"icmp-routeradvert":   9,
+	"icmp-routersolicit":  10,
+	"icmp-timxceed":       11,
+	"icmp-paramprob":      12,
+	"icmp-tstamp":         13,
+	"icmp-tstampreply":    14,
+	"icmp-ireq":           15,
+	"icmp-ireqreply":      16,
+	"icmp-maskreq":        17,
+	"icmp-maskreply":      18,
+	"icmp6type":           0,
+	"icmp6code":           1,
+	"icmp6-destinationunreach": 1,
+	"icmp6-packettoobig":  2,
+	"icmp6-timeexceeded":  3,
+	"icmp6-parameterproblem": 4,
+	"icmp6-echo":          128,
+	"icmp6-echoreply":     129,
+	"icmp6-routersolicit": 133,
+	"icmp6-routeradvert":  134,
+	"icmp6-neighborsolicit": 135,
+	"icmp6-neighboradvert": 136,
+	"icmp6-redirect":      137,
+}
+
+var two_char_ops = []string{ "&&", "||", "==", "!=", "<=", ">=", "<<", ">>" }
+
+func tokenize(expr string) ([]token, error) {
+	var toks []token
+
+	depth := 0
+
+	for i := 0; i < len(expr); {
+		c := expr[i]
+
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+
+		case is_word_char(c) || c == '\\' || (c == ':' && depth == 0):
+			if c == '\\' {
+				i++
+			}
+
+			start := i
+
+			for i < len(expr) {
+				c := expr[i]
+
+				if is_word_char(c) || (c == ':' && depth == 0) {
+					i++
+					continue
+				}
+
+				if c == '-' && i > start && i + 1 < len(expr) &&
+				   word_dash(expr[start:i], expr[i + 1], toks) {
+					i++
+					continue
+				}
+
+				break
+			}
+
+			if start == i {
+				return nil, fmt.Errorf(
+					"Syntax error at position %d", start + 1,
+				)
+			}
+
+			toks = append(toks, token{ text: expr[start:i], pos: start })
+
+		default:
+			op := string(c)
+
+			for _, two := range two_char_ops {
+				if strings.HasPrefix(expr[i:], two) {
+					op = two
+					break
+				}
+			}
+
+			if len(op) == 1 && !strings.Contains("()[]!=<>+-*/%&|^:", op) {
+				return nil, fmt.Errorf(
+					"Unexpected character '%c' at position %d",
+					c, i + 1,
+				)
+			}
+
+			switch op {
+			case "[":
+				depth++
+
+			case "]":
+				depth--
+			}
+
+			toks = append(toks, token{ op: true, text: op, pos: i })
+			i += len(op)
+		}
+	}
+
+	return toks, nil
+}
+
+func is_word_char(c byte) bool {
+	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') ||
+	       (c >= '0' && c <= '9') || c == '_' || c == '.'
+}
+
+func is_digits(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] < '0' || s[i] > '9' {
+			return false
+		}
+	}
+
+	return s != ""
+}
+
+/* Whether a dash is part of the current word: either in names like "tcp-syn"
+ * or in port ranges like "1-1024". */
+func word_dash(word string, next byte, toks []token) bool {
+	is_alpha := func(c byte) bool {
+		return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+	}
+
+	if is_alpha(word[0]) && is_alpha(next) {
+		return true
+	}
+
+	if len(toks) > 0 && toks[len(toks) - 1].text == "portrange" {
+		return true
+	}
+
+	return false
+}
+
+func (p *parser) peek() *token {
+	if p.pos >= len(p.toks) {
+		return nil
+	}
+
+	return &p.toks[p.pos]
+}
+
+func (p *parser) peek_is(text string) bool {
+	t := p.peek()
+	return t != nil && t.text == text
+}
+
+func (p *parser) peek_word(text string) bool {
+	t := p.peek()
+	return t != nil && !t.op && t.text == text
+}
+
+func (p *parser) next() *token {
+	t := p.peek()
+	if t != nil {
+		p.pos++
+	}
+
+	return t
+}
+
+func (p *parser) error(format string, args ...interface{}) error {
+	msg := fmt.Sprintf(format, args...)
+
+	if t := p.peek(); t != nil {
+		return fmt.Errorf("%s at position %d", msg, t.pos + 1)
+	}
+
+	return fmt.Errorf("%s at end of expression", msg)
+}
+
+func (p *parser) expect(text string) error {
+	if !p.peek_is(text) {
+		return p.error("Expected '%s'", text)
+	}
+
+	p.pos++
+	return nil
+}
+
+/* "and" and "or" have the same precedence and associate to the left. */
+func (p *parser) parse_expr() (node, error) {
+	left, err := p.parse_unary()
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		var is_and bool
+
+		switch {
+		case p.peek_word("and") || p.peek_is("&&"):
+			is_and = true
+
+		case p.peek_word("or") || p.peek_is("||"):
+			is_and = false
+
+		default:
+			return left, nil
+		}
+
+		p.pos++
+
+		right, err := p.parse_unary()
+		if err != nil {
+			return nil, err
+		}
+
+		if is_and {
+			left = &n_and{ left, right }
+		} else {
+			left = &n_or{ left, right }
+		}
+	}
+}
+
+func (p *parser) parse_unary() (node, error) {
+	t := p.peek()
+	if t == nil {
+		return nil, fmt.Errorf("Unexpected end of expression")
+	}
+
+	switch {
+	case t.text == "!" || (!t.op && t.text == "not"):
+		p.pos++
+
+		n, err := p.parse_unary()
+		if err != nil {
+			return nil, err
+		}
+
+		return &n_not{ n }, nil
+
+	case t.text == "(":
+		pos  := p.pos
+		link := p.link
+		last := p.last
+
+		p.pos++
+
+		n, err := p.parse_expr()
+		if err == nil && p.peek_is(")") && !p.next_is_arith(1) {
+			p.pos++
+			return n, nil
+		}
+
+		/* not a boolean expression, try with a relation */
+		p.pos  = pos
+		p.link = link
+		p.last = last
+
+		return p.parse_relation()
+	}
+
+	return p.parse_primitive()
+}
+
+/* Whether the token after the next n ones continues an arithmetic expression
+ * (e.g. the ")" in "(tcp[0] + 1) > 2"). */
+func (p *parser) next_is_arith(n int) bool {
+	if p.pos + n >= len(p.toks) {
+		return false
+	}
+
+	t := p.toks[p.pos + n]
+	if !t.op {
+		return false
+	}
+
+	return strings.Contains(" + - * / % & | ^ << >> = == != < <= > >= ",
+	                        " " + t.text + " ")
+}
+
+func is_proto_name(s string) bool {
+	switch s {
+	case "ether", "link", "ip", "ip6", "arp", "rarp",
+	     "tcp", "udp", "sctp", "icmp", "icmp6", "igmp":
+		return true
+	}
+
+	return false
+}
+
+func (p *parser) parse_primitive() (node, error) {
+	t := p.peek()
+
+	if t.op {
+		return p.parse_relation()
+	}
+
+	switch {
+	case t.text == "less" || t.text == "greater":
+		p.pos++
+
+		val, err := p.parse_number()
+		if err != nil {
+			return nil, err
+		}
+
+		rel := &n_rel{ op: "<=", l: &a_len{}, r: a_const(val) }
+		if t.text == "greater" {
+			rel.op = ">="
+		}
+
+		return rel, nil
+
+	case t.text == "vlan":
+		p.pos++
+		return p.parse_vlan()
+
+	case t.text == "len" || is_arith_constant(t.text) ||
+	     (is_number(t.text) && p.next_is_arith(1)):
+		return p.parse_relation()
+
+	case is_proto_name(t.text) && p.pos + 1 < len(p.toks) &&
+	     p.toks[p.pos + 1].text == "[":
+		return p.parse_relation()
+	}
+
+	q := &qualifiers{}
+	explicit := false
+
+	if t := p.peek(); t != nil && !t.op && is_proto_name(t.text) {
+		q.proto  = t.text
+		explicit = true
+		p.pos++
+
+		switch {
+		case p.peek_word("proto"):
+			p.pos++
+			return p.parse_proto(q.proto)
+
+		case p.peek_word("broadcast"), p.peek_word("multicast"):
+			return p.parse_cast(q.proto)
+		}
+	}
+
+	if p.peek_word("src") || p.peek_word("dst") {
+		explicit = true
+		q.dir    = dir_src
+
+		if p.next().text == "dst" {
+			q.dir = dir_dst
+		}
+
+		if (p.peek_word("or") || p.peek_word("and")) &&
+		   p.pos + 1 < len(p.toks) &&
+		   (p.toks[p.pos + 1].text == "src" ||
+		    p.toks[p.pos + 1].text == "dst") {
+			if p.next().text == "and" {
+				q.dir = dir_and
+			} else {
+				q.dir = dir_any
+			}
+
+			p.pos++
+		}
+	}
+
+	if t := p.peek(); t != nil && !t.op {
+		switch t.text {
+		case "host", "net", "port", "portrange":
+			q.typ    = t.text
+			explicit = true
+			p.pos++
+		}
+	}
+
+	if !explicit {
+		switch {
+		case p.peek_word("proto"):
+			p.pos++
+			return p.parse_proto("")
+
+		case p.peek_word("broadcast"), p.peek_word("multicast"):
+			return p.parse_cast("")
+
+		case p.last != nil:
+			/* e.g. "host a or b" means "host a or host b" */
+			q = p.last
+		}
+	} else if q.proto != "" && q.typ == "" && q.dir == dir_any &&
+	          !p.has_value() {
+		return p.proto_node(q.proto)
+	}
+
+	p.last = q
+
+	return p.parse_value(q)
+}
+
+/* Whether the next token is a value for a primitive (e.g. an address). */
+func (p *parser) has_value() bool {
+	t := p.peek()
+	if t == nil || t.op {
+		return false
+	}
+
+	switch t.text {
+	case "and", "or", "not":
+		return false
+	}
+
+	return true
+}
+
+func (p *parser) parse_value(q *qualifiers) (node, error) {
+	t := p.next()
+	if t == nil || t.op {
+		p.pos--
+		return nil, p.error("Expected a value")
+	}
+
+	typ := q.typ
+	if typ == "" {
+		typ = "host"
+	}
+
+	switch typ {
+	case "host":
+		if q.proto == "ether" {
+			mac, err := net.ParseMAC(t.text)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid MAC address '%s'",
+				                       t.text)
+			}
+
+			return p.ether_host(mac, q.dir)
+		}
+
+		ip := net.ParseIP(t.text)
+		if ip == nil {
+			return nil, fmt.Errorf("Invalid host '%s'", t.text)
+		}
+
+		return p.host_node(q, ip, nil)
+
+	case "net":
+		ip, mask, err := p.parse_net(t.text)
+		if err != nil {
+			return nil, err
+		}
+
+		return p.host_node(q, ip, mask)
+
+	case "port":
+		port, err := parse_port(t.text)
+		if err != nil {
+			return nil, err
+		}
+
+		return p.port_node(q, port, port)
+
+	case "portrange":
+		parts := strings.SplitN(t.text, "-", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("Invalid port range '%s'", t.text)
+		}
+
+		lo, err := parse_port(parts[0])
+		if err != nil {
+			return nil, err
+		}
+
+		hi, err := parse_port(parts[1])
+		if err != nil {
+			return nil, err
+		}
+
+		if lo > hi {
+			lo, hi = hi, lo
+		}
+
+		return p.port_node(q, lo, hi)
+	}
+
+	return nil, fmt.Errorf("Unknown qualifier '%s'", typ)
+}
+
+func (p *parser) parse_net(text string) (net.IP, net.IPMask, error) {
+	var ones int = -1
+
+	if p.peek_is("/") {
+		p.pos++
+
+		bits, err := p.parse_number()
+		if err != nil {
+			return nil, nil, err
+		}
+
+		ones = int(bits)
+	}
+
+	if strings.Contains(text, ":") {
+		ip := net.ParseIP(text)
+		if ip == nil {
+			return nil, nil, fmt.Errorf("Invalid network '%s'", text)
+		}
+
+		if ones < 0 {
+			ones = 128
+		}
+
+		if ones > 128 {
+			return nil, nil, fmt.Errorf("Invalid prefix length %d", ones)
+		}
+
+		return ip, net.CIDRMask(ones, 128), nil
+	}
+
+	/* IPv4 networks can omit the trailing zeros (e.g. "net 10.1") */
+	parts := strings.Split(text, ".")
+	if len(parts) > 4 {
+		return nil, nil, fmt.Errorf("Invalid network '%s'", text)
+	}
+
+	ip := make(net.IP, 4)
+
+	for i, part := range parts {
+		v, err := strconv.ParseUint(part, 10, 8)
+		if err != nil {
+			return nil, nil, fmt.Errorf("Invalid network '%s'", text)
+		}
+
+		ip[i] = byte(v)
+	}
+
+	var mask net.IPMask
+
+	switch {
+	case p.peek_word("mask"):
+		p.pos++
+
+		t := p.next()
+		if t == nil || net.ParseIP(t.text).To4() == nil {
+			return nil, nil, fmt.Errorf("Invalid network mask")
+		}
+
+		mask = net.IPMask(net.ParseIP(t.text).To4())
+
+	case ones >= 0:
+		if ones > 32 {
+			return nil, nil, fmt.Errorf("Invalid prefix length %d", ones)
+		}
+
+		mask = net.CIDRMask(ones, 32)
+
+	default:
+		mask = net.CIDRMask(len(parts) * 8, 32)
+	}
+
+	return ip, mask, nil
+}
+
+func parse_port(text string) (uint32, error) {
+	if is_number(text) {
+		port, err := parse_number(text)
+		if err != nil || port > 0xffff {
+			return 0, fmt.Errorf("Invalid port '%s'", text)
+		}
+
+		return port, nil
+	}
+
+	port, err := net.LookupPort("tcp", text)
+	if err != nil {
+		port, err = net.LookupPort("udp", text)
+	}
+
+	if err != nil {
+		return 0, fmt.Errorf("Unknown port '%s'", text)
+	}
+
+	return uint32(port), nil
+}
+
+func (p *parser) parse_proto(proto string) (node, error) {
+	t := p.next()
+	if t == nil || t.op {
+		p.pos--
+		return nil, p.error("Expected a protocol")
+	}
+
+	num, ok := proto_numbers[t.text]
+
+	if !ok {
+		switch t.text {
+		case "ip":
+			num = 0x0800
+
+		case "ip6":
+			num = 0x86dd
+
+		case "arp":
+			num = 0x0806
+
+		case "rarp":
+			num = 0x8035
+
+		default:
+			var err error
+
+			num, err = parse_number(t.text)
+			if err != nil {
+				return nil, fmt.Errorf("Unknown protocol '%s'",
+				                       t.text)
+			}
+		}
+	}
+
+	switch proto {
+	case "ether", "link":
+		return p.ether_type(uint16(num)), nil
+
+	case "ip":
+		return p.ip_proto(num), nil
+
+	case "ip6":
+		return p.ip6_proto(num), nil
+
+	case "":
+		return &n_or{ p.ip_proto(num), p.ip6_proto(num) }, nil
+	}
+
+	return nil, fmt.Errorf("Invalid qualifier '%s proto'", proto)
+}
+
+func (p *parser) parse_cast(proto string) (node, error) {
+	kind := p.next().text
+
+	switch {
+	case proto == "ether" || (proto == "" && p.link.typ == packet.Eth):
+		if p.link.typ != packet.Eth {
+			return nil, fmt.Errorf("'ether %s' requires Ethernet", kind)
+		}
+
+		if kind == "multicast" {
+			return &n_cmp{ size: Byte, off: 0, op: bpf_jset, k: 1 }, nil
+		}
+
+		mac, _ := net.ParseMAC("ff:ff:ff:ff:ff:ff")
+		return p.ether_host(mac, dir_dst)
+
+	case kind == "broadcast":
+		return nil, fmt.Errorf("'%s broadcast' requires a netmask", proto)
+
+	case proto == "ip":
+		return p.ip_multicast(), nil
+
+	case proto == "ip6":
+		return p.ip6_multicast(), nil
+
+	case proto == "":
+		return &n_or{ p.ip_multicast(), p.ip6_multicast() }, nil
+	}
+
+	return nil, fmt.Errorf("Invalid qualifier '%s %s'", proto, kind)
+}
+
+func (p *parser) parse_vlan() (node, error) {
+	if p.link.kind != link_ethertype {
+		return nil, fmt.Errorf("'vlan' not supported on %s", p.link.typ)
+	}
+
+	off := p.link.off_type
+
+	var n node = &n_or{
+		&n_or{
+			&n_cmp{ size: Half, off: off, op: bpf_jeq, k: 0x8100 },
+			&n_cmp{ size: Half, off: off, op: bpf_jeq, k: 0x88a8 },
+		},
+		&n_cmp{ size: Half, off: off, op: bpf_jeq, k: 0x9100 },
+	}
+
+	if t := p.peek(); t != nil && !t.op && is_number(t.text) {
+		p.pos++
+
+		id, err := parse_number(t.text)
+		if err != nil || id > 0x0fff {
+			return nil, fmt.Errorf("Invalid VLAN id '%s'", t.text)
+		}
+
+		n = &n_and{ n, &n_cmp{
+			size: Half, off: off + 2, mask: 0x0fff, op: bpf_jeq, k: id,
+		} }
+	}
+
+	/* the following primitives refer to the encapsulated frame */
+	p.link.off_type += 4
+	p.link.off_nl   += 4
+
+	return n, nil
+}
+
+func (p *parser) parse_relation() (node, error) {
+	var guards []node
+
+	left, err := p.parse_arith(&guards)
+	if err != nil {
+		return nil, err
+	}
+
+	t := p.peek()
+	if t == nil || !t.op {
+		return nil, p.error("Expected a relational operator")
+	}
+
+	switch t.text {
+	case "=", "==", "!=", "<", "<=", ">", ">=":
+		p.pos++
+
+	default:
+		return nil, p.error("Expected a relational operator")
+	}
+
+	right, err := p.parse_arith(&guards)
+	if err != nil {
+		return nil, err
+	}
+
+	var n node = &n_rel{ op: t.text, l: left, r: right }
+
+	for i := len(guards) - 1; i >= 0; i-- {
+		n = &n_and{ guards[i], n }
+	}
+
+	return n, nil
+}
+
+var arith_levels = [][]string{
+	{ "|", "^" },
+	{ "&" },
+	{ "<<", ">>" },
+	{ "+", "-" },
+	{ "*", "/", "%" },
+}
+
+func (p *parser) parse_arith(guards *[]node) (arith, error) {
+	return p.parse_arith_level(0, guards)
+}
+
+func (p *parser) parse_arith_level(level int, guards *[]node) (arith, error) {
+	if level >= len(arith_levels) {
+		return p.parse_arith_primary(guards)
+	}
+
+	left, err := p.parse_arith_level(level + 1, guards)
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		t := p.peek()
+		if t == nil || !t.op || !contains(arith_levels[level], t.text) {
+			return left, nil
+		}
+
+		p.pos++
+
+		right, err := p.parse_arith_level(level + 1, guards)
+		if err != nil {
+			return nil, err
+		}
+
+		left, err = fold(&a_bin{ op: t.text, l: left, r: right })
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (p *parser) parse_arith_primary(guards *[]node) (arith, error) {
+	t := p.next()
+	if t == nil {
+		return nil, fmt.Errorf("Unexpected end of expression")
+	}
+
+	switch {
+	case t.text == "(":
+		a, err := p.parse_arith(guards)
+		if err != nil {
+			return nil, err
+		}
+
+		if err := p.expect(")"); err != nil {
+			return nil, err
+		}
+
+		return a, nil
+
+	case t.text == "-":
+		a, err := p.parse_arith_primary(guards)
+		if err != nil {
+			return nil, err
+		}
+
+		return &a_neg{ a }, nil
+
+	case t.op:
+		p.pos--
+		return nil, p.error("Unexpected '%s'", t.text)
+
+	case t.text == "len":
+		return &a_len{}, nil
+
+	case is_number(t.text):
+		val, err := parse_number(t.text)
+		if err != nil {
+			p.pos--
+			return nil, p.error("Invalid number '%s'", t.text)
+		}
+
+		return a_const(val), nil
+
+	case is_proto_name(t.text) && p.peek_is("["):
+		return p.parse_load(t.text, guards)
+	}
+
+	if val, ok := arith_constants[t.text]; ok {
+		return a_const(val), nil
+	}
+
+	p.pos--
+	return nil, p.error("Unexpected '%s'", t.text)
+}
+
+func (p *parser) parse_load(proto string, guards *[]node) (arith, error) {
+	p.pos++
+
+	idx, err := p.parse_arith(guards)
+	if err != nil {
+		return nil, err
+	}
+
+	var size Size = Byte
+
+	if p.peek_is(":") {
+		p.pos++
+
+		val, err := p.parse_number()
+		if err != nil {
+			return nil, err
+		}
+
+		switch val {
+		case 1:
+			size = Byte
+
+		case 2:
+			size = Half
+
+		case 4:
+			size = Word
+
+		default:
+			return nil, fmt.Errorf("Invalid load size %d", val)
+		}
+	}
+
+	if err := p.expect("]"); err != nil {
+		return nil, err
+	}
+
+	load := &a_load{ idx: idx, size: size }
+	nl   := p.link.off_nl
+
+	var guard node
+
+	switch proto {
+	case "ether", "link":
+		load.off = 0
+
+	case "ip":
+		load.off = nl
+		guard    = p.ether_type(0x0800)
+
+	case "ip6":
+		load.off = nl
+		guard    = p.ether_type(0x86dd)
+
+	case "arp":
+		load.off = nl
+		guard    = p.ether_type(0x0806)
+
+	case "rarp":
+		load.off = nl
+		guard    = p.ether_type(0x8035)
+
+	case "icmp6":
+		load.off = nl + 40
+		guard    = p.ip6_proto(58)
+
+	default:
+		/* transport protocols are only supported over IPv4 */
+		load.off = nl
+		load.msh = true
+		load.nl  = nl
+		guard    = &n_and{ p.ip_proto(proto_numbers[proto]), p.not_frag() }
+	}
+
+	if guard != nil {
+		*guards = append(*guards, guard)
+	}
+
+	return load, nil
+}
+
+func (p *parser) parse_number() (uint32, error) {
+	t := p.next()
+	if t == nil || t.op {
+		p.pos--
+		return 0, p.error("Expected a number")
+	}
+
+	val, err := parse_number(t.text)
+	if err != nil {
+		p.pos--
+		return 0, p.error("Invalid number '%s'", t.text)
+	}
+
+	return val, nil
+}
+
+func is_number(s string) bool {
+	return s != "" && s[0] >= '0' && s[0] <= '9' && !strings.ContainsAny(s, ".:")
+}
+
+func parse_number(s string) (uint32, error) {
+	base := 10
+
+	switch {
+	case strings.HasPrefix(s, "0x") || strings.HasPrefix(s, "0X"):
+		base = 16
+		s    = s[2:]
+
+	case len(s) > 1 && s[0] == '0':
+		base = 8
+		s    = s[1:]
+	}
+
+	val, err := strconv.ParseUint(s, base, 32)
+	return uint32(val), err
+}
+
+/* Evaluate binary operations between constants. */
+func fold(a *a_bin) (arith, error) {
+	l, ok_l := a.l.(a_const)
+	r, ok_r := a.r.(a_const)
+
+	if !ok_l || !ok_r {
+		return a, nil
+	}
+
+	switch a.op {
+	case "+":
+		return l + r, nil
+
+	case "-":
+		return l - r, nil
+
+	case "*":
+		return l * r, nil
+
+	case "/", "%":
+		if r == 0 {
+			return nil, fmt.Errorf("Division by zero")
+		}
+
+		if a.op == "%" {
+			return l % r, nil
+		}
+
+		return l / r, nil
+
+	case "&":
+		return l & r, nil
+
+	case "|":
+		return l | r, nil
+
+	case "^":
+		return l ^ r, nil
+
+	case "<<":
+		return l << (r & 31), nil
+
+	case ">>":
+		return l >> (r & 31), nil
+	}
+
+	return a, nil
+}
+
+func is_arith_constant(s string) bool {
+	_, ok := arith_constants[s]
+	return ok
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+
+	return false
+}
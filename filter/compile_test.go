@@ -0,0 +1,212 @@
+/*
+ * Network packet analysis framework.
+ *
+ * Copyright (c) 2014, Alessandro Ghedini
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are
+ * met:
+ *
+ *     * Redistributions of source code must retain the above copyright
+ *       notice, this list of conditions and the following disclaimer.
+ *
+ *     * Redistributions in binary form must reproduce the above copyright
+ *       notice, this list of conditions and the following disclaimer in the
+ *       documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS
+ * IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO,
+ * THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR
+ * PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR
+ * CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+ * EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+ * PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+ * PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF
+ * LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+ * NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+ * SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package filter_test
+
+import "testing"
+
+import "github.com/ghedo/go.pkt/filter"
+import "github.com/ghedo/go.pkt/packet"
+
+var test_eth_ipv6_udp = []byte{
+	0x33, 0x33, 0x00, 0x00, 0x00, 0x01, 0x4c, 0x72, 0xb9, 0x54, 0xe5, 0x3d,
+	0x86, 0xdd, 0x60, 0x00, 0x00, 0x00, 0x00, 0x08, 0x11, 0x40, 0xfe, 0x80,
+	0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+	0x00, 0x01, 0xff, 0x02, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+	0x00, 0x00, 0x00, 0x00, 0x00, 0x01, 0x02, 0x22, 0x02, 0x23, 0x00, 0x08,
+	0x00, 0x00,
+}
+
+var test_eth_ipv4_icmp = []byte{
+	0x00, 0x21, 0x96, 0x6e, 0xf0, 0x70, 0x4c, 0x72, 0xb9, 0x54, 0xe5, 0x3d,
+	0x08, 0x00, 0x45, 0x00, 0x00, 0x1c, 0x00, 0x01, 0x00, 0x00, 0x40, 0x01,
+	0x00, 0x00, 0xc0, 0xa8, 0x01, 0x87, 0xc1, 0x1b, 0xd0, 0x25, 0x08, 0x00,
+	0x00, 0x00, 0x00, 0x01, 0x00, 0x01,
+}
+
+var test_null_ipv4_udp = append(
+	[]byte{ 0x02, 0x00, 0x00, 0x00 }, test_eth_ipv4_udp[14:]...,
+)
+
+var test_ppp_ipv4_udp = append(
+	[]byte{ 0xff, 0x03, 0x00, 0x21 }, test_eth_ipv4_udp[14:]...,
+)
+
+var compile_tests = []struct {
+	expr  string
+	link  packet.Type
+	buf   []byte
+	match bool
+}{
+	{ "", packet.Eth, test_eth_arp, true },
+	{ "arp", packet.Eth, test_eth_arp, true },
+	{ "arp", packet.Eth, test_eth_ipv4_udp, false },
+	{ "ip", packet.Eth, test_eth_ipv4_udp, true },
+	{ "ip", packet.Eth, test_eth_ipv6_udp, false },
+	{ "ip6", packet.Eth, test_eth_ipv6_udp, true },
+	{ "udp", packet.Eth, test_eth_ipv4_udp, true },
+	{ "udp", packet.Eth, test_eth_ipv6_udp, true },
+	{ "udp", packet.Eth, test_eth_ipv4_tcp, false },
+	{ "tcp", packet.Eth, test_eth_ipv4_tcp, true },
+	{ "icmp", packet.Eth, test_eth_ipv4_icmp, true },
+	{ "icmp", packet.Eth, test_eth_ipv4_udp, false },
+	{ "not arp", packet.Eth, test_eth_ipv4_udp, true },
+	{ "!arp && !tcp", packet.Eth, test_eth_ipv4_udp, true },
+	{ "arp or udp", packet.Eth, test_eth_ipv4_tcp, false },
+	{ "tcp and port 8338 or arp", packet.Eth, test_eth_arp, true },
+
+	{ "host 192.168.1.135", packet.Eth, test_eth_ipv4_udp, true },
+	{ "host 192.168.1.135", packet.Eth, test_eth_arp, true },
+	{ "host 1.2.3.4 or 192.168.1.135", packet.Eth, test_eth_ipv4_udp, true },
+	{ "src host 193.27.208.37", packet.Eth, test_eth_ipv4_udp, false },
+	{ "dst host 193.27.208.37", packet.Eth, test_eth_ipv4_udp, true },
+	{ "src and dst host 193.27.208.37", packet.Eth, test_eth_ipv4_udp, false },
+	{ "src or dst host 193.27.208.37", packet.Eth, test_eth_ipv4_udp, true },
+	{ "arp host 192.168.1.135", packet.Eth, test_eth_ipv4_udp, false },
+	{ "ip src 192.168.1.135", packet.Eth, test_eth_ipv4_udp, true },
+	{ "net 192.168.0.0/16", packet.Eth, test_eth_ipv4_udp, true },
+	{ "net 192.168", packet.Eth, test_eth_ipv4_udp, true },
+	{ "net 10.0.0.0 mask 255.0.0.0", packet.Eth, test_eth_ipv4_udp, false },
+	{ "host fe80::1", packet.Eth, test_eth_ipv6_udp, true },
+	{ "host fe80::1", packet.Eth, test_eth_ipv4_udp, false },
+	{ "dst net ff02::/16", packet.Eth, test_eth_ipv6_udp, true },
+	{ "dst net fe80::/16", packet.Eth, test_eth_ipv6_udp, false },
+
+	{ "port 8338", packet.Eth, test_eth_ipv4_udp, true },
+	{ "port 8338", packet.Eth, test_eth_ipv4_tcp, true },
+	{ "port 8338", packet.Eth, test_eth_vlan_arp, false },
+	{ "src port 8338", packet.Eth, test_eth_ipv4_udp, false },
+	{ "dst port 8338", packet.Eth, test_eth_ipv4_udp, true },
+	{ "tcp dst port 8338", packet.Eth, test_eth_ipv4_udp, false },
+	{ "tcp dst port 8338", packet.Eth, test_eth_ipv4_tcp, true },
+	{ "udp port 547", packet.Eth, test_eth_ipv6_udp, true },
+	{ "portrange 8000-9000", packet.Eth, test_eth_ipv4_udp, true },
+	{ "portrange 1-1000", packet.Eth, test_eth_ipv4_udp, false },
+
+	{ "ether src 4c:72:b9:54:e5:3d", packet.Eth, test_eth_ipv4_udp, true },
+	{ "ether dst 4c:72:b9:54:e5:3d", packet.Eth, test_eth_ipv4_udp, false },
+	{ "ether broadcast", packet.Eth, test_eth_arp, true },
+	{ "ether broadcast", packet.Eth, test_eth_ipv4_udp, false },
+	{ "ether multicast", packet.Eth, test_eth_ipv6_udp, true },
+	{ "ip6 multicast", packet.Eth, test_eth_ipv6_udp, true },
+	{ "ether proto 0x806", packet.Eth, test_eth_arp, true },
+	{ "ip proto 17", packet.Eth, test_eth_ipv4_udp, true },
+	{ "proto \\udp", packet.Eth, test_eth_ipv4_udp, true },
+	{ "ip6 proto udp", packet.Eth, test_eth_ipv6_udp, true },
+
+	{ "vlan", packet.Eth, test_eth_vlan_arp, true },
+	{ "vlan", packet.Eth, test_eth_arp, false },
+	{ "vlan 0x87 and arp", packet.Eth, test_eth_vlan_arp, true },
+	{ "vlan 5", packet.Eth, test_eth_vlan_arp, false },
+	{ "vlan and arp host 192.168.1.135", packet.Eth, test_eth_vlan_arp, true },
+
+	{ "less 50", packet.Eth, test_eth_arp, true },
+	{ "less 50", packet.Eth, test_eth_ipv4_tcp, false },
+	{ "greater 50", packet.Eth, test_eth_ipv4_tcp, true },
+	{ "len > 40 and len < 50", packet.Eth, test_eth_arp, true },
+	{ "tcp[tcpflags] & tcp-syn != 0", packet.Eth, test_eth_ipv4_tcp, true },
+	{ "tcp[tcpflags] & (tcp-syn|tcp-ack) = tcp-syn", packet.Eth,
+	  test_eth_ipv4_tcp, true },
+	{ "tcp[13] = 18", packet.Eth, test_eth_ipv4_tcp, false },
+	{ "ip[9] = 17", packet.Eth, test_eth_ipv4_udp, true },
+	{ "udp[2:2] = 8338", packet.Eth, test_eth_ipv4_udp, true },
+	{ "ether[12:2] = 0x806", packet.Eth, test_eth_arp, true },
+	{ "icmp[icmptype] = icmp-echo", packet.Eth, test_eth_ipv4_icmp, true },
+	{ "(tcp[0:2] + 1) = 41563", packet.Eth, test_eth_ipv4_tcp, true },
+	{ "udp[ip[0] & 0 : 2] = 41562", packet.Eth, test_eth_ipv4_udp, true },
+	{ "ip[2:2] - 8 = udp[4:2] + 12", packet.Eth, test_eth_ipv4_udp, true },
+	{ "udp[2:2] % 1000 = 338", packet.Eth, test_eth_ipv4_udp, true },
+	{ "udp[2:2] % (ip[9] - 7) = 8", packet.Eth, test_eth_ipv4_udp, true },
+	{ "udp[2:2] ^ 0xffff = 0xdf6d", packet.Eth, test_eth_ipv4_udp, true },
+
+	{ "ip", packet.IPv4, test_ipv4_tcp_single_byte, true },
+	{ "ip6", packet.IPv4, test_ipv4_tcp_single_byte, false },
+	{ "tcp[12] != 0xa0", packet.IPv4, test_ipv4_tcp_single_byte, false },
+	{ "tcp port 80", packet.IP, test_ipv4_tcp_single_byte, true },
+	{ "ip6", packet.IP, test_ipv4_tcp_single_byte, false },
+	{ "udp port 8338", packet.Loopback, test_null_ipv4_udp, true },
+	{ "ip6", packet.Loopback, test_null_ipv4_udp, false },
+	{ "udp port 8338", packet.PPP, test_ppp_ipv4_udp, true },
+	{ "arp", packet.PPP, test_ppp_ipv4_udp, false },
+}
+
+func TestCompile(t *testing.T) {
+	for _, test := range compile_tests {
+		for _, optimize := range []bool{ false, true } {
+			flt, err := filter.Compile(test.expr, test.link, optimize)
+			if err != nil {
+				t.Fatalf("Error compiling '%s': %s", test.expr, err)
+			}
+
+			if err := flt.Verify(); err != nil {
+				t.Fatalf("Invalid filter '%s': %s\n%s",
+				         test.expr, err, flt)
+			}
+
+			if flt.Match(test.buf) != test.match {
+				t.Fatalf("Match mismatch for '%s' (expected %v):\n%s",
+				         test.expr, test.match, flt)
+			}
+
+			flt.Cleanup()
+		}
+	}
+}
+
+func TestCompileError(t *testing.T) {
+	tests := []struct {
+		expr string
+		link packet.Type
+	}{
+		{ "foo", packet.Eth },
+		{ "host", packet.Eth },
+		{ "port 99999", packet.Eth },
+		{ "tcp[", packet.Eth },
+		{ "tcp[0] =", packet.Eth },
+		{ "ether[0:3] = 1", packet.Eth },
+		{ "ether host aa", packet.Eth },
+		{ "tcp host 1.2.3.4", packet.Eth },
+		{ "udp[0] / 0 = 1", packet.Eth },
+		{ "udp[0] % 0 = 1", packet.Eth },
+		{ "(arp", packet.Eth },
+		{ "arp )", packet.Eth },
+		{ "arp $", packet.Eth },
+		{ "vlan", packet.IPv4 },
+		{ "ip broadcast", packet.Eth },
+		{ "arp", packet.WiFi },
+	}
+
+	for _, test := range tests {
+		_, err := filter.Compile(test.expr, test.link, false)
+		if err == nil {
+			t.Fatalf("Expected error compiling '%s'", test.expr)
+		}
+	}
+}
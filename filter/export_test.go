@@ -0,0 +1,60 @@
+/*
+ * Network packet analysis framework.
+ *
+ * Copyright (c) 2014, Alessandro Ghedini
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are
+ * met:
+ *
+ *     * Redistributions of source code must retain the above copyright
+ *       notice, this list of conditions and the following disclaimer.
+ *
+ *     * Redistributions in binary form must reproduce the above copyright
+ *       notice, this list of conditions and the following disclaimer in the
+ *       documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS
+ * IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO,
+ * THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR
+ * PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR
+ * CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+ * EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+ * PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+ * PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF
+ * LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+ * NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+ * SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package filter
+
+import "github.com/ghedo/go.pkt/filter/internal/cbpf"
+
+/* whether the C implementation of the BPF machine can be used for comparison */
+const HaveC = cbpf.Available
+
+func (f *Filter) AppendInsn(code uint16, jt, jf uint8, k uint32) {
+	f.append_insn(Code(code), jt, jf, k)
+}
+
+func (f *Filter) FilterC(buf []byte) uint {
+	return cbpf.Filter(f.insns_c(), buf, uint(len(buf)))
+}
+
+func (f *Filter) ValidateC() bool {
+	return cbpf.Validate(f.insns_c())
+}
+
+func (f *Filter) insns_c() []cbpf.Insn {
+	var insns []cbpf.Insn
+
+	for _, insn := range f.prog {
+		insns = append(insns, cbpf.Insn{
+			Code: insn.code, Jt: insn.jt, Jf: insn.jf, K: insn.k,
+		})
+	}
+
+	return insns
+}
@@ -254,10 +254,20 @@ bpf_filter(const struct bpf_insn *pc, char *p, u_int wirelen, u_int buflen)
 			A /= X;
 			continue;
 
+		case BPF_ALU|BPF_MOD|BPF_X:
+			if (X == 0)
+				return (0);
+			A %= X;
+			continue;
+
 		case BPF_ALU|BPF_AND|BPF_X:
 			A &= X;
 			continue;
 
+		case BPF_ALU|BPF_XOR|BPF_X:
+			A ^= X;
+			continue;
+
 		case BPF_ALU|BPF_OR|BPF_X:
 			A |= X;
 			continue;
@@ -286,10 +296,18 @@ bpf_filter(const struct bpf_insn *pc, char *p, u_int wirelen, u_int buflen)
 			A /= pc->k;
 			continue;
 
+		case BPF_ALU|BPF_MOD|BPF_K:
+			A %= pc->k;
+			continue;
+
 		case BPF_ALU|BPF_AND|BPF_K:
 			A &= pc->k;
 			continue;
 
+		case BPF_ALU|BPF_XOR|BPF_K:
+			A ^= pc->k;
+			continue;
+
 		case BPF_ALU|BPF_OR|BPF_K:
 			A |= pc->k;
 			continue;
@@ -327,8 +345,8 @@ static const u_short	bpf_code_map[] = {
 	0x1013,	/* 0x60-0x6f: 1100100000001000 */
 	0x1010,	/* 0x70-0x7f: 0000100000001000 */
 	0x0093,	/* 0x80-0x8f: 1100100100000000 */
-	0x0000,	/* 0x90-0x9f: 0000000000000000 */
-	0x0000,	/* 0xa0-0xaf: 0000000000000000 */
+	0x1010,	/* 0x90-0x9f: 0000100000001000 */
+	0x1010,	/* 0xa0-0xaf: 0000100000001000 */
 	0x0002,	/* 0xb0-0xbf: 0100000000000000 */
 	0x0000,	/* 0xc0-0xcf: 0000000000000000 */
 	0x0000,	/* 0xd0-0xdf: 0000000000000000 */
@@ -391,41 +409,11 @@ bpf_validate(const struct bpf_insn *f, int len)
 			continue;
 		}
 		/*
-		 * Check for constant division by 0.
+		 * Check for constant division (or modulus) by 0.
 		 */
-		if (p->code == (BPF_ALU|BPF_DIV|BPF_K) && p->k == 0)
+		if ((p->code == (BPF_ALU|BPF_DIV|BPF_K) ||
+		     p->code == (BPF_ALU|BPF_MOD|BPF_K)) && p->k == 0)
 			return (0);
 	}
 	return (BPF_CLASS(f[len - 1].code) == BPF_RET);
 }
-
-int
-bpf_append_insn(struct bpf_program *p, unsigned short code,
-                unsigned char jt, unsigned char jf, unsigned int k)
-{
-	p->bf_insns = realloc(p->bf_insns, ++p->bf_len*sizeof(struct bpf_insn));
-	if (p->bf_insns == NULL)
-		return -1;
-
-	p->bf_insns[p->bf_len - 1].code = code;
-	p->bf_insns[p->bf_len - 1].jt   = jt;
-	p->bf_insns[p->bf_len - 1].jf   = jf;
-	p->bf_insns[p->bf_len - 1].k    = k;
-
-	return 0;
-}
-
-int
-bpf_get_len(struct bpf_program *p)
-{
-	return p->bf_len;
-}
-
-struct bpf_insn *
-bpf_get_insn(struct bpf_program *p, int i)
-{
-	if (i > p->bf_len)
-		return NULL;
-
-	return &p->bf_insns[i];
-}
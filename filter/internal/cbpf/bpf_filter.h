@@ -83,6 +83,8 @@ struct bpf_program {
 #define		BPF_LSH		0x60
 #define		BPF_RSH		0x70
 #define		BPF_NEG		0x80
+#define		BPF_MOD		0x90
+#define		BPF_XOR		0xa0
 #define		BPF_JA		0x00
 #define		BPF_JEQ		0x10
 #define		BPF_JGT		0x20
@@ -127,9 +129,5 @@ unsigned int bpf_filter(const struct bpf_insn *pc, char *p,
 
 int bpf_validate(const struct bpf_insn *f, int len);
 
-int bpf_append_insn(struct bpf_program *p, unsigned short code,
-                unsigned char jt, unsigned char jf, unsigned int k);
 
-int bpf_get_len(struct bpf_program *p);
 
-struct bpf_insn *bpf_get_insn(struct bpf_program *p, int i);
@@ -0,0 +1,81 @@
+/*
+ * Network packet analysis framework.
+ *
+ * Copyright (c) 2014, Alessandro Ghedini
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are
+ * met:
+ *
+ *     * Redistributions of source code must retain the above copyright
+ *       notice, this list of conditions and the following disclaimer.
+ *
+ *     * Redistributions in binary form must reproduce the above copyright
+ *       notice, this list of conditions and the following disclaimer in the
+ *       documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS
+ * IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO,
+ * THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR
+ * PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR
+ * CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+ * EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+ * PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+ * PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF
+ * LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+ * NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+ * SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+//go:build cgo
+
+// Provides the original C implementation of the BPF machine, which is only used
+// to check the Go implementation in the filter package's tests.
+package cbpf
+
+// #include <stdlib.h>
+// #include "bpf_filter.h"
+import "C"
+
+import "unsafe"
+
+// Whether the C implementation is available (that is, if cgo is enabled).
+const Available = true
+
+// A single BPF instruction, with the same layout as struct bpf_insn.
+type Insn struct {
+	Code uint16
+	Jt   uint8
+	Jf   uint8
+	K    uint32
+}
+
+// Run the given program on buf and return its result.
+func Filter(insns []Insn, buf []byte, wirelen uint) uint {
+	if len(buf) == 0 {
+		buf = make([]byte, 1)[:0]
+	}
+
+	prog := c_insns(insns)
+	cbuf := (*C.char)(unsafe.Pointer(unsafe.SliceData(buf)))
+	blen := C.uint(len(buf))
+
+	return uint(C.bpf_filter(prog, cbuf, C.uint(wirelen), blen))
+}
+
+// Validate the given program.
+func Validate(insns []Insn) bool {
+	prog := c_insns(insns)
+
+	return C.bpf_validate(prog, C.int(len(insns))) > 0
+}
+
+/* an empty program is passed as NULL, like libpcap does */
+func c_insns(insns []Insn) *C.struct_bpf_insn {
+	if len(insns) == 0 {
+		return nil
+	}
+
+	return (*C.struct_bpf_insn)(unsafe.Pointer(&insns[0]))
+}
@@ -28,6 +28,8 @@
  * SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
  */
 
+//go:build libpcap
+
 package filter
 
 // #cgo LDFLAGS: -lpcap
@@ -40,8 +42,10 @@ import "unsafe"
 
 import "github.com/ghedo/go.pkt/packet"
 
-// Compile the given tcpdump-like expression to a BPF filter.
-func Compile(filter string, link_type packet.Type, optimize bool) (*Filter, error) {
+// Compile the given tcpdump-like expression to a BPF filter using libpcap. This
+// supports the whole pcap-filter language, but requires building with the
+// "libpcap" tag.
+func CompileLibpcap(filter string, link_type packet.Type, optimize bool) (*Filter, error) {
 	var do_optimize int
 
 	if optimize {
@@ -50,21 +54,31 @@ func Compile(filter string, link_type packet.Type, optimize bool) (*Filter, erro
 		do_optimize = 0
 	}
 
-	f := &Filter{}
+	var prog C.struct_bpf_program
 
 	filter_str := C.CString(filter)
 	defer C.free(unsafe.Pointer(filter_str))
 
-	pcap_type := link_type.ToLinkType()
+	pcap_type, ok := link_type.ToLinkType()
+	if !ok {
+		return nil, fmt.Errorf("Unsupported link type: %s", link_type)
+	}
 
 	err := C.pcap_compile_nopcap(
 		C.int(0x7fff), C.int(pcap_type),
-		(*C.struct_bpf_program)(f.Program()),
-		filter_str, C.int(do_optimize), 0xffffffff,
+		&prog, filter_str, C.int(do_optimize), 0xffffffff,
 	)
 	if err < 0 {
 		return nil, fmt.Errorf("Could not compile filter")
 	}
+	defer C.pcap_freecode(&prog)
+
+	insns := unsafe.Slice(
+		(*bpf_insn)(unsafe.Pointer(prog.bf_insns)), int(prog.bf_len),
+	)
+
+	f := &Filter{}
+	f.prog = append(f.prog, insns...)
 
 	return f, nil
 }
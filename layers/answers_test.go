@@ -0,0 +1,337 @@
+/*
+ * Network packet analysis framework.
+ *
+ * Copyright (c) 2014, Alessandro Ghedini
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are
+ * met:
+ *
+ *     * Redistributions of source code must retain the above copyright
+ *       notice, this list of conditions and the following disclaimer.
+ *
+ *     * Redistributions in binary form must reproduce the above copyright
+ *       notice, this list of conditions and the following disclaimer in the
+ *       documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS
+ * IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO,
+ * THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR
+ * PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR
+ * CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+ * EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+ * PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+ * PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF
+ * LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+ * NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+ * SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package layers_test
+
+import "net"
+import "testing"
+
+import "github.com/ghedo/go.pkt/layers"
+import "github.com/ghedo/go.pkt/packet"
+import "github.com/ghedo/go.pkt/packet/arp"
+import "github.com/ghedo/go.pkt/packet/eth"
+import "github.com/ghedo/go.pkt/packet/icmpv4"
+import "github.com/ghedo/go.pkt/packet/icmpv6"
+import "github.com/ghedo/go.pkt/packet/ipv4"
+import "github.com/ghedo/go.pkt/packet/ipv6"
+import "github.com/ghedo/go.pkt/packet/tcp"
+import "github.com/ghedo/go.pkt/packet/udp"
+import "github.com/ghedo/go.pkt/packet/vlan"
+
+func compose(t *testing.T, pkts ...packet.Packet) packet.Packet {
+	pkt, err := layers.Compose(pkts...)
+	if err != nil {
+		t.Fatalf("Error composing: %s", err)
+	}
+
+	return pkt
+}
+
+func make_eth(src, dst string) *eth.Packet {
+	eth_pkt := eth.Make()
+	eth_pkt.SrcAddr, _ = net.ParseMAC(src)
+	eth_pkt.DstAddr, _ = net.ParseMAC(dst)
+	return eth_pkt
+}
+
+func make_ipv4(src, dst string) *ipv4.Packet {
+	ip4_pkt := ipv4.Make()
+	ip4_pkt.SrcAddr = net.ParseIP(src)
+	ip4_pkt.DstAddr = net.ParseIP(dst)
+	return ip4_pkt
+}
+
+func make_ipv6(src, dst string) *ipv6.Packet {
+	ip6_pkt := ipv6.Make()
+	ip6_pkt.SrcAddr = net.ParseIP(src)
+	ip6_pkt.DstAddr = net.ParseIP(dst)
+	return ip6_pkt
+}
+
+func make_udp(src, dst uint16) *udp.Packet {
+	return &udp.Packet{ SrcPort: src, DstPort: dst }
+}
+
+func make_tcp(src, dst uint16, flags tcp.Flags, seq, ack uint32) *tcp.Packet {
+	tcp_pkt := tcp.Make()
+	tcp_pkt.SrcPort = src
+	tcp_pkt.DstPort = dst
+	tcp_pkt.Flags   = flags
+	tcp_pkt.Seq     = seq
+	tcp_pkt.Ack     = ack
+	return tcp_pkt
+}
+
+func make_icmp(typ icmpv4.Type, id, seq uint16) *icmpv4.Packet {
+	icmp_pkt := icmpv4.Make()
+	icmp_pkt.Type = typ
+	icmp_pkt.Id   = id
+	icmp_pkt.Seq  = seq
+	return icmp_pkt
+}
+
+func check_answers(t *testing.T, name string, req, ans packet.Packet, expect bool) {
+	if ans.Answers(req) != expect {
+		t.Errorf("%s: Answers mismatch, expected %v", name, expect)
+	}
+
+	if expect && ans.MatchKey() != req.MatchKey() {
+		t.Errorf("%s: MatchKey mismatch: %q %q", name,
+		         req.MatchKey(), ans.MatchKey())
+	}
+}
+
+func TestAnswersUDP(t *testing.T) {
+	req := compose(t, make_eth(hwsrc_str, hwdst_str),
+	              make_ipv4(ipsrc_str, ipdst_str), make_udp(52134, 53))
+
+	ans := compose(t, make_eth(hwdst_str, hwsrc_str),
+	              make_ipv4(ipdst_str, ipsrc_str), make_udp(53, 52134))
+	check_answers(t, "udp", req, ans, true)
+
+	ans = compose(t, make_eth(hwdst_str, hwsrc_str),
+	             make_ipv4(ipdst_str, ipsrc_str), make_udp(53, 52135))
+	check_answers(t, "udp port", req, ans, false)
+
+	ans = compose(t, make_eth(hwdst_str, hwsrc_str),
+	             make_ipv4(ipdst_str, "192.168.1.136"), make_udp(53, 52134))
+	check_answers(t, "udp addr", req, ans, false)
+
+	ans = compose(t, make_eth(hwdst_str, hwsrc_str),
+	             make_ipv4(ipdst_str, ipsrc_str),
+	             make_tcp(53, 52134, tcp.Syn | tcp.Ack, 0, 1))
+	check_answers(t, "udp tcp", req, ans, false)
+
+	vlan_pkt := vlan.Make()
+	vlan_pkt.VLAN = 135
+
+	ans = compose(t, make_eth(hwdst_str, hwsrc_str), vlan_pkt,
+	             make_ipv4(ipdst_str, ipsrc_str), make_udp(53, 52134))
+	check_answers(t, "udp vlan", req, ans, true)
+}
+
+func TestAnswersTCP(t *testing.T) {
+	req := compose(t, make_ipv4(ipsrc_str, ipdst_str),
+	              make_tcp(52134, 80, tcp.Syn, 1000, 0))
+
+	ans := compose(t, make_ipv4(ipdst_str, ipsrc_str),
+	              make_tcp(80, 52134, tcp.Syn | tcp.Ack, 5000, 1001))
+	check_answers(t, "tcp syn-ack", req, ans, true)
+
+	ans = compose(t, make_ipv4(ipdst_str, ipsrc_str),
+	             make_tcp(80, 52134, tcp.Rst | tcp.Ack, 0, 1001))
+	check_answers(t, "tcp rst", req, ans, true)
+
+	ans = compose(t, make_ipv4(ipdst_str, ipsrc_str),
+	             make_tcp(80, 52134, tcp.Syn | tcp.Ack, 5000, 2001))
+	check_answers(t, "tcp ack", req, ans, false)
+}
+
+func TestAnswersICMP(t *testing.T) {
+	req := compose(t, make_ipv4(ipsrc_str, ipdst_str),
+	              make_icmp(icmpv4.EchoRequest, 1, 2))
+
+	ans := compose(t, make_ipv4(ipdst_str, ipsrc_str),
+	              make_icmp(icmpv4.EchoReply, 1, 2))
+	check_answers(t, "icmp echo", req, ans, true)
+
+	ans = compose(t, make_ipv4(ipdst_str, ipsrc_str),
+	             make_icmp(icmpv4.EchoReply, 1, 3))
+	check_answers(t, "icmp seq", req, ans, false)
+
+	req = compose(t, make_ipv4(ipsrc_str, "255.255.255.255"),
+	             make_icmp(icmpv4.EchoRequest, 1, 2))
+
+	ans = compose(t, make_ipv4(ipdst_str, ipsrc_str),
+	             make_icmp(icmpv4.EchoReply, 1, 2))
+	check_answers(t, "icmp broadcast", req, ans, true)
+}
+
+func TestAnswersICMPError(t *testing.T) {
+	req_ip4 := make_ipv4(ipsrc_str, ipdst_str)
+	req_ip4.Id = 4242
+
+	req := compose(t, req_ip4, make_udp(52134, 33434))
+
+	quote_ip4 := make_ipv4(ipsrc_str, ipdst_str)
+	quote_ip4.Id = 4242
+
+	ans := compose(t, make_ipv4("10.0.0.1", ipsrc_str),
+	              make_icmp(icmpv4.TimeExceeded, 0, 0),
+	              quote_ip4, make_udp(52134, 33434))
+	check_answers(t, "icmp error", req, ans, true)
+
+	quote_ip4 = make_ipv4(ipsrc_str, ipdst_str)
+	quote_ip4.Id = 4243
+
+	ans = compose(t, make_ipv4("10.0.0.1", ipsrc_str),
+	             make_icmp(icmpv4.TimeExceeded, 0, 0),
+	             quote_ip4, make_udp(52134, 33434))
+	check_answers(t, "icmp error id", req, ans, false)
+}
+
+func TestAnswersICMPv6(t *testing.T) {
+	req_icmp := icmpv6.Make()
+	req_icmp.Body = 0x00010002
+
+	req := compose(t, make_ipv6("fe80::1", "fe80::2"), req_icmp)
+
+	ans_icmp := icmpv6.Make()
+	ans_icmp.Type = icmpv6.EchoReply
+	ans_icmp.Body = 0x00010002
+
+	ans := compose(t, make_ipv6("fe80::2", "fe80::1"), ans_icmp)
+	check_answers(t, "icmp6 echo", req, ans, true)
+
+	ans_icmp.Body = 0x00010003
+	check_answers(t, "icmp6 body", req, ans, false)
+
+	req = compose(t, make_ipv6("fe80::1", "fe80::2"),
+	             make_udp(52134, 33434))
+
+	err_icmp := icmpv6.Make()
+	err_icmp.Type = icmpv6.DstUnreachable
+
+	ans = compose(t, make_ipv6("fe80::3", "fe80::1"), err_icmp,
+	             make_ipv6("fe80::1", "fe80::2"), make_udp(52134, 33434))
+	check_answers(t, "icmp6 error", req, ans, true)
+}
+
+func TestAnswersARP(t *testing.T) {
+	req_arp := arp.Make()
+	req_arp.HWSrcAddr, _ = net.ParseMAC(hwsrc_str)
+	req_arp.ProtoSrcAddr = net.ParseIP(ipsrc_str)
+	req_arp.ProtoDstAddr = net.ParseIP(ipdst_str)
+
+	req := compose(t, make_eth(hwsrc_str, "ff:ff:ff:ff:ff:ff"), req_arp)
+
+	ans_arp := arp.Make()
+	ans_arp.Operation = arp.Reply
+	ans_arp.HWSrcAddr, _ = net.ParseMAC(hwdst_str)
+	ans_arp.HWDstAddr, _ = net.ParseMAC(hwsrc_str)
+	ans_arp.ProtoSrcAddr = net.ParseIP(ipdst_str)
+	ans_arp.ProtoDstAddr = net.ParseIP(ipsrc_str)
+
+	ans := compose(t, make_eth(hwdst_str, hwsrc_str), ans_arp)
+	check_answers(t, "arp", req, ans, true)
+}
+
+/* pack an ICMP time exceeded error quoting pkts, truncated to quote_len bytes
+ * after the quoted IP header, and unpack it */
+func icmp_error(t *testing.T, quote_len int, pkts ...packet.Packet) packet.Packet {
+	pkts = append([]packet.Packet{
+		make_ipv4("10.0.0.1", ipsrc_str),
+		make_icmp(icmpv4.TimeExceeded, 0, 0),
+	}, pkts...)
+
+	buf, err := layers.Pack(pkts...)
+	if err != nil {
+		t.Fatalf("Error packing: %s", err)
+	}
+
+	pkt, err := layers.UnpackAll(buf[:20 + 8 + 20 + quote_len], packet.IPv4)
+	if err != nil {
+		t.Fatalf("Error unpacking: %s", err)
+	}
+
+	return pkt
+}
+
+func TestAnswersICMPErrorQuote(t *testing.T) {
+	req := compose(t, make_ipv4(ipsrc_str, ipdst_str),
+	              make_tcp(52134, 80, tcp.Syn, 1000, 0))
+
+	ans := icmp_error(t, 8, make_ipv4(ipsrc_str, ipdst_str),
+	                  make_tcp(52134, 80, tcp.Syn, 1000, 0))
+	check_answers(t, "tcp truncated", req, ans, true)
+
+	ans = icmp_error(t, 20, make_ipv4(ipsrc_str, ipdst_str),
+	                 make_tcp(52134, 80, tcp.Syn, 1000, 0))
+	check_answers(t, "tcp full", req, ans, true)
+
+	ans = icmp_error(t, 8, make_ipv4(ipsrc_str, ipdst_str),
+	                 make_tcp(52134, 80, tcp.Syn, 2000, 0))
+	check_answers(t, "tcp seq", req, ans, false)
+
+	ans = icmp_error(t, 8, make_ipv4(ipsrc_str, ipdst_str),
+	                 make_tcp(52134, 81, tcp.Syn, 1000, 0))
+	check_answers(t, "tcp port", req, ans, false)
+
+	req = compose(t, make_ipv4(ipsrc_str, ipdst_str), make_udp(52134, 33434))
+
+	ans = icmp_error(t, 8, make_ipv4(ipsrc_str, ipdst_str),
+	                 make_udp(52134, 33434))
+	check_answers(t, "udp", req, ans, true)
+
+	ans = icmp_error(t, 8, make_ipv4(ipsrc_str, ipdst_str),
+	                 make_udp(52134, 33435))
+	check_answers(t, "udp port", req, ans, false)
+
+	req = compose(t, make_ipv4(ipsrc_str, ipdst_str),
+	             make_icmp(icmpv4.EchoRequest, 1, 2))
+
+	ans = icmp_error(t, 8, make_ipv4(ipsrc_str, ipdst_str),
+	                 make_icmp(icmpv4.EchoRequest, 1, 2))
+	check_answers(t, "icmp", req, ans, true)
+
+	ans = icmp_error(t, 8, make_ipv4(ipsrc_str, ipdst_str),
+	                 make_icmp(icmpv4.EchoRequest, 1, 3))
+	check_answers(t, "icmp seq", req, ans, false)
+}
+
+func TestAnswersICMPv6ErrorQuote(t *testing.T) {
+	req_icmp := icmpv6.Make()
+	req_icmp.Body = 0x00010002
+
+	req := compose(t, make_ipv6("2001:db8::1", "2001:db8::2"), req_icmp)
+
+	for _, body := range []uint32{ 0x00010002, 0x00010003 } {
+		err_icmp := icmpv6.Make()
+		err_icmp.Type = icmpv6.TimeExceeded
+
+		quote_icmp := icmpv6.Make()
+		quote_icmp.Body = body
+
+		buf, err := layers.Pack(make_ipv6("2001:db8::3", "2001:db8::1"),
+		                        err_icmp,
+		                        make_ipv6("2001:db8::1", "2001:db8::2"),
+		                        quote_icmp)
+		if err != nil {
+			t.Fatalf("Error packing: %s", err)
+		}
+
+		ans, err := layers.UnpackAll(buf, packet.IPv6)
+		if err != nil {
+			t.Fatalf("Error unpacking: %s", err)
+		}
+
+		check_answers(t, "icmp6", req, ans, body == req_icmp.Body)
+	}
+}
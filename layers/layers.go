@@ -42,9 +42,12 @@ import "github.com/ghedo/go.pkt/packet/icmpv6"
 import "github.com/ghedo/go.pkt/packet/ipv4"
 import "github.com/ghedo/go.pkt/packet/ipv6"
 import "github.com/ghedo/go.pkt/packet/llc"
+import "github.com/ghedo/go.pkt/packet/loopback"
+import "github.com/ghedo/go.pkt/packet/ppp"
 import "github.com/ghedo/go.pkt/packet/radiotap"
 import "github.com/ghedo/go.pkt/packet/raw"
 import "github.com/ghedo/go.pkt/packet/sll"
+import "github.com/ghedo/go.pkt/packet/sll2"
 import "github.com/ghedo/go.pkt/packet/snap"
 import "github.com/ghedo/go.pkt/packet/tcp"
 import "github.com/ghedo/go.pkt/packet/udp"
@@ -164,6 +167,15 @@ func UnpackAll(buf []byte, link_type packet.Type) (packet.Packet, error) {
 			break
 		}
 
+		/* raw IP link types carry either IPv4 or IPv6 packets */
+		if link_type == packet.IP {
+			if b.Bytes()[0] >> 4 == 6 {
+				link_type = packet.IPv6
+			} else {
+				link_type = packet.IPv4
+			}
+		}
+
 		switch link_type {
 		case packet.ARP:      p = &arp.Packet{}
 		case packet.Eth:      p = &eth.Packet{}
@@ -172,8 +184,11 @@ func UnpackAll(buf []byte, link_type packet.Type) (packet.Packet, error) {
 		case packet.IPv4:     p = &ipv4.Packet{}
 		case packet.IPv6:     p = &ipv6.Packet{}
 		case packet.LLC:      p = &llc.Packet{}
+		case packet.Loopback: p = &loopback.Packet{}
+		case packet.PPP:      p = &ppp.Packet{}
 		case packet.RadioTap: p = &radiotap.Packet{}
 		case packet.SLL:      p = &sll.Packet{}
+		case packet.SLL2:     p = &sll2.Packet{}
 		case packet.SNAP:     p = &snap.Packet{}
 		case packet.TCP:      p = &tcp.Packet{}
 		case packet.UDP:      p = &udp.Packet{}
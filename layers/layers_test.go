@@ -555,6 +555,61 @@ func BenchmarkUnpackAllEthIPv4TCPRaw(bn *testing.B) {
 	}
 }
 
+func check_unpack_all(t *testing.T, buf []byte, link_type packet.Type, types ...packet.Type) {
+	pkt, err := layers.UnpackAll(buf, link_type)
+	if err != nil {
+		t.Fatalf("Error unpacking: %s", err)
+	}
+
+	for _, pkt_type := range types {
+		if pkt == nil || pkt.GetType() != pkt_type {
+			t.Fatalf("Packet type mismatch, %s", pkt)
+		}
+
+		pkt = pkt.Payload()
+	}
+}
+
+func TestUnpackAllLoopbackIPv4UDP(t *testing.T) {
+	buf := append([]byte{ 0x02, 0x00, 0x00, 0x00 }, test_eth_ipv4_udp[14:]...)
+
+	check_unpack_all(t, buf, packet.LinkType(0),
+	                 packet.Loopback, packet.IPv4, packet.UDP)
+}
+
+func TestUnpackAllSLL2IPv4UDP(t *testing.T) {
+	buf := append([]byte{
+		0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0x00, 0x01,
+		0x04, 0x06, 0x4c, 0x72, 0xb9, 0x54, 0xe5, 0x3d, 0x00, 0x00,
+	}, test_eth_ipv4_udp[14:]...)
+
+	check_unpack_all(t, buf, packet.LinkType(276),
+	                 packet.SLL2, packet.IPv4, packet.UDP)
+}
+
+func TestUnpackAllPPPIPv4UDP(t *testing.T) {
+	buf := append([]byte{ 0xff, 0x03, 0x00, 0x21 }, test_eth_ipv4_udp[14:]...)
+
+	check_unpack_all(t, buf, packet.LinkType(9),
+	                 packet.PPP, packet.IPv4, packet.UDP)
+}
+
+func TestUnpackAllRawIPv4UDP(t *testing.T) {
+	check_unpack_all(t, test_eth_ipv4_udp[14:], packet.LinkType(101),
+	                 packet.IPv4, packet.UDP)
+}
+
+func TestUnpackAllRawIPv6(t *testing.T) {
+	buf := []byte{
+		0x60, 0x00, 0x00, 0x00, 0x00, 0x00, 0x3b, 0x40, 0xfe, 0x80,
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+		0x00, 0x00, 0x00, 0x01, 0xfe, 0x80, 0x00, 0x00, 0x00, 0x00,
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02,
+	}
+
+	check_unpack_all(t, buf, packet.LinkType(101), packet.IPv6)
+}
+
 func TestFindLayer(t *testing.T) {
 	pkt, err := layers.UnpackAll(test_eth_ipv4_tcp, packet.Eth)
 	if err != nil {
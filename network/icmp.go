@@ -0,0 +1,128 @@
+/*
+ * Network packet analysis framework.
+ *
+ * Copyright (c) 2014, Alessandro Ghedini
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are
+ * met:
+ *
+ *     * Redistributions of source code must retain the above copyright
+ *       notice, this list of conditions and the following disclaimer.
+ *
+ *     * Redistributions in binary form must reproduce the above copyright
+ *       notice, this list of conditions and the following disclaimer in the
+ *       documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS
+ * IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO,
+ * THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR
+ * PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR
+ * CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+ * EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+ * PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+ * PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF
+ * LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+ * NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+ * SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package network
+
+import "fmt"
+import "net"
+
+import "github.com/ghedo/go.pkt/layers"
+import "github.com/ghedo/go.pkt/packet"
+import "github.com/ghedo/go.pkt/packet/icmpv4"
+import "github.com/ghedo/go.pkt/packet/icmpv6"
+import "github.com/ghedo/go.pkt/packet/ipv4"
+import "github.com/ghedo/go.pkt/packet/ipv6"
+
+// ICMPError describes an ICMPv4 or ICMPv6 error message received in answer to
+// a probe (e.g. "time exceeded" or "destination unreachable").
+type ICMPError struct {
+	From  net.IP
+	Proto packet.Type
+	Type  uint8
+	Code  uint8
+	Quote packet.Packet
+}
+
+// Return the ICMPv4 or ICMPv6 error message carried by the given packet, or nil
+// if the packet is not an ICMP error. The quoted packet starts at its IP layer,
+// and may be truncated (only its first 8 bytes after the IP header are
+// guaranteed to be quoted).
+func ParseICMPError(pkt packet.Packet) *ICMPError {
+	if icmp_pkt, ok := layers.FindLayer(pkt, packet.ICMPv4).(*icmpv4.Packet); ok {
+		if !icmp_pkt.Type.IsError() || icmp_pkt.Payload() == nil {
+			return nil
+		}
+
+		ip_pkt, ok := layers.FindLayer(pkt, packet.IPv4).(*ipv4.Packet)
+		if !ok {
+			return nil
+		}
+
+		return &ICMPError{
+			From:  ip_pkt.SrcAddr,
+			Proto: packet.ICMPv4,
+			Type:  uint8(icmp_pkt.Type),
+			Code:  uint8(icmp_pkt.Code),
+			Quote: icmp_pkt.Payload(),
+		}
+	}
+
+	if icmp_pkt, ok := layers.FindLayer(pkt, packet.ICMPv6).(*icmpv6.Packet); ok {
+		if !icmp_pkt.Type.IsError() || icmp_pkt.Payload() == nil {
+			return nil
+		}
+
+		ip_pkt, ok := layers.FindLayer(pkt, packet.IPv6).(*ipv6.Packet)
+		if !ok {
+			return nil
+		}
+
+		return &ICMPError{
+			From:  ip_pkt.SrcAddr,
+			Proto: packet.ICMPv6,
+			Type:  uint8(icmp_pkt.Type),
+			Code:  uint8(icmp_pkt.Code),
+			Quote: icmp_pkt.Payload(),
+		}
+	}
+
+	return nil
+}
+
+// Check if the error is a "time exceeded" message, as sent by the routers that
+// drop packets whose TTL (or hop limit) expired.
+func (e *ICMPError) TimeExceeded() bool {
+	if e.Proto == packet.ICMPv6 {
+		return icmpv6.Type(e.Type) == icmpv6.TimeExceeded
+	}
+
+	return icmpv4.Type(e.Type) == icmpv4.TimeExceeded
+}
+
+// Check if the error is a "destination unreachable" message.
+func (e *ICMPError) Unreachable() bool {
+	if e.Proto == packet.ICMPv6 {
+		return icmpv6.Type(e.Type) == icmpv6.DstUnreachable
+	}
+
+	return icmpv4.Type(e.Type) == icmpv4.DstUnreachable
+}
+
+func (e *ICMPError) String() string {
+	var typ string
+
+	if e.Proto == packet.ICMPv6 {
+		typ = icmpv6.Type(e.Type).String()
+	} else {
+		typ = icmpv4.Type(e.Type).String()
+	}
+
+	return fmt.Sprintf("%s code %d from %s", typ, e.Code, e.From)
+}
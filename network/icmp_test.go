@@ -0,0 +1,121 @@
+/*
+ * Network packet analysis framework.
+ *
+ * Copyright (c) 2014, Alessandro Ghedini
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are
+ * met:
+ *
+ *     * Redistributions of source code must retain the above copyright
+ *       notice, this list of conditions and the following disclaimer.
+ *
+ *     * Redistributions in binary form must reproduce the above copyright
+ *       notice, this list of conditions and the following disclaimer in the
+ *       documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS
+ * IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO,
+ * THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR
+ * PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR
+ * CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+ * EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+ * PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+ * PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF
+ * LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+ * NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+ * SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package network_test
+
+import "net"
+import "testing"
+
+import "github.com/ghedo/go.pkt/layers"
+import "github.com/ghedo/go.pkt/network"
+import "github.com/ghedo/go.pkt/packet"
+import "github.com/ghedo/go.pkt/packet/icmpv4"
+import "github.com/ghedo/go.pkt/packet/icmpv6"
+import "github.com/ghedo/go.pkt/packet/ipv4"
+import "github.com/ghedo/go.pkt/packet/ipv6"
+import "github.com/ghedo/go.pkt/packet/udp"
+
+func unpack_icmp(t *testing.T, link packet.Type, pkts ...packet.Packet) packet.Packet {
+	buf, err := layers.Pack(pkts...)
+	if err != nil {
+		t.Fatalf("Error packing: %s", err)
+	}
+
+	pkt, err := layers.UnpackAll(buf, link)
+	if err != nil {
+		t.Fatalf("Error unpacking: %s", err)
+	}
+
+	return pkt
+}
+
+func TestParseICMPError(t *testing.T) {
+	ip4_pkt := ipv4.Make()
+	ip4_pkt.SrcAddr = net.ParseIP("10.0.0.1")
+	ip4_pkt.DstAddr = net.ParseIP("192.168.1.1")
+
+	quote_pkt := ipv4.Make()
+	quote_pkt.SrcAddr = net.ParseIP("192.168.1.1")
+	quote_pkt.DstAddr = net.ParseIP("8.8.8.8")
+
+	icmp_pkt := icmpv4.Make()
+	icmp_pkt.Type = icmpv4.DstUnreachable
+	icmp_pkt.Code = 3
+
+	pkt := unpack_icmp(t, packet.IPv4, ip4_pkt, icmp_pkt, quote_pkt, udp.Make())
+
+	icmp_err := network.ParseICMPError(pkt)
+	if icmp_err == nil {
+		t.Fatalf("No ICMP error")
+	}
+
+	if !icmp_err.From.Equal(ip4_pkt.SrcAddr) || icmp_err.Code != 3 ||
+	   !icmp_err.Unreachable() || icmp_err.TimeExceeded() {
+		t.Fatalf("ICMP error mismatch: %s", icmp_err)
+	}
+
+	if layers.FindLayer(icmp_err.Quote, packet.UDP) == nil {
+		t.Fatalf("Quote mismatch: %s", icmp_err.Quote)
+	}
+
+	icmp_pkt = icmpv4.Make()
+	icmp_pkt.Type = icmpv4.EchoReply
+
+	pkt = unpack_icmp(t, packet.IPv4, ip4_pkt, icmp_pkt)
+
+	if network.ParseICMPError(pkt) != nil {
+		t.Fatalf("Unexpected ICMP error")
+	}
+}
+
+func TestParseICMPv6Error(t *testing.T) {
+	ip6_pkt := ipv6.Make()
+	ip6_pkt.SrcAddr = net.ParseIP("2001:db8::1")
+	ip6_pkt.DstAddr = net.ParseIP("2001:db8::2")
+
+	quote_pkt := ipv6.Make()
+	quote_pkt.SrcAddr = net.ParseIP("2001:db8::2")
+	quote_pkt.DstAddr = net.ParseIP("2001:db8::3")
+
+	icmp_pkt := icmpv6.Make()
+	icmp_pkt.Type = icmpv6.TimeExceeded
+
+	pkt := unpack_icmp(t, packet.IPv6, ip6_pkt, icmp_pkt, quote_pkt, udp.Make())
+
+	icmp_err := network.ParseICMPError(pkt)
+	if icmp_err == nil {
+		t.Fatalf("No ICMP error")
+	}
+
+	if !icmp_err.From.Equal(ip6_pkt.SrcAddr) || icmp_err.Code != 0 ||
+	   !icmp_err.TimeExceeded() || icmp_err.Unreachable() {
+		t.Fatalf("ICMP error mismatch: %s", icmp_err)
+	}
+}
@@ -0,0 +1,220 @@
+/*
+ * Network packet analysis framework.
+ *
+ * Copyright (c) 2014, Alessandro Ghedini
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are
+ * met:
+ *
+ *     * Redistributions of source code must retain the above copyright
+ *       notice, this list of conditions and the following disclaimer.
+ *
+ *     * Redistributions in binary form must reproduce the above copyright
+ *       notice, this list of conditions and the following disclaimer in the
+ *       documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS
+ * IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO,
+ * THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR
+ * PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR
+ * CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+ * EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+ * PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+ * PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF
+ * LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+ * NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+ * SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+// Provides fake capture handles for the tests of the network packages.
+package testhandle
+
+import "fmt"
+import "net"
+import "sync"
+import "time"
+
+import "github.com/ghedo/go.pkt/layers"
+import "github.com/ghedo/go.pkt/packet"
+import "github.com/ghedo/go.pkt/packet/arp"
+import "github.com/ghedo/go.pkt/packet/eth"
+import "github.com/ghedo/go.pkt/packet/icmpv6"
+import "github.com/ghedo/go.pkt/packet/ipv6"
+import "github.com/ghedo/go.pkt/packet/raw"
+
+// A Handle is a fake Ethernet capture handle. The injected packets are recorded
+// and passed to Answer (if set), which can queue the packets to be captured
+// with Queue(). Use capture.Adapt() where a full capture.Handle is needed.
+type Handle struct {
+	// Called with every injected packet, with the handle's lock held.
+	Answer func(pkt packet.Packet) error
+
+	// Delay of the queued packets.
+	Delay time.Duration
+
+	// If set, Capture() waits for a packet (or for the handle to be closed)
+	// instead of returning no packet after a short timeout.
+	Block bool
+
+	mutex  sync.Mutex
+	sent   [][]byte
+	recvd  int
+	queue  chan []byte
+	closed chan struct{}
+	once   sync.Once
+}
+
+// Create a new handle with no Answer function.
+func New() *Handle {
+	return &Handle{
+		queue:  make(chan []byte, 1024),
+		closed: make(chan struct{}),
+	}
+}
+
+func (h *Handle) LinkType() packet.Type { return packet.Eth }
+func (h *Handle) Activate() error       { return nil }
+
+func (h *Handle) Close() {
+	h.once.Do(func() { close(h.closed) })
+}
+
+func (h *Handle) Capture() ([]byte, error) {
+	h.mutex.Lock()
+	h.recvd++
+	h.mutex.Unlock()
+
+	var timeout <-chan time.Time
+
+	if !h.Block {
+		timeout = time.After(5 * time.Millisecond)
+	}
+
+	select {
+	case buf := <-h.queue:
+		return buf, nil
+
+	case <-h.closed:
+		return nil, fmt.Errorf("Handle closed")
+
+	case <-timeout:
+		return nil, nil
+	}
+}
+
+func (h *Handle) Inject(buf []byte) error {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	h.sent = append(h.sent, buf)
+
+	if h.Answer == nil {
+		return nil
+	}
+
+	pkt, err := layers.UnpackAll(buf, packet.Eth)
+	if err != nil {
+		return err
+	}
+
+	return h.Answer(pkt)
+}
+
+// Pack the given packets and queue them to be captured, after the handle's
+// delay.
+func (h *Handle) Queue(pkts ...packet.Packet) error {
+	buf, err := layers.Pack(pkts...)
+	if err != nil {
+		return err
+	}
+
+	if h.Delay > 0 {
+		time.AfterFunc(h.Delay, func() { h.queue <- buf })
+	} else {
+		h.queue <- buf
+	}
+
+	return nil
+}
+
+// Return the injected packets.
+func (h *Handle) Sent() [][]byte {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	return append([][]byte(nil), h.sent...)
+}
+
+// Return the number of calls to Capture().
+func (h *Handle) Captured() int {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	return h.recvd
+}
+
+// Return the number of queued packets not captured yet.
+func (h *Handle) Queued() int {
+	return len(h.queue)
+}
+
+// Return the address resolved by the given ARP request or neighbor
+// solicitation, or nil if pkt is neither of them.
+func NeighborTarget(pkt packet.Packet) net.IP {
+	if arp_pkt, ok := layers.FindLayer(pkt, packet.ARP).(*arp.Packet); ok {
+		if arp_pkt.Operation != arp.Request {
+			return nil
+		}
+
+		return arp_pkt.ProtoDstAddr
+	}
+
+	icmp_pkt, ok := layers.FindLayer(pkt, packet.ICMPv6).(*icmpv6.Packet)
+	if ok && icmp_pkt.Type == icmpv6.NeighborSolicitation {
+		return icmp_pkt.Target()
+	}
+
+	return nil
+}
+
+// Return the ARP reply or neighbor advertisement answering the given ARP
+// request or neighbor solicitation with hwaddr, or nil if pkt is neither of
+// them.
+func NeighborReply(pkt packet.Packet, hwaddr net.HardwareAddr) []packet.Packet {
+	target := NeighborTarget(pkt)
+	if target == nil {
+		return nil
+	}
+
+	eth_pkt := eth.Make()
+	eth_pkt.SrcAddr = hwaddr
+	eth_pkt.DstAddr = pkt.(*eth.Packet).SrcAddr
+
+	if req, ok := layers.FindLayer(pkt, packet.ARP).(*arp.Packet); ok {
+		arp_pkt := arp.Make()
+		arp_pkt.Operation    = arp.Reply
+		arp_pkt.HWSrcAddr    = hwaddr
+		arp_pkt.HWDstAddr    = req.HWSrcAddr
+		arp_pkt.ProtoSrcAddr = req.ProtoDstAddr
+		arp_pkt.ProtoDstAddr = req.ProtoSrcAddr
+
+		return []packet.Packet{ eth_pkt, arp_pkt }
+	}
+
+	ipv6_pkt := ipv6.Make()
+	ipv6_pkt.SrcAddr  = target
+	ipv6_pkt.DstAddr  = layers.FindLayer(pkt, packet.IPv6).(*ipv6.Packet).SrcAddr
+	ipv6_pkt.HopLimit = 255
+
+	icmp_pkt := icmpv6.Make()
+	icmp_pkt.Type = icmpv6.NeighborAdvertisement
+
+	/* target address, followed by the target link-layer address option */
+	raw_pkt := raw.Make()
+	raw_pkt.Data = append([]byte(target), 2, 1)
+	raw_pkt.Data = append(raw_pkt.Data, hwaddr...)
+
+	return []packet.Packet{ eth_pkt, ipv6_pkt, icmp_pkt, raw_pkt }
+}
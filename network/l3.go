@@ -0,0 +1,292 @@
+/*
+ * Network packet analysis framework.
+ *
+ * Copyright (c) 2014, Alessandro Ghedini
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are
+ * met:
+ *
+ *     * Redistributions of source code must retain the above copyright
+ *       notice, this list of conditions and the following disclaimer.
+ *
+ *     * Redistributions in binary form must reproduce the above copyright
+ *       notice, this list of conditions and the following disclaimer in the
+ *       documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS
+ * IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO,
+ * THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR
+ * PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR
+ * CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+ * EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+ * PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+ * PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF
+ * LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+ * NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+ * SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package network
+
+import "fmt"
+import "net"
+import "sync"
+import "time"
+
+import "github.com/ghedo/go.pkt/capture"
+import "github.com/ghedo/go.pkt/packet"
+import "github.com/ghedo/go.pkt/packet/eth"
+import "github.com/ghedo/go.pkt/packet/ipv4"
+import "github.com/ghedo/go.pkt/packet/ipv6"
+import "github.com/ghedo/go.pkt/network/neighbor"
+import "github.com/ghedo/go.pkt/routing"
+
+// Function used by SendL3() and SendRecvL3() to open the capture handle of a
+// network interface, which is then activated and reused for all the following
+// packets sent over the same interface. It's also used to open the handle of the
+// interface's neighbor cache. On Linux AF_PACKET sockets are used by
+// default, on the other systems this needs to be set (e.g. to a function that
+// calls pcap.Open()) before sending any packet.
+var OpenHandle func(iface string) (capture.ReadInjector, error) = open_handle
+
+// Maximum time SendL3() waits for the link-layer address of the next hop to be
+// resolved.
+var ResolveTimeout = 2 * time.Second
+
+var l3_lock      sync.Mutex
+var l3_handles   = make(map[string]capture.ReadInjector)
+var l3_neighbors = make(map[string]*l3_neighbor)
+
+/* the neighbor caches have their own handles, that nobody else reads from */
+type l3_neighbor struct {
+	cache  *neighbor.Cache
+	handle capture.ReadInjector
+}
+
+var hwaddr_bcast = net.HardwareAddr{ 0xff, 0xff, 0xff, 0xff, 0xff, 0xff }
+var hwaddr_zero  = net.HardwareAddr{ 0x00, 0x00, 0x00, 0x00, 0x00, 0x00 }
+
+// Send the given packets, which must start with an IPv4 or IPv6 layer, to their
+// destination. The route to the destination address is looked up in the system
+// routing table and the source address is set from it (unless already set).
+// The link-layer address of the next hop is looked up in a neighbor cache for
+// the interface (seeded from the kernel's neighbor table, see the neighbor
+// package), and an Ethernet header is prepended before sending the packets.
+func SendL3(pkts ...packet.Packet) error {
+	c, pkts, err := RouteL3(ResolveTimeout, pkts...)
+	if err != nil {
+		return err
+	}
+
+	return Send(c, pkts...)
+}
+
+// Like SendL3() and Recv() combined. This only returns a suitable answer for the
+// sent packets, including its link-layer header. The timeout t is used like in
+// SendRecv() and also for the resolution of the next hop.
+func SendRecvL3(t time.Duration, pkts ...packet.Packet) (packet.Packet, error) {
+	c, pkts, err := RouteL3(t, pkts...)
+	if err != nil {
+		return nil, err
+	}
+
+	return SendRecv(c, t, pkts...)
+}
+
+// Close the capture handles opened by SendL3() and SendRecvL3(), and forget the
+// link-layer addresses resolved so far.
+func CloseL3() {
+	l3_lock.Lock()
+	defer l3_lock.Unlock()
+
+	for name, c := range l3_handles {
+		c.Close()
+		delete(l3_handles, name)
+	}
+
+	for name, n := range l3_neighbors {
+		n.handle.Close()
+		delete(l3_neighbors, name)
+	}
+}
+
+// Return the neighbor cache used by SendL3() and SendRecvL3() for the given
+// network interface. This can be used e.g. to add static entries or to tweak the
+// cache's configuration. The cache sends its requests on a separate capture
+// handle, so that its answers are not consumed by the readers of the handle
+// returned by RouteL3().
+func Neighbors(iface *net.Interface) (*neighbor.Cache, error) {
+	l3_lock.Lock()
+	defer l3_lock.Unlock()
+
+	if n, ok := l3_neighbors[iface.Name]; ok {
+		return n.cache, nil
+	}
+
+	c, err := open_l3_handle(iface.Name)
+	if err != nil {
+		return nil, err
+	}
+
+	cache := neighbor.NewCache(c, iface)
+
+	/* the kernel's table is only used to avoid needless requests */
+	cache.Seed()
+
+	l3_neighbors[iface.Name] = &l3_neighbor{ cache: cache, handle: c }
+
+	return cache, nil
+}
+
+// Prepare the given packets to be sent like SendL3() does, and return them with
+// the Ethernet header prepended (if needed) along with the capture handle they
+// should be sent on. This is useful to send packets with a Session, the packets
+// can then be modified and sent again as long as the destination is unchanged.
+// The next hop is resolved on a different handle (see Neighbors()), so reading
+// from the returned one doesn't interfere with the resolution. On Linux the
+// default handles have a read timeout, so that the Session can be closed.
+func RouteL3(t time.Duration, pkts ...packet.Packet) (capture.ReadInjector, []packet.Packet, error) {
+	if len(pkts) == 0 {
+		return nil, nil, fmt.Errorf("No packets")
+	}
+
+	var dst net.IP
+
+	switch p := pkts[0].(type) {
+	case *ipv4.Packet:
+		dst = p.DstAddr
+
+	case *ipv6.Packet:
+		dst = p.DstAddr
+
+	default:
+		return nil, nil, fmt.Errorf("Expected packet type IPv4 or IPv6, got %s",
+		                            pkts[0].GetType())
+	}
+
+	route, err := routing.RouteTo(dst)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if route == nil || route.Iface == nil {
+		return nil, nil, fmt.Errorf("No route to %s", dst)
+	}
+
+	switch p := pkts[0].(type) {
+	case *ipv4.Packet:
+		if p.SrcAddr == nil || p.SrcAddr.IsUnspecified() {
+			p.SrcAddr, err = route.GetSrcAddr(dst)
+		}
+
+	case *ipv6.Packet:
+		if p.SrcAddr == nil || p.SrcAddr.IsUnspecified() {
+			p.SrcAddr, err = route.GetSrcAddr(dst)
+		}
+	}
+
+	if err != nil {
+		return nil, nil, fmt.Errorf("Could not get source address: %s", err)
+	}
+
+	c, err := l3_handle(route.Iface.Name)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	switch c.LinkType() {
+	case packet.Eth:
+
+	case pkts[0].GetType():
+		return c, pkts, nil
+
+	default:
+		return nil, nil, fmt.Errorf("Unsupported link type %s", c.LinkType())
+	}
+
+	eth_pkt := eth.Make()
+	eth_pkt.SrcAddr = route.Iface.HardwareAddr
+
+	if len(eth_pkt.SrcAddr) == 0 {
+		eth_pkt.SrcAddr = hwaddr_zero
+	}
+
+	eth_pkt.DstAddr, err = next_hop_hwaddr(t, route, dst)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return c, append([]packet.Packet{ eth_pkt }, pkts...), nil
+}
+
+func l3_handle(name string) (capture.ReadInjector, error) {
+	l3_lock.Lock()
+	defer l3_lock.Unlock()
+
+	if c, ok := l3_handles[name]; ok {
+		return c, nil
+	}
+
+	c, err := open_l3_handle(name)
+	if err != nil {
+		return nil, err
+	}
+
+	l3_handles[name] = c
+
+	return c, nil
+}
+
+/* Open and activate a new handle. Must be called with the lock held. */
+func open_l3_handle(name string) (capture.ReadInjector, error) {
+	c, err := OpenHandle(name)
+	if err != nil {
+		return nil, fmt.Errorf("Could not open interface: %s", err)
+	}
+
+	err = c.Activate()
+	if err != nil {
+		c.Close()
+		return nil, fmt.Errorf("Could not activate interface: %s", err)
+	}
+
+	return c, nil
+}
+
+/* Return the link-layer address that packets for dst are sent to. */
+func next_hop_hwaddr(t time.Duration, route *routing.Route, dst net.IP) (net.HardwareAddr, error) {
+	if route.Iface.Flags & net.FlagLoopback != 0 {
+		return hwaddr_zero, nil
+	}
+
+	if dst.Equal(net.IPv4bcast) {
+		return hwaddr_bcast, nil
+	}
+
+	if dst.IsMulticast() {
+		if ip4 := dst.To4(); ip4 != nil {
+			return net.HardwareAddr{
+				0x01, 0x00, 0x5e, ip4[1] & 0x7f, ip4[2], ip4[3],
+			}, nil
+		}
+
+		return net.HardwareAddr{
+			0x33, 0x33, dst[12], dst[13], dst[14], dst[15],
+		}, nil
+	}
+
+	next := dst
+
+	if route.Gateway != nil && !route.Gateway.IsUnspecified() {
+		next = route.Gateway
+	}
+
+	cache, err := Neighbors(route.Iface)
+	if err != nil {
+		return nil, err
+	}
+
+	return cache.ResolveTimeout(next, t)
+}
@@ -0,0 +1,254 @@
+/*
+ * Network packet analysis framework.
+ *
+ * Copyright (c) 2014, Alessandro Ghedini
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are
+ * met:
+ *
+ *     * Redistributions of source code must retain the above copyright
+ *       notice, this list of conditions and the following disclaimer.
+ *
+ *     * Redistributions in binary form must reproduce the above copyright
+ *       notice, this list of conditions and the following disclaimer in the
+ *       documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS
+ * IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO,
+ * THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR
+ * PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR
+ * CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+ * EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+ * PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+ * PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF
+ * LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+ * NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+ * SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package network_test
+
+import "bytes"
+import "net"
+import "sync"
+import "testing"
+
+import "github.com/ghedo/go.pkt/capture"
+import "github.com/ghedo/go.pkt/layers"
+import "github.com/ghedo/go.pkt/network"
+import "github.com/ghedo/go.pkt/network/internal/testhandle"
+import "github.com/ghedo/go.pkt/packet"
+import "github.com/ghedo/go.pkt/packet/eth"
+import "github.com/ghedo/go.pkt/packet/ipv4"
+import "github.com/ghedo/go.pkt/packet/ipv6"
+import "github.com/ghedo/go.pkt/packet/udp"
+import "github.com/ghedo/go.pkt/routing"
+
+var neigh_hwaddr = net.HardwareAddr{ 2, 0, 0, 0, 0, 1 }
+
+/* answers all ARP requests and neighbor solicitations with neigh_hwaddr, and
+ * keeps all the other packets, on all the handles opened by the tests */
+type l3_net struct {
+	mutex    sync.Mutex
+	handles  []*testhandle.Handle
+	resolved []net.IP
+	sent     []packet.Packet
+}
+
+func open_l3_net(t *testing.T) *l3_net {
+	n := &l3_net{}
+
+	open_handle := network.OpenHandle
+
+	network.OpenHandle = func(iface string) (capture.ReadInjector, error) {
+		return n.open(), nil
+	}
+
+	t.Cleanup(func() {
+		network.CloseL3()
+		network.OpenHandle = open_handle
+	})
+
+	return n
+}
+
+func (n *l3_net) open() *testhandle.Handle {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	h := testhandle.New()
+	h.Answer = func(pkt packet.Packet) error {
+		n.mutex.Lock()
+		defer n.mutex.Unlock()
+
+		if target := testhandle.NeighborTarget(pkt); target != nil {
+			n.resolved = append(n.resolved, target)
+			return h.Queue(testhandle.NeighborReply(pkt, neigh_hwaddr)...)
+		}
+
+		n.sent = append(n.sent, pkt)
+
+		return nil
+	}
+
+	n.handles = append(n.handles, h)
+
+	return h
+}
+
+/* check that the requests are not sent on the handles of the other packets */
+func (n *l3_net) check_handles(t *testing.T) {
+	for _, h := range n.handles {
+		requests, others := 0, 0
+
+		for _, buf := range h.Sent() {
+			pkt, _ := layers.UnpackAll(buf, packet.Eth)
+
+			if testhandle.NeighborTarget(pkt) != nil {
+				requests++
+			} else {
+				others++
+			}
+		}
+
+		if requests > 0 && others > 0 {
+			t.Fatalf("Requests sent on a shared handle")
+		}
+	}
+}
+
+func send_l3(t *testing.T, ip_pkt packet.Packet) {
+	udp_pkt := udp.Make()
+	udp_pkt.SrcPort = 49152
+	udp_pkt.DstPort = 33434
+
+	err := network.SendL3(ip_pkt, udp_pkt)
+	if err != nil {
+		t.Fatalf("Error sending: %s", err)
+	}
+}
+
+func route_to(t *testing.T, dst net.IP) *routing.Route {
+	route, err := routing.RouteTo(dst)
+	if err != nil || route == nil || route.Iface == nil {
+		t.Skipf("No route to %s", dst)
+	}
+
+	if route.Iface.Flags & net.FlagLoopback != 0 ||
+	   len(route.Iface.HardwareAddr) != 6 {
+		t.Skipf("No Ethernet route to %s", dst)
+	}
+
+	return route
+}
+
+/* remove the next hop from the neighbor cache, in case the kernel knows it */
+func forget_next_hop(t *testing.T, route *routing.Route, dst net.IP) net.IP {
+	next := dst
+	if route.Gateway != nil {
+		next = route.Gateway
+	}
+
+	cache, err := network.Neighbors(route.Iface)
+	if err != nil {
+		t.Fatalf("Error getting neighbors: %s", err)
+	}
+
+	cache.Remove(next)
+
+	return next
+}
+
+func TestSendL3Loopback(t *testing.T) {
+	h := open_l3_net(t)
+
+	ip4_pkt := ipv4.Make()
+	ip4_pkt.DstAddr = net.ParseIP("127.0.0.1")
+
+	send_l3(t, ip4_pkt)
+
+	if len(h.resolved) != 0 || len(h.sent) != 1 {
+		t.Fatalf("Unexpected packets: %d %d", len(h.resolved), len(h.sent))
+	}
+
+	eth_pkt := h.sent[0].(*eth.Packet)
+	if !bytes.Equal(eth_pkt.DstAddr, make([]byte, 6)) {
+		t.Fatalf("Destination mismatch: %s", eth_pkt.DstAddr)
+	}
+
+	ip4_rsp := eth_pkt.Payload().(*ipv4.Packet)
+	if !ip4_rsp.SrcAddr.IsLoopback() {
+		t.Fatalf("Source mismatch: %s", ip4_rsp.SrcAddr)
+	}
+}
+
+func TestSendL3ARP(t *testing.T) {
+	dst := net.ParseIP("198.51.100.1")
+
+	route := route_to(t, dst)
+
+	h := open_l3_net(t)
+
+	next := forget_next_hop(t, route, dst)
+
+	for i := 0; i < 2; i++ {
+		ip4_pkt := ipv4.Make()
+		ip4_pkt.DstAddr = dst
+
+		send_l3(t, ip4_pkt)
+	}
+
+	/* the next hop is only resolved once */
+	if len(h.resolved) != 1 || !h.resolved[0].Equal(next) {
+		t.Fatalf("Resolution mismatch: %v", h.resolved)
+	}
+
+	h.check_handles(t)
+
+	for _, pkt := range h.sent {
+		eth_pkt := pkt.(*eth.Packet)
+		if !bytes.Equal(eth_pkt.DstAddr, neigh_hwaddr) {
+			t.Fatalf("Destination mismatch: %s", eth_pkt.DstAddr)
+		}
+	}
+}
+
+func TestSendL3NDP(t *testing.T) {
+	dst := net.ParseIP("2001:db8::1")
+
+	route := route_to(t, dst)
+
+	h := open_l3_net(t)
+
+	next := forget_next_hop(t, route, dst)
+
+	ip6_pkt := ipv6.Make()
+	ip6_pkt.DstAddr = dst
+
+	send_l3(t, ip6_pkt)
+
+	if len(h.resolved) != 1 || !h.resolved[0].Equal(next) {
+		t.Fatalf("Resolution mismatch: %v", h.resolved)
+	}
+
+	eth_pkt := h.sent[0].(*eth.Packet)
+	if !bytes.Equal(eth_pkt.DstAddr, neigh_hwaddr) {
+		t.Fatalf("Destination mismatch: %s", eth_pkt.DstAddr)
+	}
+
+	ip6_rsp := eth_pkt.Payload().(*ipv6.Packet)
+	if ip6_rsp.SrcAddr == nil || ip6_rsp.SrcAddr.To4() != nil {
+		t.Fatalf("Source mismatch: %s", ip6_rsp.SrcAddr)
+	}
+}
+
+func TestSendL3Invalid(t *testing.T) {
+	open_l3_net(t)
+
+	err := network.SendL3(udp.Make())
+	if err == nil {
+		t.Fatalf("Expected error")
+	}
+}
@@ -0,0 +1,569 @@
+/*
+ * Network packet analysis framework.
+ *
+ * Copyright (c) 2014, Alessandro Ghedini
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are
+ * met:
+ *
+ *     * Redistributions of source code must retain the above copyright
+ *       notice, this list of conditions and the following disclaimer.
+ *
+ *     * Redistributions in binary form must reproduce the above copyright
+ *       notice, this list of conditions and the following disclaimer in the
+ *       documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS
+ * IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO,
+ * THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR
+ * PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR
+ * CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+ * EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+ * PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+ * PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF
+ * LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+ * NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+ * SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+// Provides a cache of the link-layer addresses of the hosts directly connected
+// to a network interface. Addresses that are not known are resolved with ARP
+// (for IPv4) or NDP (for IPv6) requests, and the cache can also be seeded from
+// the kernel's neighbor table and updated by observing the traffic.
+package neighbor
+
+import "fmt"
+import "net"
+import "sync"
+import "time"
+
+import "github.com/ghedo/go.pkt/capture"
+import "github.com/ghedo/go.pkt/layers"
+import "github.com/ghedo/go.pkt/packet"
+import "github.com/ghedo/go.pkt/packet/arp"
+import "github.com/ghedo/go.pkt/packet/eth"
+import "github.com/ghedo/go.pkt/packet/icmpv6"
+import "github.com/ghedo/go.pkt/packet/ipv6"
+import "github.com/ghedo/go.pkt/packet/raw"
+
+// A Cache maps the IP addresses of the hosts on a network interface to their
+// link-layer addresses. It is safe for concurrent use.
+type Cache struct {
+	handle  capture.ReadInjector
+	iface   *net.Interface
+	ttl     time.Duration
+	neg_ttl time.Duration
+	timeout time.Duration
+	retries uint
+
+	mutex     sync.Mutex
+	entries   map[string]*entry
+	resolving int
+	reader    *reader
+}
+
+type entry struct {
+	hwaddr  net.HardwareAddr
+	err     error
+	expires time.Time
+	static  bool
+	done    chan struct{}
+}
+
+/* the goroutine capturing the answers to the requests */
+type reader struct {
+	stopped chan struct{}
+	err     error
+}
+
+const default_ttl     = time.Minute
+const default_neg_ttl = 10 * time.Second
+const default_timeout = time.Second
+const default_retries = 2
+
+/* how long to wait before polling again a handle with no packets available */
+const idle_wait = time.Millisecond
+
+var hwaddr_bcast = net.HardwareAddr{ 0xff, 0xff, 0xff, 0xff, 0xff, 0xff }
+var hwaddr_zero  = net.HardwareAddr{ 0x00, 0x00, 0x00, 0x00, 0x00, 0x00 }
+
+// Create a new, empty, cache for the given network interface. The requests are
+// sent, and the answers received, on the given (already activated) capture
+// handle, which must have Ethernet link type. While addresses are being resolved
+// the handle is read from a separate goroutine, so it shouldn't be read from
+// elsewhere. Resolutions time out even if the handle blocks, but a handle with
+// a read timeout (or non-blocking) lets the goroutine stop sooner.
+func NewCache(c capture.ReadInjector, iface *net.Interface) *Cache {
+	return &Cache{
+		handle:  c,
+		iface:   iface,
+		ttl:     default_ttl,
+		neg_ttl: default_neg_ttl,
+		timeout: default_timeout,
+		retries: default_retries,
+		entries: make(map[string]*entry),
+	}
+}
+
+// Set how long resolved (or learned) addresses and failed resolutions are
+// cached. If ttl is zero the entries never expire, if neg_ttl is zero failed
+// resolutions are not cached.
+func (c *Cache) SetTTL(ttl, neg_ttl time.Duration) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.ttl     = ttl
+	c.neg_ttl = neg_ttl
+}
+
+// Set the time Resolve() waits for an address to be resolved.
+func (c *Cache) SetTimeout(t time.Duration) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.timeout = t
+}
+
+// Set the number of additional requests sent (evenly spaced within the
+// timeout) for an address that is not resolved.
+func (c *Cache) SetRetries(retries uint) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.retries = retries
+}
+
+// Add the entries of the kernel's neighbor table for the cache's network
+// interface. The permanent kernel entries never expire, the others expire like
+// the resolved ones.
+func (c *Cache) Seed() error {
+	neighs, err := kernel_neighbors(c.iface.Index)
+	if err != nil {
+		return fmt.Errorf("Could not get kernel neighbors: %s", err)
+	}
+
+	for _, n := range neighs {
+		if n.static {
+			c.Add(n.addr, n.hwaddr)
+		} else {
+			c.update(n.addr, n.hwaddr)
+		}
+	}
+
+	return nil
+}
+
+// Add a static entry to the cache. Static entries never expire and are not
+// replaced by learned addresses.
+func (c *Cache) Add(addr net.IP, hwaddr net.HardwareAddr) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	key := addr_key(addr)
+
+	e := c.entries[key]
+	if e != nil && e.done != nil {
+		c.complete(key, e, hwaddr, nil)
+	}
+
+	c.entries[key] = &entry{ hwaddr: copy_hwaddr(hwaddr), static: true }
+}
+
+// Remove the entry for the given address from the cache, if any.
+func (c *Cache) Remove(addr net.IP) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	key := addr_key(addr)
+
+	if e := c.entries[key]; e != nil && e.done == nil {
+		delete(c.entries, key)
+	}
+}
+
+// Return the cached link-layer address of the given IP address, without
+// sending any request. The second return value is false if the address is not
+// in the cache (or it couldn't be resolved).
+func (c *Cache) Lookup(addr net.IP) (net.HardwareAddr, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	e := c.entries[addr_key(addr)]
+	if !c.is_valid(e) || e.err != nil {
+		return nil, false
+	}
+
+	return e.hwaddr, true
+}
+
+// Return the link-layer address of the given IP address, sending requests for
+// it if it's not in the cache. Concurrent resolutions of the same address are
+// coalesced into a single one.
+func (c *Cache) Resolve(addr net.IP) (net.HardwareAddr, error) {
+	return c.ResolveTimeout(addr, 0)
+}
+
+// Like Resolve(), but with the given timeout (or the cache's timeout if t is
+// zero).
+func (c *Cache) ResolveTimeout(addr net.IP, t time.Duration) (net.HardwareAddr, error) {
+	key := addr_key(addr)
+
+	c.mutex.Lock()
+
+	if t <= 0 {
+		t = c.timeout
+	}
+
+	e := c.entries[key]
+
+	if e != nil && e.done != nil {
+		done := e.done
+		c.mutex.Unlock()
+
+		select {
+		case <-done:
+
+		case <-time.After(t):
+			return nil, fmt.Errorf("Could not resolve %s: timeout", addr)
+		}
+
+		c.mutex.Lock()
+		defer c.mutex.Unlock()
+
+		return e.hwaddr, e.err
+	}
+
+	if c.is_valid(e) {
+		c.mutex.Unlock()
+		return e.hwaddr, e.err
+	}
+
+	e = &entry{ done: make(chan struct{}) }
+	c.entries[key] = e
+
+	retries := c.retries
+	done    := e.done
+
+	c.mutex.Unlock()
+
+	err := c.resolve(addr, done, t, retries)
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	/* the address may have been learned in the meantime */
+	if e.done != nil {
+		if err == nil {
+			err = fmt.Errorf("Could not resolve %s: timeout", addr)
+		}
+
+		c.complete(key, e, nil, err)
+	}
+
+	return e.hwaddr, e.err
+}
+
+// Learn the link-layer address of the sender of the given packet, if it's an
+// ARP request or reply or an NDP solicitation or advertisement. Only packets
+// received on the cache's network interface should be passed.
+func (c *Cache) Learn(pkt packet.Packet) {
+	if arp_pkt, ok := layers.FindLayer(pkt, packet.ARP).(*arp.Packet); ok {
+		/* probes (RFC 5227) don't carry the sender address */
+		if arp_pkt.ProtoSrcAddr == nil ||
+		   arp_pkt.ProtoSrcAddr.IsUnspecified() {
+			return
+		}
+
+		c.update(arp_pkt.ProtoSrcAddr, arp_pkt.HWSrcAddr)
+		return
+	}
+
+	icmp_pkt, ok := layers.FindLayer(pkt, packet.ICMPv6).(*icmpv6.Packet)
+	if !ok {
+		return
+	}
+
+	hwaddr := icmp_pkt.LinkAddr()
+	if hwaddr == nil {
+		return
+	}
+
+	switch icmp_pkt.Type {
+	case icmpv6.NeighborAdvertisement:
+		c.update(icmp_pkt.Target(), hwaddr)
+
+	case icmpv6.NeighborSolicitation:
+		ipv6_pkt, ok := layers.FindLayer(pkt, packet.IPv6).(*ipv6.Packet)
+		if ok && !ipv6_pkt.SrcAddr.IsUnspecified() {
+			c.update(ipv6_pkt.SrcAddr, hwaddr)
+		}
+	}
+}
+
+/*
+ * Send the requests for addr, until done is closed (by Learn()) or the timeout
+ * expires. The packets are captured by the reader, which runs as long as there
+ * are resolutions in progress, so that a blocking Capture() doesn't delay the
+ * retries.
+ */
+func (c *Cache) resolve(addr net.IP, done chan struct{}, t time.Duration, retries uint) error {
+	if c.handle.LinkType() != packet.Eth {
+		return fmt.Errorf("Unsupported link type %s", c.handle.LinkType())
+	}
+
+	req, err := c.request(addr)
+	if err != nil {
+		return err
+	}
+
+	c.mutex.Lock()
+
+	c.resolving++
+
+	if c.reader == nil {
+		c.reader = &reader{ stopped: make(chan struct{}) }
+		go c.read_loop(c.reader)
+	}
+
+	r := c.reader
+
+	c.mutex.Unlock()
+
+	defer func() {
+		c.mutex.Lock()
+		c.resolving--
+		c.mutex.Unlock()
+	}()
+
+	try_t := t / time.Duration(retries + 1)
+
+	for try := uint(0); try <= retries; try++ {
+		err := c.handle.Inject(req)
+		if err != nil {
+			return fmt.Errorf("Could not inject: %s", err)
+		}
+
+		timer := time.NewTimer(try_t)
+
+		select {
+		case <-done:
+			timer.Stop()
+			return nil
+
+		case <-r.stopped:
+			timer.Stop()
+			return fmt.Errorf("Could not capture: %s", r.err)
+
+		case <-timer.C:
+		}
+	}
+
+	return nil
+}
+
+/* Capture packets and learn from them, while there are resolutions in progress. */
+func (c *Cache) read_loop(r *reader) {
+	for {
+		c.mutex.Lock()
+
+		if c.resolving == 0 {
+			c.reader = nil
+			c.mutex.Unlock()
+			return
+		}
+
+		c.mutex.Unlock()
+
+		buf, err := c.handle.Capture()
+		if err != nil {
+			c.mutex.Lock()
+			c.reader = nil
+			r.err    = err
+			c.mutex.Unlock()
+
+			close(r.stopped)
+			return
+		}
+
+		if buf == nil {
+			time.Sleep(idle_wait)
+			continue
+		}
+
+		pkt, err := layers.UnpackAll(buf, packet.Eth)
+		if err != nil {
+			continue
+		}
+
+		c.Learn(pkt)
+	}
+}
+
+/* Build the ARP request or neighbor solicitation for addr. */
+func (c *Cache) request(addr net.IP) ([]byte, error) {
+	if len(c.iface.HardwareAddr) != 6 {
+		return nil, fmt.Errorf("Interface %s has no link-layer address",
+		                       c.iface.Name)
+	}
+
+	src, err := c.src_addr(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	eth_pkt := eth.Make()
+	eth_pkt.SrcAddr = c.iface.HardwareAddr
+
+	if ip4 := addr.To4(); ip4 != nil {
+		eth_pkt.DstAddr = hwaddr_bcast
+
+		arp_pkt := arp.Make()
+		arp_pkt.HWSrcAddr    = c.iface.HardwareAddr
+		arp_pkt.HWDstAddr    = hwaddr_zero
+		arp_pkt.ProtoSrcAddr = src
+		arp_pkt.ProtoDstAddr = ip4
+
+		return layers.Pack(eth_pkt, arp_pkt)
+	}
+
+	addr = addr.To16()
+
+	/* solicitations are sent to the target's solicited-node address */
+	eth_pkt.DstAddr = net.HardwareAddr{
+		0x33, 0x33, 0xff, addr[13], addr[14], addr[15],
+	}
+
+	ipv6_pkt := ipv6.Make()
+	ipv6_pkt.SrcAddr  = src
+	ipv6_pkt.DstAddr  = net.IP{
+		0xff, 0x02, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+		0x00, 0x00, 0x00, 0x01, 0xff, addr[13], addr[14], addr[15],
+	}
+	ipv6_pkt.HopLimit = 255
+
+	icmp_pkt := icmpv6.Make()
+	icmp_pkt.Type = icmpv6.NeighborSolicitation
+
+	/* target address, followed by the source link-layer address option */
+	raw_pkt := raw.Make()
+	raw_pkt.Data = append([]byte(addr), 1, 1)
+	raw_pkt.Data = append(raw_pkt.Data, c.iface.HardwareAddr...)
+
+	return layers.Pack(eth_pkt, ipv6_pkt, icmp_pkt, raw_pkt)
+}
+
+/*
+ * Return the interface address to send the requests for addr from, preferring
+ * the ones on the same subnet as addr (and IPv6 link-local ones otherwise).
+ */
+func (c *Cache) src_addr(addr net.IP) (net.IP, error) {
+	var src net.IP
+
+	addrs, err := c.iface.Addrs()
+	if err != nil {
+		return nil, fmt.Errorf("Could not get interface addresses: %s", err)
+	}
+
+	is_ipv4 := addr.To4() != nil
+
+	for _, a := range addrs {
+		ipnet, ok := a.(*net.IPNet)
+		if !ok || (ipnet.IP.To4() != nil) != is_ipv4 {
+			continue
+		}
+
+		if ipnet.Contains(addr) {
+			return ipnet.IP, nil
+		}
+
+		if src == nil || (!is_ipv4 && ipnet.IP.IsLinkLocalUnicast()) {
+			src = ipnet.IP
+		}
+	}
+
+	if src == nil {
+		return nil, fmt.Errorf("No address found")
+	}
+
+	return src, nil
+}
+
+/* Learn addr. Takes the lock. */
+func (c *Cache) update(addr net.IP, hwaddr net.HardwareAddr) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	key := addr_key(addr)
+
+	e := c.entries[key]
+
+	switch {
+	case e != nil && e.static:
+
+	case e != nil && e.done != nil:
+		c.complete(key, e, hwaddr, nil)
+
+	default:
+		c.entries[key] = &entry{
+			hwaddr:  copy_hwaddr(hwaddr),
+			expires: c.expiry(c.ttl),
+		}
+	}
+}
+
+/*
+ * Store the result of a resolution and wake up the goroutines waiting for it.
+ * Must be called with the lock held.
+ */
+func (c *Cache) complete(key string, e *entry, hwaddr net.HardwareAddr, err error) {
+	e.hwaddr = copy_hwaddr(hwaddr)
+	e.err    = err
+
+	if err != nil {
+		e.expires = c.expiry(c.neg_ttl)
+
+		if c.neg_ttl == 0 && c.entries[key] == e {
+			delete(c.entries, key)
+		}
+	} else {
+		e.expires = c.expiry(c.ttl)
+	}
+
+	close(e.done)
+	e.done = nil
+}
+
+func (c *Cache) expiry(ttl time.Duration) time.Time {
+	if ttl == 0 {
+		return time.Time{}
+	}
+
+	return time.Now().Add(ttl)
+}
+
+/* Must be called with the lock held. */
+func (c *Cache) is_valid(e *entry) bool {
+	if e == nil || e.done != nil {
+		return false
+	}
+
+	if e.static || e.expires.IsZero() {
+		return true
+	}
+
+	return time.Now().Before(e.expires)
+}
+
+func addr_key(addr net.IP) string {
+	return string(addr.To16())
+}
+
+func copy_hwaddr(hwaddr net.HardwareAddr) net.HardwareAddr {
+	if hwaddr == nil {
+		return nil
+	}
+
+	return append(net.HardwareAddr(nil), hwaddr...)
+}
@@ -0,0 +1,132 @@
+/*
+ * Network packet analysis framework.
+ *
+ * Copyright (c) 2014, Alessandro Ghedini
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are
+ * met:
+ *
+ *     * Redistributions of source code must retain the above copyright
+ *       notice, this list of conditions and the following disclaimer.
+ *
+ *     * Redistributions in binary form must reproduce the above copyright
+ *       notice, this list of conditions and the following disclaimer in the
+ *       documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS
+ * IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO,
+ * THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR
+ * PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR
+ * CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+ * EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+ * PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+ * PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF
+ * LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+ * NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+ * SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package neighbor
+
+import "fmt"
+import "net"
+import "syscall"
+import "unsafe"
+
+type ndmsg struct {
+	family  uint8
+	pad1    uint8
+	pad2    uint16
+	ifindex int32
+	state   uint16
+	flags   uint8
+	typ     uint8
+}
+
+type kernel_neigh struct {
+	addr   net.IP
+	hwaddr net.HardwareAddr
+	static bool
+}
+
+/* not defined by the syscall package */
+const (
+	nda_dst    = 1
+	nda_lladdr = 2
+
+	nud_reachable = 0x02
+	nud_stale     = 0x04
+	nud_delay     = 0x08
+	nud_probe     = 0x10
+	nud_permanent = 0x80
+)
+
+/* Return the usable entries of the kernel's neighbor table for ifindex. */
+func kernel_neighbors(ifindex int) ([]kernel_neigh, error) {
+	var neighs []kernel_neigh
+
+	rib, err := syscall.NetlinkRIB(syscall.RTM_GETNEIGH, syscall.AF_UNSPEC)
+	if err != nil {
+		return nil, fmt.Errorf("Could not retrieve RIB: %s", err)
+	}
+
+	msgs, err := syscall.ParseNetlinkMessage(rib)
+	if err != nil {
+		return nil, fmt.Errorf("Could not parse messages: %s", err)
+	}
+
+	hdr_len := int(unsafe.Sizeof(ndmsg{}))
+
+	for _, m := range msgs {
+		if m.Header.Type != syscall.RTM_NEWNEIGH || len(m.Data) < hdr_len {
+			continue
+		}
+
+		nd := (*ndmsg)(unsafe.Pointer(&m.Data[0]))
+
+		if int(nd.ifindex) != ifindex ||
+		   nd.state & (nud_reachable | nud_stale | nud_delay |
+		               nud_probe | nud_permanent) == 0 {
+			continue
+		}
+
+		n := kernel_neigh{ static: nd.state & nud_permanent != 0 }
+
+		for attrs := m.Data[hdr_len:]; len(attrs) >= 4; {
+			attr_len := int(*(*uint16)(unsafe.Pointer(&attrs[0])))
+			attr_typ := *(*uint16)(unsafe.Pointer(&attrs[2]))
+
+			if attr_len < 4 || attr_len > len(attrs) {
+				break
+			}
+
+			value := attrs[4:attr_len]
+
+			switch attr_typ {
+			case nda_dst:
+				n.addr = net.IP(append([]byte(nil), value...))
+
+			case nda_lladdr:
+				n.hwaddr = net.HardwareAddr(append([]byte(nil), value...))
+			}
+
+			/* attributes are aligned to 4 bytes */
+			attr_len = (attr_len + 3) &^ 3
+			if attr_len > len(attrs) {
+				break
+			}
+
+			attrs = attrs[attr_len:]
+		}
+
+		if n.addr == nil || len(n.hwaddr) != 6 {
+			continue
+		}
+
+		neighs = append(neighs, n)
+	}
+
+	return neighs, nil
+}
@@ -0,0 +1,267 @@
+/*
+ * Network packet analysis framework.
+ *
+ * Copyright (c) 2014, Alessandro Ghedini
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are
+ * met:
+ *
+ *     * Redistributions of source code must retain the above copyright
+ *       notice, this list of conditions and the following disclaimer.
+ *
+ *     * Redistributions in binary form must reproduce the above copyright
+ *       notice, this list of conditions and the following disclaimer in the
+ *       documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS
+ * IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO,
+ * THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR
+ * PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR
+ * CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+ * EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+ * PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+ * PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF
+ * LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+ * NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+ * SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package neighbor_test
+
+import "bytes"
+import "net"
+import "sync"
+import "testing"
+import "time"
+
+import "github.com/ghedo/go.pkt/network/internal/testhandle"
+import "github.com/ghedo/go.pkt/network/neighbor"
+import "github.com/ghedo/go.pkt/packet"
+import "github.com/ghedo/go.pkt/packet/arp"
+
+var host_hwaddr = net.HardwareAddr{ 2, 0, 0, 0, 0, 1 }
+var self_hwaddr = net.HardwareAddr{ 2, 0, 0, 0, 0, 0xff }
+
+/* answers the ARP requests and neighbor solicitations for the addresses in
+ * hosts with host_hwaddr, after the given delay */
+func new_test_handle(delay time.Duration, hosts ...string) *testhandle.Handle {
+	known := make(map[string]bool)
+
+	for _, addr := range hosts {
+		known[net.ParseIP(addr).String()] = true
+	}
+
+	h := testhandle.New()
+	h.Delay  = delay
+	h.Answer = func(pkt packet.Packet) error {
+		target := testhandle.NeighborTarget(pkt)
+		if target == nil || !known[target.String()] {
+			return nil
+		}
+
+		return h.Queue(testhandle.NeighborReply(pkt, host_hwaddr)...)
+	}
+
+	return h
+}
+
+func count(h *testhandle.Handle) int {
+	return len(h.Sent())
+}
+
+/* the loopback interface, with a fake link-layer address */
+func test_iface(t *testing.T) *net.Interface {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		t.Fatalf("Error listing interfaces: %s", err)
+	}
+
+	for _, iface := range ifaces {
+		if iface.Flags & net.FlagLoopback != 0 {
+			iface.HardwareAddr = self_hwaddr
+			return &iface
+		}
+	}
+
+	t.Skip("No loopback interface")
+	return nil
+}
+
+func resolve(t *testing.T, cache *neighbor.Cache, addr string) {
+	hwaddr, err := cache.Resolve(net.ParseIP(addr))
+	if err != nil {
+		t.Fatalf("Error resolving: %s", err)
+	}
+
+	if !bytes.Equal(hwaddr, host_hwaddr) {
+		t.Fatalf("Address mismatch: %s", hwaddr)
+	}
+}
+
+func TestResolve(t *testing.T) {
+	h := new_test_handle(0, "127.0.0.2", "::2")
+
+	cache := neighbor.NewCache(h, test_iface(t))
+
+	for i := 0; i < 3; i++ {
+		resolve(t, cache, "127.0.0.2")
+		resolve(t, cache, "::2")
+	}
+
+	if count(h) != 2 {
+		t.Fatalf("Requests mismatch: %d", count(h))
+	}
+
+	_, ok := cache.Lookup(net.ParseIP("::2"))
+	if !ok {
+		t.Fatalf("Lookup failed")
+	}
+}
+
+func TestResolveNegative(t *testing.T) {
+	h := new_test_handle(0)
+
+	cache := neighbor.NewCache(h, test_iface(t))
+	cache.SetTimeout(30 * time.Millisecond)
+	cache.SetRetries(1)
+
+	for i := 0; i < 3; i++ {
+		_, err := cache.Resolve(net.ParseIP("127.0.0.2"))
+		if err == nil {
+			t.Fatalf("Expected error")
+		}
+	}
+
+	if count(h) != 2 {
+		t.Fatalf("Requests mismatch: %d", count(h))
+	}
+
+	cache.SetTTL(time.Minute, 0)
+
+	for i := 0; i < 2; i++ {
+		_, err := cache.Resolve(net.ParseIP("127.0.0.3"))
+		if err == nil {
+			t.Fatalf("Expected error")
+		}
+	}
+
+	if count(h) != 6 {
+		t.Fatalf("Requests mismatch: %d", count(h))
+	}
+}
+
+func TestResolveCoalesce(t *testing.T) {
+	var wg sync.WaitGroup
+
+	h := new_test_handle(20 * time.Millisecond, "127.0.0.2")
+
+	cache := neighbor.NewCache(h, test_iface(t))
+
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+			resolve(t, cache, "127.0.0.2")
+		}()
+	}
+
+	wg.Wait()
+
+	if count(h) != 1 {
+		t.Fatalf("Requests mismatch: %d", count(h))
+	}
+}
+
+func TestResolveBlocking(t *testing.T) {
+	h := new_test_handle(0, "127.0.0.2")
+	h.Block = true
+	defer h.Close()
+
+	cache := neighbor.NewCache(h, test_iface(t))
+	cache.SetTimeout(50 * time.Millisecond)
+	cache.SetRetries(1)
+
+	resolve(t, cache, "127.0.0.2")
+
+	start := time.Now()
+
+	_, err := cache.Resolve(net.ParseIP("127.0.0.3"))
+	if err == nil {
+		t.Fatalf("Expected error")
+	}
+
+	if time.Since(start) > time.Second {
+		t.Fatalf("Timeout not honoured: %s", time.Since(start))
+	}
+
+	if count(h) != 3 {
+		t.Fatalf("Requests mismatch: %d", count(h))
+	}
+}
+
+func TestExpire(t *testing.T) {
+	h := new_test_handle(0, "127.0.0.2")
+
+	cache := neighbor.NewCache(h, test_iface(t))
+	cache.SetTTL(10 * time.Millisecond, 0)
+
+	resolve(t, cache, "127.0.0.2")
+
+	time.Sleep(20 * time.Millisecond)
+
+	_, ok := cache.Lookup(net.ParseIP("127.0.0.2"))
+	if ok {
+		t.Fatalf("Entry not expired")
+	}
+
+	resolve(t, cache, "127.0.0.2")
+
+	if count(h) != 2 {
+		t.Fatalf("Requests mismatch: %d", count(h))
+	}
+}
+
+func TestLearn(t *testing.T) {
+	h := new_test_handle(0)
+
+	cache := neighbor.NewCache(h, test_iface(t))
+	cache.Add(net.ParseIP("127.0.0.3"), self_hwaddr)
+
+	for _, addr := range []string{ "127.0.0.2", "127.0.0.3" } {
+		arp_pkt := arp.Make()
+		arp_pkt.HWSrcAddr    = host_hwaddr
+		arp_pkt.ProtoSrcAddr = net.ParseIP(addr)
+		arp_pkt.ProtoDstAddr = net.ParseIP("127.0.0.1")
+
+		cache.Learn(arp_pkt)
+	}
+
+	hwaddr, ok := cache.Lookup(net.ParseIP("127.0.0.2"))
+	if !ok || !bytes.Equal(hwaddr, host_hwaddr) {
+		t.Fatalf("Learned address mismatch: %s", hwaddr)
+	}
+
+	/* static entries are not replaced */
+	hwaddr, ok = cache.Lookup(net.ParseIP("127.0.0.3"))
+	if !ok || !bytes.Equal(hwaddr, self_hwaddr) {
+		t.Fatalf("Static address mismatch: %s", hwaddr)
+	}
+
+	resolve(t, cache, "127.0.0.2")
+
+	if count(h) != 0 {
+		t.Fatalf("Requests mismatch: %d", count(h))
+	}
+}
+
+func TestSeed(t *testing.T) {
+	cache := neighbor.NewCache(new_test_handle(0), test_iface(t))
+
+	err := cache.Seed()
+	if err != nil {
+		t.Skipf("Error seeding: %s", err)
+	}
+}
@@ -43,15 +43,10 @@ import "github.com/ghedo/go.pkt/layers"
 // Pack packets into their binary form and inject them in the given capture
 // handle.. This will stack the packets before encoding them and also calculate
 // the checksums.
-func Send(c capture.Handle, pkts ...packet.Packet) error {
-	if pkts[0].GetType() != c.LinkType() {
-		return fmt.Errorf("Expected packet type %s, got %s",
-		                  pkts[0].GetType(), c.LinkType())
-	}
-
-	buf, err := layers.Pack(pkts...)
+func Send(c capture.Injector, pkts ...packet.Packet) error {
+	buf, err := pack(c, pkts...)
 	if err != nil {
-		return fmt.Errorf("Could not pack: %s", err)
+		return err
 	}
 
 	err = c.Inject(buf)
@@ -63,8 +58,9 @@ func Send(c capture.Handle, pkts ...packet.Packet) error {
 }
 
 // Capture a single packet from the given capture handle, unpack it and return
-// it. This will block until a packet is received.
-func Recv(c capture.Handle) (packet.Packet, error) {
+// it. This will block until a packet is received. If the handle returns no
+// packet (e.g. because its read timeout expired), nil is returned.
+func Recv(c capture.Reader) (packet.Packet, error) {
 	buf, err := c.Capture()
 	if err != nil {
 		return nil, fmt.Errorf("Could not capture: %s", err)
@@ -80,8 +76,9 @@ func Recv(c capture.Handle) (packet.Packet, error) {
 
 // Like Send() and Recv() combined. This only returns a suitable answer for the
 // sent packets. If t is not zero, this will return if not answer is received
-// before t expires.
-func SendRecv(c capture.Handle, t time.Duration, pkts ...packet.Packet) (packet.Packet, error) {
+// before t expires, otherwise it keeps waiting (even on handles with a read
+// timeout).
+func SendRecv(c capture.ReadInjector, t time.Duration, pkts ...packet.Packet) (packet.Packet, error) {
 	err := Send(c, pkts...)
 	if err != nil {
 		return nil, err
@@ -95,12 +92,13 @@ func SendRecv(c capture.Handle, t time.Duration, pkts ...packet.Packet) (packet.
 			return nil, err
 		}
 
-		if pkt == nil {
-			return nil, nil
+		if pkt != nil && pkt.Answers(pkts[0]) {
+			return pkt, nil
 		}
 
-		if pkt.Answers(pkts[0]) {
-			return pkt, nil
+		/* handles with a read timeout return no packet when idle */
+		if pkt == nil {
+			time.Sleep(idle_wait)
 		}
 
 		if int64(t) > 0 &&
@@ -111,3 +109,17 @@ func SendRecv(c capture.Handle, t time.Duration, pkts ...packet.Packet) (packet.
 
 	return nil, fmt.Errorf("WTF")
 }
+
+func pack(c capture.Base, pkts ...packet.Packet) ([]byte, error) {
+	if pkts[0].GetType() != c.LinkType() {
+		return nil, fmt.Errorf("Expected packet type %s, got %s",
+		                       c.LinkType(), pkts[0].GetType())
+	}
+
+	buf, err := layers.Pack(pkts...)
+	if err != nil {
+		return nil, fmt.Errorf("Could not pack: %s", err)
+	}
+
+	return buf, nil
+}
@@ -0,0 +1,284 @@
+/*
+ * Network packet analysis framework.
+ *
+ * Copyright (c) 2014, Alessandro Ghedini
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are
+ * met:
+ *
+ *     * Redistributions of source code must retain the above copyright
+ *       notice, this list of conditions and the following disclaimer.
+ *
+ *     * Redistributions in binary form must reproduce the above copyright
+ *       notice, this list of conditions and the following disclaimer in the
+ *       documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS
+ * IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO,
+ * THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR
+ * PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR
+ * CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+ * EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+ * PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+ * PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF
+ * LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+ * NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+ * SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+// Provides rate-limited injection of packets into capture handles. A Pacer
+// wraps a handle and delays its Inject() calls to keep the injected traffic
+// within the configured packet and/or bit rate, backing off when the packet
+// source runs out of buffer space.
+package pacer
+
+import "errors"
+import "fmt"
+import "math/rand"
+import "sync"
+import "syscall"
+import "time"
+
+import "github.com/ghedo/go.pkt/capture"
+
+// A Pacer is a Handle that forwards all the calls to the wrapped handle, but
+// limits the rate of the injected packets. It can be used in place of the
+// wrapped handle with network.Send(), network.SendRecv(), etc...
+type Pacer struct {
+	capture.Handle
+
+	mutex       sync.Mutex
+	pps         float64
+	bps         float64
+	burst       uint
+	jitter      float64
+	retries     uint
+	min_backoff time.Duration
+	max_backoff time.Duration
+	backoff     time.Duration
+	tat         time.Time
+	counters    Counters
+}
+
+// Counters contains the statistics of the packets injected through a Pacer.
+type Counters struct {
+	Sent     uint64
+	Failed   uint64
+	Bytes    uint64
+	Backoffs uint64
+}
+
+// Create a new Pacer wrapping the given handle. By default the injected
+// packets are not rate-limited, but failed injections due to ENOBUFS are still
+// retried with an exponential back-off.
+func New(h capture.Handle) *Pacer {
+	return &Pacer{
+		Handle:      h,
+		burst:       1,
+		retries:     5,
+		min_backoff: time.Millisecond,
+		max_backoff: 100 * time.Millisecond,
+	}
+}
+
+// Limit the injected packets to the given number of packets per second. If pps
+// is zero the packet rate is not limited.
+func (p *Pacer) SetPPS(pps float64) error {
+	if pps < 0 {
+		return fmt.Errorf("Invalid packet rate")
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.pps = pps
+	return nil
+}
+
+// Limit the injected packets to the given number of bits per second. If bps is
+// zero the bit rate is not limited. When both the packet and bit rates are set
+// the most restrictive one applies to each packet.
+func (p *Pacer) SetBPS(bps float64) error {
+	if bps < 0 {
+		return fmt.Errorf("Invalid bit rate")
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.bps = bps
+	return nil
+}
+
+// Allow up to the given number of packets to be injected back-to-back after the
+// Pacer has been idle, as long as the average rate stays within the limits.
+func (p *Pacer) SetBurst(burst uint) error {
+	if burst < 1 {
+		return fmt.Errorf("Invalid burst size")
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.burst = burst
+	return nil
+}
+
+// Randomize the interval between packets by up to the given fraction of it
+// (e.g. 0.1 varies each interval by ±10%). The average rate is not affected.
+func (p *Pacer) SetJitter(jitter float64) error {
+	if jitter < 0 || jitter > 1 {
+		return fmt.Errorf("Invalid jitter")
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.jitter = jitter
+	return nil
+}
+
+// Retry an injection failed with ENOBUFS up to the given number of times,
+// waiting between min and max (doubling the delay at every consecutive
+// failure). The delay is also applied to the following packets, and is reduced
+// again as injections succeed.
+func (p *Pacer) SetBackoff(retries uint, min, max time.Duration) error {
+	if min <= 0 || max < min {
+		return fmt.Errorf("Invalid back-off delay")
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.retries     = retries
+	p.min_backoff = min
+	p.max_backoff = max
+	return nil
+}
+
+// Inject a packet in the wrapped handle, waiting as needed to respect the
+// configured rate.
+func (p *Pacer) Inject(buf []byte) error {
+	p.wait(len(buf))
+
+	for try := uint(0); ; try++ {
+		err := p.Handle.Inject(buf)
+		if err == nil {
+			p.succeeded(len(buf))
+			return nil
+		}
+
+		if !is_nobufs(err) || try >= p.get_retries() {
+			p.failed()
+			return err
+		}
+
+		time.Sleep(p.back_off())
+	}
+}
+
+// Return the counters of the injected packets.
+func (p *Pacer) Counters() Counters {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	return p.counters
+}
+
+/* reserve the next slot for a packet of n bytes and sleep until then, using the
+ * "theoretical arrival time" (GCRA) formulation of the token bucket */
+func (p *Pacer) wait(n int) {
+	p.mutex.Lock()
+
+	interval := p.interval(n)
+	if interval <= 0 {
+		p.mutex.Unlock()
+		return
+	}
+
+	tolerance := time.Duration(p.burst - 1) * interval
+
+	if p.jitter > 0 {
+		interval = time.Duration(
+			float64(interval) * (1 + p.jitter * (2 * rand.Float64() - 1)),
+		)
+	}
+
+	now := time.Now()
+	if p.tat.Before(now) {
+		p.tat = now
+	}
+
+	when := p.tat.Add(-tolerance)
+	p.tat = p.tat.Add(interval)
+
+	p.mutex.Unlock()
+
+	if delay := when.Sub(now); delay > 0 {
+		time.Sleep(delay)
+	}
+}
+
+/* the minimum interval between packets of n bytes, plus the current back-off */
+func (p *Pacer) interval(n int) time.Duration {
+	var secs float64
+
+	if p.pps > 0 {
+		secs = 1 / p.pps
+	}
+
+	if p.bps > 0 {
+		if bits := float64(n * 8) / p.bps; bits > secs {
+			secs = bits
+		}
+	}
+
+	return time.Duration(secs * float64(time.Second)) + p.backoff
+}
+
+func (p *Pacer) back_off() time.Duration {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.counters.Backoffs++
+
+	if p.backoff < p.min_backoff {
+		p.backoff = p.min_backoff
+	} else if p.backoff *= 2; p.backoff > p.max_backoff {
+		p.backoff = p.max_backoff
+	}
+
+	return p.backoff
+}
+
+func (p *Pacer) succeeded(n int) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.counters.Sent++
+	p.counters.Bytes += uint64(n)
+
+	if p.backoff /= 2; p.backoff < p.min_backoff {
+		p.backoff = 0
+	}
+}
+
+func (p *Pacer) failed() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.counters.Failed++
+}
+
+func (p *Pacer) get_retries() uint {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	return p.retries
+}
+
+func is_nobufs(err error) bool {
+	return errors.Is(err, syscall.ENOBUFS)
+}
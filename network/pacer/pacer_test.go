@@ -0,0 +1,258 @@
+/*
+ * Network packet analysis framework.
+ *
+ * Copyright (c) 2014, Alessandro Ghedini
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are
+ * met:
+ *
+ *     * Redistributions of source code must retain the above copyright
+ *       notice, this list of conditions and the following disclaimer.
+ *
+ *     * Redistributions in binary form must reproduce the above copyright
+ *       notice, this list of conditions and the following disclaimer in the
+ *       documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS
+ * IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO,
+ * THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR
+ * PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR
+ * CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+ * EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+ * PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+ * PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF
+ * LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+ * NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+ * SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package pacer_test
+
+import "fmt"
+import "syscall"
+import "testing"
+import "time"
+
+import "github.com/ghedo/go.pkt/capture"
+import "github.com/ghedo/go.pkt/network/pacer"
+import "github.com/ghedo/go.pkt/packet"
+
+type test_handle struct {
+	sent    []time.Time
+	nobufs  int
+	fail    bool
+}
+
+func (h *test_handle) LinkType() packet.Type { return packet.Eth }
+func (h *test_handle) Activate() error       { return nil }
+func (h *test_handle) Close()                { }
+
+func (h *test_handle) Inject(buf []byte) error {
+	if h.nobufs > 0 {
+		h.nobufs--
+		return fmt.Errorf("Could not inject packet: %w", syscall.ENOBUFS)
+	}
+
+	if h.fail {
+		return fmt.Errorf("Injection failed")
+	}
+
+	h.sent = append(h.sent, time.Now())
+	return nil
+}
+
+func inject(t *testing.T, p *pacer.Pacer, count, size int) time.Duration {
+	buf := make([]byte, size)
+
+	start := time.Now()
+
+	for i := 0; i < count; i++ {
+		err := p.Inject(buf)
+		if err != nil {
+			t.Fatalf("Error injecting: %s", err)
+		}
+	}
+
+	return time.Since(start)
+}
+
+func TestUnlimited(t *testing.T) {
+	h := &test_handle{}
+	p := pacer.New(capture.Adapt(h))
+
+	elapsed := inject(t, p, 100, 100)
+	if elapsed > 50 * time.Millisecond {
+		t.Fatalf("Too slow: %s", elapsed)
+	}
+
+	c := p.Counters()
+	if c.Sent != 100 || c.Failed != 0 || c.Bytes != 10000 {
+		t.Fatalf("Counters mismatch: %+v", c)
+	}
+}
+
+func TestPPS(t *testing.T) {
+	h := &test_handle{}
+	p := pacer.New(capture.Adapt(h))
+
+	err := p.SetPPS(500)
+	if err != nil {
+		t.Fatalf("Error setting rate: %s", err)
+	}
+
+	/* 20 packets at 500pps, 2ms apart */
+	elapsed := inject(t, p, 20, 100)
+	if elapsed < 36 * time.Millisecond || elapsed > 200 * time.Millisecond {
+		t.Fatalf("Rate mismatch: %s", elapsed)
+	}
+}
+
+func TestBPS(t *testing.T) {
+	h := &test_handle{}
+	p := pacer.New(capture.Adapt(h))
+
+	p.SetPPS(100000)
+
+	err := p.SetBPS(800000)
+	if err != nil {
+		t.Fatalf("Error setting rate: %s", err)
+	}
+
+	/* 1000 bytes packets at 800kbps, 10ms apart */
+	elapsed := inject(t, p, 5, 1000)
+	if elapsed < 38 * time.Millisecond || elapsed > 200 * time.Millisecond {
+		t.Fatalf("Rate mismatch: %s", elapsed)
+	}
+}
+
+func TestBurst(t *testing.T) {
+	h := &test_handle{}
+	p := pacer.New(capture.Adapt(h))
+
+	p.SetPPS(20)
+
+	err := p.SetBurst(5)
+	if err != nil {
+		t.Fatalf("Error setting burst: %s", err)
+	}
+
+	/* the first 5 packets pass immediately, the 6th waits 50ms */
+	elapsed := inject(t, p, 5, 100)
+	if elapsed > 20 * time.Millisecond {
+		t.Fatalf("Burst not allowed: %s", elapsed)
+	}
+
+	elapsed = inject(t, p, 1, 100)
+	if elapsed < 35 * time.Millisecond {
+		t.Fatalf("Burst exceeded: %s", elapsed)
+	}
+}
+
+func TestJitter(t *testing.T) {
+	h := &test_handle{}
+	p := pacer.New(capture.Adapt(h))
+
+	p.SetPPS(500)
+
+	err := p.SetJitter(0.5)
+	if err != nil {
+		t.Fatalf("Error setting jitter: %s", err)
+	}
+
+	elapsed := inject(t, p, 50, 100)
+	if elapsed < 70 * time.Millisecond || elapsed > 300 * time.Millisecond {
+		t.Fatalf("Rate mismatch: %s", elapsed)
+	}
+
+	var min, max time.Duration
+
+	for i := 1; i < len(h.sent); i++ {
+		gap := h.sent[i].Sub(h.sent[i - 1])
+
+		if min == 0 || gap < min {
+			min = gap
+		}
+
+		if gap > max {
+			max = gap
+		}
+	}
+
+	if max - min < 500 * time.Microsecond {
+		t.Fatalf("Intervals not jittered: min %s max %s", min, max)
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	h := &test_handle{ nobufs: 3 }
+	p := pacer.New(capture.Adapt(h))
+
+	err := p.SetBackoff(5, time.Millisecond, 4 * time.Millisecond)
+	if err != nil {
+		t.Fatalf("Error setting back-off: %s", err)
+	}
+
+	/* 1ms + 2ms + 4ms of back-off */
+	elapsed := inject(t, p, 1, 100)
+	if elapsed < 7 * time.Millisecond {
+		t.Fatalf("Back-off too short: %s", elapsed)
+	}
+
+	c := p.Counters()
+	if c.Sent != 1 || c.Failed != 0 || c.Backoffs != 3 {
+		t.Fatalf("Counters mismatch: %+v", c)
+	}
+
+	h.nobufs = 10
+
+	err = p.Inject(make([]byte, 100))
+	if err == nil {
+		t.Fatalf("Injection not failed")
+	}
+
+	c = p.Counters()
+	if c.Sent != 1 || c.Failed != 1 || c.Backoffs != 8 {
+		t.Fatalf("Counters mismatch: %+v", c)
+	}
+}
+
+func TestFailed(t *testing.T) {
+	h := &test_handle{ fail: true }
+	p := pacer.New(capture.Adapt(h))
+
+	err := p.Inject(make([]byte, 100))
+	if err == nil {
+		t.Fatalf("Injection not failed")
+	}
+
+	c := p.Counters()
+	if c.Sent != 0 || c.Failed != 1 || c.Backoffs != 0 {
+		t.Fatalf("Counters mismatch: %+v", c)
+	}
+}
+
+func TestInvalid(t *testing.T) {
+	p := pacer.New(capture.Adapt(&test_handle{}))
+
+	if p.SetPPS(-1) == nil {
+		t.Fatalf("Invalid packet rate accepted")
+	}
+
+	if p.SetBPS(-1) == nil {
+		t.Fatalf("Invalid bit rate accepted")
+	}
+
+	if p.SetBurst(0) == nil {
+		t.Fatalf("Invalid burst accepted")
+	}
+
+	if p.SetJitter(2) == nil {
+		t.Fatalf("Invalid jitter accepted")
+	}
+
+	if p.SetBackoff(1, 0, 0) == nil {
+		t.Fatalf("Invalid back-off accepted")
+	}
+}
@@ -0,0 +1,262 @@
+/*
+ * Network packet analysis framework.
+ *
+ * Copyright (c) 2014, Alessandro Ghedini
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are
+ * met:
+ *
+ *     * Redistributions of source code must retain the above copyright
+ *       notice, this list of conditions and the following disclaimer.
+ *
+ *     * Redistributions in binary form must reproduce the above copyright
+ *       notice, this list of conditions and the following disclaimer in the
+ *       documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS
+ * IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO,
+ * THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR
+ * PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR
+ * CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+ * EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+ * PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+ * PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF
+ * LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+ * NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+ * SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+// Provides timed replay of pcap dump files into capture handles. Packets can be
+// injected following the original inter-packet timing (optionally scaled by a
+// speed multiplier), at a fixed packet or bit rate, or as fast as possible.
+package replay
+
+import "fmt"
+import "sync"
+import "time"
+
+import "github.com/ghedo/go.pkt/capture"
+import "github.com/ghedo/go.pkt/capture/file"
+
+// A Replay injects the packets read from a dump file into a capture handle.
+type Replay struct {
+	src   *file.Handle
+	dst   capture.Injector
+	mode  mode
+	speed float64
+	pps   float64
+	mbps  float64
+	loop  uint
+	stop  chan struct{}
+	once  sync.Once
+}
+
+// Stats contains the statistics of a replay run.
+type Stats struct {
+	Sent    uint64
+	Failed  uint64
+	Late    uint64
+	Bytes   uint64
+	Elapsed time.Duration
+}
+
+type mode int
+
+const (
+	original mode = iota
+	fixed_pps
+	fixed_mbps
+)
+
+/* how much a packet can be injected after its scheduled time before being
+ * considered late */
+const late_tolerance = time.Millisecond
+
+// Create a new Replay that reads packets from src and injects them in dst. By
+// default the packets are injected once, following their original timing.
+func New(src *file.Handle, dst capture.Injector) *Replay {
+	return &Replay{
+		src:   src,
+		dst:   dst,
+		mode:  original,
+		speed: 1.0,
+		loop:  1,
+		stop:  make(chan struct{}),
+	}
+}
+
+// Follow the original inter-packet timing, with the delays divided by the given
+// multiplier (e.g. 2.0 replays twice as fast). If mult is zero packets are
+// injected as fast as possible.
+func (r *Replay) SetSpeed(mult float64) error {
+	if mult < 0 {
+		return fmt.Errorf("Invalid speed multiplier")
+	}
+
+	r.mode  = original
+	r.speed = mult
+	return nil
+}
+
+// Inject packets at the given fixed rate of packets per second.
+func (r *Replay) SetPPS(pps float64) error {
+	if pps <= 0 {
+		return fmt.Errorf("Invalid packet rate")
+	}
+
+	r.mode = fixed_pps
+	r.pps  = pps
+	return nil
+}
+
+// Inject packets at the given fixed rate of megabits per second.
+func (r *Replay) SetMbps(mbps float64) error {
+	if mbps <= 0 {
+		return fmt.Errorf("Invalid bit rate")
+	}
+
+	r.mode = fixed_mbps
+	r.mbps = mbps
+	return nil
+}
+
+// Replay the dump file the given number of times. If count is zero the file is
+// replayed until Stop() is called.
+func (r *Replay) SetLoop(count uint) {
+	r.loop = count
+}
+
+// Interrupt a running replay. This can be called from a different goroutine
+// than the one executing Run().
+func (r *Replay) Stop() {
+	r.once.Do(func() { close(r.stop) })
+}
+
+// Run the replay, blocking until all the packets have been injected (or until
+// Stop() is called). Packets that could not be injected are counted as failed
+// and don't interrupt the replay, while errors reading the dump file do.
+func (r *Replay) Run() (*Stats, error) {
+	stats := &Stats{}
+
+	start := time.Now()
+	defer func() { stats.Elapsed = time.Since(start) }()
+
+	var sched_bytes uint64
+	var sched_pkts  uint64
+
+	for i := uint(0); r.loop == 0 || i < r.loop; i++ {
+		if i > 0 {
+			err := r.src.Rewind()
+			if err != nil {
+				return stats, err
+			}
+		}
+
+		var first_ts   time.Time
+		var loop_start time.Time
+
+		for n := 0; ; n++ {
+			buf, err := r.src.Capture()
+			if err != nil {
+				return stats, err
+			}
+
+			if buf == nil {
+				if n == 0 {
+					return stats, nil
+				}
+
+				break
+			}
+
+			now := time.Now()
+
+			if n == 0 {
+				first_ts   = r.src.Timestamp()
+				loop_start = now
+			}
+
+			var when time.Time
+
+			switch r.mode {
+			case original:
+				if r.speed > 0 {
+					delay := r.src.Timestamp().Sub(first_ts)
+					delay  = time.Duration(float64(delay) / r.speed)
+					when   = loop_start.Add(delay)
+				}
+
+			case fixed_pps:
+				secs := float64(sched_pkts) / r.pps
+				when  = start.Add(time.Duration(secs * float64(time.Second)))
+
+			case fixed_mbps:
+				secs := float64(sched_bytes * 8) / (r.mbps * 1000000)
+				when  = start.Add(time.Duration(secs * float64(time.Second)))
+			}
+
+			sched_pkts  += 1
+			sched_bytes += uint64(len(buf))
+
+			if !when.IsZero() {
+				if !r.wait(when) {
+					return stats, nil
+				}
+
+				if time.Since(when) > late_tolerance {
+					stats.Late++
+				}
+			} else if r.stopped() {
+				return stats, nil
+			}
+
+			err = r.dst.Inject(buf)
+			if err != nil {
+				stats.Failed++
+				continue
+			}
+
+			stats.Sent++
+			stats.Bytes += uint64(len(buf))
+		}
+	}
+
+	return stats, nil
+}
+
+func (r *Replay) wait(when time.Time) bool {
+	delay := when.Sub(time.Now())
+	if delay <= 0 {
+		return !r.stopped()
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return true
+
+	case <-r.stop:
+		return false
+	}
+}
+
+func (r *Replay) stopped() bool {
+	select {
+	case <-r.stop:
+		return true
+
+	default:
+		return false
+	}
+}
+
+func (s *Stats) String() string {
+	return fmt.Sprintf(
+		"sent=%d failed=%d late=%d bytes=%d elapsed=%s",
+		s.Sent, s.Failed, s.Late, s.Bytes, s.Elapsed,
+	)
+}
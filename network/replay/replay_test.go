@@ -0,0 +1,241 @@
+/*
+ * Network packet analysis framework.
+ *
+ * Copyright (c) 2014, Alessandro Ghedini
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are
+ * met:
+ *
+ *     * Redistributions of source code must retain the above copyright
+ *       notice, this list of conditions and the following disclaimer.
+ *
+ *     * Redistributions in binary form must reproduce the above copyright
+ *       notice, this list of conditions and the following disclaimer in the
+ *       documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS
+ * IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO,
+ * THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR
+ * PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR
+ * CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+ * EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+ * PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+ * PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF
+ * LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+ * NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+ * SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package replay_test
+
+import "encoding/binary"
+import "fmt"
+import "io/ioutil"
+import "os"
+import "path/filepath"
+import "testing"
+import "time"
+
+import "github.com/ghedo/go.pkt/capture/file"
+import "github.com/ghedo/go.pkt/network/replay"
+import "github.com/ghedo/go.pkt/packet"
+
+type test_handle struct {
+	sent    []time.Time
+	fail_on int
+}
+
+func (h *test_handle) LinkType() packet.Type { return packet.Eth }
+func (h *test_handle) Activate() error       { return nil }
+func (h *test_handle) Close()                { }
+
+func (h *test_handle) Inject(buf []byte) error {
+	h.sent = append(h.sent, time.Now())
+
+	if h.fail_on > 0 && len(h.sent) % h.fail_on == 0 {
+		return fmt.Errorf("Injection failed")
+	}
+
+	return nil
+}
+
+/* write a dump file with count 100 bytes packets, spaced by gap */
+func make_dump(t *testing.T, count int, gap time.Duration) (string, func()) {
+	dir, err := ioutil.TempDir("", "replay_test")
+	if err != nil {
+		t.Fatalf("Error creating dir: %s", err)
+	}
+
+	name := filepath.Join(dir, "dump.pcap")
+
+	out, err := os.Create(name)
+	if err != nil {
+		t.Fatalf("Error creating file: %s", err)
+	}
+	defer out.Close()
+
+	out.Write(file.BigEndian)
+
+	binary.Write(out, binary.BigEndian, uint16(2))
+	binary.Write(out, binary.BigEndian, uint16(4))
+	binary.Write(out, binary.BigEndian, uint32(0))
+	binary.Write(out, binary.BigEndian, uint32(0))
+	binary.Write(out, binary.BigEndian, uint32(0x7fff))
+	binary.Write(out, binary.BigEndian, uint32(1))
+
+	ts := time.Unix(1400000000, 0)
+
+	for i := 0; i < count; i++ {
+		binary.Write(out, binary.BigEndian, uint32(ts.Unix()))
+		binary.Write(out, binary.BigEndian, uint32(ts.Nanosecond() / 1000))
+		binary.Write(out, binary.BigEndian, uint32(100))
+		binary.Write(out, binary.BigEndian, uint32(100))
+		out.Write(make([]byte, 100))
+
+		ts = ts.Add(gap)
+	}
+
+	return name, func() { os.RemoveAll(dir) }
+}
+
+func open_replay(t *testing.T, name string, dst *test_handle) *replay.Replay {
+	src, err := file.Open(name)
+	if err != nil {
+		t.Fatalf("Error opening: %s", err)
+	}
+
+	return replay.New(src, dst)
+}
+
+func TestReplayOriginal(t *testing.T) {
+	name, cleanup := make_dump(t, 5, 20 * time.Millisecond)
+	defer cleanup()
+
+	dst := &test_handle{}
+
+	stats, err := open_replay(t, name, dst).Run()
+	if err != nil {
+		t.Fatalf("Error replaying: %s", err)
+	}
+
+	if stats.Sent != 5 || stats.Bytes != 500 {
+		t.Fatalf("Stats mismatch: %s", stats)
+	}
+
+	elapsed := dst.sent[4].Sub(dst.sent[0])
+	if elapsed < 80 * time.Millisecond {
+		t.Fatalf("Replay too fast: %s", elapsed)
+	}
+}
+
+func TestReplaySpeed(t *testing.T) {
+	name, cleanup := make_dump(t, 5, 100 * time.Millisecond)
+	defer cleanup()
+
+	dst := &test_handle{}
+
+	r := open_replay(t, name, dst)
+	r.SetSpeed(10.0)
+
+	_, err := r.Run()
+	if err != nil {
+		t.Fatalf("Error replaying: %s", err)
+	}
+
+	elapsed := dst.sent[4].Sub(dst.sent[0])
+	if elapsed < 40 * time.Millisecond || elapsed > 300 * time.Millisecond {
+		t.Fatalf("Replay speed mismatch: %s", elapsed)
+	}
+}
+
+func TestReplayPPS(t *testing.T) {
+	name, cleanup := make_dump(t, 10, time.Hour)
+	defer cleanup()
+
+	dst := &test_handle{}
+
+	r := open_replay(t, name, dst)
+	r.SetPPS(200)
+
+	_, err := r.Run()
+	if err != nil {
+		t.Fatalf("Error replaying: %s", err)
+	}
+
+	elapsed := dst.sent[9].Sub(dst.sent[0])
+	if elapsed < 45 * time.Millisecond || elapsed > 1 * time.Second {
+		t.Fatalf("Replay rate mismatch: %s", elapsed)
+	}
+}
+
+func TestReplayMbps(t *testing.T) {
+	name, cleanup := make_dump(t, 5, time.Hour)
+	defer cleanup()
+
+	dst := &test_handle{}
+
+	r := open_replay(t, name, dst)
+
+	/* 100 bytes packets at 0.04 Mbps => one packet every 20ms */
+	r.SetMbps(0.04)
+
+	_, err := r.Run()
+	if err != nil {
+		t.Fatalf("Error replaying: %s", err)
+	}
+
+	elapsed := dst.sent[4].Sub(dst.sent[0])
+	if elapsed < 80 * time.Millisecond || elapsed > 1 * time.Second {
+		t.Fatalf("Replay rate mismatch: %s", elapsed)
+	}
+}
+
+func TestReplayLoopFailed(t *testing.T) {
+	name, cleanup := make_dump(t, 4, time.Hour)
+	defer cleanup()
+
+	dst := &test_handle{ fail_on: 3 }
+
+	r := open_replay(t, name, dst)
+	r.SetSpeed(0)
+	r.SetLoop(3)
+
+	stats, err := r.Run()
+	if err != nil {
+		t.Fatalf("Error replaying: %s", err)
+	}
+
+	if stats.Sent != 8 || stats.Failed != 4 {
+		t.Fatalf("Stats mismatch: %s", stats)
+	}
+}
+
+func TestReplayStop(t *testing.T) {
+	name, cleanup := make_dump(t, 4, time.Hour)
+	defer cleanup()
+
+	dst := &test_handle{}
+
+	r := open_replay(t, name, dst)
+	r.SetPPS(1000)
+	r.SetLoop(0)
+
+	/* concurrent calls to Stop() must not close the channel twice */
+	for i := 0; i < 4; i++ {
+		go func() {
+			time.Sleep(50 * time.Millisecond)
+			r.Stop()
+		}()
+	}
+
+	stats, err := r.Run()
+	if err != nil {
+		t.Fatalf("Error replaying: %s", err)
+	}
+
+	if stats.Sent == 0 || stats.Sent > 200 {
+		t.Fatalf("Stats mismatch: %s", stats)
+	}
+}
@@ -0,0 +1,228 @@
+/*
+ * Network packet analysis framework.
+ *
+ * Copyright (c) 2014, Alessandro Ghedini
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are
+ * met:
+ *
+ *     * Redistributions of source code must retain the above copyright
+ *       notice, this list of conditions and the following disclaimer.
+ *
+ *     * Redistributions in binary form must reproduce the above copyright
+ *       notice, this list of conditions and the following disclaimer in the
+ *       documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS
+ * IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO,
+ * THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR
+ * PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR
+ * CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+ * EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+ * PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+ * PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF
+ * LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+ * NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+ * SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package responder
+
+import "net"
+
+import "github.com/ghedo/go.pkt/layers"
+import "github.com/ghedo/go.pkt/packet"
+import "github.com/ghedo/go.pkt/packet/arp"
+import "github.com/ghedo/go.pkt/packet/eth"
+import "github.com/ghedo/go.pkt/packet/icmpv4"
+import "github.com/ghedo/go.pkt/packet/icmpv6"
+import "github.com/ghedo/go.pkt/packet/ipv4"
+import "github.com/ghedo/go.pkt/packet/ipv6"
+import "github.com/ghedo/go.pkt/packet/raw"
+import "github.com/ghedo/go.pkt/packet/tcp"
+import "github.com/ghedo/go.pkt/packet/vlan"
+
+// Answer the ARP requests for the given IPv4 address with the given hardware
+// address.
+func (r *Responder) ReplyARP(addr net.IP, hwaddr net.HardwareAddr) {
+	addr = addr.To4()
+
+	match := func(pkt packet.Packet) bool {
+		req, ok := layers.FindLayer(pkt, packet.ARP).(*arp.Packet)
+		return ok && req.Operation == arp.Request &&
+		       req.ProtoDstAddr.Equal(addr)
+	}
+
+	r.Handle(match, func(pkt packet.Packet) []packet.Packet {
+		req := layers.FindLayer(pkt, packet.ARP).(*arp.Packet)
+
+		eth_pkt := eth.Make()
+		eth_pkt.SrcAddr = hwaddr
+		eth_pkt.DstAddr = req.HWSrcAddr
+
+		arp_pkt := arp.Make()
+		arp_pkt.Operation    = arp.Reply
+		arp_pkt.HWSrcAddr    = hwaddr
+		arp_pkt.HWDstAddr    = req.HWSrcAddr
+		arp_pkt.ProtoSrcAddr = addr
+		arp_pkt.ProtoDstAddr = req.ProtoSrcAddr
+
+		reply := append([]packet.Packet{ eth_pkt }, vlan_tags(pkt)...)
+
+		return append(reply, arp_pkt)
+	})
+}
+
+// Answer the ICMP (or ICMPv6) echo requests for the given IP address. The echo
+// data of the requests is returned in the replies.
+func (r *Responder) ReplyEcho(addr net.IP) {
+	match := func(pkt packet.Packet) bool {
+		if !dst_is(pkt, addr) {
+			return false
+		}
+
+		if req, ok := layers.FindLayer(pkt, packet.ICMPv4).(*icmpv4.Packet); ok {
+			return req.Type == icmpv4.EchoRequest
+		}
+
+		if req, ok := layers.FindLayer(pkt, packet.ICMPv6).(*icmpv6.Packet); ok {
+			return req.Type == icmpv6.EchoRequest
+		}
+
+		return false
+	}
+
+	r.Handle(match, func(pkt packet.Packet) []packet.Packet {
+		reply := reverse(pkt)
+		if reply == nil {
+			return nil
+		}
+
+		var data packet.Packet
+
+		if req, ok := layers.FindLayer(pkt, packet.ICMPv4).(*icmpv4.Packet); ok {
+			icmp_pkt := icmpv4.Make()
+			icmp_pkt.Type = icmpv4.EchoReply
+			icmp_pkt.Id   = req.Id
+			icmp_pkt.Seq  = req.Seq
+
+			reply = append(reply, icmp_pkt)
+			data  = req.Payload()
+		} else {
+			req := layers.FindLayer(pkt, packet.ICMPv6).(*icmpv6.Packet)
+
+			icmp_pkt := icmpv6.Make()
+			icmp_pkt.Type = icmpv6.EchoReply
+			icmp_pkt.Body = req.Body
+
+			reply = append(reply, icmp_pkt)
+			data  = req.Payload()
+		}
+
+		if req_raw, ok := data.(*raw.Packet); ok {
+			/* the request's data belongs to the captured buffer */
+			raw_pkt := raw.Make()
+			raw_pkt.Data = append([]byte(nil), req_raw.Data...)
+
+			reply = append(reply, raw_pkt)
+		}
+
+		return reply
+	})
+}
+
+// Reset the TCP connections attempted to the given port (on any address), as
+// done by a host with no service listening on it.
+func (r *Responder) ResetPort(port uint16) {
+	match := func(pkt packet.Packet) bool {
+		req, ok := layers.FindLayer(pkt, packet.TCP).(*tcp.Packet)
+		return ok && req.DstPort == port &&
+		       req.Flags & (tcp.Syn | tcp.Ack) == tcp.Syn
+	}
+
+	r.Handle(match, func(pkt packet.Packet) []packet.Packet {
+		reply := reverse(pkt)
+		if reply == nil {
+			return nil
+		}
+
+		req := layers.FindLayer(pkt, packet.TCP).(*tcp.Packet)
+
+		tcp_pkt := tcp.Make()
+		tcp_pkt.SrcPort    = req.DstPort
+		tcp_pkt.DstPort    = req.SrcPort
+		tcp_pkt.Flags      = tcp.Rst | tcp.Ack
+		tcp_pkt.Ack        = req.Seq + 1
+		tcp_pkt.WindowSize = 0
+
+		return append(reply, tcp_pkt)
+	})
+}
+
+/* check if the destination IP address of the packet is addr */
+func dst_is(pkt packet.Packet, addr net.IP) bool {
+	if ip, ok := layers.FindLayer(pkt, packet.IPv4).(*ipv4.Packet); ok {
+		return ip.DstAddr.Equal(addr)
+	}
+
+	if ip, ok := layers.FindLayer(pkt, packet.IPv6).(*ipv6.Packet); ok {
+		return ip.DstAddr.Equal(addr)
+	}
+
+	return false
+}
+
+/* create the link and IP layers of a reply to the given packet, with swapped
+ * addresses and the same VLAN tags; only Ethernet and raw IP packets are
+ * supported */
+func reverse(pkt packet.Packet) []packet.Packet {
+	var reply []packet.Packet
+
+	if req, ok := pkt.(*eth.Packet); ok {
+		eth_pkt := eth.Make()
+		eth_pkt.SrcAddr = req.DstAddr
+		eth_pkt.DstAddr = req.SrcAddr
+
+		reply = append(reply, eth_pkt)
+		reply = append(reply, vlan_tags(pkt)...)
+		pkt   = packet.SkipVLAN(req.Payload())
+	}
+
+	switch req := pkt.(type) {
+	case *ipv4.Packet:
+		ip4_pkt := ipv4.Make()
+		ip4_pkt.SrcAddr = req.DstAddr
+		ip4_pkt.DstAddr = req.SrcAddr
+
+		return append(reply, ip4_pkt)
+
+	case *ipv6.Packet:
+		ip6_pkt := ipv6.Make()
+		ip6_pkt.SrcAddr = req.DstAddr
+		ip6_pkt.DstAddr = req.SrcAddr
+
+		return append(reply, ip6_pkt)
+	}
+
+	return nil
+}
+
+/* copy the VLAN tags following the Ethernet header of the given packet */
+func vlan_tags(pkt packet.Packet) []packet.Packet {
+	var tags []packet.Packet
+
+	for p := pkt.Payload(); p != nil && p.GetType() == packet.VLAN; p = p.Payload() {
+		req := p.(*vlan.Packet)
+
+		vlan_pkt := vlan.Make()
+		vlan_pkt.Priority     = req.Priority
+		vlan_pkt.DropEligible = req.DropEligible
+		vlan_pkt.VLAN         = req.VLAN
+
+		tags = append(tags, vlan_pkt)
+	}
+
+	return tags
+}
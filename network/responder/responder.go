@@ -0,0 +1,220 @@
+/*
+ * Network packet analysis framework.
+ *
+ * Copyright (c) 2014, Alessandro Ghedini
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are
+ * met:
+ *
+ *     * Redistributions of source code must retain the above copyright
+ *       notice, this list of conditions and the following disclaimer.
+ *
+ *     * Redistributions in binary form must reproduce the above copyright
+ *       notice, this list of conditions and the following disclaimer in the
+ *       documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS
+ * IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO,
+ * THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR
+ * PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR
+ * CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+ * EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+ * PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+ * PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF
+ * LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+ * NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+ * SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+// Provides a framework for answering packets in user space, e.g. to simulate
+// hosts and services for honeypots or test fixtures. Handlers are registered on
+// a Responder together with a BPF filter or a predicate, and the replies they
+// return are injected in the capture handle the packets were received from.
+package responder
+
+import "fmt"
+import "sync"
+import "time"
+
+import "github.com/ghedo/go.pkt/capture"
+import "github.com/ghedo/go.pkt/filter"
+import "github.com/ghedo/go.pkt/layers"
+import "github.com/ghedo/go.pkt/packet"
+
+// A Responder receives packets from a capture handle and dispatches them to
+// the registered handlers.
+type Responder struct {
+	handle  capture.ReadInjector
+	mutex   sync.Mutex
+	rules   []*rule
+	stats   Stats
+	stopped bool
+}
+
+// A Handler is called with a decoded packet and returns the layers of the reply
+// to inject (e.g. Ethernet, IPv4 and ICMPv4), or nil if no reply should be sent.
+type Handler func(pkt packet.Packet) []packet.Packet
+
+// A Predicate selects the decoded packets a Handler is called for.
+type Predicate func(pkt packet.Packet) bool
+
+// Stats contains the statistics of the packets handled by a Responder.
+type Stats struct {
+	Received uint64
+	Matched  uint64
+	Replied  uint64
+	Failed   uint64
+}
+
+type rule struct {
+	filter  *filter.Filter
+	match   Predicate
+	handler Handler
+}
+
+/* how long to wait before polling again a handle with no packets available */
+const idle_wait = time.Millisecond
+
+// Create a new Responder on the given capture handle. Packets are not received
+// until Run() is called.
+func New(c capture.ReadInjector) *Responder {
+	return &Responder{
+		handle: c,
+	}
+}
+
+// Call the given handler for the packets matching the given predicate. Rules
+// are tried in the order they were registered, and each packet is only
+// dispatched to the first matching one. If match is nil all packets match.
+func (r *Responder) Handle(match Predicate, handler Handler) {
+	r.add(&rule{ match: match, handler: handler })
+}
+
+// Call the given handler for the packets matching the given filter. The filter
+// is run against the captured data, before the packet is decoded, so it must
+// have been compiled for the link type of the capture handle.
+func (r *Responder) HandleFilter(flt *filter.Filter, handler Handler) error {
+	if !flt.Validate() {
+		return fmt.Errorf("Invalid filter")
+	}
+
+	r.add(&rule{ filter: flt, handler: handler })
+	return nil
+}
+
+// Receive packets and dispatch them to the handlers until Stop() is called or
+// an error occurs while capturing.
+func (r *Responder) Run() error {
+	for !r.is_stopped() {
+		buf, err := r.handle.Capture()
+		if err != nil {
+			return fmt.Errorf("Could not capture: %s", err)
+		}
+
+		if buf == nil {
+			time.Sleep(idle_wait)
+			continue
+		}
+
+		r.dispatch(buf)
+	}
+
+	return nil
+}
+
+// Interrupt a running responder. This can be called from a different goroutine
+// than the one executing Run(), which returns after the next packet is received.
+func (r *Responder) Stop() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.stopped = true
+}
+
+// Return the statistics of the packets handled so far.
+func (r *Responder) Stats() Stats {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	return r.stats
+}
+
+func (s Stats) String() string {
+	return fmt.Sprintf(
+		"%d received, %d matched, %d replied, %d failed",
+		s.Received, s.Matched, s.Replied, s.Failed,
+	)
+}
+
+func (r *Responder) add(ru *rule) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.rules = append(r.rules, ru)
+}
+
+/* decode the packet only if a rule needs it, and inject the reply of the first
+ * matching rule */
+func (r *Responder) dispatch(buf []byte) {
+	r.mutex.Lock()
+	rules := r.rules
+	r.stats.Received++
+	r.mutex.Unlock()
+
+	var pkt packet.Packet
+
+	for _, ru := range rules {
+		if ru.filter != nil && !ru.filter.Match(buf) {
+			continue
+		}
+
+		if pkt == nil {
+			var err error
+
+			pkt, err = layers.UnpackAll(buf, r.handle.LinkType())
+			if err != nil {
+				return
+			}
+		}
+
+		if ru.match != nil && !ru.match(pkt) {
+			continue
+		}
+
+		r.count(&r.stats.Matched)
+
+		reply := ru.handler(pkt)
+		if reply == nil {
+			return
+		}
+
+		out, err := layers.Pack(reply...)
+		if err == nil {
+			err = r.handle.Inject(out)
+		}
+
+		if err != nil {
+			r.count(&r.stats.Failed)
+		} else {
+			r.count(&r.stats.Replied)
+		}
+
+		return
+	}
+}
+
+func (r *Responder) count(counter *uint64) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	*counter++
+}
+
+func (r *Responder) is_stopped() bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	return r.stopped
+}
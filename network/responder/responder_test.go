@@ -0,0 +1,368 @@
+/*
+ * Network packet analysis framework.
+ *
+ * Copyright (c) 2014, Alessandro Ghedini
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are
+ * met:
+ *
+ *     * Redistributions of source code must retain the above copyright
+ *       notice, this list of conditions and the following disclaimer.
+ *
+ *     * Redistributions in binary form must reproduce the above copyright
+ *       notice, this list of conditions and the following disclaimer in the
+ *       documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS
+ * IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO,
+ * THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR
+ * PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR
+ * CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+ * EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+ * PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+ * PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF
+ * LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+ * NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+ * SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package responder_test
+
+import "bytes"
+import "net"
+import "testing"
+
+import "github.com/ghedo/go.pkt/filter"
+import "github.com/ghedo/go.pkt/layers"
+import "github.com/ghedo/go.pkt/network/responder"
+import "github.com/ghedo/go.pkt/packet"
+import "github.com/ghedo/go.pkt/packet/arp"
+import "github.com/ghedo/go.pkt/packet/eth"
+import "github.com/ghedo/go.pkt/packet/icmpv4"
+import "github.com/ghedo/go.pkt/packet/icmpv6"
+import "github.com/ghedo/go.pkt/packet/ipv4"
+import "github.com/ghedo/go.pkt/packet/ipv6"
+import "github.com/ghedo/go.pkt/packet/raw"
+import "github.com/ghedo/go.pkt/packet/tcp"
+import "github.com/ghedo/go.pkt/packet/vlan"
+
+var host_mac, _ = net.ParseMAC("02:00:00:00:00:05")
+var peer_mac, _ = net.ParseMAC("02:00:00:00:00:01")
+
+var host_ip = net.ParseIP("10.0.0.5")
+var peer_ip = net.ParseIP("10.0.0.1")
+
+/* a handle that returns the queued packets, and stops the responder when there
+ * are no more */
+type test_handle struct {
+	link  packet.Type
+	queue [][]byte
+	sent  [][]byte
+	stop  func()
+}
+
+func (h *test_handle) LinkType() packet.Type { return h.link }
+func (h *test_handle) Activate() error       { return nil }
+func (h *test_handle) Close()                { }
+
+func (h *test_handle) Capture() ([]byte, error) {
+	if len(h.queue) == 0 {
+		h.stop()
+		return nil, nil
+	}
+
+	buf := h.queue[0]
+	h.queue = h.queue[1:]
+
+	return buf, nil
+}
+
+func (h *test_handle) Inject(buf []byte) error {
+	h.sent = append(h.sent, buf)
+	return nil
+}
+
+func pack(t *testing.T, pkts ...packet.Packet) []byte {
+	buf, err := layers.Pack(pkts...)
+	if err != nil {
+		t.Fatalf("Error packing: %s", err)
+	}
+
+	return buf
+}
+
+func make_eth() *eth.Packet {
+	eth_pkt := eth.Make()
+	eth_pkt.SrcAddr = peer_mac
+	eth_pkt.DstAddr = host_mac
+	return eth_pkt
+}
+
+func make_ipv4() *ipv4.Packet {
+	ip4_pkt := ipv4.Make()
+	ip4_pkt.SrcAddr = peer_ip
+	ip4_pkt.DstAddr = host_ip
+	return ip4_pkt
+}
+
+func make_syn(port uint16) *tcp.Packet {
+	tcp_pkt := tcp.Make()
+	tcp_pkt.SrcPort = 40000
+	tcp_pkt.DstPort = port
+	tcp_pkt.Seq     = 1000
+	return tcp_pkt
+}
+
+/* run the responder over the given packets and return the injected ones */
+func run(t *testing.T, h *test_handle, r *responder.Responder, pkts ...[]byte) []packet.Packet {
+	h.queue = pkts
+	h.stop  = r.Stop
+
+	err := r.Run()
+	if err != nil {
+		t.Fatalf("Error running: %s", err)
+	}
+
+	var sent []packet.Packet
+
+	for _, buf := range h.sent {
+		pkt, err := layers.UnpackAll(buf, h.link)
+		if err != nil {
+			t.Fatalf("Error unpacking: %s", err)
+		}
+
+		sent = append(sent, pkt)
+	}
+
+	return sent
+}
+
+func TestReplyARP(t *testing.T) {
+	h := &test_handle{ link: packet.Eth }
+	r := responder.New(h)
+
+	r.ReplyARP(host_ip, host_mac)
+
+	eth_pkt := make_eth()
+	eth_pkt.DstAddr, _ = net.ParseMAC("ff:ff:ff:ff:ff:ff")
+
+	arp_pkt := arp.Make()
+	arp_pkt.HWSrcAddr    = peer_mac
+	arp_pkt.HWDstAddr    = make([]byte, 6)
+	arp_pkt.ProtoSrcAddr = peer_ip.To4()
+	arp_pkt.ProtoDstAddr = host_ip.To4()
+
+	req := pack(t, eth_pkt, arp_pkt)
+
+	other := arp.Make()
+	other.HWSrcAddr    = peer_mac
+	other.HWDstAddr    = make([]byte, 6)
+	other.ProtoSrcAddr = peer_ip.To4()
+	other.ProtoDstAddr = net.ParseIP("10.0.0.6").To4()
+
+	sent := run(t, h, r, req, pack(t, make_eth(), other))
+	if len(sent) != 1 {
+		t.Fatalf("Replies mismatch: %d", len(sent))
+	}
+
+	if !sent[0].Answers(eth_pkt) {
+		t.Fatalf("Not an answer: %s", sent[0])
+	}
+
+	reply := layers.FindLayer(sent[0], packet.ARP).(*arp.Packet)
+	if reply.HWSrcAddr.String() != host_mac.String() {
+		t.Fatalf("Address mismatch: %s", reply.HWSrcAddr)
+	}
+
+	if sent[0].(*eth.Packet).DstAddr.String() != peer_mac.String() {
+		t.Fatalf("Address mismatch: %s", sent[0])
+	}
+}
+
+func make_data() *raw.Packet {
+	raw_pkt := raw.Make()
+	raw_pkt.Data = []byte("echo data")
+	return raw_pkt
+}
+
+/* check that the echo data was returned */
+func check_data(t *testing.T, pkt packet.Packet) {
+	raw_pkt, ok := layers.FindLayer(pkt, packet.Raw).(*raw.Packet)
+	if !ok || !bytes.Equal(raw_pkt.Data, make_data().Data) {
+		t.Fatalf("Echo data mismatch: %s", pkt)
+	}
+}
+
+func TestReplyEcho(t *testing.T) {
+	h := &test_handle{ link: packet.Eth }
+	r := responder.New(h)
+
+	r.ReplyEcho(host_ip)
+
+	eth_pkt  := make_eth()
+	ip4_pkt  := make_ipv4()
+	icmp_pkt := icmpv4.Make()
+	icmp_pkt.Id  = 0x4242
+	icmp_pkt.Seq = 7
+
+	sent := run(t, h, r, pack(t, eth_pkt, ip4_pkt, icmp_pkt, make_data()))
+	if len(sent) != 1 {
+		t.Fatalf("Replies mismatch: %d", len(sent))
+	}
+
+	if !sent[0].Answers(eth_pkt) {
+		t.Fatalf("Not an answer: %s", sent[0])
+	}
+
+	if sent[0].(*eth.Packet).SrcAddr.String() != host_mac.String() {
+		t.Fatalf("Address mismatch: %s", sent[0])
+	}
+
+	check_data(t, sent[0])
+}
+
+func TestReplyEchoIPv6(t *testing.T) {
+	h := &test_handle{ link: packet.IPv6 }
+	r := responder.New(h)
+
+	r.ReplyEcho(net.ParseIP("fd00::5"))
+
+	ip6_pkt := ipv6.Make()
+	ip6_pkt.SrcAddr = net.ParseIP("fd00::1")
+	ip6_pkt.DstAddr = net.ParseIP("fd00::5")
+
+	icmp_pkt := icmpv6.Make()
+	icmp_pkt.Type = icmpv6.EchoRequest
+	icmp_pkt.Body = 0x42420007
+
+	sent := run(t, h, r, pack(t, ip6_pkt, icmp_pkt, make_data()))
+	if len(sent) != 1 {
+		t.Fatalf("Replies mismatch: %d", len(sent))
+	}
+
+	if !sent[0].Answers(ip6_pkt) {
+		t.Fatalf("Not an answer: %s", sent[0])
+	}
+
+	check_data(t, sent[0])
+}
+
+func TestReplyEchoVLAN(t *testing.T) {
+	h := &test_handle{ link: packet.Eth }
+	r := responder.New(h)
+
+	r.ReplyEcho(host_ip)
+
+	vlan_pkt := vlan.Make()
+	vlan_pkt.VLAN = 100
+
+	icmp_pkt := icmpv4.Make()
+
+	sent := run(t, h, r, pack(t, make_eth(), vlan_pkt, make_ipv4(), icmp_pkt))
+	if len(sent) != 1 {
+		t.Fatalf("Replies mismatch: %d", len(sent))
+	}
+
+	rsp, ok := sent[0].Payload().(*vlan.Packet)
+	if !ok || rsp.VLAN != 100 {
+		t.Fatalf("VLAN tag mismatch: %s", sent[0])
+	}
+
+	if layers.FindLayer(sent[0], packet.ICMPv4) == nil {
+		t.Fatalf("Not an echo reply: %s", sent[0])
+	}
+}
+
+func TestResetPort(t *testing.T) {
+	h := &test_handle{ link: packet.Eth }
+	r := responder.New(h)
+
+	r.ResetPort(23)
+
+	eth_pkt := make_eth()
+	syn_pkt := make_syn(23)
+
+	ack_pkt := make_syn(23)
+	ack_pkt.Flags = tcp.Ack
+
+	sent := run(t, h, r,
+		pack(t, eth_pkt, make_ipv4(), syn_pkt),
+		pack(t, make_eth(), make_ipv4(), make_syn(22)),
+		pack(t, make_eth(), make_ipv4(), ack_pkt),
+	)
+	if len(sent) != 1 {
+		t.Fatalf("Replies mismatch: %d", len(sent))
+	}
+
+	if !sent[0].Answers(eth_pkt) {
+		t.Fatalf("Not an answer: %s", sent[0])
+	}
+
+	reply := layers.FindLayer(sent[0], packet.TCP).(*tcp.Packet)
+	if reply.Flags != tcp.Rst | tcp.Ack || reply.Ack != syn_pkt.Seq + 1 {
+		t.Fatalf("Reply mismatch: %s", reply)
+	}
+
+	stats := r.Stats()
+	if stats.Received != 3 || stats.Matched != 1 || stats.Replied != 1 {
+		t.Fatalf("Stats mismatch: %s", stats)
+	}
+}
+
+func TestHandleFilter(t *testing.T) {
+	h := &test_handle{ link: packet.Eth }
+	r := responder.New(h)
+
+	/* match the IPv4 packets only */
+	flt, err := filter.NewBuilder().
+		LD(filter.Half, filter.ABS, 12).
+		JEQ(filter.Const, "", "fail", uint32(eth.IPv4)).
+		RET(filter.Const, 0x40000).
+		Label("fail").
+		RET(filter.Const, 0x0).
+		Build()
+	if err != nil {
+		t.Fatalf("Error building filter: %s", err)
+	}
+
+	var filtered, matched int
+
+	err = r.HandleFilter(flt, func(pkt packet.Packet) []packet.Packet {
+		filtered++
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Error adding handler: %s", err)
+	}
+
+	r.Handle(nil, func(pkt packet.Packet) []packet.Packet {
+		matched++
+		return nil
+	})
+
+	arp_pkt := arp.Make()
+	arp_pkt.HWSrcAddr    = peer_mac
+	arp_pkt.HWDstAddr    = make([]byte, 6)
+	arp_pkt.ProtoSrcAddr = peer_ip.To4()
+	arp_pkt.ProtoDstAddr = host_ip.To4()
+
+	sent := run(t, h, r,
+		pack(t, make_eth(), make_ipv4(), make_syn(22)),
+		pack(t, make_eth(), arp_pkt),
+	)
+	if len(sent) != 0 {
+		t.Fatalf("Replies mismatch: %d", len(sent))
+	}
+
+	/* the first matching rule takes the packet */
+	if filtered != 1 || matched != 1 {
+		t.Fatalf("Dispatch mismatch: %d %d", filtered, matched)
+	}
+
+	stats := r.Stats()
+	if stats.Received != 2 || stats.Matched != 2 || stats.Replied != 0 {
+		t.Fatalf("Stats mismatch: %s", stats)
+	}
+}
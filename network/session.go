@@ -0,0 +1,356 @@
+/*
+ * Network packet analysis framework.
+ *
+ * Copyright (c) 2014, Alessandro Ghedini
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are
+ * met:
+ *
+ *     * Redistributions of source code must retain the above copyright
+ *       notice, this list of conditions and the following disclaimer.
+ *
+ *     * Redistributions in binary form must reproduce the above copyright
+ *       notice, this list of conditions and the following disclaimer in the
+ *       documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS
+ * IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO,
+ * THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR
+ * PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR
+ * CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+ * EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+ * PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+ * PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF
+ * LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+ * NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+ * SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package network
+
+import "fmt"
+import "sync"
+import "time"
+
+import "github.com/ghedo/go.pkt/capture"
+import "github.com/ghedo/go.pkt/layers"
+import "github.com/ghedo/go.pkt/packet"
+
+// A Session sends probes and matches the packets received in the background
+// with them, so that many probes can be outstanding at the same time.
+type Session struct {
+	handle  capture.ReadInjector
+	timeout time.Duration
+	retries uint
+	multi   bool
+
+	mutex   sync.Mutex
+	cond    *sync.Cond
+	pending map[*probe]bool
+	index   map[string][]*probe
+	done    []*Result
+	err     error
+	closed  bool
+	stopped chan struct{}
+}
+
+// Result contains a probe sent by a Session and the packets received in answer
+// to it (if any). If the first answer is an ICMP error message (i.e. the probe
+// didn't reach its destination), ICMPError describes it.
+type Result struct {
+	Probe     packet.Packet
+	Answers   []packet.Packet
+	ICMPError *ICMPError
+	Sent      time.Time
+	Tries     uint
+}
+
+type probe struct {
+	result  *Result
+	key     string
+	buf     []byte
+	timeout time.Duration
+	retries uint
+	timer   *time.Timer
+}
+
+/* how long to wait before polling again a handle with no packets available */
+const idle_wait = time.Millisecond
+
+// Create a new session on the given capture handle, and start receiving
+// packets. Probes that are not answered within t are sent again (if retries
+// are enabled with SetRetries()) or reported as unanswered. If t is zero probes
+// are waited for until they are answered or the session is closed.
+func NewSession(c capture.ReadInjector, t time.Duration) *Session {
+	s := &Session{
+		handle:  c,
+		timeout: t,
+		pending: make(map[*probe]bool),
+		index:   make(map[string][]*probe),
+		stopped: make(chan struct{}),
+	}
+
+	s.cond = sync.NewCond(&s.mutex)
+
+	go s.recv_loop()
+
+	return s
+}
+
+// Send the probes that are not answered the given number of additional times
+// before reporting them as unanswered.
+func (s *Session) SetRetries(retries uint) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.retries = retries
+}
+
+// Collect all the answers received for a probe until its timeout expires
+// (e.g. for probes sent to a broadcast address), instead of stopping at the
+// first one.
+func (s *Session) SetMultiple(multi bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.multi = multi
+}
+
+// Pack the given packets and send them as a new probe, using the session's
+// timeout and retries. The packets are copied, so they can be modified (e.g.
+// to build the next probe) as soon as this returns.
+func (s *Session) Send(pkts ...packet.Packet) error {
+	s.mutex.Lock()
+	t, retries := s.timeout, s.retries
+	s.mutex.Unlock()
+
+	return s.SendTimeout(t, retries, pkts...)
+}
+
+// Like Send(), but with the given timeout and retries for this probe only.
+func (s *Session) SendTimeout(t time.Duration, retries uint, pkts ...packet.Packet) error {
+	if s.is_closed() {
+		return fmt.Errorf("Session closed")
+	}
+
+	buf, err := pack(s.handle, pkts...)
+	if err != nil {
+		return err
+	}
+
+	/* keep a copy of the probe, since the given packets may be reused */
+	pkt, err := layers.UnpackAll(buf, s.handle.LinkType())
+	if err != nil {
+		pkt = pkts[0]
+	}
+
+	p := &probe{
+		result:  &Result{ Probe: pkt },
+		key:     pkt.MatchKey(),
+		buf:     buf,
+		timeout: t,
+		retries: retries,
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.closed {
+		return fmt.Errorf("Session closed")
+	}
+
+	s.pending[p]    = true
+	s.index[p.key] = append(s.index[p.key], p)
+
+	return s.transmit(p)
+}
+
+// Wait until all the probes sent so far are either answered or timed out, and
+// return them split between answered and unanswered. Each probe is only
+// returned once, so Wait() can be called again after sending new probes.
+func (s *Session) Wait() ([]*Result, []*Result, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for len(s.pending) > 0 {
+		s.cond.Wait()
+	}
+
+	var ans, unans []*Result
+
+	for _, r := range s.done {
+		if len(r.Answers) > 0 {
+			ans = append(ans, r)
+		} else {
+			unans = append(unans, r)
+		}
+	}
+
+	s.done = nil
+
+	return ans, unans, s.err
+}
+
+// Stop receiving packets. The probes still waiting for an answer are reported
+// as unanswered. The capture handle is not closed.
+//
+// Since the receive loop can only stop between Capture() calls, this waits for
+// the handle to return from Capture(). Handles that block until a packet is
+// received should have a read timeout (e.g. afpacket's SetReadTimeout()) or be
+// non-blocking (e.g. pcap's SetNonBlock()), otherwise Close() waits for the
+// next packet.
+func (s *Session) Close() {
+	s.mutex.Lock()
+
+	if !s.closed {
+		s.closed = true
+		s.finish_all()
+	}
+
+	s.mutex.Unlock()
+
+	<-s.stopped
+}
+
+/*
+ * Inject the probe and arm its timer. Must be called with the lock held, but the
+ * lock is released while injecting, so that the receive loop isn't blocked by
+ * slow (e.g. rate-limited) handles.
+ */
+func (s *Session) transmit(p *probe) error {
+	p.result.Sent   = time.Now()
+	p.result.Tries += 1
+
+	s.mutex.Unlock()
+	err := s.handle.Inject(p.buf)
+	s.mutex.Lock()
+
+	if err != nil {
+		if s.pending[p] {
+			s.finish(p)
+		}
+
+		return fmt.Errorf("Could not inject: %s", err)
+	}
+
+	/* the probe may have been answered, or the session closed, meanwhile */
+	if !s.pending[p] {
+		return nil
+	}
+
+	if p.timeout > 0 {
+		p.timer = time.AfterFunc(p.timeout, func() { s.expire(p) })
+	}
+
+	return nil
+}
+
+func (s *Session) expire(p *probe) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if !s.pending[p] {
+		return
+	}
+
+	if len(p.result.Answers) == 0 && p.result.Tries <= p.retries {
+		s.transmit(p)
+		return
+	}
+
+	s.finish(p)
+}
+
+func (s *Session) recv_loop() {
+	defer close(s.stopped)
+
+	for !s.is_closed() {
+		buf, err := s.handle.Capture()
+		if err != nil {
+			s.mutex.Lock()
+			s.err = fmt.Errorf("Could not capture: %s", err)
+			s.closed = true
+			s.finish_all()
+			s.mutex.Unlock()
+			return
+		}
+
+		if buf == nil {
+			time.Sleep(idle_wait)
+			continue
+		}
+
+		pkt, err := layers.UnpackAll(buf, s.handle.LinkType())
+		if err != nil {
+			continue
+		}
+
+		s.mutex.Lock()
+		s.match(pkt)
+		s.mutex.Unlock()
+	}
+}
+
+/*
+ * Add pkt to the probes it answers. Only the probes with the same match key as
+ * pkt are checked. Must be called with the lock held.
+ */
+func (s *Session) match(pkt packet.Packet) {
+	for _, p := range s.index[pkt.MatchKey()] {
+		if !pkt.Answers(p.result.Probe) {
+			continue
+		}
+
+		if len(p.result.Answers) == 0 {
+			p.result.ICMPError = ParseICMPError(pkt)
+		}
+
+		p.result.Answers = append(p.result.Answers, pkt)
+
+		if !s.multi {
+			s.finish(p)
+			return
+		}
+	}
+}
+
+func (s *Session) is_closed() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.closed
+}
+
+func (s *Session) finish(p *probe) {
+	if p.timer != nil {
+		p.timer.Stop()
+	}
+
+	delete(s.pending, p)
+
+	probes := s.index[p.key]
+
+	for i, q := range probes {
+		if q == p {
+			probes = append(probes[:i], probes[i + 1:]...)
+			break
+		}
+	}
+
+	if len(probes) > 0 {
+		s.index[p.key] = probes
+	} else {
+		delete(s.index, p.key)
+	}
+
+	s.done = append(s.done, p.result)
+	s.cond.Broadcast()
+}
+
+func (s *Session) finish_all() {
+	for p := range s.pending {
+		s.finish(p)
+	}
+}
@@ -0,0 +1,269 @@
+/*
+ * Network packet analysis framework.
+ *
+ * Copyright (c) 2014, Alessandro Ghedini
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are
+ * met:
+ *
+ *     * Redistributions of source code must retain the above copyright
+ *       notice, this list of conditions and the following disclaimer.
+ *
+ *     * Redistributions in binary form must reproduce the above copyright
+ *       notice, this list of conditions and the following disclaimer in the
+ *       documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS
+ * IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO,
+ * THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR
+ * PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR
+ * CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+ * EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+ * PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+ * PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF
+ * LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+ * NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+ * SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package network_test
+
+import "net"
+import "testing"
+import "time"
+
+import "github.com/ghedo/go.pkt/layers"
+import "github.com/ghedo/go.pkt/network"
+import "github.com/ghedo/go.pkt/network/internal/testhandle"
+import "github.com/ghedo/go.pkt/packet"
+import "github.com/ghedo/go.pkt/packet/arp"
+import "github.com/ghedo/go.pkt/packet/eth"
+
+/* answers the ARP requests for the addresses in hosts (with the given number
+ * of replies), after ignoring the first drop requests for each of them */
+func new_test_handle(hosts map[string]int, drop int) *testhandle.Handle {
+	seen := make(map[string]int)
+
+	h := testhandle.New()
+	h.Answer = func(pkt packet.Packet) error {
+		dst := testhandle.NeighborTarget(pkt).String()
+
+		count, ok := hosts[dst]
+		if !ok {
+			return nil
+		}
+
+		seen[dst]++
+		if seen[dst] <= drop {
+			return nil
+		}
+
+		for i := 0; i < count; i++ {
+			hwaddr := net.HardwareAddr{ 2, 0, 0, 0, 0, byte(i) }
+
+			err := h.Queue(testhandle.NeighborReply(pkt, hwaddr)...)
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+
+	return h
+}
+
+func send_arp(t *testing.T, s *network.Session, addrs ...string) {
+	eth_pkt := eth.Make()
+	eth_pkt.SrcAddr = net.HardwareAddr{ 2, 0, 0, 0, 0, 0xff }
+	eth_pkt.DstAddr = net.HardwareAddr{ 0xff, 0xff, 0xff, 0xff, 0xff, 0xff }
+
+	arp_pkt := arp.Make()
+	arp_pkt.HWSrcAddr    = eth_pkt.SrcAddr
+	arp_pkt.HWDstAddr    = net.HardwareAddr{ 0, 0, 0, 0, 0, 0 }
+	arp_pkt.ProtoSrcAddr = net.ParseIP("192.168.1.1")
+
+	/* the same packets are reused for all the probes */
+	for _, addr := range addrs {
+		arp_pkt.ProtoDstAddr = net.ParseIP(addr)
+
+		err := s.Send(eth_pkt, arp_pkt)
+		if err != nil {
+			t.Fatalf("Error sending: %s", err)
+		}
+	}
+}
+
+func result_addr(r *network.Result) string {
+	req := layers.FindLayer(r.Probe, packet.ARP).(*arp.Packet)
+	return req.ProtoDstAddr.String()
+}
+
+func TestSession(t *testing.T) {
+	h := new_test_handle(map[string]int{
+		"192.168.1.2": 1, "192.168.1.4": 1, "192.168.1.5": 1,
+	}, 0)
+
+	s := network.NewSession(h, 100 * time.Millisecond)
+	defer s.Close()
+
+	send_arp(t, s, "192.168.1.2", "192.168.1.3", "192.168.1.4",
+	               "192.168.1.5", "192.168.1.6")
+
+	ans, unans, err := s.Wait()
+	if err != nil {
+		t.Fatalf("Error waiting: %s", err)
+	}
+
+	if len(ans) != 3 || len(unans) != 2 {
+		t.Fatalf("Results mismatch: %d %d", len(ans), len(unans))
+	}
+
+	for _, r := range ans {
+		rep := layers.FindLayer(r.Answers[0], packet.ARP).(*arp.Packet)
+
+		if rep.ProtoSrcAddr.String() != result_addr(r) {
+			t.Fatalf("Answer mismatch: %s", rep.ProtoSrcAddr)
+		}
+
+		if len(r.Answers) != 1 || r.Tries != 1 {
+			t.Fatalf("Answer count mismatch: %d", len(r.Answers))
+		}
+	}
+
+	for _, r := range unans {
+		addr := result_addr(r)
+		if addr != "192.168.1.3" && addr != "192.168.1.6" {
+			t.Fatalf("Unanswered mismatch: %s", addr)
+		}
+	}
+
+	ans, unans, _ = s.Wait()
+	if len(ans) != 0 || len(unans) != 0 {
+		t.Fatalf("Results returned twice")
+	}
+}
+
+func TestSessionRetries(t *testing.T) {
+	h := new_test_handle(map[string]int{ "192.168.1.2": 1 }, 2)
+
+	s := network.NewSession(h, 20 * time.Millisecond)
+	defer s.Close()
+
+	s.SetRetries(3)
+
+	send_arp(t, s, "192.168.1.2", "192.168.1.3")
+
+	ans, unans, _ := s.Wait()
+
+	if len(ans) != 1 || ans[0].Tries != 3 {
+		t.Fatalf("Answered mismatch: %d", len(ans))
+	}
+
+	if len(unans) != 1 || unans[0].Tries != 4 {
+		t.Fatalf("Unanswered mismatch: %d", len(unans))
+	}
+
+	if len(h.Sent()) != 7 {
+		t.Fatalf("Sent mismatch: %d", len(h.Sent()))
+	}
+}
+
+func TestSessionMultiple(t *testing.T) {
+	h := new_test_handle(map[string]int{ "192.168.1.2": 3 }, 0)
+
+	s := network.NewSession(h, 50 * time.Millisecond)
+	defer s.Close()
+
+	s.SetMultiple(true)
+
+	send_arp(t, s, "192.168.1.2")
+
+	ans, _, _ := s.Wait()
+
+	if len(ans) != 1 || len(ans[0].Answers) != 3 {
+		t.Fatalf("Answers mismatch")
+	}
+}
+
+/* blocks the injection of the probes for slow until the session has captured
+ * the pending answers and gone back to capturing */
+type slow_handle struct {
+	*testhandle.Handle
+	slow    string
+	stalled bool
+}
+
+func (h *slow_handle) Inject(buf []byte) error {
+	err := h.Handle.Inject(buf)
+
+	pkt, _ := layers.UnpackAll(buf, packet.Eth)
+	req := layers.FindLayer(pkt, packet.ARP).(*arp.Packet)
+
+	if req.ProtoDstAddr.String() != h.slow {
+		return err
+	}
+
+	start := h.Captured()
+
+	for i := 0; i < 100; i++ {
+		time.Sleep(5 * time.Millisecond)
+
+		if h.Queued() == 0 && h.Captured() > start + 1 {
+			return err
+		}
+	}
+
+	h.stalled = true
+	return err
+}
+
+func TestSessionSlowInject(t *testing.T) {
+	h := &slow_handle{
+		Handle: new_test_handle(map[string]int{ "192.168.1.2": 1 }, 0),
+		slow:        "192.168.1.3",
+	}
+
+	s := network.NewSession(h, 50 * time.Millisecond)
+	defer s.Close()
+
+	send_arp(t, s, "192.168.1.2", "192.168.1.3")
+
+	if h.stalled {
+		t.Fatalf("Receive loop blocked by Inject()")
+	}
+
+	ans, unans, _ := s.Wait()
+	if len(ans) != 1 || len(unans) != 1 {
+		t.Fatalf("Results mismatch: %d %d", len(ans), len(unans))
+	}
+}
+
+func TestSessionClose(t *testing.T) {
+	h := new_test_handle(map[string]int{}, 0)
+
+	s := network.NewSession(h, 0)
+
+	send_arp(t, s, "192.168.1.2")
+
+	s.Close()
+
+	ans, unans, _ := s.Wait()
+	if len(ans) != 0 || len(unans) != 1 {
+		t.Fatalf("Results mismatch")
+	}
+
+	eth_pkt := eth.Make()
+
+	arp_pkt := arp.Make()
+	arp_pkt.HWSrcAddr    = eth_pkt.SrcAddr
+	arp_pkt.HWDstAddr    = eth_pkt.DstAddr
+	arp_pkt.ProtoSrcAddr = net.ParseIP("192.168.1.1")
+	arp_pkt.ProtoDstAddr = net.ParseIP("192.168.1.2")
+
+	if s.Send(eth_pkt, arp_pkt) == nil {
+		t.Fatalf("Error expected")
+	}
+}
@@ -94,6 +94,19 @@ func (p *Packet) Answers(other packet.Packet) bool {
 	return false
 }
 
+func (p *Packet) MatchKey() string {
+	addr := p.ProtoDstAddr
+	if p.Operation == Reply {
+		addr = p.ProtoSrcAddr
+	}
+
+	if addr4 := addr.To4(); addr4 != nil {
+		addr = addr4
+	}
+
+	return "arp" + string(addr)
+}
+
 func (p *Packet) Pack(buf *packet.Buffer) error {
 	buf.WriteN(p.HWType)
 	buf.WriteN(p.ProtoType)
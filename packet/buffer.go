@@ -31,6 +31,7 @@
 package packet
 
 import "encoding/binary"
+import "io"
 
 // A Buffer is a variable-sized buffer of bytes with Read and Write methods.
 // It's based on the bytes.Buffer code provided by the standard library, but
@@ -110,7 +111,13 @@ func (b *Buffer) PutUint16N(off int, data uint16) {
 }
 
 // Read the next len(p) bytes from the buffer or until the buffer is drained.
+// If the buffer has no data left io.EOF is returned (unless len(p) is zero).
 func (b *Buffer) Read(p []byte) (n int, err error) {
+	/* truncated packets would make the readers loop forever otherwise */
+	if b.off >= len(b.buf) && len(p) > 0 {
+		return 0, io.EOF
+	}
+
 	n = copy(p, b.buf[b.off:])
 	b.off += n
 	return
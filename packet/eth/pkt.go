@@ -77,15 +77,11 @@ func (p *Packet) Answers(other packet.Packet) bool {
 		return false
 	}
 
-	if p.Type != other.(*Packet).Type {
-		return false
-	}
-
-	if p.Payload() != nil {
-		return p.Payload().Answers(other.Payload())
-	}
+	return packet.AnswersPayload(p, other)
+}
 
-	return true
+func (p *Packet) MatchKey() string {
+	return packet.PayloadKey(p)
 }
 
 func (p *Packet) GetType() packet.Type {
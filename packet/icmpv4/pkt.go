@@ -81,6 +81,10 @@ func (p *Packet) GetType() packet.Type {
 }
 
 func (p *Packet) GetLength() uint16 {
+	if p.pkt_payload != nil {
+		return p.pkt_payload.GetLength() + 8
+	}
+
 	return 8
 }
 
@@ -104,6 +108,28 @@ func (p *Packet) Answers(other packet.Packet) bool {
 	return false
 }
 
+func (p *Packet) MatchKey() string {
+	if p.Type.IsError() && p.pkt_payload != nil {
+		return p.pkt_payload.MatchKey()
+	}
+
+	switch p.Type {
+	case EchoRequest, EchoReply, Timestamp, TimestampReply,
+	     InfoRequest, InfoReply, AddrMaskRequest, AddrMaskReply:
+		return "icmp" + string([]byte{
+			byte(p.Id >> 8), byte(p.Id), byte(p.Seq >> 8), byte(p.Seq),
+		})
+	}
+
+	return "icmp"
+}
+
+func (p *Packet) MatchesQuote(quote packet.Packet) bool {
+	q, ok := quote.(*Packet)
+	return ok && q.Type == p.Type && q.Code == p.Code &&
+	       q.Id == p.Id && q.Seq == p.Seq
+}
+
 func (p *Packet) Pack(buf *packet.Buffer) error {
 	buf.WriteN(byte(p.Type))
 	buf.WriteN(byte(p.Code))
@@ -124,8 +150,6 @@ func (p *Packet) Unpack(buf *packet.Buffer) error {
 	buf.ReadN(&p.Id)
 	buf.ReadN(&p.Seq)
 
-	/* TODO: data */
-
 	return nil
 }
 
@@ -134,17 +158,21 @@ func (p *Packet) Payload() packet.Packet {
 }
 
 func (p *Packet) GuessPayloadType() packet.Type {
-	switch p.Type {
-	case DstUnreachable, SrcQuench, RedirectMsg, TimeExceeded, ParamProblem:
+	if p.Type.IsError() {
 		return packet.IPv4
 	}
 
+	/* the echo data is kept undecoded */
+	switch p.Type {
+	case EchoRequest, EchoReply:
+		return packet.Raw
+	}
+
 	return packet.None
 }
 
 func (p *Packet) SetPayload(pl packet.Packet) error {
-	switch p.Type {
-	case DstUnreachable, SrcQuench, RedirectMsg, TimeExceeded, ParamProblem:
+	if p.Type.IsError() || p.Type == EchoRequest || p.Type == EchoReply {
 		p.pkt_payload = pl
 	}
 
@@ -158,6 +186,17 @@ func (p *Packet) String() string {
 	return packet.Stringify(p)
 }
 
+// Check if the type is an error message, which carries the IP header and (at
+// least) the first 8 bytes of the packet that caused it.
+func (t Type) IsError() bool {
+	switch t {
+	case DstUnreachable, SrcQuench, RedirectMsg, TimeExceeded, ParamProblem:
+		return true
+	}
+
+	return false
+}
+
 func (t Type) String() string {
 	switch t {
 	case EchoReply:         return "echo-reply"
@@ -32,31 +32,39 @@
 package icmpv6
 
 import "fmt"
+import "net"
 
 import "github.com/ghedo/go.pkt/packet"
 import "github.com/ghedo/go.pkt/packet/ipv4"
+import "github.com/ghedo/go.pkt/packet/raw"
 
 type Packet struct {
-	Type      Type
-	Code      Code
-	Checksum  uint16 `string:"sum"`
-	csum_seed uint32 `cmp:"skip" string:"skip"`
-	Body      uint32 `cmp:"skip" string:"skip"`
+	Type        Type
+	Code        Code
+	Checksum    uint16        `string:"sum"`
+	csum_seed   uint32        `cmp:"skip" string:"skip"`
+	Body        uint32        `cmp:"skip" string:"skip"`
+	pkt_payload packet.Packet `cmp:"skip" string:"skip"`
 }
 
 type Type uint8
 type Code uint8
 
 const (
-	DstUnreachable Type = 0
-	PacketTooBig        = 1
-	TimeExceeded        = 2
-	ParamProblem        = 4
-	Private1            = 100
-	Private2            = 101
-	Reserved1           = 127
-	EchoRequest         = 128
-	EchoReply           = 129
+	DstUnreachable Type   = 1
+	PacketTooBig          = 2
+	TimeExceeded          = 3
+	ParamProblem          = 4
+	Private1              = 100
+	Private2              = 101
+	Reserved1             = 127
+	EchoRequest           = 128
+	EchoReply             = 129
+	RouterSolicitation    = 133
+	RouterAdvertisement   = 134
+	NeighborSolicitation  = 135
+	NeighborAdvertisement = 136
+	Redirect              = 137
 	/* TODO: more types */
 )
 
@@ -71,6 +79,10 @@ func (p *Packet) GetType() packet.Type {
 }
 
 func (p *Packet) GetLength() uint16 {
+	if p.pkt_payload != nil {
+		return p.pkt_payload.GetLength() + 8
+	}
+
 	return 8
 }
 
@@ -83,13 +95,94 @@ func (p *Packet) Answers(other packet.Packet) bool {
 		return false
 	}
 
+	/* the body of echo messages holds their identifier and sequence */
 	if other.(*Packet).Type == EchoRequest && p.Type == EchoReply {
-		return true
+		return other.(*Packet).Body == p.Body
+	}
+
+	if other.(*Packet).Type == NeighborSolicitation &&
+	   p.Type == NeighborAdvertisement {
+		target := p.Target()
+		return target != nil && target.Equal(other.(*Packet).Target())
 	}
 
 	return false
 }
 
+func (p *Packet) MatchKey() string {
+	if p.Type.IsError() && p.pkt_payload != nil {
+		return p.pkt_payload.MatchKey()
+	}
+
+	switch p.Type {
+	case EchoRequest, EchoReply:
+		return "icmp6" + string([]byte{
+			byte(p.Body >> 24), byte(p.Body >> 16),
+			byte(p.Body >> 8), byte(p.Body),
+		})
+
+	case NeighborSolicitation, NeighborAdvertisement:
+		return "icmp6nd" + string(p.Target())
+	}
+
+	return "icmp6"
+}
+
+func (p *Packet) MatchesQuote(quote packet.Packet) bool {
+	q, ok := quote.(*Packet)
+	return ok && q.Type == p.Type && q.Code == p.Code && q.Body == p.Body
+}
+
+// Return the target address of neighbor solicitation and advertisement
+// messages, or nil for other messages.
+func (p *Packet) Target() net.IP {
+	data := p.nd_data()
+	if len(data) < 16 {
+		return nil
+	}
+
+	return net.IP(data[:16])
+}
+
+// Return the link-layer address carried in the source or target link-layer
+// address option of neighbor discovery messages, or nil if there isn't one.
+func (p *Packet) LinkAddr() net.HardwareAddr {
+	data := p.nd_data()
+	if len(data) < 16 {
+		return nil
+	}
+
+	opts := data[16:]
+
+	for len(opts) >= 8 {
+		opt_len := int(opts[1]) * 8
+		if opt_len == 0 || opt_len > len(opts) {
+			break
+		}
+
+		/* source (1) and target (2) link-layer address options */
+		if opts[0] == 1 || opts[0] == 2 {
+			return net.HardwareAddr(opts[2:8])
+		}
+
+		opts = opts[opt_len:]
+	}
+
+	return nil
+}
+
+func (p *Packet) nd_data() []byte {
+	if p.Type != NeighborSolicitation && p.Type != NeighborAdvertisement {
+		return nil
+	}
+
+	if raw_pkt, ok := p.pkt_payload.(*raw.Packet); ok {
+		return raw_pkt.Data
+	}
+
+	return nil
+}
+
 func (p *Packet) Pack(buf *packet.Buffer) error {
 	buf.WriteN(byte(p.Type))
 	buf.WriteN(byte(p.Code))
@@ -116,14 +209,32 @@ func (p *Packet) Unpack(buf *packet.Buffer) error {
 }
 
 func (p *Packet) Payload() packet.Packet {
-	return nil
+	return p.pkt_payload
 }
 
 func (p *Packet) GuessPayloadType() packet.Type {
+	if p.Type.IsError() {
+		return packet.IPv6
+	}
+
+	/* the echo and neighbor discovery messages' data is left undecoded */
+	switch p.Type {
+	case EchoRequest, EchoReply, RouterSolicitation, RouterAdvertisement,
+	     NeighborSolicitation, NeighborAdvertisement, Redirect:
+		return packet.Raw
+	}
+
 	return packet.None
 }
 
 func (p *Packet) SetPayload(pl packet.Packet) error {
+	switch p.Type {
+	case DstUnreachable, PacketTooBig, TimeExceeded, ParamProblem,
+	     EchoRequest, EchoReply, RouterSolicitation, RouterAdvertisement,
+	     NeighborSolicitation, NeighborAdvertisement, Redirect:
+		p.pkt_payload = pl
+	}
+
 	return nil
 }
 
@@ -135,15 +246,31 @@ func (p *Packet) String() string {
 	return packet.Stringify(p)
 }
 
+// Check if the type is an error message, which carries (as much as possible of)
+// the packet that caused it.
+func (t Type) IsError() bool {
+	switch t {
+	case DstUnreachable, PacketTooBig, TimeExceeded, ParamProblem:
+		return true
+	}
+
+	return false
+}
+
 func (t Type) String() string {
 	switch t {
-	case DstUnreachable:    return "dst-unreach"
-	case PacketTooBig:      return "too-big"
-	case TimeExceeded:      return "timeout"
-	case ParamProblem:      return "param-problem"
-	case EchoRequest:       return "echo-request"
-	case EchoReply:         return "echo-reply"
-	default:                return "unknown"
+	case DstUnreachable:        return "dst-unreach"
+	case PacketTooBig:          return "too-big"
+	case TimeExceeded:          return "timeout"
+	case ParamProblem:          return "param-problem"
+	case EchoRequest:           return "echo-request"
+	case EchoReply:             return "echo-reply"
+	case RouterSolicitation:    return "router-solicit"
+	case RouterAdvertisement:   return "router-advert"
+	case NeighborSolicitation:  return "neighbor-solicit"
+	case NeighborAdvertisement: return "neighbor-advert"
+	case Redirect:              return "redirect"
+	default:                    return "unknown"
 	}
 }
 
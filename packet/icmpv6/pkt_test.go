@@ -150,3 +150,33 @@ func TestUnpackWithIPv6(t *testing.T) {
 		t.Fatalf("Packet mismatch:\n%s\n%s", &p, cmp)
 	}
 }
+
+func TestErrorTypes(t *testing.T) {
+	/* the type values defined by RFC 4443 */
+	types := map[icmpv6.Type]uint8{
+		icmpv6.DstUnreachable: 1,
+		icmpv6.PacketTooBig:   2,
+		icmpv6.TimeExceeded:   3,
+		icmpv6.ParamProblem:   4,
+	}
+
+	for typ, val := range types {
+		var p icmpv6.Packet
+
+		var b packet.Buffer
+		b.Init([]byte{ val, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00 })
+
+		err := p.Unpack(&b)
+		if err != nil {
+			t.Fatalf("Error unpacking: %s", err)
+		}
+
+		if p.Type != typ || !p.Type.IsError() {
+			t.Fatalf("Type mismatch: %s", p.Type)
+		}
+
+		if p.GuessPayloadType() != packet.IPv6 {
+			t.Fatalf("Payload type mismatch: %s", p.GuessPayloadType())
+		}
+	}
+}
@@ -112,24 +112,59 @@ func (p *Packet) Answers(other packet.Packet) bool {
 		return false
 	}
 
-	if p.Payload() != nil &&
-	   p.Payload().GetType() == packet.ICMPv4 &&
-	   p.Payload().Payload() != nil {
-		return p.Payload().Payload().Equals(other)
+	req := other.(*Packet)
+
+	/* ICMP errors answer the packet they quote */
+	if quote := p.quote(); quote != nil {
+		return p.DstAddr.Equal(req.SrcAddr) &&
+		       quote.SrcAddr.Equal(req.SrcAddr) &&
+		       quote.DstAddr.Equal(req.DstAddr) &&
+		       quote.Protocol == req.Protocol &&
+		       quote.Id == req.Id &&
+		       packet.MatchQuote(quote.Payload(), req.Payload())
 	}
 
-	if !p.SrcAddr.Equal(other.(*Packet).DstAddr) ||
-	    p.Protocol != other.(*Packet).Protocol {
+	if !p.DstAddr.Equal(req.SrcAddr) || p.Protocol != req.Protocol {
+		return false
+	}
+
+	/* broadcast and multicast requests can be answered by any host */
+	if !p.SrcAddr.Equal(req.DstAddr) &&
+	   !req.DstAddr.Equal(net.IPv4bcast) && !req.DstAddr.IsMulticast() {
 		return false
 	}
 
 	if p.Payload() != nil {
-		return p.Payload().Answers(other.Payload())
+		return p.Payload().Answers(req.Payload())
 	}
 
 	return true
 }
 
+func (p *Packet) MatchKey() string {
+	if quote := p.quote(); quote != nil {
+		return quote.MatchKey()
+	}
+
+	key := "ipv4" + string([]byte{ byte(p.Protocol) })
+
+	if p.Payload() != nil {
+		key += p.Payload().MatchKey()
+	}
+
+	return key
+}
+
+/* Return the IPv4 header quoted by the ICMP error carried by p, if any. */
+func (p *Packet) quote() *Packet {
+	if p.Payload() == nil || p.Payload().GetType() != packet.ICMPv4 {
+		return nil
+	}
+
+	quote, _ := p.Payload().Payload().(*Packet)
+	return quote
+}
+
 func (p *Packet) Pack(buf *packet.Buffer) error {
 	buf.WriteN((p.Version << 4) | p.IHL)
 	buf.WriteN(p.TOS)
@@ -79,20 +79,57 @@ func (p *Packet) Answers(other packet.Packet) bool {
 		return false
 	}
 
-	/* TODO: check link-local broadcast addresses */
-	if !p.DstAddr.Equal(other.(*Packet).SrcAddr) {
+	req := other.(*Packet)
+
+	/* ICMPv6 errors answer the packet they quote */
+	if quote := p.quote(); quote != nil {
+		return p.DstAddr.Equal(req.SrcAddr) &&
+		       quote.SrcAddr.Equal(req.SrcAddr) &&
+		       quote.DstAddr.Equal(req.DstAddr) &&
+		       quote.NextHdr == req.NextHdr &&
+		       packet.MatchQuote(quote.Payload(), req.Payload())
+	}
+
+	if !p.DstAddr.Equal(req.SrcAddr) || p.NextHdr != req.NextHdr {
 		return false
 	}
 
-	/* TODO: check ICMPv6 errors */
+	/* multicast requests can be answered by any host */
+	if !p.SrcAddr.Equal(req.DstAddr) && !req.DstAddr.IsMulticast() {
+		return false
+	}
 
 	if p.Payload() != nil {
-		return p.Payload().Answers(other.Payload())
+		return p.Payload().Answers(req.Payload())
 	}
 
 	return true
 }
 
+func (p *Packet) MatchKey() string {
+	if quote := p.quote(); quote != nil {
+		return quote.MatchKey()
+	}
+
+	key := "ipv6" + string([]byte{ byte(p.NextHdr) })
+
+	if p.Payload() != nil {
+		key += p.Payload().MatchKey()
+	}
+
+	return key
+}
+
+/* Return the IPv6 header quoted by the ICMPv6 error carried by p, if any. */
+func (p *Packet) quote() *Packet {
+	if p.Payload() == nil || p.Payload().GetType() != packet.ICMPv6 {
+		return nil
+	}
+
+	quote, _ := p.Payload().Payload().(*Packet)
+	return quote
+}
+
 func (p *Packet) Pack(buf *packet.Buffer) error {
 	buf.WriteN(uint8(p.Version << 4 | (p.Class >> 4)))
 	buf.WriteN(p.Class << 4 | uint8(p.Label >> 16))
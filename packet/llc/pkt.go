@@ -62,7 +62,15 @@ func (p *Packet) Equals(other packet.Packet) bool {
 }
 
 func (p *Packet) Answers(other packet.Packet) bool {
-	return false
+	if other == nil || other.GetType() != packet.LLC {
+		return false
+	}
+
+	return packet.AnswersPayload(p, other)
+}
+
+func (p *Packet) MatchKey() string {
+	return packet.PayloadKey(p)
 }
 
 func (p *Packet) Pack(buf *packet.Buffer) error {
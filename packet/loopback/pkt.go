@@ -0,0 +1,173 @@
+/*
+ * Network packet analysis framework.
+ *
+ * Copyright (c) 2014, Alessandro Ghedini
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are
+ * met:
+ *
+ *     * Redistributions of source code must retain the above copyright
+ *       notice, this list of conditions and the following disclaimer.
+ *
+ *     * Redistributions in binary form must reproduce the above copyright
+ *       notice, this list of conditions and the following disclaimer in the
+ *       documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS
+ * IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO,
+ * THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR
+ * PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR
+ * CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+ * EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+ * PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+ * PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF
+ * LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+ * NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+ * SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+// Provides encoding and decoding for BSD loopback (DLT_NULL and DLT_LOOP)
+// packets. Since DLT_NULL uses the byte order of the capturing host, decoded
+// packets are encoded again in their original byte order, while new packets are
+// encoded in the byte order of the host.
+package loopback
+
+import "encoding/binary"
+import "fmt"
+
+import "github.com/ghedo/go.pkt/packet"
+
+type Packet struct {
+	Family      Family
+	order       binary.ByteOrder `cmp:"skip" string:"skip"`
+	pkt_payload packet.Packet    `cmp:"skip" string:"skip"`
+}
+
+// Family is the address family of the encapsulated packet. Note that its value
+// for IPv6 depends on the operating system the packet was captured on.
+type Family uint32
+
+const (
+	None        Family = 0
+	IPv4        Family = 2
+	IPv6Linux   Family = 10
+	IPv6BSD     Family = 24
+	IPv6FreeBSD Family = 28
+	IPv6Darwin  Family = 30
+)
+
+func Make() *Packet {
+	return &Packet{
+		Family: IPv4,
+	}
+}
+
+func (p *Packet) GetType() packet.Type {
+	return packet.Loopback
+}
+
+func (p *Packet) GetLength() uint16 {
+	if p.pkt_payload != nil {
+		return p.pkt_payload.GetLength() + 4
+	}
+
+	return 4
+}
+
+func (p *Packet) Equals(other packet.Packet) bool {
+	return packet.Compare(p, other)
+}
+
+func (p *Packet) Answers(other packet.Packet) bool {
+	if other == nil || other.GetType() != packet.Loopback {
+		return false
+	}
+
+	return packet.AnswersPayload(p, other)
+}
+
+func (p *Packet) MatchKey() string {
+	return packet.PayloadKey(p)
+}
+
+func (p *Packet) Pack(buf *packet.Buffer) error {
+	/* keep the byte order the packet was decoded with, if any */
+	order := p.order
+	if order == nil {
+		order = binary.NativeEndian
+	}
+
+	return binary.Write(buf, order, p.Family)
+}
+
+func (p *Packet) Unpack(buf *packet.Buffer) error {
+	buf.ReadN(&p.Family)
+
+	p.order = binary.BigEndian
+
+	/*
+	 * DLT_NULL uses the byte order of the capturing host, so values that
+	 * don't fit in 16 bits must have been written in little endian.
+	 */
+	if p.Family > 0xffff {
+		f := uint32(p.Family)
+		p.Family = Family(f >> 24 | (f >> 8) & 0xff00 |
+		                  (f << 8) & 0xff0000 | f << 24)
+		p.order  = binary.LittleEndian
+	}
+
+	return nil
+}
+
+func (p *Packet) Payload() packet.Packet {
+	return p.pkt_payload
+}
+
+func (p *Packet) GuessPayloadType() packet.Type {
+	switch p.Family {
+	case IPv4:
+		return packet.IPv4
+
+	case IPv6Linux, IPv6BSD, IPv6FreeBSD, IPv6Darwin:
+		return packet.IPv6
+	}
+
+	return packet.Raw
+}
+
+func (p *Packet) SetPayload(pl packet.Packet) error {
+	p.pkt_payload = pl
+
+	switch pl.GetType() {
+	case packet.IPv4:
+		p.Family = IPv4
+
+	case packet.IPv6:
+		if p.GuessPayloadType() != packet.IPv6 {
+			p.Family = IPv6BSD
+		}
+	}
+
+	return nil
+}
+
+func (p *Packet) InitChecksum(csum uint32) {
+}
+
+func (p *Packet) String() string {
+	return packet.Stringify(p)
+}
+
+func (f Family) String() string {
+	switch f {
+	case None:      return "none"
+	case IPv4:      return "inet"
+	case IPv6Linux,
+	     IPv6BSD,
+	     IPv6FreeBSD,
+	     IPv6Darwin: return "inet6"
+	default:        return fmt.Sprintf("%d", uint32(f))
+	}
+}
@@ -70,6 +70,10 @@ const (
 	VLAN
 	WiFi      /* TODO */
 	WoL       /* TODO */
+	IP        /* either IPv4 or IPv6 */
+	Loopback
+	PPP
+	SLL2
 )
 
 // Packet is the interface used internally to implement packet encoding and
@@ -87,6 +91,9 @@ type Packet interface {
 	/* Check if the packet is an answer to another packet */
 	Answers(other Packet) bool
 
+	/* Return a key that is the same for the packet and its answers */
+	MatchKey() string
+
 	/* Encode the packet and write it to the given buffer */
 	Pack(out *Buffer) error
 
@@ -109,11 +116,17 @@ type Packet interface {
 }
 
 var pcap_link_type_to_type_map = [][2]uint32{
+	{   0, uint32(Loopback) },
 	{   1, uint32(Eth)      },
+	{   9, uint32(PPP)      },
+	{ 101, uint32(IP)       },
+	{  12, uint32(IP)       }, /* DLT_RAW on most platforms */
+	{ 108, uint32(Loopback) },
 	{ 113, uint32(SLL)      },
 	{ 127, uint32(RadioTap) },
 	{ 228, uint32(IPv4)     },
 	{ 229, uint32(IPv6)     },
+	{ 276, uint32(SLL2)     },
 }
 
 // Create a new type from the given PCAP link type.
@@ -127,15 +140,16 @@ func LinkType(link_type uint32) Type {
 	return None
 }
 
-// Convert the Type to the corresponding PCAP link type.
-func (pkttype Type) ToLinkType() uint32 {
+// Convert the Type to the corresponding PCAP link type. The second return value
+// is false if the type has no corresponding link type.
+func (pkttype Type) ToLinkType() (uint32, bool) {
 	for _, t := range pcap_link_type_to_type_map {
 		if t[1] == uint32(pkttype) {
-			return t[0]
+			return t[0], true
 		}
 	}
 
-	return 0x00
+	return 0x00, false
 }
 
 func (t Type) String() string {
@@ -147,6 +161,7 @@ func (t Type) String() string {
 	case ICMPv4:    return "ICMPv4"
 	case ICMPv6:    return "ICMPv6"
 	case IGMP:      return "IGMP"
+	case IP:        return "IP"
 	case IPSec:     return "IPSec"
 	case IPv4:      return "IPv4"
 	case IPv6:      return "IPv6"
@@ -154,12 +169,15 @@ func (t Type) String() string {
 	case L2TP:      return "L2TP"
 	case LLC:       return "LLC"
 	case LLDP:      return "LLDP"
+	case Loopback:  return "Loopback"
 	case None:      return "None"
 	case OSPF:      return "OSPF"
+	case PPP:       return "PPP"
 	case RadioTap:  return "RadioTap"
 	case SCTP:      return "SCTP"
 	case SNAP:      return "SNAP"
 	case SLL:       return "SLL"
+	case SLL2:      return "SLL2"
 	case TCP:       return "TCP"
 	case TRILL:     return "TRILL"
 	case UDPLite:   return "UDP Lite"
@@ -172,6 +190,65 @@ func (t Type) String() string {
 	}
 }
 
+// Quotable is implemented by the packets that can be quoted by ICMP error
+// messages, so that errors can be matched with the probes that triggered them.
+type Quotable interface {
+	/* Check if the quoted packet is a copy of the packet. Only the first 8
+	 * bytes are guaranteed to be quoted, so only those are compared. */
+	MatchesQuote(quote Packet) bool
+}
+
+// Check if the packet quoted by an ICMP error message (without the IP header)
+// matches the probe that triggered the error. Missing quotes and packets that
+// don't implement Quotable are always considered a match.
+func MatchQuote(quote, probe Packet) bool {
+	if quote == nil || probe == nil {
+		return true
+	}
+
+	if quote.GetType() != probe.GetType() {
+		return false
+	}
+
+	if q, ok := probe.(Quotable); ok {
+		return q.MatchesQuote(quote)
+	}
+
+	return true
+}
+
+// Return the first layer of the given packet that is not a VLAN tag.
+func SkipVLAN(p Packet) Packet {
+	for p != nil && p.GetType() == VLAN {
+		p = p.Payload()
+	}
+
+	return p
+}
+
+// Check if the payload of p is an answer to the payload of other, ignoring any
+// VLAN tag (answers may be tagged differently than requests). This is used by
+// the link-layer protocols.
+func AnswersPayload(p, other Packet) bool {
+	payload := SkipVLAN(p.Payload())
+	if payload == nil {
+		return true
+	}
+
+	return payload.Answers(SkipVLAN(other.Payload()))
+}
+
+// Return the match key of the payload of p, ignoring any VLAN tag. This is used
+// by the link-layer protocols.
+func PayloadKey(p Packet) string {
+	payload := SkipVLAN(p.Payload())
+	if payload == nil {
+		return ""
+	}
+
+	return payload.MatchKey()
+}
+
 func Compare(a, b Packet) bool {
 	if a == nil || b == nil {
 		return a == b
@@ -0,0 +1,197 @@
+/*
+ * Network packet analysis framework.
+ *
+ * Copyright (c) 2014, Alessandro Ghedini
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are
+ * met:
+ *
+ *     * Redistributions of source code must retain the above copyright
+ *       notice, this list of conditions and the following disclaimer.
+ *
+ *     * Redistributions in binary form must reproduce the above copyright
+ *       notice, this list of conditions and the following disclaimer in the
+ *       documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS
+ * IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO,
+ * THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR
+ * PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR
+ * CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+ * EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+ * PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+ * PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF
+ * LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+ * NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+ * SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+// Provides encoding and decoding for PPP packets, either with or without the
+// HDLC-like framing of RFC 1662.
+package ppp
+
+import "fmt"
+
+import "github.com/ghedo/go.pkt/packet"
+
+type Packet struct {
+	Address     uint8         `string:"addr"`
+	Control     uint8         `string:"ctrl"`
+	Protocol    Protocol      `string:"proto"`
+	Compressed  bool          `string:"skip"`
+	pkt_payload packet.Packet `cmp:"skip" string:"skip"`
+}
+
+type Protocol uint16
+
+const (
+	None   Protocol = 0x0000
+	IPv4   Protocol = 0x0021
+	IPv6   Protocol = 0x0057
+	IPCP   Protocol = 0x8021
+	IPv6CP Protocol = 0x8057
+	LCP    Protocol = 0xc021
+	PAP    Protocol = 0xc023
+	CHAP   Protocol = 0xc223
+)
+
+func Make() *Packet {
+	return &Packet{
+		Address: 0xff,
+		Control: 0x03,
+	}
+}
+
+func (p *Packet) GetType() packet.Type {
+	return packet.PPP
+}
+
+func (p *Packet) GetLength() uint16 {
+	length := uint16(2)
+
+	if p.is_compressed() {
+		length = 1
+	}
+
+	if p.Address != 0 {
+		length += 2
+	}
+
+	if p.pkt_payload != nil {
+		return p.pkt_payload.GetLength() + length
+	}
+
+	return length
+}
+
+func (p *Packet) Equals(other packet.Packet) bool {
+	return packet.Compare(p, other)
+}
+
+func (p *Packet) Answers(other packet.Packet) bool {
+	if other == nil || other.GetType() != packet.PPP {
+		return false
+	}
+
+	return packet.AnswersPayload(p, other)
+}
+
+func (p *Packet) MatchKey() string {
+	return packet.PayloadKey(p)
+}
+
+func (p *Packet) Pack(buf *packet.Buffer) error {
+	if p.Address != 0 {
+		buf.WriteN(p.Address)
+		buf.WriteN(p.Control)
+	}
+
+	if p.is_compressed() {
+		buf.WriteN(uint8(p.Protocol))
+	} else {
+		buf.WriteN(p.Protocol)
+	}
+
+	return nil
+}
+
+func (p *Packet) Unpack(buf *packet.Buffer) error {
+	if buf.Len() >= 2 && buf.Bytes()[0] == 0xff && buf.Bytes()[1] == 0x03 {
+		buf.ReadN(&p.Address)
+		buf.ReadN(&p.Control)
+	}
+
+	/* with protocol field compression the protocol is a single byte */
+	if buf.Len() >= 1 && buf.Bytes()[0] & 0x01 != 0 {
+		var proto uint8
+
+		buf.ReadN(&proto)
+		p.Protocol   = Protocol(proto)
+		p.Compressed = true
+
+		return nil
+	}
+
+	buf.ReadN(&p.Protocol)
+	p.Compressed = false
+
+	return nil
+}
+
+func (p *Packet) Payload() packet.Packet {
+	return p.pkt_payload
+}
+
+func (p *Packet) GuessPayloadType() packet.Type {
+	switch p.Protocol {
+	case IPv4:
+		return packet.IPv4
+
+	case IPv6:
+		return packet.IPv6
+	}
+
+	return packet.Raw
+}
+
+func (p *Packet) SetPayload(pl packet.Packet) error {
+	p.pkt_payload = pl
+
+	switch pl.GetType() {
+	case packet.IPv4:
+		p.Protocol = IPv4
+
+	case packet.IPv6:
+		p.Protocol = IPv6
+	}
+
+	return nil
+}
+
+func (p *Packet) InitChecksum(csum uint32) {
+}
+
+/* only protocols with an empty high byte can be compressed (RFC 1661) */
+func (p *Packet) is_compressed() bool {
+	return p.Compressed && p.Protocol <= 0xff
+}
+
+func (p *Packet) String() string {
+	return packet.Stringify(p)
+}
+
+func (p Protocol) String() string {
+	switch p {
+	case None:   return "None"
+	case IPv4:   return "IPv4"
+	case IPv6:   return "IPv6"
+	case IPCP:   return "IPCP"
+	case IPv6CP: return "IPv6CP"
+	case LCP:    return "LCP"
+	case PAP:    return "PAP"
+	case CHAP:   return "CHAP"
+	default:     return fmt.Sprintf("0x%x", uint16(p))
+	}
+}
@@ -88,6 +88,10 @@ func (p *Packet) Answers(other packet.Packet) bool {
 	return false
 }
 
+func (p *Packet) MatchKey() string {
+	return ""
+}
+
 func (p *Packet) Pack(buf *packet.Buffer) error {
 	buf.WriteL(p.Version)
 	buf.WriteL(uint8(0x00))
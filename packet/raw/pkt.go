@@ -59,6 +59,10 @@ func (p *Packet) Answers(other packet.Packet) bool {
 	return false
 }
 
+func (p *Packet) MatchKey() string {
+	return ""
+}
+
 func (p *Packet) Pack(buf *packet.Buffer) error {
 	buf.Write(p.Data)
 
@@ -0,0 +1,151 @@
+/*
+ * Network packet analysis framework.
+ *
+ * Copyright (c) 2014, Alessandro Ghedini
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are
+ * met:
+ *
+ *     * Redistributions of source code must retain the above copyright
+ *       notice, this list of conditions and the following disclaimer.
+ *
+ *     * Redistributions in binary form must reproduce the above copyright
+ *       notice, this list of conditions and the following disclaimer in the
+ *       documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS
+ * IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO,
+ * THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR
+ * PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR
+ * CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+ * EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+ * PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+ * PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF
+ * LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+ * NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+ * SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+// Provides encoding and decoding for SLL2 (Linux cooked mode v2) packets.
+package sll2
+
+import "net"
+
+import "github.com/ghedo/go.pkt/packet"
+import "github.com/ghedo/go.pkt/packet/eth"
+import "github.com/ghedo/go.pkt/packet/sll"
+
+type Packet struct {
+	Type        sll.Type
+	IfIndex     uint32           `string:"ifindex"`
+	AddrType    uint16           `string:"atype"`
+	AddrLen     uint8            `string:"alen"`
+	SrcAddr     net.HardwareAddr `string:"src"`
+	EtherType   eth.EtherType
+	pkt_payload packet.Packet    `cmp:"skip" string:"skip"`
+}
+
+func Make() *Packet {
+	return &Packet{
+		Type: sll.Host,
+		AddrType: 1,
+		AddrLen: 6,
+	}
+}
+
+func (p *Packet) GetType() packet.Type {
+	return packet.SLL2
+}
+
+func (p *Packet) GetLength() uint16 {
+	if p.pkt_payload != nil {
+		return p.pkt_payload.GetLength() + 20
+	}
+
+	return 20
+}
+
+func (p *Packet) Equals(other packet.Packet) bool {
+	return packet.Compare(p, other)
+}
+
+func (p *Packet) Answers(other packet.Packet) bool {
+	if other == nil || other.GetType() != packet.SLL2 {
+		return false
+	}
+
+	return packet.AnswersPayload(p, other)
+}
+
+func (p *Packet) MatchKey() string {
+	return packet.PayloadKey(p)
+}
+
+func (p *Packet) Pack(buf *packet.Buffer) error {
+	/* the address field has a fixed size */
+	addr := p.SrcAddr
+	if len(addr) > 8 {
+		addr = addr[:8]
+	}
+
+	buf.WriteN(p.EtherType)
+	buf.WriteN(uint16(0x0000))
+	buf.WriteN(p.IfIndex)
+	buf.WriteN(p.AddrType)
+	buf.WriteN(uint8(p.Type))
+	buf.WriteN(uint8(len(addr)))
+	buf.Write(addr)
+
+	for i := len(addr); i < 8; i++ {
+		buf.WriteN(uint8(0x00))
+	}
+
+	return nil
+}
+
+func (p *Packet) Unpack(buf *packet.Buffer) error {
+	var pkt_type uint8
+
+	buf.ReadN(&p.EtherType)
+	buf.Next(2)
+	buf.ReadN(&p.IfIndex)
+	buf.ReadN(&p.AddrType)
+	buf.ReadN(&pkt_type)
+	buf.ReadN(&p.AddrLen)
+
+	p.Type = sll.Type(pkt_type)
+
+	addr_len := int(p.AddrLen)
+	if addr_len > 8 {
+		addr_len = 8
+	}
+
+	p.SrcAddr = net.HardwareAddr(buf.Next(addr_len))
+	buf.Next(8 - addr_len)
+
+	return nil
+}
+
+func (p *Packet) Payload() packet.Packet {
+	return p.pkt_payload
+}
+
+func (p *Packet) GuessPayloadType() packet.Type {
+	return eth.EtherTypeToType(p.EtherType)
+}
+
+func (p *Packet) SetPayload(pl packet.Packet) error {
+	p.pkt_payload = pl
+	p.EtherType   = eth.TypeToEtherType(pl.GetType())
+
+	return nil
+}
+
+func (p *Packet) InitChecksum(csum uint32) {
+}
+
+func (p *Packet) String() string {
+	return packet.Stringify(p)
+}
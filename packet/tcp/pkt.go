@@ -112,14 +112,37 @@ func (p *Packet) Answers(other packet.Packet) bool {
 		return false
 	}
 
-	if p.SrcPort != other.(*Packet).DstPort ||
-	   p.DstPort != other.(*Packet).SrcPort {
+	req := other.(*Packet)
+
+	if p.SrcPort != req.DstPort || p.DstPort != req.SrcPort {
 		return false
 	}
 
+	/* answers to a SYN must acknowledge it */
+	if req.Flags & (Syn | Ack) == Syn && p.Flags & Ack != 0 {
+		return p.Ack == req.Seq + 1
+	}
+
 	return true
 }
 
+func (p *Packet) MatchKey() string {
+	lo, hi := p.SrcPort, p.DstPort
+	if lo > hi {
+		lo, hi = hi, lo
+	}
+
+	return "tcp" + string([]byte{
+		byte(lo >> 8), byte(lo), byte(hi >> 8), byte(hi),
+	})
+}
+
+func (p *Packet) MatchesQuote(quote packet.Packet) bool {
+	q, ok := quote.(*Packet)
+	return ok && q.SrcPort == p.SrcPort && q.DstPort == p.DstPort &&
+	       q.Seq == p.Seq
+}
+
 func (p *Packet) Pack(buf *packet.Buffer) error {
 	buf.WriteN(p.SrcPort)
 	buf.WriteN(p.DstPort)
@@ -66,7 +66,7 @@ func (p *Packet) Equals(other packet.Packet) bool {
 }
 
 func (p *Packet) Answers(other packet.Packet) bool {
-	if other == nil || other.GetType() != packet.TCP {
+	if other == nil || other.GetType() != packet.UDP {
 		return false
 	}
 
@@ -78,6 +78,22 @@ func (p *Packet) Answers(other packet.Packet) bool {
 	return true
 }
 
+func (p *Packet) MatchKey() string {
+	lo, hi := p.SrcPort, p.DstPort
+	if lo > hi {
+		lo, hi = hi, lo
+	}
+
+	return "udp" + string([]byte{
+		byte(lo >> 8), byte(lo), byte(hi >> 8), byte(hi),
+	})
+}
+
+func (p *Packet) MatchesQuote(quote packet.Packet) bool {
+	q, ok := quote.(*Packet)
+	return ok && q.SrcPort == p.SrcPort && q.DstPort == p.DstPort
+}
+
 func (p *Packet) Pack(buf *packet.Buffer) error {
 	buf.WriteN(p.SrcPort)
 	buf.WriteN(p.DstPort)
@@ -67,16 +67,21 @@ func (p *Packet) Answers(other packet.Packet) bool {
 		return false
 	}
 
-	if  other.GetType() == packet.VLAN &&
-	    p.VLAN != other.(*Packet).VLAN {
-		return false
+	if other.GetType() != packet.VLAN {
+		/* the request was not tagged */
+		payload := packet.SkipVLAN(p.Payload())
+		return payload == nil || payload.Answers(other)
 	}
 
-	if p.Payload() != nil {
-		return p.Payload().Answers(other.Payload())
+	if p.VLAN != other.(*Packet).VLAN {
+		return false
 	}
 
-	return true
+	return packet.AnswersPayload(p, other)
+}
+
+func (p *Packet) MatchKey() string {
+	return packet.PayloadKey(p)
 }
 
 func (p *Packet) Pack(buf *packet.Buffer) error {
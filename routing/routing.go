@@ -43,6 +43,7 @@ type Route struct {
 	SrcNet  *net.IPNet
 	DstNet  *net.IPNet
 	Gateway net.IP
+	PrefSrc net.IP
 	Iface   *net.Interface
 }
 
@@ -93,7 +94,7 @@ func RouteTo(dst net.IP) (*Route, error) {
 
 	for _, r := range routes {
 		if r.Default &&
-		   (is_ipv4 && r.Gateway.To4() != nil) &&
+		   r.Gateway != nil && (r.Gateway.To4() != nil) == is_ipv4 &&
 		   r.Iface != nil &&
 		   r.Iface.Flags & net.FlagLoopback == 0 {
 			def = r
@@ -129,8 +130,11 @@ func (r *Route) GetIfaceIPv4Addr() (net.IP, error) {
 	return nil, fmt.Errorf("No address found")
 }
 
-// Return the default IPv6 address of a network interface.
+// Return the default IPv6 address of a network interface. Global addresses are
+// preferred to link-local ones.
 func (r *Route) GetIfaceIPv6Addr() (net.IP, error) {
+	var link_local net.IP
+
 	iface := r.Iface
 
 	addrs, err := iface.Addrs();
@@ -140,15 +144,44 @@ func (r *Route) GetIfaceIPv6Addr() (net.IP, error) {
 
 	for _, a := range addrs {
 		if ipnet, ok := a.(*net.IPNet); ok {
-			if ip6 := ipnet.IP.To16(); ip6 != nil {
-				return ip6, nil
+			if ipnet.IP.To4() != nil {
+				continue
+			}
+
+			if ipnet.IP.IsLinkLocalUnicast() {
+				if link_local == nil {
+					link_local = ipnet.IP
+				}
+
+				continue
 			}
+
+			return ipnet.IP, nil
 		}
 	}
 
+	if link_local != nil {
+		return link_local, nil
+	}
+
 	return nil, fmt.Errorf("No address found")
 }
 
+// Return the source address to use for packets sent over the route, that is the
+// route's preferred source address if any, or the default address of the route's
+// network interface otherwise.
+func (r *Route) GetSrcAddr(dst net.IP) (net.IP, error) {
+	if r.PrefSrc != nil {
+		return r.PrefSrc, nil
+	}
+
+	if dst.To4() != nil {
+		return r.GetIfaceIPv4Addr()
+	}
+
+	return r.GetIfaceIPv6Addr()
+}
+
 func (r *Route) String() string {
 	var parts []string
 
@@ -173,5 +206,10 @@ func (r *Route) String() string {
 		parts = append(parts, iface)
 	}
 
+	if r.PrefSrc != nil {
+		src := fmt.Sprintf("src %s", r.PrefSrc.String())
+		parts = append(parts, src)
+	}
+
 	return strings.Join(parts, " ")
 }
@@ -104,6 +104,9 @@ func Routes() ([]*Route, error) {
 			case syscall.RTA_GATEWAY:
 				route.Gateway = net.IP(a.Value)
 
+			case syscall.RTA_PREFSRC:
+				route.PrefSrc = net.IP(a.Value)
+
 			case syscall.RTA_OIF:
 				oif := *(*uint32)(unsafe.Pointer(&a.Value[0]))
 				iface, err := net.InterfaceByIndex(int(oif))